@@ -2,6 +2,7 @@ package av
 
 import "io"
 import "fmt"
+import "bomin/utils/pool"
 
 const (
 	TAG_AUDIO          = 8
@@ -45,8 +46,9 @@ const (
 	AVC_NALU   = 1
 	AVC_EOS    = 2
 
-	FRAME_KEY   = 1
-	FRAME_INTER = 2
+	FRAME_KEY        = 1
+	FRAME_INTER      = 2
+	FRAME_DISPOSABLE = 3
 
 	VIDEO_H264 = 7
 )
@@ -65,6 +67,20 @@ type Packet struct {
 	StreamID   uint32
 	Header     PacketHeader
 	Data       []byte
+	// Buffer holds Data when it was read into a pooled buffer, nil
+	// otherwise.
+	Buffer *pool.Buffer
+}
+
+// Retain keeps the data of p past the Write it was given to, until Release.
+func (p *Packet) Retain() {
+	p.Buffer.Retain()
+}
+
+// Release gives back the data of p, kept with Retain or owned as the
+// reader of p. The data must not be used afterwards.
+func (p *Packet) Release() {
+	p.Buffer.Release()
 }
 
 type PacketHeader interface {
@@ -119,15 +135,17 @@ type Closer interface {
 	Close(error)
 }
 
-type CalcTime interface {
-	CalcBaseTimestamp()
-}
-
 type Info struct {
 	Key   string
 	URL   string
 	UID   string
 	Inter bool
+	// Relayed is set for a stream pulled from another server, or published
+	// by the forwarder or relay of one, which is not forwarded again.
+	Relayed bool
+	// Internal is set for the clients of the server itself, as its
+	// transcoding processes, which the client caps leave out.
+	Internal bool
 }
 
 func (info Info) IsInterval() bool {
@@ -145,9 +163,12 @@ type ReadCloser interface {
 	Read(*Packet) error
 }
 
+// WriteCloser is a player of a stream. The packets given to Write are
+// shared by all the players and must not be modified. Their data may be
+// recycled once Write returns, a player keeping a packet Retains it and
+// Releases it when done.
 type WriteCloser interface {
 	Closer
 	Alive
-	CalcTime
 	Write(*Packet) error
 }
@@ -4,12 +4,9 @@ import "time"
 import "sync"
 
 type RWBaser struct {
-	lock               sync.Mutex
-	timeout            time.Duration
-	PreTime            time.Time
-	BaseTimestamp      uint32
-	LastVideoTimestamp uint32
-	LastAudioTimestamp uint32
+	lock    sync.Mutex
+	timeout time.Duration
+	PreTime time.Time
 }
 
 func NewRWBaser(duration time.Duration) RWBaser {
@@ -19,26 +16,6 @@ func NewRWBaser(duration time.Duration) RWBaser {
 	}
 }
 
-func (rw *RWBaser) BaseTimeStamp() uint32 {
-	return rw.BaseTimestamp
-}
-
-func (rw *RWBaser) CalcBaseTimestamp() {
-	if rw.LastAudioTimestamp > rw.LastVideoTimestamp {
-		rw.BaseTimestamp = rw.LastAudioTimestamp
-	} else {
-		rw.BaseTimestamp = rw.LastVideoTimestamp
-	}
-}
-
-func (rw *RWBaser) RecTimeStamp(timestamp, typeID uint32) {
-	if typeID == TAG_VIDEO {
-		rw.LastVideoTimestamp = timestamp
-	} else if typeID == TAG_AUDIO {
-		rw.LastAudioTimestamp = timestamp
-	}
-}
-
 func (rw *RWBaser) SetPreTime() {
 	rw.lock.Lock()
 	rw.PreTime = time.Now()
@@ -0,0 +1,138 @@
+package av
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	statsTick    = 100 * time.Millisecond
+	statsBuckets = 300 // 30s of ticks
+)
+
+// StatsWindows are the spans the bitrates of Counters are averaged over.
+var StatsWindows = [3]time.Duration{time.Second, 5 * time.Second, 30 * time.Second}
+
+// now is replaced by the tests.
+var now = time.Now
+
+// Stats counts the media a reader or writer has moved. Its owner updates it
+// as packets go through, the API reads it concurrently. The zero value is
+// ready to use.
+type Stats struct {
+	lock       sync.Mutex
+	bytes      uint64
+	videoBytes uint64
+	audioBytes uint64
+	packets    uint64
+	frames     uint64
+	dropped    uint64
+	start      int64 // tick of the first update
+	tick       int64 // tick of the current bucket
+	buckets    [statsBuckets + 1]uint64
+}
+
+// Counters is a snapshot of Stats.
+type Counters struct {
+	Bytes      uint64 `json:"bytes"`
+	VideoBytes uint64 `json:"video_bytes"`
+	AudioBytes uint64 `json:"audio_bytes"`
+	Packets    uint64 `json:"packets"`
+	// Frames counts the video frames, sequence headers aside.
+	Frames  uint64 `json:"frames"`
+	Dropped uint64 `json:"dropped"`
+	// Bitrates are in kbit/s, averaged over each of StatsWindows.
+	Bitrates [3]float64 `json:"bitrates_kbps"`
+}
+
+// Bitrate returns the bitrate in kbit/s averaged over the 5s window.
+func (c Counters) Bitrate() float64 {
+	return c.Bitrates[1]
+}
+
+// Counted is a reader or writer keeping Stats.
+type Counted interface {
+	Counters() Counters
+}
+
+// Update counts p, its size being the length of its data.
+func (s *Stats) Update(p *Packet) {
+	size := uint64(len(p.Data))
+	s.lock.Lock()
+	s.advance()
+	s.bytes += size
+	s.packets++
+	if p.IsVideo {
+		s.videoBytes += size
+		if vh, ok := p.Header.(VideoPacketHeader); !ok || !vh.IsSeq() {
+			s.frames++
+		}
+	} else if p.IsAudio {
+		s.audioBytes += size
+	}
+	s.buckets[s.tick%int64(len(s.buckets))] += size
+	s.lock.Unlock()
+}
+
+// Drop counts n packets dropped.
+func (s *Stats) Drop(n uint64) {
+	s.lock.Lock()
+	s.dropped += n
+	s.lock.Unlock()
+}
+
+// Counters returns a snapshot of s. The bitrates decay while nothing goes
+// through.
+func (s *Stats) Counters() Counters {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	c := Counters{
+		Bytes:      s.bytes,
+		VideoBytes: s.videoBytes,
+		AudioBytes: s.audioBytes,
+		Packets:    s.packets,
+		Frames:     s.frames,
+		Dropped:    s.dropped,
+	}
+	if s.packets == 0 {
+		return c
+	}
+	s.advance()
+	for i, window := range StatsWindows {
+		// the current tick is still filling up, so the window ends before
+		// it, and it starts no earlier than the first update
+		ticks := int64(window / statsTick)
+		if elapsed := s.tick - s.start; elapsed < ticks {
+			ticks = elapsed
+		}
+		if ticks == 0 {
+			continue
+		}
+		var sum uint64
+		for t := s.tick - ticks; t < s.tick; t++ {
+			sum += s.buckets[t%int64(len(s.buckets))]
+		}
+		seconds := float64(ticks) * statsTick.Seconds()
+		c.Bitrates[i] = float64(sum) * 8 / 1000 / seconds
+	}
+	return c
+}
+
+// advance moves the current bucket to now, emptying the ones skipped.
+func (s *Stats) advance() {
+	tick := now().UnixNano() / int64(statsTick)
+	if s.start == 0 {
+		s.start, s.tick = tick, tick
+		return
+	}
+	if tick <= s.tick {
+		return
+	}
+	if tick-s.tick > int64(len(s.buckets)) {
+		s.tick = tick - int64(len(s.buckets))
+	}
+	for s.tick < tick {
+		s.tick++
+		s.buckets[s.tick%int64(len(s.buckets))] = 0
+	}
+}
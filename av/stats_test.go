@@ -0,0 +1,112 @@
+package av
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeClock struct {
+	lock sync.Mutex
+	t    time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.t
+}
+
+func (c *fakeClock) add(d time.Duration) {
+	c.lock.Lock()
+	c.t = c.t.Add(d)
+	c.lock.Unlock()
+}
+
+// useClock makes the stats use a fake clock until the returned function is
+// called.
+func useClock() (*fakeClock, func()) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	now = clock.now
+	return clock, func() { now = time.Now }
+}
+
+type videoHeader bool
+
+func (h videoHeader) IsKeyFrame() bool       { return true }
+func (h videoHeader) IsSeq() bool            { return bool(h) }
+func (h videoHeader) CodecID() uint8         { return VIDEO_H264 }
+func (h videoHeader) CompositionTime() int32 { return 0 }
+
+func TestStatsBitrates(t *testing.T) {
+	at := assert.New(t)
+	clock, restore := useClock()
+	defer restore()
+	var s Stats
+	at.Equal(Counters{}, s.Counters())
+
+	// 1000 kbit/s for 10s
+	for i := 0; i < 100; i++ {
+		s.Update(&Packet{IsVideo: true, Header: videoHeader(false), Data: make([]byte, 12500)})
+		clock.add(100 * time.Millisecond)
+	}
+	c := s.Counters()
+	at.Equal(uint64(1250000), c.Bytes)
+	at.Equal(uint64(1250000), c.VideoBytes)
+	at.Equal(uint64(100), c.Packets)
+	at.Equal(uint64(100), c.Frames)
+	// the 30s window only spans the 10s since the first packet
+	for _, rate := range c.Bitrates {
+		at.InDelta(1000, rate, 0.01)
+	}
+
+	// the rates decay without packets
+	clock.add(3 * time.Second)
+	c = s.Counters()
+	at.InDelta(0, c.Bitrates[0], 0.01)
+	at.InDelta(400, c.Bitrates[1], 0.01)
+	at.InDelta(1000*10/13.0, c.Bitrates[2], 0.01)
+	at.Equal(c.Bitrates[1], c.Bitrate())
+
+	clock.add(time.Minute)
+	c = s.Counters()
+	at.Equal([3]float64{}, c.Bitrates)
+	at.Equal(uint64(1250000), c.Bytes)
+}
+
+func TestStatsCounters(t *testing.T) {
+	at := assert.New(t)
+	_, restore := useClock()
+	defer restore()
+	var s Stats
+	s.Update(&Packet{IsVideo: true, Header: videoHeader(true), Data: make([]byte, 10)})
+	s.Update(&Packet{IsVideo: true, Header: videoHeader(false), Data: make([]byte, 100)})
+	s.Update(&Packet{IsAudio: true, Data: make([]byte, 20)})
+	s.Update(&Packet{IsMetadata: true, Data: make([]byte, 5)})
+	s.Drop(2)
+	c := s.Counters()
+	at.Equal(uint64(135), c.Bytes)
+	at.Equal(uint64(110), c.VideoBytes)
+	at.Equal(uint64(20), c.AudioBytes)
+	at.Equal(uint64(4), c.Packets)
+	at.Equal(uint64(1), c.Frames)
+	at.Equal(uint64(2), c.Dropped)
+}
+
+func TestStatsConcurrentReads(t *testing.T) {
+	var s Stats
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			s.Counters()
+		}
+	}()
+	for i := 0; i < 1000; i++ {
+		s.Update(&Packet{IsAudio: true, Data: make([]byte, 10)})
+	}
+	<-done
+	assert.Equal(t, uint64(1000), s.Counters().Packets)
+}
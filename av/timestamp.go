@@ -0,0 +1,147 @@
+package av
+
+const (
+	// DefaultMaxTimestampJump is the largest forward step in ms accepted
+	// between two packets of the same track before it counts as a jump.
+	DefaultMaxTimestampJump = 5000
+	// DefaultMaxAVDrift is the largest distance in ms allowed between the
+	// audio and video clocks before the drifting track is resynced.
+	DefaultMaxAVDrift = 3000
+)
+
+// timestampJitter is how far in ms a track may step back before it counts
+// as a jump; smaller steps are only clamped.
+const timestampJitter = 100
+
+const (
+	trackAudio = iota
+	trackVideo
+	trackNum
+)
+
+type trackTimestamp struct {
+	started   bool
+	lastRaw   uint32
+	lastDelta int64
+	offset    int64
+	lastOut   int64
+	// ext is the raw timestamp unwrapped past 2^32 ms
+	ext int64
+}
+
+// TimestampCorrector rewrites packet timestamps of one publisher so that
+// every stream starts at zero, survives 32 bit rollover and encoder clock
+// jumps, and keeps audio and video monotonic and close to each other.
+type TimestampCorrector struct {
+	MaxJump  int64
+	MaxDrift int64
+
+	based   bool
+	base    int64
+	startAt int64
+	tracks  [trackNum]trackTimestamp
+	// Discontinuities counts the jumps and drifts corrected so far.
+	Discontinuities uint64
+}
+
+func NewTimestampCorrector() *TimestampCorrector {
+	return &TimestampCorrector{
+		MaxJump:  DefaultMaxTimestampJump,
+		MaxDrift: DefaultMaxAVDrift,
+	}
+}
+
+// Continue prepares the corrector for a new publisher of the same stream:
+// the next packets are rebased to follow the last timestamps sent so that
+// players attached to the stream see no step back.
+func (c *TimestampCorrector) Continue() {
+	last := c.lastOut()
+	for i := range c.tracks {
+		c.tracks[i].started = false
+		c.tracks[i].lastOut = last
+	}
+	c.based = false
+	c.startAt = last
+}
+
+// Correct rewrites p.TimeStamp in place.
+func (c *TimestampCorrector) Correct(p *Packet) {
+	if p.IsMetadata || (!p.IsAudio && !p.IsVideo) {
+		p.TimeStamp = uint32(c.lastOut())
+		return
+	}
+	idx, other := trackAudio, trackVideo
+	if p.IsVideo {
+		idx, other = trackVideo, trackAudio
+	}
+	t := &c.tracks[idx]
+	o := &c.tracks[other]
+
+	if !t.started {
+		t.started = true
+		t.ext = int64(p.TimeStamp)
+		t.lastRaw = p.TimeStamp
+		if !c.based {
+			c.based = true
+			c.base = t.ext - c.startAt
+		}
+		t.offset = -c.base
+		if out := t.ext + t.offset; o.started && c.MaxDrift > 0 &&
+			(out > o.lastOut+c.MaxDrift || out < o.lastOut-c.MaxDrift) {
+			// the encoder started this track on a different clock
+			c.Discontinuities++
+			t.offset = o.lastOut - t.ext
+		}
+		c.emit(t, p)
+		return
+	}
+
+	// signed 32 bit difference handles the rollover at 2^32 ms
+	delta := int64(int32(p.TimeStamp - t.lastRaw))
+	t.lastRaw = p.TimeStamp
+	t.ext += delta
+
+	if delta < -timestampJitter || delta > c.MaxJump {
+		c.resync(t, o, t.lastOut+t.lastDelta)
+	} else {
+		if delta > 0 {
+			t.lastDelta = delta
+		}
+		// Only a track falling behind is pulled forward; one running ahead
+		// usually means the other track paused and will catch up itself.
+		if out := t.ext + t.offset; o.started && c.MaxDrift > 0 && out < o.lastOut-c.MaxDrift {
+			c.resync(t, o, o.lastOut)
+		}
+	}
+	c.emit(t, p)
+}
+
+// resync moves the track offset so that the current packet maps to want,
+// but never more than MaxDrift behind the other track's clock.
+func (c *TimestampCorrector) resync(t, o *trackTimestamp, want int64) {
+	c.Discontinuities++
+	if o.started && want < o.lastOut-c.MaxDrift {
+		want = o.lastOut
+	}
+	t.offset = want - t.ext
+}
+
+func (c *TimestampCorrector) emit(t *trackTimestamp, p *Packet) {
+	out := t.ext + t.offset
+	if out < t.lastOut {
+		out = t.lastOut
+	}
+	if out < 0 {
+		out = 0
+	}
+	t.lastOut = out
+	p.TimeStamp = uint32(out)
+}
+
+func (c *TimestampCorrector) lastOut() int64 {
+	last := c.tracks[trackAudio].lastOut
+	if v := c.tracks[trackVideo].lastOut; v > last {
+		last = v
+	}
+	return last
+}
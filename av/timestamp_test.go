@@ -0,0 +1,110 @@
+package av
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func correct(c *TimestampCorrector, video bool, ts uint32) uint32 {
+	p := &Packet{IsVideo: video, IsAudio: !video, TimeStamp: ts}
+	c.Correct(p)
+	return p.TimeStamp
+}
+
+func TestTimestampRebase(t *testing.T) {
+	at := assert.New(t)
+	c := NewTimestampCorrector()
+	at.Equal(uint32(0), correct(c, true, 10000))
+	at.Equal(uint32(20), correct(c, false, 10020))
+	at.Equal(uint32(40), correct(c, true, 10040))
+	at.Equal(uint32(43), correct(c, false, 10043))
+	at.Equal(uint64(0), c.Discontinuities)
+}
+
+func TestTimestampRollover(t *testing.T) {
+	at := assert.New(t)
+	c := NewTimestampCorrector()
+	at.Equal(uint32(0), correct(c, true, 0xffffffd8))
+	at.Equal(uint32(40), correct(c, true, 0))
+	at.Equal(uint32(80), correct(c, true, 40))
+	at.Equal(uint64(0), c.Discontinuities)
+}
+
+func TestTimestampBackwardJump(t *testing.T) {
+	at := assert.New(t)
+	c := NewTimestampCorrector()
+	at.Equal(uint32(0), correct(c, true, 5000))
+	at.Equal(uint32(40), correct(c, true, 5040))
+	// encoder restarted its clock
+	at.Equal(uint32(80), correct(c, true, 0))
+	at.Equal(uint32(120), correct(c, true, 40))
+	at.Equal(uint64(1), c.Discontinuities)
+}
+
+func TestTimestampForwardJump(t *testing.T) {
+	at := assert.New(t)
+	c := NewTimestampCorrector()
+	at.Equal(uint32(0), correct(c, true, 0))
+	at.Equal(uint32(40), correct(c, true, 40))
+	at.Equal(uint32(80), correct(c, true, 3600040))
+	at.Equal(uint32(120), correct(c, true, 3600080))
+	at.Equal(uint64(1), c.Discontinuities)
+}
+
+func TestTimestampSmallBackwardStepClamped(t *testing.T) {
+	at := assert.New(t)
+	c := NewTimestampCorrector()
+	at.Equal(uint32(0), correct(c, false, 100))
+	at.Equal(uint32(23), correct(c, false, 123))
+	at.Equal(uint32(23), correct(c, false, 120))
+	at.Equal(uint32(46), correct(c, false, 146))
+	at.Equal(uint64(0), c.Discontinuities)
+}
+
+func TestTimestampDriftResync(t *testing.T) {
+	at := assert.New(t)
+	c := NewTimestampCorrector()
+	at.Equal(uint32(0), correct(c, true, 0))
+	at.Equal(uint32(0), correct(c, false, 0))
+	// audio keeps going, video falls behind
+	at.Equal(uint32(4000), correct(c, false, 4000))
+	at.Equal(uint32(8000), correct(c, false, 8000))
+	at.Equal(uint32(5000), correct(c, true, 5000))
+	at.Equal(uint32(8040), correct(c, false, 8040))
+	at.Equal(uint32(8040), correct(c, true, 5020))
+	at.Equal(uint32(8080), correct(c, true, 5060))
+	at.Equal(uint64(1), c.Discontinuities)
+}
+
+func TestTimestampTrackStartsOnOtherClock(t *testing.T) {
+	at := assert.New(t)
+	c := NewTimestampCorrector()
+	at.Equal(uint32(0), correct(c, true, 0))
+	at.Equal(uint32(40), correct(c, true, 40))
+	at.Equal(uint32(40), correct(c, false, 900000))
+	at.Equal(uint32(63), correct(c, false, 900023))
+}
+
+func TestTimestampContinue(t *testing.T) {
+	at := assert.New(t)
+	c := NewTimestampCorrector()
+	correct(c, true, 0)
+	correct(c, false, 1000)
+	correct(c, true, 2000)
+	c.Continue()
+	// the new publisher starts on its own clock
+	at.Equal(uint32(2000), correct(c, true, 50000))
+	at.Equal(uint32(2010), correct(c, false, 50010))
+	at.Equal(uint32(2040), correct(c, true, 50040))
+}
+
+func TestTimestampMetadata(t *testing.T) {
+	at := assert.New(t)
+	c := NewTimestampCorrector()
+	correct(c, true, 100)
+	correct(c, true, 140)
+	p := &Packet{IsMetadata: true, TimeStamp: 12345}
+	c.Correct(p)
+	at.Equal(uint32(40), p.TimeStamp)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bomin"
+	"bomin/configure"
+	"bomin/logging"
+	"bomin/protocol/rtmp"
+	"bomin/protocol/rtmp/queue"
+	"bomin/protocol/websocket"
+	"bomin/utils/network"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+var (
+	version        = "master"
+	rtmpAddr       = flag.String("rtmp-addr", ":1935", "RTMP server listen address")
+	httpFlvAddr    = flag.String("httpflv-addr", ":7001", "HTTP-FLV server listen address")
+	hlsAddr        = flag.String("hls-addr", ":7002", "HLS server listen address")
+	operaAddr      = flag.String("manage-addr", ":8090", "HTTP manage interface server listen address")
+	configfilename = flag.String("cfgfile", "livego.cfg", "live configure filename")
+	drainTimeout   = flag.Duration("drain-timeout", 10*time.Second, "how long players may drain on shutdown")
+	readTimeout    = flag.Int("readTimeout", 10, "read time out")
+	writeTimeout   = flag.Int("writeTimeout", 10, "write time out")
+	gopNum         = flag.Int("gopNum", 1, "gop num")
+	fileDir        = flag.String("file-dir", "", "directory the API may publish FLV files from")
+	dropPolicy     = flag.String("drop-policy", "keyframe", "what a slow player's full queue does: keyframe, non-reference or disconnect")
+	maxLag         = flag.Duration("max-lag", 0, "disconnect players this far behind the stream, 0 never")
+	maxConns       = flag.Int("max-conns", 0, "most RTMP connections served at once, 0 no limit")
+	maxConnsPerIP  = flag.Int("max-conns-per-ip", 0, "most RTMP connections from one IP, 0 no limit")
+	handshakeTime  = flag.Duration("handshake-timeout", 5*time.Second, "how long an RTMP handshake may take")
+	connectTime    = flag.Duration("connect-timeout", 10*time.Second, "how long an RTMP client may take to publish or play")
+	ffmpeg         = flag.String("ffmpeg", "ffmpeg", "ffmpeg binary run for the apps' transcode profiles")
+	webAddr        = flag.String("addr", ":443", "http service address")
+	logLevel       = flag.String("log-level", "", "log levels, e.g. info,rtmp=debug,hls=warn")
+	logJSON        = flag.Bool("log-json", false, "write logs as JSON lines")
+)
+
+func init() {
+	log.SetFlags(log.Lshortfile | log.Ltime | log.Ldate)
+	flag.Parse()
+	if *logLevel != "" {
+		if err := logging.Default.SetLevels(*logLevel); err != nil {
+			log.Fatal("log-level: ", err)
+		}
+	}
+	if *logJSON {
+		logging.Default.SetJSON(true)
+	}
+}
+
+func checkError(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
+
+func genPem() {
+
+	if _, err := os.Stat("cert.pem"); err == nil { // file is exists
+		return
+	}
+	//create 2 files cert.pem and key.pem
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	checkError(err)
+
+	SNLimit := new(big.Int).Lsh(big.NewInt(1), 128)
+	SN, err := rand.Int(rand.Reader, SNLimit)
+	checkError(err)
+	template := x509.Certificate{
+		SerialNumber: SN,
+		Subject: pkix.Name{
+			Organization: []string{"test"},
+		},
+		NotBefore: time.Now(),
+		NotAfter:  time.Now().Add(365 * 24 * time.Hour),
+
+		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+	}
+	template.DNSNames = append(template.DNSNames, network.GetOutboundIP())
+	template.EmailAddresses = append(template.EmailAddresses, "test@test.com")
+
+	certBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &privateKey.PublicKey, privateKey)
+	checkError(err)
+	certFile, err := os.Create("cert.pem")
+	checkError(err)
+	checkError(pem.Encode(certFile, &pem.Block{Type: "CERTIFICATE", Bytes: certBytes}))
+	checkError(certFile.Close())
+
+	keyFile, err := os.OpenFile("key.pem", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	checkError(err)
+	// pem.Encode(keyOut, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv.(*rsa.PrivateKey))})
+	checkError(pem.Encode(keyFile, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)}))
+	checkError(keyFile.Close())
+}
+
+// startHTTPSWeb serves the WebRTC demo over HTTPS on the -addr address, its
+// rooms named by the streams of stream.
+func startHTTPSWeb(stream *rtmp.RtmpStream) *http.Server {
+	//webDir := http.Dir("demo")
+	webDir := http.Dir("demo_p2p")
+	fs := http.FileServer(webDir)
+	hub := websocket.NewHub()
+	hub.SetKeyMapper(stream)
+	go hub.Run()
+	http.Handle("/", fs)
+	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		websocket.ServeWs(hub, w, r)
+	})
+
+	// Create a CA certificate pool and add cert.pem to it
+	//caCert, err := ioutil.ReadFile("tls/cert.pem")
+	//if err != nil {
+	//	log.Fatal(err)
+	//}
+	//caCertPool := x509.NewCertPool()
+	//caCertPool.AppendCertsFromPEM(caCert)
+	//
+	//// Create the TLS Config with the CA pool and enable Client certificate validation
+	//tlsConfig := &tls.Config{
+	//	ClientCAs: caCertPool,
+	//	ClientAuth: tls.RequireAndVerifyClientCert,
+	//}
+	//tlsConfig.BuildNameToCertificate()
+
+	// Create a Server instance to listen on port 8443 with the TLS config
+	server := &http.Server{
+		Addr: *webAddr,
+		//TLSConfig: tlsConfig,
+	}
+
+	go func() {
+		//err := server.ListenAndServe()
+		err := server.ListenAndServeTLS("cert.pem", "key.pem")
+		//err := server.ListenAndServeTLS("/usr/local/share/ca-certificates/public.pem", "/usr/local/share/ca-certificates/private.key")
+		if err != nil && err != http.ErrServerClosed {
+			log.Println(err)
+		}
+	}()
+	return server
+}
+
+func main() {
+	// without its file the server runs the default live app, but a file it
+	// cannot use would leave the address lists it sets off
+	if err := configure.LoadConfig(*configfilename); err != nil && !os.IsNotExist(err) {
+		log.Fatal("cfgfile: ", err)
+	}
+	genPem()
+	fmt.Println(network.GetOutboundIP())
+
+	policy, err := queue.ParsePolicy(*dropPolicy)
+	if err != nil {
+		log.Fatal("drop-policy: ", err)
+	}
+	srv := bomin.NewServer(bomin.Options{
+		RtmpAddr:         *rtmpAddr,
+		HttpFlvAddr:      *httpFlvAddr,
+		HlsAddr:          *hlsAddr,
+		ApiAddr:          *operaAddr,
+		ReadTimeout:      time.Second * time.Duration(*readTimeout),
+		WriteTimeout:     time.Second * time.Duration(*writeTimeout),
+		GopNum:           *gopNum,
+		Queue:            queue.Config{Policy: policy, MaxLag: *maxLag},
+		FileDir:          *fileDir,
+		DrainTimeout:     *drainTimeout,
+		HandshakeTimeout: *handshakeTime,
+		ConnectTimeout:   *connectTime,
+		MaxConns:         *maxConns,
+		MaxConnsPerIP:    *maxConnsPerIP,
+		FFmpeg:           *ffmpeg,
+	})
+	if err := srv.Start(); err != nil {
+		log.Fatal(err)
+	}
+	web := startHTTPSWeb(srv.Stream())
+	log.Println("listening on", srv.Addrs())
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	<-sig
+	log.Println("shutting down, a second signal exits at once")
+	go func() {
+		<-sig
+		os.Exit(1)
+	}()
+	// the demo's WebSockets are hijacked, Shutdown does not wait for them
+	ctx, cancel := context.WithTimeout(context.Background(), *drainTimeout)
+	if err := web.Shutdown(ctx); err != nil {
+		web.Close()
+	}
+	cancel()
+	if err := srv.Shutdown(context.Background()); err != nil {
+		log.Println("shutdown:", err)
+	}
+}
@@ -1,74 +1,405 @@
 package configure
 
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+)
+
 /*
 {
 	[
 	{
 	"application":"live",
+	"vhost":"live.example.com",
 	"live":"on",
 	"hls":"on",
-	"static_push":["rtmp://xx/live"]
+	"static_push":["rtmp://xx/live"],
+	"edge_origins":["rtmp://origin1:1935", "rtmp://origin2:1935"],
+	"forward_nodes":["node2:1935", "node3:1935"],
+	"forward_template":"rtmp://{node}/{app}/{name}",
+	"max_publishers":10,
+	"max_players":1000,
+	"publish_allow":["10.0.0.0/8", "192.168.1.20"],
+	"play_deny":["203.0.113.0/24"],
+	"key_aliases":{"8f3a6c":"channel1"},
+	"key_rewrites":[{"match":"^pub_(.*)$", "replace":"$1"}],
+	"transcode":[{"name":"{name}_720", "args":["-c:v", "libx264", "-s", "1280x720", "-c:a", "copy"]}]
 	}
 	]
 }
 */
 type Application struct {
-	Appname     string
-	Liveon      string
-	Hlson       string
-	Static_push []string
+	Appname          string
+	// Vhost serves the application to the clients connecting to that host
+	// name only, its streams apart from those of the application on the
+	// other hosts.
+	Vhost            string
+	Liveon           string
+	Hlson            string
+	Static_push      []string
+	Edge_origins     []string
+	Forward_nodes    []string
+	Forward_template string
+	// Max_publishers and Max_players cap the clients of the app, 0 is no
+	// limit. The HLS players are not counted: a playlist request is
+	// refused once the RTMP and HTTP-FLV players reach Max_players.
+	Max_publishers int
+	Max_players    int
+	// The addresses, IPs or CIDRs, that may publish and play. A denied
+	// address never may, an allow list lets only its addresses.
+	Publish_allow []string
+	Publish_deny  []string
+	Play_allow    []string
+	Play_deny     []string
+	// Key_aliases maps the stream names publishers ask for to the streams
+	// they publish, Key_rewrites rewrite the names of publishers and players
+	// no alias matched, the first matching rule wins.
+	Key_aliases  map[string]string
+	Key_rewrites []Rewrite
+	// Transcode are the profiles every stream published to the app is
+	// transcoded into.
+	Transcode []Transcode
+}
+
+// Rewrite replaces a stream name matching the regular expression Match by
+// Replace, which may refer to its groups as $1.
+type Rewrite struct {
+	Match   string
+	Replace string
+}
+
+// compiled caches the expressions of the rewrites, by Match.
+var compiled = struct {
+	sync.Mutex
+	m map[string]*regexp.Regexp
+}{m: make(map[string]*regexp.Regexp)}
+
+// compile returns the compiled expression of the rule.
+func (rule Rewrite) compile() (*regexp.Regexp, error) {
+	compiled.Lock()
+	defer compiled.Unlock()
+	if re, ok := compiled.m[rule.Match]; ok {
+		return re, nil
+	}
+	re, err := regexp.Compile(rule.Match)
+	if err != nil {
+		return nil, err
+	}
+	compiled.m[rule.Match] = re
+	return re, nil
+}
+
+// output returns the name the rule maps all names it matches to, if it
+// does not depend on them.
+func (rule Rewrite) output() (string, bool) {
+	return rule.Replace, !strings.Contains(rule.Replace, "$")
+}
+
+// Transcode publishes the stream Name, {name} standing for the name of the
+// source, encoded by ffmpeg with the output options Args.
+type Transcode struct {
+	Name string
+	Args []string
 }
 
 type ServerCfg struct {
 	Server []Application
 }
 
+// RtmpServercfg is the configuration of the applications. Once clients are
+// served it is only changed through SetConfig and read through Config.
 var RtmpServercfg ServerCfg
 
+// cfgLock guards RtmpServercfg.
+var cfgLock sync.RWMutex
+
+var defaultServercfg = ServerCfg{Server: []Application{{Appname: "live", Hlson: "on", Liveon: "on"}}}
+
+// LoadConfig reads the applications from the JSON file configfilename. On any
+// error the default configuration is kept: the error satisfies os.IsNotExist
+// when the file is missing.
 func LoadConfig(configfilename string) error {
-	//log.Printf("starting load configure file(%s)......", configfilename)
-	//filename := configfilename
-	//projectDir, found := syscall.Getenv("DIR")
-	//if found {
-	//	filename = projectDir + "/" + configfilename
-	//}
-	//
-	//data, err := ioutil.ReadFile(filename)
-	//if err != nil {
-	//	log.Printf("ReadFile %s error:%v", filename, err)
-	//	return err
-	//}
-
-	//log.Printf("loadconfig: \r\n%s", string(data))
-	RtmpServercfg = ServerCfg{Server: []Application{{Appname: "live", Hlson: "on", Liveon: "on"}}}
-	//err = json.Unmarshal(data, &RtmpServercfg)
-	//if err != nil {
-	//	log.Printf("json.Unmarshal error:%v", err)
-	//	return err
-	//}
-	//log.Printf("get config json data:%v", RtmpServercfg)
+	log.Printf("starting load configure file(%s)......", configfilename)
+	filename := configfilename
+	projectDir, found := syscall.Getenv("DIR")
+	if found {
+		filename = projectDir + "/" + configfilename
+	}
+
+	cfgLock.Lock()
+	RtmpServercfg = defaultServercfg
+	cfgLock.Unlock()
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		log.Printf("ReadFile %s error:%v, use default configure", filename, err)
+		return err
+	}
+
+	var cfg ServerCfg
+	if err = json.Unmarshal(data, &cfg); err != nil {
+		log.Printf("json.Unmarshal error:%v", err)
+		return err
+	}
+	if err = SetConfig(cfg); err != nil {
+		log.Printf("invalid configure: %v", err)
+		return err
+	}
+	log.Printf("get config json data:%v", cfg)
 	return nil
 }
 
+// SetConfig checks cfg and makes it the configuration of the applications.
+func SetConfig(cfg ServerCfg) error {
+	if err := cfg.check(); err != nil {
+		return err
+	}
+	cfgLock.Lock()
+	RtmpServercfg = cfg
+	cfgLock.Unlock()
+	return nil
+}
+
+// Config returns the configuration of the applications.
+func Config() ServerCfg {
+	cfgLock.RLock()
+	defer cfgLock.RUnlock()
+	return RtmpServercfg
+}
+
+// vhostSep joins an application and the vhost it is served on in the
+// application names of the streams.
+const vhostSep = "@"
+
+// SplitApp returns the application and the vhost, if any, of an application
+// name as ResolveApp returns it.
+func SplitApp(appname string) (app, vhost string) {
+	if pos := strings.Index(appname, vhostSep); pos >= 0 {
+		return appname[:pos], appname[pos+len(vhostSep):]
+	}
+	return appname, ""
+}
+
+// findApp returns the configuration of the application, appname being
+// qualified by its vhost, if any, as ResolveApp returns it.
+func findApp(appname string) (Application, bool) {
+	appname, vhost := SplitApp(appname)
+	for _, app := range Config().Server {
+		if (app.Appname == appname) && (strings.EqualFold(app.Vhost, vhost)) && (app.Liveon == "on") {
+			return app, true
+		}
+	}
+	return Application{}, false
+}
+
+// ResolveApp returns the name of the application a client connecting to host
+// asks for: appname@host when host has its own appname, appname otherwise.
+// Clients only reach the app of a vhost through its host: ok is false for
+// an appname already qualified by one.
+func ResolveApp(host, appname string) (resolved string, ok bool) {
+	if strings.Contains(appname, vhostSep) {
+		return "", false
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.Trim(host, "[]"))
+	if host == "" {
+		return appname, true
+	}
+	if _, ok := findApp(appname + vhostSep + host); ok {
+		return appname + vhostSep + host, true
+	}
+	return appname, true
+}
+
+// StreamPath returns the path, app/name, of the stream key in the RTMP URLs
+// of other servers and of the local clients, the vhost of its application,
+// if any, being passed as the vhost parameter.
+func StreamPath(key string) string {
+	paths := strings.SplitN(key, "/", 2)
+	app, vhost := SplitApp(paths[0])
+	if vhost == "" || len(paths) != 2 {
+		return key
+	}
+	return app + "/" + paths[1] + "?vhost=" + url.QueryEscape(vhost)
+}
+
 func CheckAppName(appname string) bool {
-	for _, app := range RtmpServercfg.Server {
-		if (app.Appname == appname) && (app.Liveon == "on") {
+	_, ok := findApp(appname)
+	return ok
+}
+
+func GetStaticPushUrlList(appname string) ([]string, bool) {
+	if app, ok := findApp(appname); ok {
+		if len(app.Static_push) > 0 {
+			return app.Static_push, true
+		} else {
+			return nil, false
+		}
+	}
+	return nil, false
+}
+
+func GetEdgeOriginList(appname string) ([]string, bool) {
+	if app, ok := findApp(appname); ok {
+		if len(app.Edge_origins) > 0 {
+			return app.Edge_origins, true
+		}
+		return nil, false
+	}
+	return nil, false
+}
+
+func GetForwardConfig(appname string) ([]string, string, bool) {
+	if app, ok := findApp(appname); ok {
+		if len(app.Forward_nodes) > 0 {
+			return app.Forward_nodes, app.Forward_template, true
+		}
+		return nil, "", false
+	}
+	return nil, "", false
+}
+
+func (cfg *ServerCfg) check() error {
+	for _, app := range cfg.Server {
+		lists := [][]string{app.Publish_allow, app.Publish_deny, app.Play_allow, app.Play_deny}
+		for _, list := range lists {
+			for _, addr := range list {
+				if parseNet(addr) == nil {
+					return fmt.Errorf("application %s: invalid address %q", app.Appname, addr)
+				}
+			}
+		}
+		for _, profile := range app.Transcode {
+			if profile.Name == "" || !strings.Contains(profile.Name, "{name}") {
+				return fmt.Errorf("application %s: transcode name %q without {name}", app.Appname, profile.Name)
+			}
+		}
+		for _, rule := range app.Key_rewrites {
+			if _, err := rule.compile(); err != nil {
+				return fmt.Errorf("application %s: invalid rewrite %q: %v", app.Appname, rule.Match, err)
+			}
+		}
+	}
+	return nil
+}
+
+// parseNet parses a CIDR, or an IP as a network of its own.
+func parseNet(addr string) *net.IPNet {
+	if strings.Contains(addr, "/") {
+		_, ipnet, err := net.ParseCIDR(addr)
+		if err != nil {
+			return nil
+		}
+		return ipnet
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil
+	}
+	bits := 8 * net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 8*net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+}
+
+func matchNets(list []string, ip net.IP) bool {
+	for _, addr := range list {
+		if ipnet := parseNet(addr); ipnet != nil && ipnet.Contains(ip) {
 			return true
 		}
 	}
 	return false
 }
 
-func GetStaticPushUrlList(appname string) ([]string, bool) {
-	for _, app := range RtmpServercfg.Server {
-		if (app.Appname == appname) && (app.Liveon == "on") {
-			if len(app.Static_push) > 0 {
-				return app.Static_push, true
-			} else {
-				return nil, false
-			}
+func checkAddr(allow, deny []string, ip net.IP) bool {
+	if matchNets(deny, ip) {
+		return false
+	}
+	return len(allow) == 0 || matchNets(allow, ip)
+}
+
+// CheckPublishAddr reports whether ip may publish to the application, one
+// not configured has no address lists.
+func CheckPublishAddr(appname string, ip net.IP) bool {
+	if app, ok := findApp(appname); ok {
+		return checkAddr(app.Publish_allow, app.Publish_deny, ip)
+	}
+	return true
+}
+
+// CheckPlayAddr reports whether ip may play from the application, one not
+// configured has no address lists.
+func CheckPlayAddr(appname string, ip net.IP) bool {
+	if app, ok := findApp(appname); ok {
+		return checkAddr(app.Play_allow, app.Play_deny, ip)
+	}
+	return true
+}
+
+// GetClientLimits returns the most publishers and players the application
+// takes, 0 for no limit.
+func GetClientLimits(appname string) (int, int) {
+	if app, ok := findApp(appname); ok {
+		return app.Max_publishers, app.Max_players
+	}
+	return 0, 0
+}
+
+// MapStreamName returns the stream a client publishing, or playing, name in
+// the application gets: the alias of the name for a publisher, the first
+// rewrite matching it for both, the name itself otherwise. The names the
+// aliases and rewrites stand for are only published through them: ok is
+// false for a publisher asking for an alias target or for the fixed
+// replacement of a rewrite. The replacements taking groups of the name
+// cannot be told in advance and are not refused.
+func MapStreamName(appname, name string, publish bool) (mapped string, ok bool) {
+	app, found := findApp(appname)
+	if !found {
+		return name, true
+	}
+	if alias, found := app.Key_aliases[name]; found && publish {
+		return alias, true
+	}
+	for _, rule := range app.Key_rewrites {
+		re, err := rule.compile()
+		if err != nil {
+			log.Printf("application %s: invalid rewrite %q skipped: %v", appname, rule.Match, err)
+			continue
+		}
+		if re.MatchString(name) {
+			return re.ReplaceAllString(name, rule.Replace), true
+		}
+	}
+	if !publish {
+		return name, true
+	}
+	for _, rule := range app.Key_rewrites {
+		if output, fixed := rule.output(); fixed && output == name {
+			return name, false
 		}
+	}
+	for _, target := range app.Key_aliases {
+		if target == name {
+			return name, false
+		}
+	}
+	return name, true
+}
 
+// GetTranscodeProfiles returns the transcode profiles of the application.
+func GetTranscodeProfiles(appname string) []Transcode {
+	if app, ok := findApp(appname); ok {
+		return app.Transcode
 	}
-	return nil, false
+	return nil
 }
@@ -0,0 +1,129 @@
+package configure
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveApp(t *testing.T) {
+	at := assert.New(t)
+	saved := RtmpServercfg
+	defer func() { RtmpServercfg = saved }()
+	RtmpServercfg = ServerCfg{Server: []Application{
+		{Appname: "live", Liveon: "on"},
+		{Appname: "live", Vhost: "media.example.com", Liveon: "on", Max_players: 10},
+		{Appname: "vod", Vhost: "media.example.com", Liveon: "on"},
+	}}
+
+	resolve := func(host, appname string) string {
+		app, ok := ResolveApp(host, appname)
+		at.True(ok)
+		return app
+	}
+	at.Equal("live", resolve("", "live"))
+	at.Equal("live", resolve("other.example.com:1935", "live"))
+	at.Equal("live@media.example.com", resolve("Media.Example.com:1935", "live"))
+	at.Equal("vod", resolve("other.example.com", "vod"))
+	// a vhost is only reached through its host
+	_, ok := ResolveApp("other.example.com", "live@media.example.com")
+	at.False(ok)
+	_, ok = ResolveApp("media.example.com", "live@media.example.com")
+	at.False(ok)
+
+	at.True(CheckAppName("live"))
+	at.True(CheckAppName("live@media.example.com"))
+	at.True(CheckAppName("vod@media.example.com"))
+	at.False(CheckAppName("vod"))
+	at.False(CheckAppName("live@other.example.com"))
+
+	_, players := GetClientLimits("live@media.example.com")
+	at.Equal(10, players)
+	_, players = GetClientLimits("live")
+	at.Equal(0, players)
+}
+
+func TestStreamPath(t *testing.T) {
+	at := assert.New(t)
+	app, vhost := SplitApp("live@media.example.com")
+	at.Equal("live", app)
+	at.Equal("media.example.com", vhost)
+	app, vhost = SplitApp("live")
+	at.Equal("live", app)
+	at.Equal("", vhost)
+
+	at.Equal("live/movie", StreamPath("live/movie"))
+	at.Equal("live/movie?vhost=media.example.com", StreamPath("live@media.example.com/movie"))
+}
+
+func TestMapStreamName(t *testing.T) {
+	at := assert.New(t)
+	saved := RtmpServercfg
+	defer func() { RtmpServercfg = saved }()
+	// set without SetConfig, as an embedding program may
+	RtmpServercfg = ServerCfg{Server: []Application{
+		{Appname: "live", Liveon: "on", Key_rewrites: []Rewrite{
+			{Match: "(", Replace: "broken"},
+			{Match: "^(.*)_hd$", Replace: "hd/$1"},
+			{Match: "^secret$", Replace: "movie"},
+		}},
+	}}
+
+	check := func(name string, publish bool, mapped string, ok bool) {
+		m, o := MapStreamName("live", name, publish)
+		at.Equal(mapped, m, name)
+		at.Equal(ok, o, name)
+	}
+	check("a_hd", true, "hd/a", true)
+	check("secret", false, "movie", true)
+	// ordinary names are published as is, the fixed target is not
+	check("other", true, "other", true)
+	check("movie", true, "movie", false)
+	check("movie", false, "movie", true)
+}
+
+func TestLoadConfig(t *testing.T) {
+	at := assert.New(t)
+	saved := RtmpServercfg
+	defer func() { RtmpServercfg = saved }()
+	dir, err := ioutil.TempDir("", "configure")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	err = LoadConfig(filepath.Join(dir, "missing.cfg"))
+	at.True(os.IsNotExist(err))
+	at.Equal(defaultServercfg, RtmpServercfg)
+
+	filename := filepath.Join(dir, "live.cfg")
+	at.Nil(ioutil.WriteFile(filename, []byte(`{"server":[{"appname":"live","liveon":"on","publish_allow":["10.0.0.0/33"]}]}`), 0644))
+	err = LoadConfig(filename)
+	at.NotNil(err)
+	at.False(os.IsNotExist(err))
+
+	at.Nil(ioutil.WriteFile(filename, []byte(`{"server":[{"appname":"live","liveon":"on","publish_allow":["10.0.0.0/8"]}]}`), 0644))
+	at.Nil(LoadConfig(filename))
+	at.Equal([]string{"10.0.0.0/8"}, RtmpServercfg.Server[0].Publish_allow)
+}
+
+func TestSetConfigConcurrent(t *testing.T) {
+	at := assert.New(t)
+	saved := Config()
+	defer SetConfig(saved)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			SetConfig(ServerCfg{Server: []Application{{Appname: "live", Liveon: "on"}}})
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		CheckAppName("live")
+	}
+	<-done
+	at.True(CheckAppName("live"))
+}
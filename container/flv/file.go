@@ -0,0 +1,277 @@
+package flv
+
+import (
+	"bomin/av"
+	"bomin/logging"
+	"bomin/protocol/amf"
+	"bomin/utils/uid"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+var ErrFileEmpty = errors.New("no media to publish in file")
+
+// FileOptions tells how to publish a file.
+type FileOptions struct {
+	// Loop starts the file over at its end instead of ending the stream.
+	Loop bool
+	// Offset starts the file at its first key frame at or after Offset,
+	// on every loop.
+	Offset time.Duration
+}
+
+// FileReader publishes an FLV file as a live stream, in real time as told
+// by the tag timestamps. The timestamps keep increasing when the file
+// loops, and the metadata and sequence headers are only sent once.
+type FileReader struct {
+	av.Stats
+	Uid  string
+	key  string
+	name string
+	opts FileOptions
+	file *os.File
+	tags *TagReader
+	log  logging.Logger
+
+	lock sync.Mutex
+	err  error
+	done chan struct{}
+
+	hasVideo bool // start at a key frame
+	loops    int
+	based    bool      // the first tag of the loop was sent
+	base     uint32    // its timestamp in the file
+	shift    uint32    // its timestamp on the stream
+	last     uint32    // the last timestamp sent
+	delta    uint32    // the last gap between timestamps
+	played   bool      // a tag was sent since the file was opened
+	start    time.Time // when timestamp 0 is due
+}
+
+// NewFileReader opens the FLV file name to be published as key,
+// "app/name".
+func NewFileReader(key, name string, opts FileOptions) (*FileReader, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	tags, err := NewTagReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	id := uid.NewId()
+	return &FileReader{
+		Uid:  id,
+		key:  key,
+		name: name,
+		opts: opts,
+		file: f,
+		tags: tags,
+		log:  logger.With("uid", id, "key", key, "file", name),
+		done: make(chan struct{}),
+
+		hasVideo: tags.HasVideo(),
+	}, nil
+}
+
+// PublishFile publishes the FLV file name as key through handler.
+func PublishFile(handler av.Handler, key, name string, opts FileOptions) (*FileReader, error) {
+	r, err := NewFileReader(key, name, opts)
+	if err != nil {
+		return nil, err
+	}
+	handler.HandleReader(r)
+	r.log.Info("publishing file")
+	return r, nil
+}
+
+func (r *FileReader) Info() av.Info {
+	return av.Info{Key: r.key, URL: "file://" + r.name, UID: r.Uid}
+}
+
+// Name returns the file name.
+func (r *FileReader) Name() string {
+	return r.name
+}
+
+// Options returns how the file is published.
+func (r *FileReader) Options() FileOptions {
+	return r.opts
+}
+
+// Alive reports whether the file is still published, it does not time
+// out.
+func (r *FileReader) Alive() bool {
+	return r.Err() == nil
+}
+
+// Read waits until the next tag is due and reads it. The file is closed
+// when it ends, with io.EOF unless it loops, or fails.
+func (r *FileReader) Read(p *av.Packet) error {
+	if err := r.read(p); err != nil {
+		r.Close(err)
+		return r.Err()
+	}
+	r.Update(p)
+	return nil
+}
+
+func (r *FileReader) read(p *av.Packet) error {
+	for {
+		if err := r.Err(); err != nil {
+			return err
+		}
+		err := r.tags.ReadTag(p)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			if !r.played {
+				return ErrFileEmpty
+			}
+			if !r.opts.Loop {
+				return io.EOF
+			}
+			if err := r.rewind(); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if p.IsMetadata || isSeq(p) {
+			if r.loops > 0 {
+				continue
+			}
+			if p.IsMetadata {
+				if p.Data, err = amf.MetaDataReform(p.Data, amf.ADD); err != nil {
+					continue
+				}
+			}
+			if p.IsVideo {
+				r.hasVideo = true
+			}
+			p.TimeStamp = r.last
+			return nil
+		}
+
+		ts := p.TimeStamp
+		if !r.based {
+			if time.Duration(ts)*time.Millisecond < r.opts.Offset {
+				continue
+			}
+			if r.hasVideo && !isKeyFrame(p) {
+				continue
+			}
+			r.based = true
+			r.base = ts
+		}
+		if ts < r.base {
+			ts = r.base
+		}
+		ts = r.shift + ts - r.base
+		if r.played && ts > r.last {
+			r.delta = ts - r.last
+		}
+		r.last = ts
+		p.TimeStamp = ts
+		if !r.played {
+			r.played = true
+			if r.start.IsZero() {
+				r.start = time.Now().Add(-time.Duration(ts) * time.Millisecond)
+			}
+		}
+		return r.wait(ts)
+	}
+}
+
+// rewind starts the file over, after the last tag sent.
+func (r *FileReader) rewind() error {
+	if _, err := r.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	tags, err := NewTagReader(r.file)
+	if err != nil {
+		return err
+	}
+	r.tags = tags
+	r.loops++
+	r.based = false
+	r.played = false
+	delta := r.delta
+	if delta == 0 {
+		delta = 1
+	}
+	r.shift = r.last + delta
+	r.log.Debugf("loop %d", r.loops)
+	return nil
+}
+
+// wait sleeps until timestamp ts is due.
+func (r *FileReader) wait(ts uint32) error {
+	d := time.Until(r.start.Add(time.Duration(ts) * time.Millisecond))
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-r.done:
+		return r.Err()
+	}
+}
+
+// Close stops publishing and closes the file, a nil err is reported as
+// io.EOF. Only the first call counts.
+func (r *FileReader) Close(err error) {
+	if err == nil {
+		err = io.EOF
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.err != nil {
+		return
+	}
+	r.err = err
+	close(r.done)
+	r.file.Close()
+	if err == io.EOF {
+		r.log.Info("file ended")
+	} else {
+		r.log.Infof("closed: %v", err)
+	}
+}
+
+// Done is closed when the file stops being published.
+func (r *FileReader) Done() <-chan struct{} {
+	return r.done
+}
+
+// Err returns why the file stopped being published, nil while it is.
+func (r *FileReader) Err() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.err
+}
+
+func isSeq(p *av.Packet) bool {
+	if p.IsVideo {
+		vh, ok := p.Header.(av.VideoPacketHeader)
+		return ok && vh.IsSeq()
+	}
+	if p.IsAudio {
+		ah, ok := p.Header.(av.AudioPacketHeader)
+		return ok && ah.SoundFormat() == av.SOUND_AAC && ah.AACPacketType() == av.AAC_SEQHDR
+	}
+	return false
+}
+
+func isKeyFrame(p *av.Packet) bool {
+	vh, ok := p.Header.(av.VideoPacketHeader)
+	return p.IsVideo && ok && vh.IsKeyFrame()
+}
@@ -2,11 +2,10 @@ package flv
 
 import (
 	"bomin/av"
+	"bomin/logging"
 	"bomin/protocol/amf"
 	"bomin/utils/pio"
 	"bomin/utils/uid"
-	"flag"
-	"log"
 	"os"
 	"strings"
 	"time"
@@ -14,20 +13,23 @@ import (
 
 var (
 	flvHeader = []byte{0x46, 0x4c, 0x56, 0x01, 0x05, 0x00, 0x00, 0x00, 0x09}
-	flvFile   = flag.String("filFile", "./out.flv", "output flv file name")
 )
 
-func NewFlv(handler av.Handler, info av.Info) {
+var logger = logging.New("flv")
+
+// NewFlv records the stream of info to the file name until it ends.
+func NewFlv(handler av.Handler, info av.Info, name string) {
 	patths := strings.SplitN(info.Key, "/", 2)
 
 	if len(patths) != 2 {
-		log.Println("invalid info")
+		logger.With("key", info.Key).Warn("invalid stream key")
 		return
 	}
 
-	w, err := os.OpenFile(*flvFile, os.O_CREATE|os.O_RDWR, 0755)
+	w, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR, 0755)
 	if err != nil {
-		log.Println("open file error: ", err)
+		logger.With("key", info.Key).Errorf("open %s failed: %v", name, err)
+		return
 	}
 
 	writer := NewFLVWriter(patths[0], patths[1], info.URL, w)
@@ -35,9 +37,7 @@ func NewFlv(handler av.Handler, info av.Info) {
 	handler.HandleWriter(writer)
 
 	writer.Wait()
-	// close flv file
-	log.Println("close flv file")
-	writer.ctx.Close()
+	logger.With("key", info.Key).Debugf("closed %s", name)
 }
 
 const (
@@ -47,6 +47,7 @@ const (
 type FLVWriter struct {
 	Uid             string
 	av.RWBaser
+	av.Stats
 	app, title, url string
 	buf             []byte
 	closed          chan struct{}
@@ -76,11 +77,13 @@ func (writer *FLVWriter) Write(p *av.Packet) error {
 	writer.RWBaser.SetPreTime()
 	h := writer.buf[:headerLen]
 	typeID := av.TAG_VIDEO
+	// p is shared with the other writers
+	data := p.Data
 	if !p.IsVideo {
 		if p.IsMetadata {
 			var err error
 			typeID = av.TAG_SCRIPTDATAAMF0
-			p.Data, err = amf.MetaDataReform(p.Data, amf.DEL)
+			data, err = amf.MetaDataReform(data, amf.DEL)
 			if err != nil {
 				return err
 			}
@@ -88,10 +91,8 @@ func (writer *FLVWriter) Write(p *av.Packet) error {
 			typeID = av.TAG_AUDIO
 		}
 	}
-	dataLen := len(p.Data)
+	dataLen := len(data)
 	timestamp := p.TimeStamp
-	timestamp += writer.BaseTimeStamp()
-	writer.RWBaser.RecTimeStamp(timestamp, uint32(typeID))
 
 	preDataLen := dataLen + headerLen
 	timestampbase := timestamp & 0xffffff
@@ -106,7 +107,7 @@ func (writer *FLVWriter) Write(p *av.Packet) error {
 		return err
 	}
 
-	if _, err := writer.ctx.Write(p.Data); err != nil {
+	if _, err := writer.ctx.Write(data); err != nil {
 		return err
 	}
 
@@ -114,6 +115,7 @@ func (writer *FLVWriter) Write(p *av.Packet) error {
 	if _, err := writer.ctx.Write(h[:4]); err != nil {
 		return err
 	}
+	writer.Update(p)
 
 	return nil
 }
@@ -125,7 +127,9 @@ func (writer *FLVWriter) Wait() {
 	}
 }
 
+// Close flushes the file to disk and closes it.
 func (writer *FLVWriter) Close(error) {
+	writer.ctx.Sync()
 	writer.ctx.Close()
 	close(writer.closed)
 }
@@ -0,0 +1,100 @@
+package flv
+
+import (
+	"bomin/av"
+	"bomin/utils/pio"
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+var ErrNotFLV = errors.New("not an flv file")
+
+// TagReader reads the tags of an FLV file one by one.
+type TagReader struct {
+	r       io.Reader
+	demuxer *Demuxer
+	header  []byte
+	flags   byte
+}
+
+// NewTagReader reads the file header from r.
+func NewTagReader(r io.Reader) (*TagReader, error) {
+	h := make([]byte, len(flvHeader))
+	if _, err := io.ReadFull(r, h); err != nil {
+		return nil, err
+	}
+	if string(h[:3]) != "FLV" {
+		return nil, ErrNotFLV
+	}
+	// the header may be longer, it is followed by PreviousTagSize0
+	skip := int64(pio.U32BE(h[5:9])) - int64(len(flvHeader)) + 4
+	if skip < 4 {
+		return nil, ErrNotFLV
+	}
+	if _, err := io.CopyN(ioutil.Discard, r, skip); err != nil {
+		return nil, err
+	}
+	return &TagReader{
+		r:       r,
+		demuxer: NewDemuxer(),
+		header:  make([]byte, headerLen),
+		flags:   h[4],
+	}, nil
+}
+
+// HasVideo reports whether the file header announces video.
+func (tr *TagReader) HasVideo() bool {
+	return tr.flags&0x01 != 0
+}
+
+// HasAudio reports whether the file header announces audio.
+func (tr *TagReader) HasAudio() bool {
+	return tr.flags&0x04 != 0
+}
+
+// ReadTag reads the next audio, video or AMF0 script tag into p, with the
+// header of audio and video parsed. Other and empty tags are skipped. It
+// returns io.EOF at the end of the file and io.ErrUnexpectedEOF if the
+// file ends within a tag.
+func (tr *TagReader) ReadTag(p *av.Packet) error {
+	for {
+		if _, err := io.ReadFull(tr.r, tr.header); err != nil {
+			return err
+		}
+		typeID := tr.header[0] & 0x1f
+		size := pio.U24BE(tr.header[1:4])
+		timestamp := pio.U24BE(tr.header[4:7]) | uint32(tr.header[7])<<24
+
+		// the tag is followed by its size
+		data := make([]byte, size+4)
+		if _, err := io.ReadFull(tr.r, data); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		if size == 0 {
+			continue
+		}
+		switch typeID {
+		case av.TAG_AUDIO, av.TAG_VIDEO, av.TAG_SCRIPTDATAAMF0:
+		default:
+			continue
+		}
+
+		*p = av.Packet{
+			IsAudio:    typeID == av.TAG_AUDIO,
+			IsVideo:    typeID == av.TAG_VIDEO,
+			IsMetadata: typeID == av.TAG_SCRIPTDATAAMF0,
+			TimeStamp:  timestamp,
+			Data:       data[:size],
+		}
+		if !p.IsMetadata {
+			if err := tr.demuxer.DemuxH(p); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
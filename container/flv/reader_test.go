@@ -0,0 +1,118 @@
+package flv
+
+import (
+	"bomin/av"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func videoPacket(ts uint32, frame, avcType byte) *av.Packet {
+	return &av.Packet{IsVideo: true, TimeStamp: ts, Data: []byte{frame<<4 | av.VIDEO_H264, avcType, 0, 0, 0, 0xff}}
+}
+
+func audioPacket(ts uint32) *av.Packet {
+	return &av.Packet{IsAudio: true, TimeStamp: ts, Data: []byte{av.SOUND_AAC<<4 | 0x0f, av.AAC_RAW, 0xff}}
+}
+
+// writeTestFile writes a file with a GOP every 100ms from 0 to 300ms.
+func writeTestFile(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "flv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(dir, "test.flv")
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewFLVWriter("live", "test", "", f)
+	packets := []*av.Packet{videoPacket(0, av.FRAME_KEY, av.AVC_SEQHDR)}
+	for ts := uint32(0); ts < 400; ts += 50 {
+		if ts%100 == 0 {
+			packets = append(packets, videoPacket(ts, av.FRAME_KEY, av.AVC_NALU))
+		} else {
+			packets = append(packets, videoPacket(ts, av.FRAME_INTER, av.AVC_NALU))
+		}
+		packets = append(packets, audioPacket(ts))
+	}
+	for _, p := range packets {
+		if err := w.Write(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close(nil)
+	return name
+}
+
+func TestTagReader(t *testing.T) {
+	at := assert.New(t)
+	name := writeTestFile(t)
+	defer os.RemoveAll(filepath.Dir(name))
+
+	f, err := os.Open(name)
+	at.Nil(err)
+	defer f.Close()
+	tr, err := NewTagReader(f)
+	at.Nil(err)
+	at.True(tr.HasVideo())
+
+	var p av.Packet
+	at.Nil(tr.ReadTag(&p))
+	at.True(p.IsVideo)
+	at.True(isSeq(&p))
+	n := 1
+	for {
+		err := tr.ReadTag(&p)
+		if err == io.EOF {
+			break
+		}
+		at.Nil(err)
+		n++
+	}
+	at.Equal(17, n)
+	at.Equal(uint32(350), p.TimeStamp)
+	at.True(p.IsAudio)
+
+	_, err = NewTagReader(f)
+	at.NotNil(err)
+}
+
+func TestFileReader(t *testing.T) {
+	at := assert.New(t)
+	name := writeTestFile(t)
+	defer os.RemoveAll(filepath.Dir(name))
+
+	r, err := NewFileReader("live/file", name, FileOptions{Loop: true, Offset: 150 * time.Millisecond})
+	at.Nil(err)
+
+	var p av.Packet
+	at.Nil(r.Read(&p))
+	at.True(isSeq(&p))
+
+	// starts at the key frame at 200ms, and loops back to it after 350ms
+	start := time.Now()
+	var stamps []uint32
+	for len(stamps) < 10 {
+		at.Nil(r.Read(&p))
+		stamps = append(stamps, p.TimeStamp)
+		if len(stamps) == 1 {
+			at.True(isKeyFrame(&p))
+		}
+		if len(stamps) == 9 {
+			at.True(isKeyFrame(&p))
+		}
+	}
+	at.Equal([]uint32{0, 0, 50, 50, 100, 100, 150, 150, 200, 200}, stamps)
+	elapsed := time.Since(start)
+	at.True(elapsed >= 190*time.Millisecond, elapsed.String())
+
+	r.Close(nil)
+	at.Equal(io.EOF, r.Read(&p))
+	at.False(r.Alive())
+}
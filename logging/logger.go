@@ -0,0 +1,330 @@
+// Package logging provides the leveled, scoped loggers used by the media
+// server and the WebRTC stack.
+//
+// Each subsystem logs under a scope ("rtmp", "hls", ...) whose level can be
+// set on its own, and loggers carry context fields such as the remote
+// address or the stream key of the connection they belong to.
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogLevel is the verbosity of a logger, a logger writes the messages at
+// or below its level.
+type LogLevel int32
+
+const (
+	LogLevelDisabled LogLevel = iota
+	LogLevelError
+	LogLevelWarn
+	LogLevelInfo
+	LogLevelDebug
+	LogLevelTrace
+)
+
+var levelNames = []string{"disabled", "error", "warn", "info", "debug", "trace"}
+
+func (l LogLevel) String() string {
+	if l < 0 || int(l) >= len(levelNames) {
+		return "unknown"
+	}
+	return levelNames[l]
+}
+
+// ParseLevel parses a level name as printed by LogLevel.String.
+func ParseLevel(s string) (LogLevel, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "warning" {
+		return LogLevelWarn, nil
+	}
+	for i, name := range levelNames {
+		if s == name {
+			return LogLevel(i), nil
+		}
+	}
+	return LogLevelDisabled, fmt.Errorf("unknown log level %q", s)
+}
+
+// LeveledLogger is the logger interface of the WebRTC stack.
+type LeveledLogger interface {
+	Trace(msg string)
+	Tracef(format string, args ...interface{})
+	Debug(msg string)
+	Debugf(format string, args ...interface{})
+	Info(msg string)
+	Infof(format string, args ...interface{})
+	Warn(msg string)
+	Warnf(format string, args ...interface{})
+	Error(msg string)
+	Errorf(format string, args ...interface{})
+}
+
+// LoggerFactory creates the logger of a scope.
+type LoggerFactory interface {
+	NewLogger(scope string) LeveledLogger
+}
+
+// Logger is a LeveledLogger with context fields.
+type Logger interface {
+	LeveledLogger
+	// With returns a logger that adds the given key/value pairs to every
+	// message.
+	With(keyvals ...interface{}) Logger
+}
+
+// DefaultLoggerFactory writes text or JSON lines to a single writer, with
+// a default level and optional levels per scope. It is safe for concurrent
+// use, and changes apply to the loggers already created.
+type DefaultLoggerFactory struct {
+	lock         sync.RWMutex
+	defaultLevel LogLevel
+	scopeLevels  map[string]LogLevel
+
+	writeLock sync.Mutex
+	writer    io.Writer
+	json      bool
+}
+
+// NewDefaultLoggerFactory returns a factory writing text to stderr at info
+// level. The environment can change that:
+//
+//	BOMIN_LOG_LEVEL=info,rtmp=debug,hls=warn
+//	BOMIN_LOG_FORMAT=json
+func NewDefaultLoggerFactory() *DefaultLoggerFactory {
+	f := &DefaultLoggerFactory{
+		defaultLevel: LogLevelInfo,
+		scopeLevels:  make(map[string]LogLevel),
+		writer:       os.Stderr,
+	}
+	if spec := os.Getenv("BOMIN_LOG_LEVEL"); spec != "" {
+		if err := f.SetLevels(spec); err != nil {
+			fmt.Fprintf(os.Stderr, "BOMIN_LOG_LEVEL: %v\n", err)
+		}
+	}
+	if strings.EqualFold(os.Getenv("BOMIN_LOG_FORMAT"), "json") {
+		f.json = true
+	}
+	return f
+}
+
+// SetWriter sets where the messages go.
+func (f *DefaultLoggerFactory) SetWriter(w io.Writer) {
+	f.writeLock.Lock()
+	f.writer = w
+	f.writeLock.Unlock()
+}
+
+// SetJSON switches between text lines and JSON lines.
+func (f *DefaultLoggerFactory) SetJSON(json bool) {
+	f.writeLock.Lock()
+	f.json = json
+	f.writeLock.Unlock()
+}
+
+// SetDefaultLevel sets the level of the scopes without their own level.
+func (f *DefaultLoggerFactory) SetDefaultLevel(level LogLevel) {
+	f.lock.Lock()
+	f.defaultLevel = level
+	f.lock.Unlock()
+}
+
+// SetScopeLevel sets the level of one scope.
+func (f *DefaultLoggerFactory) SetScopeLevel(scope string, level LogLevel) {
+	f.lock.Lock()
+	f.scopeLevels[scope] = level
+	f.lock.Unlock()
+}
+
+// SetLevels sets the levels from a comma separated list of "level" and
+// "scope=level" items, e.g. "warn,rtmp=debug". Nothing is changed if the
+// list is invalid.
+func (f *DefaultLoggerFactory) SetLevels(spec string) error {
+	defaultLevel := LogLevel(-1)
+	scopeLevels := make(map[string]LogLevel)
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		scope, name := "", item
+		if i := strings.IndexByte(item, '='); i >= 0 {
+			scope, name = strings.TrimSpace(item[:i]), item[i+1:]
+			if scope == "" {
+				return fmt.Errorf("missing scope in %q", item)
+			}
+		}
+		level, err := ParseLevel(name)
+		if err != nil {
+			return err
+		}
+		if scope == "" {
+			defaultLevel = level
+		} else {
+			scopeLevels[scope] = level
+		}
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if defaultLevel >= 0 {
+		f.defaultLevel = defaultLevel
+	}
+	for scope, level := range scopeLevels {
+		f.scopeLevels[scope] = level
+	}
+	return nil
+}
+
+// Level returns the level of scope.
+func (f *DefaultLoggerFactory) Level(scope string) LogLevel {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	if level, ok := f.scopeLevels[scope]; ok {
+		return level
+	}
+	return f.defaultLevel
+}
+
+// NewLogger returns the logger of scope, it also implements Logger.
+func (f *DefaultLoggerFactory) NewLogger(scope string) LeveledLogger {
+	return f.newLogger(scope)
+}
+
+// Logger returns the logger of scope.
+func (f *DefaultLoggerFactory) Logger(scope string) Logger {
+	return f.newLogger(scope)
+}
+
+func (f *DefaultLoggerFactory) newLogger(scope string) *defaultLogger {
+	return &defaultLogger{factory: f, scope: scope}
+}
+
+type field struct {
+	key   string
+	value interface{}
+}
+
+type defaultLogger struct {
+	factory *DefaultLoggerFactory
+	scope   string
+	fields  []field
+}
+
+func (l *defaultLogger) With(keyvals ...interface{}) Logger {
+	fields := make([]field, len(l.fields), len(l.fields)+(len(keyvals)+1)/2)
+	copy(fields, l.fields)
+	for i := 0; i < len(keyvals); i += 2 {
+		key := fmt.Sprint(keyvals[i])
+		var value interface{} = "(missing)"
+		if i+1 < len(keyvals) {
+			value = keyvals[i+1]
+		}
+		fields = append(fields, field{key, value})
+	}
+	return &defaultLogger{factory: l.factory, scope: l.scope, fields: fields}
+}
+
+func (l *defaultLogger) logf(level LogLevel, format string, args ...interface{}) {
+	if l.factory.Level(l.scope) < level {
+		return
+	}
+	msg := format
+	if len(args) > 0 {
+		msg = fmt.Sprintf(format, args...)
+	}
+	l.factory.write(time.Now(), level, l.scope, msg, l.fields)
+}
+
+func (l *defaultLogger) Trace(msg string) { l.logf(LogLevelTrace, "%s", msg) }
+func (l *defaultLogger) Tracef(format string, args ...interface{}) {
+	l.logf(LogLevelTrace, format, args...)
+}
+func (l *defaultLogger) Debug(msg string) { l.logf(LogLevelDebug, "%s", msg) }
+func (l *defaultLogger) Debugf(format string, args ...interface{}) {
+	l.logf(LogLevelDebug, format, args...)
+}
+func (l *defaultLogger) Info(msg string) { l.logf(LogLevelInfo, "%s", msg) }
+func (l *defaultLogger) Infof(format string, args ...interface{}) {
+	l.logf(LogLevelInfo, format, args...)
+}
+func (l *defaultLogger) Warn(msg string) { l.logf(LogLevelWarn, "%s", msg) }
+func (l *defaultLogger) Warnf(format string, args ...interface{}) {
+	l.logf(LogLevelWarn, format, args...)
+}
+func (l *defaultLogger) Error(msg string) { l.logf(LogLevelError, "%s", msg) }
+func (l *defaultLogger) Errorf(format string, args ...interface{}) {
+	l.logf(LogLevelError, format, args...)
+}
+
+// plain turns errors and Stringers, net.Addr for one, into their text.
+func plain(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return v
+}
+
+func (f *DefaultLoggerFactory) write(t time.Time, level LogLevel, scope, msg string, fields []field) {
+	f.writeLock.Lock()
+	defer f.writeLock.Unlock()
+
+	var buf bytes.Buffer
+	if f.json {
+		buf.WriteString(`{"time":`)
+		buf.WriteString(strconv.Quote(t.Format(time.RFC3339Nano)))
+		buf.WriteString(`,"level":`)
+		buf.WriteString(strconv.Quote(level.String()))
+		buf.WriteString(`,"scope":`)
+		writeJSON(&buf, scope)
+		buf.WriteString(`,"msg":`)
+		writeJSON(&buf, msg)
+		for _, fd := range fields {
+			buf.WriteByte(',')
+			writeJSON(&buf, fd.key)
+			buf.WriteByte(':')
+			writeJSON(&buf, plain(fd.value))
+		}
+		buf.WriteString("}\n")
+	} else {
+		buf.WriteString(t.Format("2006/01/02 15:04:05.000000 "))
+		fmt.Fprintf(&buf, "%-5s %s: %s", strings.ToUpper(level.String()), scope, msg)
+		for _, fd := range fields {
+			value := fmt.Sprint(plain(fd.value))
+			if value == "" || strings.ContainsAny(value, " \t\n\"=") {
+				value = strconv.Quote(value)
+			}
+			fmt.Fprintf(&buf, " %s=%s", fd.key, value)
+		}
+		buf.WriteByte('\n')
+	}
+	f.writer.Write(buf.Bytes())
+}
+
+func writeJSON(buf *bytes.Buffer, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprint(v))
+	}
+	buf.Write(data)
+}
+
+// Default is the factory behind New, the server configures it from its
+// flags.
+var Default = NewDefaultLoggerFactory()
+
+// New returns the logger of scope from the Default factory.
+func New(scope string) Logger {
+	return Default.Logger(scope)
+}
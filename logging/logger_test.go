@@ -0,0 +1,107 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestFactory() (*DefaultLoggerFactory, *bytes.Buffer) {
+	var buf bytes.Buffer
+	f := &DefaultLoggerFactory{
+		defaultLevel: LogLevelInfo,
+		scopeLevels:  make(map[string]LogLevel),
+		writer:       &buf,
+	}
+	return f, &buf
+}
+
+func TestLevels(t *testing.T) {
+	at := assert.New(t)
+	f, buf := newTestFactory()
+	rtmp := f.NewLogger("rtmp")
+	hls := f.NewLogger("hls")
+
+	rtmp.Debug("hidden")
+	rtmp.Info("shown")
+	at.Equal(1, strings.Count(buf.String(), "\n"))
+	at.Contains(buf.String(), "INFO  rtmp: shown")
+
+	at.Nil(f.SetLevels("warn, rtmp=debug"))
+	buf.Reset()
+	rtmp.Debugf("frame %d", 1)
+	hls.Info("hidden")
+	hls.Warn("shown")
+	at.Contains(buf.String(), "DEBUG rtmp: frame 1")
+	at.NotContains(buf.String(), "hidden")
+	at.Contains(buf.String(), "WARN  hls: shown")
+
+	at.NotNil(f.SetLevels("info,rtmp=loud"))
+	at.Equal(LogLevelDebug, f.Level("rtmp"))
+	at.Equal(LogLevelWarn, f.Level("hls"))
+	at.NotNil(f.SetLevels("=info"))
+
+	f.SetScopeLevel("hls", LogLevelDisabled)
+	buf.Reset()
+	hls.Error("hidden")
+	at.Equal("", buf.String())
+}
+
+func TestParseLevel(t *testing.T) {
+	at := assert.New(t)
+	for i, name := range levelNames {
+		level, err := ParseLevel(strings.ToUpper(name))
+		at.Nil(err)
+		at.Equal(LogLevel(i), level)
+		at.Equal(name, level.String())
+	}
+	level, err := ParseLevel("warning")
+	at.Nil(err)
+	at.Equal(LogLevelWarn, level)
+	_, err = ParseLevel("verbose")
+	at.NotNil(err)
+}
+
+func TestFields(t *testing.T) {
+	at := assert.New(t)
+	f, buf := newTestFactory()
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1935}
+	conn := f.Logger("rtmp").With("remote", addr, "uid", "abc")
+	stream := conn.With("key", "live/my movie")
+
+	stream.Errorf("closed: %v", errors.New("EOF"))
+	conn.Info("connected")
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	at.Equal(2, len(lines))
+	at.True(strings.HasSuffix(lines[0], `ERROR rtmp: closed: EOF remote=127.0.0.1:1935 uid=abc key="live/my movie"`), lines[0])
+	at.True(strings.HasSuffix(lines[1], "INFO  rtmp: connected remote=127.0.0.1:1935 uid=abc"), lines[1])
+
+	buf.Reset()
+	conn.With("odd").Info("x")
+	at.Contains(buf.String(), "odd=(missing)")
+}
+
+func TestJSON(t *testing.T) {
+	at := assert.New(t)
+	f, buf := newTestFactory()
+	f.SetJSON(true)
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1935}
+	f.Logger("hls").With("remote", addr, "bytes", 42, "err", errors.New("EOF")).Warnf("say \"%s\"", "hi")
+
+	var line map[string]interface{}
+	at.Nil(json.Unmarshal(buf.Bytes(), &line))
+	at.Equal("warn", line["level"])
+	at.Equal("hls", line["scope"])
+	at.Equal(`say "hi"`, line["msg"])
+	at.Equal("127.0.0.1:1935", line["remote"])
+	at.Equal(float64(42), line["bytes"])
+	at.Equal("EOF", line["err"])
+	at.NotEmpty(line["time"])
+}
+
+var _ LoggerFactory = NewDefaultLoggerFactory()
@@ -3,6 +3,7 @@ package aac
 import (
 	"bomin/av"
 	"errors"
+	"fmt"
 	"io"
 )
 
@@ -58,6 +59,45 @@ func (parser *Parser) specificInfo(src []byte) error {
 	return nil
 }
 
+var objectTypeNames = map[int]string{
+	1:  "Main",
+	2:  "LC",
+	3:  "SSR",
+	4:  "LTP",
+	5:  "HE-AAC",
+	29: "HE-AACv2",
+}
+
+// Config is the AudioSpecificConfig of an AAC sequence header.
+type Config struct {
+	ObjectType int
+	SampleRate int
+	Channels   int
+}
+
+func (cfg *Config) Profile() string {
+	if name, ok := objectTypeNames[cfg.ObjectType]; ok {
+		return name
+	}
+	return fmt.Sprintf("%d", cfg.ObjectType)
+}
+
+// ParseConfig parses an AudioSpecificConfig.
+func ParseConfig(src []byte) (*Config, error) {
+	if len(src) < 2 {
+		return nil, specificBufInvalid
+	}
+	cfg := &Config{
+		ObjectType: int(src[0] >> 3),
+		Channels:   int(src[1]>>3) & 0x0f,
+	}
+	rateIndex := int((src[0]&0x07)<<1 | src[1]>>7)
+	if rateIndex < len(aacRates) {
+		cfg.SampleRate = aacRates[rateIndex]
+	}
+	return cfg, nil
+}
+
 func (parser *Parser) adts(src []byte, w io.Writer) error {
 	if len(src) <= 0 || !parser.gettedSpecific {
 		return audioBufInvalid
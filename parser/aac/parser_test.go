@@ -0,0 +1,22 @@
+package aac
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseConfig(t *testing.T) {
+	at := assert.New(t)
+	cfg, err := ParseConfig([]byte{0x12, 0x10})
+	at.Nil(err)
+	at.Equal(&Config{ObjectType: 2, SampleRate: 44100, Channels: 2}, cfg)
+	at.Equal("LC", cfg.Profile())
+
+	cfg, err = ParseConfig([]byte{0x11, 0x88})
+	at.Nil(err)
+	at.Equal(&Config{ObjectType: 2, SampleRate: 48000, Channels: 1}, cfg)
+
+	_, err = ParseConfig([]byte{0x12})
+	at.Equal(specificBufInvalid, err)
+}
@@ -0,0 +1,253 @@
+package h264
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	spsTooShort    = errors.New("sps too short")
+	spsNotSPS      = errors.New("nalu is not a sps")
+	spsExpGolombOv = errors.New("sps exp-golomb overflow")
+)
+
+// SPS holds the fields of a sequence parameter set that describe the picture.
+type SPS struct {
+	ProfileIdc uint8
+	LevelIdc   uint8
+	Width      int
+	Height     int
+	// FrameRate comes from the VUI timing info, it is 0 when absent.
+	FrameRate float64
+}
+
+var profileNames = map[uint8]string{
+	66:  "Baseline",
+	77:  "Main",
+	88:  "Extended",
+	100: "High",
+	110: "High 10",
+	122: "High 4:2:2",
+	244: "High 4:4:4",
+}
+
+func (sps *SPS) Profile() string {
+	if name, ok := profileNames[sps.ProfileIdc]; ok {
+		return name
+	}
+	return fmt.Sprintf("%d", sps.ProfileIdc)
+}
+
+func (sps *SPS) Level() string {
+	return fmt.Sprintf("%d.%d", sps.LevelIdc/10, sps.LevelIdc%10)
+}
+
+type bitReader struct {
+	buf []byte
+	pos int
+	err error
+}
+
+func (r *bitReader) bit() uint32 {
+	if r.pos >= len(r.buf)*8 {
+		r.err = spsTooShort
+		return 0
+	}
+	b := r.buf[r.pos/8] >> uint(7-r.pos%8) & 1
+	r.pos++
+	return uint32(b)
+}
+
+func (r *bitReader) bits(n int) uint32 {
+	var v uint32
+	for i := 0; i < n; i++ {
+		v = v<<1 | r.bit()
+	}
+	return v
+}
+
+func (r *bitReader) ue() uint32 {
+	zeros := 0
+	for r.bit() == 0 {
+		if r.err != nil {
+			return 0
+		}
+		zeros++
+		if zeros > 31 {
+			r.err = spsExpGolombOv
+			return 0
+		}
+	}
+	return 1<<uint(zeros) - 1 + r.bits(zeros)
+}
+
+func (r *bitReader) se() int32 {
+	v := r.ue()
+	if v&1 == 1 {
+		return int32(v+1) / 2
+	}
+	return -int32(v / 2)
+}
+
+// rbsp removes the emulation prevention bytes of a nalu.
+func rbsp(nalu []byte) []byte {
+	out := make([]byte, 0, len(nalu))
+	zeros := 0
+	for _, b := range nalu {
+		if zeros >= 2 && b == 0x03 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+func skipScalingList(r *bitReader, size int) {
+	last, next := int32(8), int32(8)
+	for j := 0; j < size; j++ {
+		if next != 0 {
+			next = (last + r.se() + 256) % 256
+		}
+		if next != 0 {
+			last = next
+		}
+	}
+}
+
+// ParseSPS parses a sps nalu, starting with its nalu header byte.
+func ParseSPS(nalu []byte) (*SPS, error) {
+	if len(nalu) < 4 {
+		return nil, spsTooShort
+	}
+	if nalu[0]&0x1f != nalu_type_sps {
+		return nil, spsNotSPS
+	}
+	r := &bitReader{buf: rbsp(nalu[1:])}
+	sps := &SPS{}
+	sps.ProfileIdc = uint8(r.bits(8))
+	r.bits(8) // constraint flags
+	sps.LevelIdc = uint8(r.bits(8))
+	r.ue() // seq_parameter_set_id
+
+	chromaFormatIdc := uint32(1)
+	separateColourPlane := uint32(0)
+	switch sps.ProfileIdc {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		chromaFormatIdc = r.ue()
+		if chromaFormatIdc == 3 {
+			separateColourPlane = r.bit()
+		}
+		r.ue()  // bit_depth_luma_minus8
+		r.ue()  // bit_depth_chroma_minus8
+		r.bit() // qpprime_y_zero_transform_bypass_flag
+		if r.bit() == 1 {
+			n := 8
+			if chromaFormatIdc == 3 {
+				n = 12
+			}
+			for i := 0; i < n; i++ {
+				if r.bit() == 1 {
+					if i < 6 {
+						skipScalingList(r, 16)
+					} else {
+						skipScalingList(r, 64)
+					}
+				}
+			}
+		}
+	}
+
+	r.ue() // log2_max_frame_num_minus4
+	switch r.ue() {
+	case 0:
+		r.ue() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		r.bit() // delta_pic_order_always_zero_flag
+		r.se()  // offset_for_non_ref_pic
+		r.se()  // offset_for_top_to_bottom_field
+		n := r.ue()
+		for i := uint32(0); i < n && r.err == nil; i++ {
+			r.se()
+		}
+	}
+	r.ue()  // max_num_ref_frames
+	r.bit() // gaps_in_frame_num_value_allowed_flag
+
+	widthMbs := int(r.ue()) + 1
+	heightMapUnits := int(r.ue()) + 1
+	frameMbsOnly := int(r.bit())
+	if frameMbsOnly == 0 {
+		r.bit() // mb_adaptive_frame_field_flag
+	}
+	r.bit() // direct_8x8_inference_flag
+
+	var cropLeft, cropRight, cropTop, cropBottom int
+	if r.bit() == 1 {
+		cropLeft = int(r.ue())
+		cropRight = int(r.ue())
+		cropTop = int(r.ue())
+		cropBottom = int(r.ue())
+	}
+	cropUnitX, cropUnitY := 1, 2-frameMbsOnly
+	if chromaFormatIdc != 0 && separateColourPlane == 0 {
+		if chromaFormatIdc == 1 || chromaFormatIdc == 2 {
+			cropUnitX = 2
+		}
+		if chromaFormatIdc == 1 {
+			cropUnitY *= 2
+		}
+	}
+	sps.Width = widthMbs*16 - cropUnitX*(cropLeft+cropRight)
+	sps.Height = (2-frameMbsOnly)*heightMapUnits*16 - cropUnitY*(cropTop+cropBottom)
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	// the VUI is optional, a truncated one still leaves a usable sps
+	if r.bit() == 1 {
+		if r.bit() == 1 { // aspect_ratio_info_present_flag
+			if r.bits(8) == 255 {
+				r.bits(32) // sar_width, sar_height
+			}
+		}
+		if r.bit() == 1 { // overscan_info_present_flag
+			r.bit()
+		}
+		if r.bit() == 1 { // video_signal_type_present_flag
+			r.bits(4)
+			if r.bit() == 1 {
+				r.bits(24)
+			}
+		}
+		if r.bit() == 1 { // chroma_loc_info_present_flag
+			r.ue()
+			r.ue()
+		}
+		if r.bit() == 1 { // timing_info_present_flag
+			unitsInTick := r.bits(32)
+			timeScale := r.bits(32)
+			if r.err == nil && unitsInTick > 0 {
+				sps.FrameRate = float64(timeScale) / float64(2*unitsInTick)
+			}
+		}
+	}
+	return sps, nil
+}
+
+// ParseDecoderConfig returns the first sps of an AVCDecoderConfigurationRecord.
+func ParseDecoderConfig(src []byte) (*SPS, error) {
+	if len(src) < 8 || src[5]&0x1f == 0 {
+		return nil, spsDataError
+	}
+	spsLen := int(src[6])<<8 | int(src[7])
+	if len(src[8:]) < spsLen || spsLen <= 0 {
+		return nil, spsDataError
+	}
+	return ParseSPS(src[8 : 8+spsLen])
+}
@@ -0,0 +1,65 @@
+package h264
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSPS(t *testing.T) {
+	at := assert.New(t)
+	cases := []struct {
+		nalu []byte
+		want SPS
+	}{
+		{
+			[]byte{0x67, 0x4d, 0x00, 0x1e, 0xab, 0x40, 0x5a, 0x12, 0x6c, 0x09, 0x28, 0x28, 0x28, 0x2f,
+				0x80, 0x00, 0x01, 0xf4, 0x00, 0x00, 0x61, 0xa8, 0x4a},
+			SPS{ProfileIdc: 77, LevelIdc: 30, Width: 720, Height: 576, FrameRate: 25},
+		},
+		{
+			[]byte{0x67, 0x64, 0x00, 0x1f, 0xac, 0xd9, 0x40, 0x50, 0x05, 0xbb, 0x01, 0x10, 0x00, 0x00,
+				0x03, 0x00, 0x10, 0x00, 0x00, 0x03, 0x03, 0xc0, 0xf1, 0x83, 0x19, 0x60},
+			SPS{ProfileIdc: 100, LevelIdc: 31, Width: 1280, Height: 720, FrameRate: 30},
+		},
+		{
+			// 1088 coded lines cropped to 1080
+			[]byte{0x67, 0x64, 0x00, 0x28, 0xac, 0xd9, 0x40, 0x78, 0x02, 0x27, 0xe5, 0xc0, 0x44, 0x00,
+				0x00, 0x03, 0x00, 0x04, 0x00, 0x00, 0x03, 0x00, 0xf0, 0x3c, 0x60, 0xc6, 0x58},
+			SPS{ProfileIdc: 100, LevelIdc: 40, Width: 1920, Height: 1080, FrameRate: 30},
+		},
+	}
+	for _, c := range cases {
+		sps, err := ParseSPS(c.nalu)
+		at.Nil(err)
+		at.Equal(c.want, *sps)
+	}
+
+	sps, _ := ParseSPS(cases[1].nalu)
+	at.Equal("High", sps.Profile())
+	at.Equal("3.1", sps.Level())
+}
+
+func TestParseSPSInvalid(t *testing.T) {
+	at := assert.New(t)
+	_, err := ParseSPS([]byte{0x68, 0x4d, 0x00, 0x1e})
+	at.Equal(spsNotSPS, err)
+	_, err = ParseSPS([]byte{0x67, 0x4d})
+	at.Equal(spsTooShort, err)
+	_, err = ParseSPS([]byte{0x67, 0x4d, 0x00, 0x1e, 0x00})
+	at.NotNil(err)
+}
+
+func TestParseDecoderConfig(t *testing.T) {
+	at := assert.New(t)
+	seq := []byte{
+		0x01, 0x4d, 0x00, 0x1e, 0xff, 0xe1, 0x00, 0x17, 0x67, 0x4d, 0x00,
+		0x1e, 0xab, 0x40, 0x5a, 0x12, 0x6c, 0x09, 0x28, 0x28, 0x28, 0x2f,
+		0x80, 0x00, 0x01, 0xf4, 0x00, 0x00, 0x61, 0xa8, 0x4a, 0x01, 0x00,
+		0x04, 0x68, 0xde, 0x31, 0x12,
+	}
+	sps, err := ParseDecoderConfig(seq)
+	at.Nil(err)
+	at.Equal(720, sps.Width)
+	at.Equal(576, sps.Height)
+}
@@ -5,6 +5,7 @@ import (
 	"container/list"
 	"errors"
 	"fmt"
+	"strings"
 	"sync"
 )
 
@@ -22,6 +23,8 @@ type TSCacheItem struct {
 	lock sync.RWMutex
 	ll   *list.List
 	lm   map[string]TSItem
+	// ended is set once the stream is over, the playlist gets EXT-X-ENDLIST
+	ended bool
 }
 
 func NewTSCacheItem(id string) *TSCacheItem {
@@ -37,6 +40,16 @@ func (tcCacheItem *TSCacheItem) ID() string {
 	return tcCacheItem.id
 }
 
+// segmentURI returns the segment /app/name/N.ts relative to its playlist
+// /app/name.m3u8, so the playlist works under any prefix.
+func segmentURI(name string) string {
+	parts := strings.SplitN(strings.TrimPrefix(name, "/"), "/", 2)
+	if len(parts) != 2 {
+		return name
+	}
+	return parts[1]
+}
+
 // TODO: found data race, fix it
 func (tcCacheItem *TSCacheItem) GenM3U8PlayList() ([]byte, error) {
 	var seq int
@@ -54,7 +67,7 @@ func (tcCacheItem *TSCacheItem) GenM3U8PlayList() ([]byte, error) {
 				getSeq = true
 				seq = v.SeqNum
 			}
-			fmt.Fprintf(m3u8body, "#EXTINF:%.3f,\n%s\n", float64(v.Duration)/float64(1000), v.Name)
+			fmt.Fprintf(m3u8body, "#EXTINF:%.3f,\n%s\n", float64(v.Duration)/float64(1000), segmentURI(v.Name))
 		}
 	}
 	w := bytes.NewBuffer(nil)
@@ -62,9 +75,21 @@ func (tcCacheItem *TSCacheItem) GenM3U8PlayList() ([]byte, error) {
 		"#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-ALLOW-CACHE:NO\n#EXT-X-TARGETDURATION:%d\n#EXT-X-MEDIA-SEQUENCE:%d\n\n",
 		maxDuration/1000+1, seq)
 	w.Write(m3u8body.Bytes())
+	tcCacheItem.lock.RLock()
+	if tcCacheItem.ended {
+		w.WriteString("#EXT-X-ENDLIST\n")
+	}
+	tcCacheItem.lock.RUnlock()
 	return w.Bytes(), nil
 }
 
+// End marks the playlist as complete.
+func (tcCacheItem *TSCacheItem) End() {
+	tcCacheItem.lock.Lock()
+	tcCacheItem.ended = true
+	tcCacheItem.lock.Unlock()
+}
+
 func (tcCacheItem *TSCacheItem) SetItem(key string, item TSItem) {
 	if tcCacheItem.ll.Len() == tcCacheItem.num {
 		e := tcCacheItem.ll.Front()
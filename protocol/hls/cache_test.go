@@ -0,0 +1,24 @@
+package hls
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPlaylistEnd(t *testing.T) {
+	at := assert.New(t)
+	c := NewTSCacheItem("live/movie")
+	c.SetItem("/live/movie/1.ts", NewTSItem("/live/movie/1.ts", 3000, 1, []byte{0}))
+
+	body, err := c.GenM3U8PlayList()
+	at.Nil(err)
+	at.Contains(string(body), "#EXTINF:3.000,\nmovie/1.ts\n")
+	at.NotContains(string(body), "#EXT-X-ENDLIST")
+
+	c.End()
+	body, err = c.GenM3U8PlayList()
+	at.Nil(err)
+	at.True(strings.HasSuffix(string(body), "\nmovie/1.ts\n#EXT-X-ENDLIST\n"), string(body))
+}
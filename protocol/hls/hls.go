@@ -2,13 +2,17 @@ package hls
 
 import (
 	"bomin/av"
+	"bomin/configure"
+	"bomin/logging"
+	"bomin/protocol/rtmp"
+	"bomin/protocol/rtmp/queue"
 	"errors"
 	"fmt"
 	"github.com/gorilla/websocket"
 	"github.com/orcaman/concurrent-map"
-	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"path"
 	"strconv"
 	"strings"
@@ -26,26 +30,55 @@ var (
 	ErrNoSupportAudioCodec = errors.New("no support audio codec")
 )
 
+var logger = logging.New("hls")
+
 var crossdomainxml = []byte(`<?xml version="1.0" ?>
 <cross-domain-policy>
 	<allow-access-from domain="*" />
 	<allow-http-request-headers-from domain="*" headers="*"/>
 </cross-domain-policy>`)
 
+type puller interface {
+	Pull(key string) bool
+}
+
+// keyMapper maps the stream names players ask for.
+type keyMapper interface {
+	MapName(app, name string, query url.Values, publish bool) (string, error)
+}
+
+// admitter checks the players against the limits of the apps.
+type admitter interface {
+	Admit(key string, publish bool, remote string) error
+}
+
 type Server struct {
 	listener net.Listener
 	conns    cmap.ConcurrentMap
+	puller   puller
+	mapper   keyMapper
+	admitter admitter
+	// Queue is how the muxers' queues handle a muxer that cannot keep up.
+	Queue queue.Config
 }
 
 func NewServer() *Server {
 	ret := &Server{
 		conns: cmap.New(),
+		Queue: queue.DefaultConfig,
 	}
 	go ret.checkStop()
 	return ret
 }
 
 func (server *Server) Serve(listener net.Listener) error {
+	server.listener = listener
+	http.Serve(listener, server.Handler())
+	return nil
+}
+
+// Handler returns the handler serving playlists and segments.
+func (server *Server) Handler() http.Handler {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		server.handle(w, r)
@@ -53,10 +86,43 @@ func (server *Server) Serve(listener net.Listener) error {
 	mux.HandleFunc("/ws",  func(w http.ResponseWriter, r *http.Request) {
 		server.onWs(w, r)
 	})
+	return mux
+}
 
-	server.listener = listener
-	http.Serve(listener, mux)
-	return nil
+// SetPuller lets playlist requests for unpublished keys start an edge pull.
+func (server *Server) SetPuller(p puller) {
+	server.puller = p
+}
+
+// SetKeyMapper maps the stream names of the playlist requests through m.
+// The segments are named after the stream, already mapped.
+func (server *Server) SetKeyMapper(m keyMapper) {
+	server.mapper = m
+}
+
+// SetAdmitter checks the playlist requests against the address lists and
+// the client caps of the apps with a.
+func (server *Server) SetAdmitter(a admitter) {
+	server.admitter = a
+}
+
+// admit answers a player the limits of the app refuse: 403 for an address
+// not allowed, 503 for a cap reached.
+func (server *Server) admit(w http.ResponseWriter, r *http.Request, key string) bool {
+	if server.admitter == nil {
+		return true
+	}
+	err := server.admitter.Admit(key, false, r.RemoteAddr)
+	switch err {
+	case nil:
+		return true
+	case rtmp.ErrAddrDenied:
+		http.Error(w, err.Error(), http.StatusForbidden)
+	default:
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	}
+	logger.With("remote", r.RemoteAddr).Warnf("rejected %s: %v", key, err)
+	return false
 }
 
 func (server *Server) GetWriter(info av.Info) av.WriteCloser {
@@ -64,7 +130,7 @@ func (server *Server) GetWriter(info av.Info) av.WriteCloser {
 	ok := server.conns.Has(info.Key)
 	if !ok {
 		//log.Println("new hls source")
-		s = NewSource(info)
+		s = NewSource(info, server.Queue)
 		server.conns.Set(info.Key, s)
 	} else {
 		v, _ := server.conns.Get(info.Key)
@@ -87,7 +153,7 @@ func (server *Server) checkStop() {
 		for item := range server.conns.IterBuffered() {
 			v := item.Val.(*Source)
 			if !v.Alive() {
-				log.Println("check stop and remove: xxxxx", v.Info())
+				v.log.Debug("source timed out, removed")
 				server.conns.Remove(item.Key)
 			}
 		}
@@ -100,12 +166,16 @@ var upgrader = websocket.Upgrader{
 }
 
 func (server *Server) onWs(w http.ResponseWriter, r *http.Request) {
+	if !server.admit(w, r, "live/movie") {
+		return
+	}
 	upgrader.CheckOrigin = func(r *http.Request) bool { return true }
 	ws, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Println(err)
+		logger.With("remote", r.RemoteAddr).Debugf("websocket upgrade failed: %v", err)
+		return
 	}
-	log.Println("Client Connected")
+	logger.With("remote", r.RemoteAddr).Debug("websocket client connected")
 	conn := server.getConn("live/movie")
 	if conn == nil {
 		http.Error(w, ErrNoPublisher.Error(), http.StatusForbidden)
@@ -119,7 +189,7 @@ func (server *Server) onWs(w http.ResponseWriter, r *http.Request) {
 	body, err := tsCache.GenM3U8PlayList()
 	err = ws.WriteMessage(1, body)
 	if err != nil {
-		log.Println(err)
+		logger.With("remote", r.RemoteAddr).Debugf("websocket write failed: %v", err)
 	}
 	// listen indefinitely for new messages coming
 	// through on our WebSocket connection
@@ -131,14 +201,11 @@ func reader(conn *websocket.Conn) {
 		// read in a message
 		messageType, p, err := conn.ReadMessage()
 		if err != nil {
-			log.Println(err)
+			logger.With("remote", conn.RemoteAddr()).Debugf("websocket read failed: %v", err)
 			return
 		}
-		// print out that message for clarity
-		fmt.Println(string(p))
-
 		if err := conn.WriteMessage(messageType, p); err != nil {
-			log.Println(err)
+			logger.With("remote", conn.RemoteAddr()).Debugf("websocket write failed: %v", err)
 			return
 		}
 
@@ -154,6 +221,26 @@ func (server *Server) handle(w http.ResponseWriter, r *http.Request) {
 	switch path.Ext(r.URL.Path) {
 	case ".m3u8":
 		key, _ := server.parseM3u8(r.URL.Path)
+		if paths := strings.SplitN(key, "/", 2); len(paths) == 2 {
+			app, ok := configure.ResolveApp(r.Host, paths[0])
+			if !ok {
+				http.Error(w, "application not configured", http.StatusForbidden)
+				return
+			}
+			name := paths[1]
+			if server.mapper != nil {
+				// players are never refused a name
+				name, _ = server.mapper.MapName(app, name, r.URL.Query(), false)
+			}
+			key = app + "/" + name
+		}
+		// the segments are only listed in the playlists
+		if !server.admit(w, r, key) {
+			return
+		}
+		if server.puller != nil {
+			server.puller.Pull(key)
+		}
 		conn := server.getConn(key)
 		if conn == nil {
 			http.Error(w, ErrNoPublisher.Error(), http.StatusForbidden)
@@ -166,7 +253,7 @@ func (server *Server) handle(w http.ResponseWriter, r *http.Request) {
 		}
 		body, err := tsCache.GenM3U8PlayList()
 		if err != nil {
-			log.Println("GenM3U8PlayList error: ", err)
+			logger.With("remote", r.RemoteAddr, "key", key).Warnf("playlist failed: %v", err)
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
@@ -178,6 +265,9 @@ func (server *Server) handle(w http.ResponseWriter, r *http.Request) {
 		w.Write(body)
 	case ".ts":
 		key, _ := server.parseTs(r.URL.Path)
+		if server.puller != nil {
+			server.puller.Pull(key)
+		}
 		conn := server.getConn(key)
 		if conn == nil {
 			http.Error(w, ErrNoPublisher.Error(), http.StatusForbidden)
@@ -186,7 +276,7 @@ func (server *Server) handle(w http.ResponseWriter, r *http.Request) {
 		tsCache := conn.GetCacheInc()
 		item, err := tsCache.GetItem(r.URL.Path)
 		if err != nil {
-			log.Println("GetItem error: ", err)
+			logger.With("remote", r.RemoteAddr, "key", key).Debugf("segment %s not found: %v", r.URL.Path, err)
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
@@ -0,0 +1,45 @@
+package hls
+
+import (
+	"bomin/protocol/rtmp"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type admitFunc func(key string, publish bool, remote string) error
+
+func (f admitFunc) Admit(key string, publish bool, remote string) error {
+	return f(key, publish, remote)
+}
+
+func TestHandleAdmit(t *testing.T) {
+	at := assert.New(t)
+	server := NewServer()
+	var keys []string
+	var admitted error
+	server.SetAdmitter(admitFunc(func(key string, publish bool, remote string) error {
+		at.False(publish)
+		keys = append(keys, key)
+		return admitted
+	}))
+
+	admitted = rtmp.ErrAddrDenied
+	w := httptest.NewRecorder()
+	server.handle(w, httptest.NewRequest(http.MethodGet, "/live/movie.m3u8?token=1", nil))
+	at.Equal(http.StatusForbidden, w.Code)
+	at.Contains(w.Body.String(), rtmp.ErrAddrDenied.Error())
+
+	admitted = rtmp.ErrTooManyPlayers
+	w = httptest.NewRecorder()
+	server.handle(w, httptest.NewRequest(http.MethodGet, "/live/movie.m3u8", nil))
+	at.Equal(http.StatusServiceUnavailable, w.Code)
+
+	admitted = nil
+	w = httptest.NewRecorder()
+	server.handle(w, httptest.NewRequest(http.MethodGet, "/live/movie.m3u8", nil))
+	at.Contains(w.Body.String(), ErrNoPublisher.Error())
+	at.Equal([]string{"live/movie", "live/movie", "live/movie"}, keys)
+}
@@ -4,11 +4,14 @@ import (
 	"bomin/av"
 	"bomin/container/flv"
 	"bomin/container/ts"
+	"bomin/logging"
 	"bomin/parser"
+	"bomin/protocol/rtmp"
+	"bomin/protocol/rtmp/queue"
+	"bomin/utils/metrics"
 	"bytes"
-	"errors"
 	"fmt"
-	"log"
+	"io"
 	"time"
 )
 
@@ -19,45 +22,52 @@ const (
 	h264_default_hz uint64 = 90
 )
 
+var hlsSegments = metrics.NewCounter("bomin_hls_segments_total", "HLS segments produced.")
+
 type Source struct {
 	av.RWBaser
-	seq         int
-	info        av.Info
-	bwriter     *bytes.Buffer
-	btswriter   *bytes.Buffer
-	demuxer     *flv.Demuxer
-	muxer       *ts.Muxer
-	pts, dts    uint64
-	stat        *status
-	align       *align
-	cache       *audioCache
-	tsCache     *TSCacheItem
-	tsparser    *parser.CodecParser
-	closed      bool
-	packetQueue chan *av.Packet
+	av.Stats
+	seq       int
+	info      av.Info
+	bwriter   *bytes.Buffer
+	btswriter *bytes.Buffer
+	demuxer   *flv.Demuxer
+	muxer     *ts.Muxer
+	pts, dts  uint64
+	stat      *status
+	align     *align
+	cache     *audioCache
+	tsCache   *TSCacheItem
+	tsparser  *parser.CodecParser
+	drained   chan struct{}
+	queue     *queue.Queue
+	log       logging.Logger
 }
 
-func NewSource(info av.Info) *Source {
+func NewSource(info av.Info, cfg queue.Config) *Source {
 	info.Inter = true
 	s := &Source{
-		info:        info,
-		align:       &align{},
-		stat:        newStatus(),
-		RWBaser:     av.NewRWBaser(time.Second * 10),
-		cache:       newAudioCache(),
-		demuxer:     flv.NewDemuxer(),
-		muxer:       ts.NewMuxer(),
-		tsCache:     NewTSCacheItem(info.Key),
-		tsparser:    parser.NewCodecParser(),
-		bwriter:     bytes.NewBuffer(make([]byte, 100*1024)),
-		packetQueue: make(chan *av.Packet, maxQueueNum),
+		info:     info,
+		align:    &align{},
+		stat:     newStatus(),
+		RWBaser:  av.NewRWBaser(time.Second * 10),
+		cache:    newAudioCache(),
+		demuxer:  flv.NewDemuxer(),
+		muxer:    ts.NewMuxer(),
+		tsCache:  NewTSCacheItem(info.Key),
+		tsparser: parser.NewCodecParser(),
+		bwriter:  bytes.NewBuffer(make([]byte, 100*1024)),
+		queue:    queue.New("hls", maxQueueNum, cfg),
+		drained:  make(chan struct{}),
+		log:      logger.With("uid", info.UID, "key", info.Key),
 	}
 	go func() {
 		err := s.SendPacket()
 		if err != nil {
-			log.Println("Send packet closed: ", err)
-			s.closed = true
+			s.log.Debugf("muxer stopped: %v", err)
 		}
+		s.queue.Close(false)
+		close(s.drained)
 	}()
 	return s
 }
@@ -66,102 +76,83 @@ func (source *Source) GetCacheInc() *TSCacheItem {
 	return source.tsCache
 }
 
-func (source *Source) DropPacket(pktQue chan *av.Packet, info av.Info) {
-	log.Printf("[%v] packet queue max!!!", info)
-	for i := 0; i < maxQueueNum-84; i++ {
-		tmpPkt, ok := <-pktQue
-		// try to don't drop audio
-		if ok && tmpPkt.IsAudio {
-			if len(pktQue) > maxQueueNum-2 {
-				<-pktQue
-			} else {
-				pktQue <- tmpPkt
-			}
-		}
-
-		if ok && tmpPkt.IsVideo {
-			videoPkt, ok := tmpPkt.Header.(av.VideoPacketHeader)
-			// dont't drop sps config and dont't drop key frame
-			if ok && (videoPkt.IsSeq() || videoPkt.IsKeyFrame()) {
-				pktQue <- tmpPkt
-			}
-			if len(pktQue) > maxQueueNum-10 {
-				<-pktQue
-			}
-		}
+// Write queues p, a full queue drops packets as configured.
+func (source *Source) Write(p *av.Packet) error {
+	source.SetPreTime()
+	return source.queue.Push(p)
+}
 
-	}
-	log.Println("packet queue len: ", len(pktQue))
+// Dropped returns the number of packets dropped by the muxer.
+func (source *Source) Dropped() uint64 {
+	return source.queue.Dropped()
 }
 
-func (source *Source) Write(p *av.Packet) (err error) {
-	err = nil
-	if source.closed {
-		err = errors.New("hls source closed")
-		return
-	}
-	source.SetPreTime()
-	defer func() {
-		if e := recover(); e != nil {
-			errString := fmt.Sprintf("hls source has already been closed:%v", e)
-			err = errors.New(errString)
-		}
-	}()
-	if len(source.packetQueue) >= maxQueueNum-24 {
-		source.DropPacket(source.packetQueue, source.info)
-	} else {
-		if !source.closed {
-			source.packetQueue <- p
-		}
-	}
-	return
+// Counters returns what was given to the muxer, and dropped by its queue.
+func (source *Source) Counters() av.Counters {
+	c := source.Stats.Counters()
+	c.Dropped = source.queue.Dropped()
+	return c
 }
 
 func (source *Source) SendPacket() error {
 	defer func() {
 		//log.Printf("[%v] hls sender stop", source.info)
 		if r := recover(); r != nil {
-			log.Println("hls SendPacket panic: ", r)
+			source.log.Errorf("muxer panic: %v", r)
 		}
 	}()
 
 	for {
-		if source.closed {
-			return errors.New("closed")
+		shared, err := source.queue.Pop()
+		if err == io.EOF {
+			source.end()
+			return err
+		}
+		if err != nil {
+			source.cleanup()
+			return err
+		}
+		err = source.mux(shared)
+		source.Update(shared)
+		shared.Release()
+		if err != nil {
+			return err
 		}
+	}
+}
 
-		p, ok := <-source.packetQueue
-		if ok {
-			if p.IsMetadata {
-				continue
-			}
+// mux adds shared to the segment in progress, the TS muxer copies its data.
+func (source *Source) mux(shared *av.Packet) error {
+	if shared.IsMetadata {
+		return nil
+	}
+	// the demuxer modifies the packet, shared with the other writers
+	pkt := *shared
+	p := &pkt
 
-			err := source.demuxer.Demux(p)
-			if err == flv.ErrAvcEndSEQ {
-				log.Println(err)
-				continue
-			} else {
-				if err != nil {
-					log.Println(err)
-					return err
-				}
-			}
-			compositionTime, isSeq, err := source.parse(p)
-			if err != nil {
-				log.Println(err)
-			}
-			if err != nil || isSeq {
-				continue
-			}
-			if source.btswriter != nil {
-				source.stat.update(p.IsVideo, p.TimeStamp)
-				source.calcPtsDts(p.IsVideo, p.TimeStamp, uint32(compositionTime))
-				source.tsMux(p)
-			}
-		} else {
-			return errors.New("closed")
+	err := source.demuxer.Demux(p)
+	if err == flv.ErrAvcEndSEQ {
+		source.log.Debug(err.Error())
+		return nil
+	} else {
+		if err != nil {
+			source.log.Warnf("demux failed: %v", err)
+			return err
 		}
 	}
+	compositionTime, isSeq, err := source.parse(p)
+	if err != nil {
+		source.log.Tracef("parse failed: %v", err)
+	}
+	if err != nil || isSeq {
+		return nil
+	}
+	if source.btswriter != nil {
+		source.stat.update(p.IsVideo, p.TimeStamp)
+		source.calcPtsDts(p.IsVideo, p.TimeStamp, uint32(compositionTime))
+		source.tsMux(p)
+	}
+	return nil
 }
 
 func (source *Source) Info() (ret av.Info) {
@@ -169,19 +160,42 @@ func (source *Source) Info() (ret av.Info) {
 }
 
 func (source *Source) cleanup() {
-	close(source.packetQueue)
 	source.bwriter = nil
 	source.btswriter = nil
 	source.cache = nil
 	source.tsCache = nil
 }
 
+// Drained is closed once the source has stopped muxing.
+func (source *Source) Drained() <-chan struct{} {
+	return source.drained
+}
+
+// Close stops the source. Closed with rtmp.ErrShutdown it first muxes what
+// is queued, publishes the segment in progress and ends the playlist, which
+// stays available.
 func (source *Source) Close(err error) {
 	//log.Println("hls source closed: ", source.info)
-	if !source.closed {
-		source.cleanup()
+	source.queue.Close(err == rtmp.ErrShutdown)
+}
+
+// end publishes the segment in progress and ends the playlist.
+func (source *Source) end() {
+	if source.btswriter != nil && source.stat.durationMs() > 0 {
+		source.flushAudio()
+		source.newSegment()
 	}
-	source.closed = true
+	source.tsCache.End()
+	source.log.Debug("playlist ended")
+}
+
+// newSegment adds what has been muxed as a segment to the playlist.
+func (source *Source) newSegment() {
+	source.seq++
+	filename := fmt.Sprintf("/%s/%d.ts", source.info.Key, time.Now().Unix())
+	item := NewTSItem(filename, int(source.stat.durationMs()), source.seq, source.btswriter.Bytes())
+	source.tsCache.SetItem(filename, item)
+	hlsSegments.Inc()
 }
 
 func (source *Source) cut() {
@@ -190,11 +204,7 @@ func (source *Source) cut() {
 		source.btswriter = bytes.NewBuffer(nil)
 	} else if source.btswriter != nil && source.stat.durationMs() >= duration {
 		source.flushAudio()
-
-		source.seq++
-		filename := fmt.Sprintf("/%s/%d.ts", source.info.Key, time.Now().Unix())
-		item := NewTSItem(filename, int(source.stat.durationMs()), source.seq, source.btswriter.Bytes())
-		source.tsCache.SetItem(filename, item)
+		source.newSegment()
 
 		source.btswriter.Reset()
 		source.stat.resetAndNew()
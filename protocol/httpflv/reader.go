@@ -0,0 +1,109 @@
+package httpflv
+
+import (
+	"bomin/av"
+	"bomin/container/flv"
+	"bomin/logging"
+	"bomin/protocol/amf"
+	"bomin/utils/uid"
+	"io"
+	"sync"
+	"time"
+)
+
+// FLVReader publishes the FLV stream of an HTTP request body, as sent by
+// encoders that can only push over HTTP.
+type FLVReader struct {
+	Uid string
+	av.RWBaser
+	av.Stats
+	app, title, url string
+	tags            *flv.TagReader
+	log             logging.Logger
+
+	// held while the body is read
+	reading sync.Mutex
+
+	lock sync.Mutex
+	err  error
+	done chan struct{}
+}
+
+// NewFLVReader reads the FLV header from body.
+func NewFLVReader(app, title, url string, body io.Reader) (*FLVReader, error) {
+	tags, err := flv.NewTagReader(body)
+	if err != nil {
+		return nil, err
+	}
+	id := uid.NewId()
+	return &FLVReader{
+		Uid:     id,
+		app:     app,
+		title:   title,
+		url:     url,
+		RWBaser: av.NewRWBaser(time.Second * 10),
+		tags:    tags,
+		log:     logger.With("uid", id, "key", app+"/"+title),
+		done:    make(chan struct{}),
+	}, nil
+}
+
+// Read reads the next tag. The reader is closed when the body ends, with
+// io.EOF, or fails. Once it is closed, Read does not read the body any more.
+func (flvReader *FLVReader) Read(p *av.Packet) error {
+	flvReader.reading.Lock()
+	defer flvReader.reading.Unlock()
+	if err := flvReader.Err(); err != nil {
+		return err
+	}
+	if err := flvReader.tags.ReadTag(p); err != nil {
+		flvReader.Close(err)
+		return flvReader.Err()
+	}
+	flvReader.SetPreTime()
+	if p.IsMetadata {
+		// as an RTMP publisher sends it
+		if data, err := amf.MetaDataReform(p.Data, amf.ADD); err == nil {
+			p.Data = data
+		}
+	}
+	flvReader.Update(p)
+	return nil
+}
+
+// Close ends the publishing, the read in progress, if any, still has to
+// return. Only the first call counts.
+func (flvReader *FLVReader) Close(err error) {
+	if err == nil {
+		err = io.EOF
+	}
+	flvReader.lock.Lock()
+	defer flvReader.lock.Unlock()
+	if flvReader.err == nil {
+		flvReader.log.Debugf("closed: %v", err)
+		flvReader.err = err
+		close(flvReader.done)
+	}
+}
+
+// Err returns why the reader was closed, nil while it is open.
+func (flvReader *FLVReader) Err() error {
+	flvReader.lock.Lock()
+	defer flvReader.lock.Unlock()
+	return flvReader.err
+}
+
+// Wait returns once the reader is closed and the read in progress, if any,
+// returned, so that the body is not read after the request is answered.
+func (flvReader *FLVReader) Wait() {
+	<-flvReader.done
+	flvReader.reading.Lock()
+	flvReader.reading.Unlock()
+}
+
+func (flvReader *FLVReader) Info() (ret av.Info) {
+	ret.UID = flvReader.Uid
+	ret.URL = flvReader.url
+	ret.Key = flvReader.app + "/" + flvReader.title
+	return
+}
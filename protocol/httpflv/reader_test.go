@@ -0,0 +1,148 @@
+package httpflv
+
+import (
+	"bomin/av"
+	"bomin/configure"
+	"bomin/protocol/rtmp"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func flvTag(typeID byte, ts uint32, data []byte) []byte {
+	size := len(data)
+	tag := []byte{typeID, byte(size >> 16), byte(size >> 8), byte(size), byte(ts >> 16), byte(ts >> 8), byte(ts), byte(ts >> 24), 0, 0, 0}
+	tag = append(tag, data...)
+	total := size + 11
+	return append(tag, byte(total>>24), byte(total>>16), byte(total>>8), byte(total))
+}
+
+func TestPublish(t *testing.T) {
+	at := assert.New(t)
+	saved := configure.RtmpServercfg
+	defer func() { configure.RtmpServercfg = saved }()
+	configure.RtmpServercfg = configure.ServerCfg{Server: []configure.Application{
+		{Appname: "live", Liveon: "on"},
+	}}
+	stream := rtmp.NewRtmpStream()
+	ts := httptest.NewServer(NewServer(stream).Handler())
+	defer ts.Close()
+
+	resp, err := http.Post(ts.URL+"/other/movie.flv", "video/x-flv", strings.NewReader("FLV"))
+	at.Nil(err)
+	resp.Body.Close()
+	at.Equal(http.StatusForbidden, resp.StatusCode)
+	resp, err = http.Post(ts.URL+"/live/movie.flv", "video/x-flv", strings.NewReader("not flv at all"))
+	at.Nil(err)
+	resp.Body.Close()
+	at.Equal(http.StatusBadRequest, resp.StatusCode)
+
+	body, encoder := io.Pipe()
+	done := make(chan *http.Response)
+	go func() {
+		resp, err := http.Post(ts.URL+"/live/movie.flv", "video/x-flv", body)
+		at.Nil(err)
+		done <- resp
+	}()
+	encoder.Write([]byte{'F', 'L', 'V', 1, 5, 0, 0, 0, 9, 0, 0, 0, 0})
+	sub := stream.NewSubscriber("live/movie", 0)
+	encoder.Write(flvTag(av.TAG_VIDEO, 0, []byte{0x17, 0, 0, 0, 0, 1}))
+	encoder.Write(flvTag(av.TAG_VIDEO, 40, []byte{0x17, 1, 0, 0, 0, 0xff}))
+
+	select {
+	case p := <-sub.Packets():
+		vh := p.Header.(av.VideoPacketHeader)
+		at.True(vh.IsSeq())
+	case <-time.After(time.Second):
+		t.Fatal("no packet")
+	}
+	stat, _ := stream.Stat("live/movie")
+	at.True(stat.Publishing)
+	at.Equal("httpflv.FLVReader", stat.Publisher.Type)
+
+	encoder.Close()
+	resp = <-done
+	resp.Body.Close()
+	at.Equal(http.StatusNoContent, resp.StatusCode)
+}
+
+func TestPublishAlias(t *testing.T) {
+	at := assert.New(t)
+	saved := configure.RtmpServercfg
+	defer func() { configure.RtmpServercfg = saved }()
+	configure.RtmpServercfg = configure.ServerCfg{Server: []configure.Application{
+		{Appname: "live", Liveon: "on", Key_aliases: map[string]string{"8f3a6c": "channel1"}},
+	}}
+	stream := rtmp.NewRtmpStream()
+	ts := httptest.NewServer(NewServer(stream).Handler())
+	defer ts.Close()
+
+	body, encoder := io.Pipe()
+	done := make(chan *http.Response)
+	go func() {
+		resp, err := http.Post(ts.URL+"/live/8f3a6c.flv", "video/x-flv", body)
+		at.Nil(err)
+		done <- resp
+	}()
+	encoder.Write([]byte{'F', 'L', 'V', 1, 5, 0, 0, 0, 9, 0, 0, 0, 0})
+	sub := stream.NewSubscriber("live/channel1", 0)
+	encoder.Write(flvTag(av.TAG_VIDEO, 0, []byte{0x17, 0, 0, 0, 0, 1}))
+	select {
+	case <-sub.Packets():
+	case <-time.After(time.Second):
+		t.Fatal("no packet")
+	}
+	stat, _ := stream.Stat("live/channel1")
+	at.True(stat.Publishing)
+	_, ok := stream.Stat("live/8f3a6c")
+	at.False(ok)
+	r, ok := stream.GetStreams().Get("live/channel1")
+	at.True(ok)
+	at.Equal("/live/channel1.flv", r.(*rtmp.Stream).GetReader().Info().URL)
+
+	encoder.Close()
+	resp := <-done
+	resp.Body.Close()
+	at.Equal(http.StatusNoContent, resp.StatusCode)
+}
+
+func TestReaderWaitsForRead(t *testing.T) {
+	at := assert.New(t)
+	body, encoder := io.Pipe()
+	go encoder.Write([]byte{'F', 'L', 'V', 1, 5, 0, 0, 0, 9, 0, 0, 0, 0})
+	reader, err := NewFLVReader("live", "movie", "/live/movie.flv", body)
+	at.Nil(err)
+
+	read := make(chan error)
+	go func() {
+		var p av.Packet
+		read <- reader.Read(&p)
+	}()
+	waited := make(chan struct{})
+	go func() {
+		reader.Wait()
+		close(waited)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	reader.Close(rtmp.ErrShutdown)
+	select {
+	case <-waited:
+		t.Fatal("Wait returned while the body is read")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	encoder.Write(flvTag(av.TAG_VIDEO, 0, []byte{0x17, 0, 0, 0, 0, 1}))
+	at.Nil(<-read)
+	select {
+	case <-waited:
+	case <-time.After(time.Second):
+		t.Fatal("Wait blocked")
+	}
+	var p av.Packet
+	at.Equal(rtmp.ErrShutdown, reader.Read(&p))
+}
@@ -2,17 +2,32 @@ package httpflv
 
 import (
 	"bomin/av"
+	"bomin/configure"
+	"bomin/logging"
 	"bomin/protocol/rtmp"
+	"bomin/protocol/rtmp/queue"
 	"encoding/json"
-
-	"log"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"io"
 	"net"
 	"net/http"
 	"strings"
 )
 
+var logger = logging.New("httpflv")
+
+// puller is implemented by the handlers that know the streams published and
+// pull the others from an origin when they are an edge, as rtmp.RtmpStream.
+type puller interface {
+	Pull(key string) bool
+}
+
 type Server struct {
 	handler av.Handler
+	getter  av.GetWriter
+	// Queue is how the players' queues handle players that cannot keep up.
+	Queue queue.Config
 }
 
 type stream struct {
@@ -28,10 +43,23 @@ type streams struct {
 func NewServer(h av.Handler) *Server {
 	return &Server{
 		handler: h,
+		Queue:   queue.DefaultConfig,
 	}
 }
 
+// SetGetter makes the streams published over HTTP muxed by getter too, as
+// the RTMP server does for its publishers.
+func (server *Server) SetGetter(getter av.GetWriter) {
+	server.getter = getter
+}
+
 func (server *Server) Serve(l net.Listener) error {
+	http.Serve(l, server.Handler())
+	return nil
+}
+
+// Handler returns the handler serving streams as FLV over HTTP.
+func (server *Server) Handler() http.Handler {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		server.handleConn(w, r)
@@ -39,14 +67,13 @@ func (server *Server) Serve(l net.Listener) error {
 	mux.HandleFunc("/streams", func(w http.ResponseWriter, r *http.Request) {
 		server.getStream(w, r)
 	})
-	http.Serve(l, mux)
-	return nil
+	return mux
 }
 
 // 获取发布和播放器的信息
 func (server *Server) getStreams(w http.ResponseWriter, r *http.Request) *streams {
-	rtmpStream := server.handler.(*rtmp.RtmpStream)
-	if rtmpStream == nil {
+	rtmpStream, ok := server.handler.(*rtmp.RtmpStream)
+	if !ok {
 		return nil
 	}
 	msgs := new(streams)
@@ -60,14 +87,9 @@ func (server *Server) getStreams(w http.ResponseWriter, r *http.Request) *stream
 	}
 
 	for item := range rtmpStream.GetStreams().IterBuffered() {
-		ws := item.Val.(*rtmp.Stream).GetWs()
-		for s := range ws.IterBuffered() {
-			if pw, ok := s.Val.(*rtmp.PackWriterCloser); ok {
-				if pw.GetWriter() != nil {
-					msg := stream{item.Key, pw.GetWriter().Info().UID}
-					msgs.Players = append(msgs.Players, msg)
-				}
-			}
+		for _, pw := range item.Val.(*rtmp.Stream).GetWs() {
+			msg := stream{item.Key, pw.GetWriter().Info().UID}
+			msgs.Players = append(msgs.Players, msg)
 		}
 	}
 
@@ -85,13 +107,89 @@ func (server *Server) getStream(w http.ResponseWriter, r *http.Request) {
 }
 
 func (server *Server) handleConn(w http.ResponseWriter, r *http.Request) {
+	clog := logger.With("remote", r.RemoteAddr)
 	defer func() {
 		if r := recover(); r != nil {
-			log.Println("http flv handleConn panic: ", r)
+			clog.Errorf("handleConn panic: %v", r)
 		}
 	}()
 
-	url := r.URL.String()
+	if r.Method == http.MethodPost {
+		server.handlePublish(w, r)
+		return
+	}
+	app, name, ok := server.playPath(w, r)
+	if !ok {
+		return
+	}
+	if websocket.IsWebSocketUpgrade(r) {
+		server.handleWs(w, r, app, name)
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	writer := NewFLVWriter(app, name, streamURL(r, app, name), w, server.Queue)
+	clog = clog.With("uid", writer.Uid, "key", app+"/"+name)
+	clog.Info("player connected")
+
+	server.handler.HandleWriter(writer)
+	writer.Wait()
+	clog.Info("player disconnected")
+}
+
+// handlePublish publishes the FLV stream in the request body, usually
+// chunked, as /app/name.flv. It answers once the stream ends.
+func (server *Server) handlePublish(w http.ResponseWriter, r *http.Request) {
+	clog := logger.With("remote", r.RemoteAddr)
+	app, name, ok := parsePath(w, r)
+	if !ok {
+		return
+	}
+	app, name, err := server.mapName(r, app, name, true)
+	if err != nil {
+		clog.Warnf("rejected: %v", err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if !configure.CheckAppName(app) {
+		clog.Warnf("rejected: application name=%s is not configured", app)
+		http.Error(w, "application not configured", http.StatusForbidden)
+		return
+	}
+	if !server.admit(w, r, app+"/"+name, true) {
+		return
+	}
+	reader, err := NewFLVReader(app, name, streamURL(r, app, name), r.Body)
+	if err != nil {
+		clog.Warnf("invalid flv stream: %v", err)
+		http.Error(w, "invalid flv stream", http.StatusBadRequest)
+		return
+	}
+	clog = clog.With("uid", reader.Uid, "key", app+"/"+name)
+	clog.Info("publisher connected")
+
+	server.handler.HandleReader(reader)
+	if server.getter != nil {
+		server.handler.HandleWriter(server.getter.GetWriter(reader.Info()))
+	}
+	// returns once the stream stopped reading the body too, when it kicked
+	// or replaced the publisher
+	reader.Wait()
+	clog.Infof("publisher disconnected: %v", reader.Err())
+
+	switch err := reader.Err(); err {
+	case io.EOF:
+		w.WriteHeader(http.StatusNoContent)
+	case rtmp.ErrShutdown:
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	default:
+		http.Error(w, err.Error(), http.StatusConflict)
+	}
+}
+
+// parsePath returns the stream of a /app/name.flv request, or answers it
+// if the path is invalid.
+func parsePath(w http.ResponseWriter, r *http.Request) (app, name string, ok bool) {
 	u := r.URL.Path
 	if pos := strings.LastIndex(u, "."); pos < 0 || u[pos:] != ".flv" {
 		http.Error(w, "invalid path", http.StatusBadRequest)
@@ -99,35 +197,90 @@ func (server *Server) handleConn(w http.ResponseWriter, r *http.Request) {
 	}
 	path := strings.TrimSuffix(strings.TrimLeft(u, "/"), ".flv")
 	paths := strings.SplitN(path, "/", 2)
-	log.Println("url:", u, "path:", path, "paths:", paths)
 
 	if len(paths) != 2 {
 		http.Error(w, "invalid path", http.StatusBadRequest)
 		return
 	}
+	return paths[0], paths[1], true
+}
+
+// mapName returns the app, of the vhost r is for, and the stream a client
+// publishing, or playing, name in app gets.
+func (server *Server) mapName(r *http.Request, app, name string, publish bool) (string, string, error) {
+	resolved, ok := configure.ResolveApp(r.Host, app)
+	if !ok {
+		return "", "", fmt.Errorf("application name=%s is not configured", app)
+	}
+	app = resolved
+	if rtmpStream, ok := server.handler.(*rtmp.RtmpStream); ok {
+		mapped, err := rtmpStream.MapName(app, name, r.URL.Query(), publish)
+		if err != nil {
+			return "", "", err
+		}
+		name = mapped
+	}
+	return app, name, nil
+}
+
+// streamURL returns the URL of r with the path of the stream it maps to and
+// without its query, so that neither a secret name nor a token shows.
+func streamURL(r *http.Request, app, name string) string {
+	u := *r.URL
+	u.Path, u.RawPath, u.RawQuery = "/"+app+"/"+name+".flv", "", ""
+	return u.String()
+}
+
+// playPath returns the stream of a /app/name.flv request. It answers the
+// request itself if the path is invalid or the stream is not published,
+// nor pulled from an origin.
+func (server *Server) playPath(w http.ResponseWriter, r *http.Request) (app, name string, ok bool) {
+	if app, name, ok = parsePath(w, r); !ok {
+		return
+	}
+	app, name, err := server.mapName(r, app, name, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return "", "", false
+	}
+
+	if !server.admit(w, r, app+"/"+name, false) {
+		return "", "", false
+	}
 
 	// 判断视屏流是否发布,如果没有发布,直接返回404
-	msgs := server.getStreams(w, r)
-	if msgs == nil || len(msgs.Publishers) == 0 {
+	if !server.published(app + "/" + name) {
 		http.Error(w, "invalid path", http.StatusNotFound)
-		return
-	} else {
-		include := false
-		for _, item := range msgs.Publishers {
-			if item.Key == path {
-				include = true
-				break
-			}
-		}
-		if include == false {
-			http.Error(w, "invalid path", http.StatusNotFound)
-			return
-		}
+		return "", "", false
 	}
+	return app, name, true
+}
 
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	writer := NewFLVWriter(paths[0], paths[1], url, w)
+// published reports whether key is published, or pulled by an edge server
+// from its origin. A handler that cannot tell gets the player.
+func (server *Server) published(key string) bool {
+	if p, ok := server.handler.(puller); ok {
+		return p.Pull(key)
+	}
+	return true
+}
 
-	server.handler.HandleWriter(writer)
-	writer.Wait()
+// admit answers a client the limits of the app refuse: 403 for an address
+// not allowed, 503 for a cap reached.
+func (server *Server) admit(w http.ResponseWriter, r *http.Request, key string, publish bool) bool {
+	rtmpStream, ok := server.handler.(*rtmp.RtmpStream)
+	if !ok {
+		return true
+	}
+	err := rtmpStream.Admit(key, publish, r.RemoteAddr)
+	switch err {
+	case nil:
+		return true
+	case rtmp.ErrAddrDenied:
+		http.Error(w, err.Error(), http.StatusForbidden)
+	default:
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	}
+	logger.With("remote", r.RemoteAddr).Warnf("rejected %s: %v", key, err)
+	return false
 }
@@ -2,13 +2,15 @@ package httpflv
 
 import (
 	"bomin/av"
+	"bomin/logging"
 	"bomin/protocol/amf"
+	"bomin/protocol/rtmp"
+	"bomin/protocol/rtmp/queue"
 	"bomin/utils/pio"
 	"bomin/utils/uid"
-	"errors"
-	"fmt"
-	"log"
+	"io"
 	"net/http"
+	"sync"
 	"time"
 )
 
@@ -20,140 +22,120 @@ const (
 type FLVWriter struct {
 	Uid string
 	av.RWBaser
+	av.Stats
 	app, title, url string
 	buf             []byte
-	closed          bool
 	closedChan      chan struct{}
-	ctx             http.ResponseWriter
-	packetQueue     chan *av.Packet
+	closeOnce       sync.Once
+	ctx             io.Writer
+	queue           *queue.Queue
+	log             logging.Logger
 }
 
-func NewFLVWriter(app, title, url string, ctx http.ResponseWriter) *FLVWriter {
+func NewFLVWriter(app, title, url string, ctx http.ResponseWriter, cfg queue.Config) *FLVWriter {
+	return newFLVWriter(app, title, url, ctx, cfg)
+}
+
+// newFLVWriter writes the file header and then every tag to ctx, each in a
+// single Write.
+func newFLVWriter(app, title, url string, ctx io.Writer, cfg queue.Config) *FLVWriter {
+	id := uid.NewId()
 	ret := &FLVWriter{
-		Uid:         uid.NewId(),
-		app:         app,
-		title:       title,
-		url:         url,
-		ctx:         ctx,
-		RWBaser:     av.NewRWBaser(time.Second * 10),
-		closedChan:  make(chan struct{}),
-		buf:         make([]byte, headerLen),
-		packetQueue: make(chan *av.Packet, maxQueueNum),
+		Uid:        id,
+		app:        app,
+		title:      title,
+		url:        url,
+		ctx:        ctx,
+		RWBaser:    av.NewRWBaser(time.Second * 10),
+		closedChan: make(chan struct{}),
+		buf:        make([]byte, headerLen),
+		queue:      queue.New("httpflv", maxQueueNum, cfg),
+		log:        logger.With("uid", id, "key", app+"/"+title),
 	}
 
-	ret.ctx.Write([]byte{0x46, 0x4c, 0x56, 0x01, 0x05, 0x00, 0x00, 0x00, 0x09})
-	pio.PutI32BE(ret.buf[:4], 0)
-	ret.ctx.Write(ret.buf[:4])
+	ret.ctx.Write([]byte{0x46, 0x4c, 0x56, 0x01, 0x05, 0x00, 0x00, 0x00, 0x09, 0, 0, 0, 0})
 	go func() {
 		err := ret.SendPacket()
 		if err != nil {
-			log.Println("SendPacket error:", err)
-			ret.closed = true
+			ret.log.Debugf("send stopped: %v", err)
 		}
+		ret.queue.Close(false)
+		ret.closeOnce.Do(func() { close(ret.closedChan) })
 	}()
 	return ret
 }
 
-func (flvWriter *FLVWriter) DropPacket(pktQue chan *av.Packet, info av.Info) {
-	log.Printf("[%v] packet queue max!!!", info)
-	for i := 0; i < maxQueueNum-84; i++ {
-		tmpPkt, ok := <-pktQue
-		if ok && tmpPkt.IsVideo {
-			videoPkt, ok := tmpPkt.Header.(av.VideoPacketHeader)
-			// dont't drop sps config and dont't drop key frame
-			if ok && (videoPkt.IsSeq() || videoPkt.IsKeyFrame()) {
-				log.Println("insert keyframe to queue")
-				pktQue <- tmpPkt
-			}
-
-			if len(pktQue) > maxQueueNum-10 {
-				<-pktQue
-			}
-			// drop other packet
-			<-pktQue
-		}
-		// try to don't drop audio
-		if ok && tmpPkt.IsAudio {
-			log.Println("insert audio to queue")
-			pktQue <- tmpPkt
-		}
-	}
-	log.Println("packet queue len: ", len(pktQue))
+// Write queues p, a full queue drops packets as configured.
+func (flvWriter *FLVWriter) Write(p *av.Packet) error {
+	return flvWriter.queue.Push(p)
 }
 
-func (flvWriter *FLVWriter) Write(p *av.Packet) (err error) {
-	err = nil
-	if flvWriter.closed {
-		err = errors.New("flvwrite source closed")
-		return
-	}
-	defer func() {
-		if e := recover(); e != nil {
-			errString := fmt.Sprintf("FLVWriter has already been closed:%v", e)
-			err = errors.New(errString)
-		}
-	}()
-	if len(flvWriter.packetQueue) >= maxQueueNum-24 {
-		flvWriter.DropPacket(flvWriter.packetQueue, flvWriter.Info())
-	} else {
-		flvWriter.packetQueue <- p
-	}
+// Dropped returns the number of packets dropped for the player.
+func (flvWriter *FLVWriter) Dropped() uint64 {
+	return flvWriter.queue.Dropped()
+}
 
-	return
+// Counters returns what was sent to the player, and dropped by its queue.
+func (flvWriter *FLVWriter) Counters() av.Counters {
+	c := flvWriter.Stats.Counters()
+	c.Dropped = flvWriter.queue.Dropped()
+	return c
 }
 
 func (flvWriter *FLVWriter) SendPacket() error {
 	for {
-		p, ok := <-flvWriter.packetQueue
-		if ok {
-			flvWriter.RWBaser.SetPreTime()
-			h := flvWriter.buf[:headerLen]
-			typeID := av.TAG_VIDEO
-			if !p.IsVideo {
-				if p.IsMetadata {
-					var err error
-					typeID = av.TAG_SCRIPTDATAAMF0
-					p.Data, err = amf.MetaDataReform(p.Data, amf.DEL)
-					if err != nil {
-						return err
-					}
-				} else {
-					typeID = av.TAG_AUDIO
-				}
-			}
-			dataLen := len(p.Data)
-			timestamp := p.TimeStamp
-			timestamp += flvWriter.BaseTimeStamp()
-			flvWriter.RWBaser.RecTimeStamp(timestamp, uint32(typeID))
-
-			preDataLen := dataLen + headerLen
-			timestampbase := timestamp & 0xffffff
-			timestampExt := timestamp >> 24 & 0xff
-
-			pio.PutU8(h[0:1], uint8(typeID))
-			pio.PutI24BE(h[1:4], int32(dataLen))
-			pio.PutI24BE(h[4:7], int32(timestampbase))
-			pio.PutU8(h[7:8], uint8(timestampExt))
-
-			if _, err := flvWriter.ctx.Write(h); err != nil {
-				return err
-			}
-
-			if _, err := flvWriter.ctx.Write(p.Data); err != nil {
-				return err
-			}
+		p, err := flvWriter.queue.Pop()
+		if err != nil {
+			return err
+		}
+		err = flvWriter.writeTag(p)
+		if err == nil {
+			flvWriter.Update(p)
+		}
+		p.Release()
+		if err != nil {
+			return err
+		}
+	}
+}
 
-			pio.PutI32BE(h[:4], int32(preDataLen))
-			if _, err := flvWriter.ctx.Write(h[:4]); err != nil {
+func (flvWriter *FLVWriter) writeTag(p *av.Packet) error {
+	flvWriter.RWBaser.SetPreTime()
+	typeID := av.TAG_VIDEO
+	data := p.Data
+	if !p.IsVideo {
+		if p.IsMetadata {
+			var err error
+			typeID = av.TAG_SCRIPTDATAAMF0
+			data, err = amf.MetaDataReform(data, amf.DEL)
+			if err != nil {
 				return err
 			}
 		} else {
-			return errors.New("closed")
+			typeID = av.TAG_AUDIO
 		}
-
 	}
+	dataLen := len(data)
+	timestamp := p.TimeStamp
+
+	preDataLen := dataLen + headerLen
+	timestampbase := timestamp & 0xffffff
+	timestampExt := timestamp >> 24 & 0xff
 
-	return nil
+	if cap(flvWriter.buf) < preDataLen+4 {
+		flvWriter.buf = make([]byte, preDataLen+4)
+	}
+	tag := flvWriter.buf[:preDataLen+4]
+	pio.PutU8(tag[0:1], uint8(typeID))
+	pio.PutI24BE(tag[1:4], int32(dataLen))
+	pio.PutI24BE(tag[4:7], int32(timestampbase))
+	pio.PutU8(tag[7:8], uint8(timestampExt))
+	pio.PutI24BE(tag[8:11], 0)
+	copy(tag[headerLen:], data)
+	pio.PutI32BE(tag[preDataLen:], int32(preDataLen))
+
+	_, err := flvWriter.ctx.Write(tag)
+	return err
 }
 
 func (flvWriter *FLVWriter) Wait() {
@@ -163,13 +145,21 @@ func (flvWriter *FLVWriter) Wait() {
 	}
 }
 
-func (flvWriter *FLVWriter) Close(error) {
-	log.Println("http flv closed")
-	if !flvWriter.closed {
-		close(flvWriter.packetQueue)
-		close(flvWriter.closedChan)
+// Drained is closed once the writer has stopped sending.
+func (flvWriter *FLVWriter) Drained() <-chan struct{} {
+	return flvWriter.closedChan
+}
+
+// Close ends the response. Closed with rtmp.ErrShutdown the writer first
+// sends what is queued.
+func (flvWriter *FLVWriter) Close(err error) {
+	drain := err == rtmp.ErrShutdown
+	if flvWriter.queue.Close(drain) {
+		flvWriter.log.Debugf("closed: %v", err)
+	}
+	if !drain {
+		flvWriter.closeOnce.Do(func() { close(flvWriter.closedChan) })
 	}
-	flvWriter.closed = true
 }
 
 func (flvWriter *FLVWriter) Info() (ret av.Info) {
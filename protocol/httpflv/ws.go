@@ -0,0 +1,96 @@
+package httpflv
+
+import (
+	"github.com/gorilla/websocket"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	wsWriteWait  = 10 * time.Second
+	wsPongWait   = 30 * time.Second
+	wsPingPeriod = wsPongWait / 3
+)
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 4096,
+	// like the HTTP responses, playable from any page
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// WSFLVWriter plays a stream as FLV over a WebSocket, as flv.js and
+// mpegts.js do: the file header and then each tag is a binary message.
+type WSFLVWriter struct {
+	*FLVWriter
+}
+
+// wsConn writes each Write as a binary message.
+type wsConn struct {
+	conn *websocket.Conn
+}
+
+func (c wsConn) Write(b []byte) (int, error) {
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	if err := c.conn.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (server *Server) handleWs(w http.ResponseWriter, r *http.Request, app, name string) {
+	clog := logger.With("remote", r.RemoteAddr)
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		clog.Debugf("websocket upgrade failed: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	writer := &WSFLVWriter{newFLVWriter(app, name, streamURL(r, app, name), wsConn{conn}, server.Queue)}
+	clog = clog.With("uid", writer.Uid, "key", app+"/"+name)
+	clog.Info("websocket player connected")
+	server.handler.HandleWriter(writer)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	// the player only sends pongs and the close message
+	go func() {
+		defer wg.Done()
+		conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		conn.SetPongHandler(func(string) error {
+			conn.SetReadDeadline(time.Now().Add(wsPongWait))
+			return nil
+		})
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				writer.Close(err)
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(wsPingPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+					return
+				}
+			case <-writer.Drained():
+				return
+			}
+		}
+	}()
+
+	writer.Wait()
+	// the player may be gone already
+	conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(wsWriteWait))
+	conn.Close()
+	wg.Wait()
+	clog.Info("websocket player disconnected")
+}
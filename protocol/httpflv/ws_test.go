@@ -0,0 +1,98 @@
+package httpflv
+
+import (
+	"bomin/av"
+	"bomin/protocol/rtmp"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebSocketFLV(t *testing.T) {
+	at := assert.New(t)
+	stream := rtmp.NewRtmpStream()
+	ts := httptest.NewServer(NewServer(stream).Handler())
+	defer ts.Close()
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/live/movie.flv"
+
+	_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	at.NotNil(err)
+	at.Equal(http.StatusNotFound, resp.StatusCode)
+
+	pub := stream.NewPublisher("live/movie")
+	key := &av.Packet{IsVideo: true, TimeStamp: 40, Data: []byte{0x17, 1, 0, 0, 0, 0xff}}
+	at.Nil(pub.Write(key))
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	at.Nil(err)
+	defer conn.Close()
+	// the player is added once upgraded
+	for i := 0; i < 100; i++ {
+		if stat, _ := stream.Stat("live/movie"); len(stat.Players) > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// sent with the cache on the next packet
+	at.Nil(pub.Write(&av.Packet{IsVideo: true, TimeStamp: 80, Data: []byte{0x27, 1, 0, 0, 0, 0xff}}))
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	kind, msg, err := conn.ReadMessage()
+	at.Nil(err)
+	at.Equal(websocket.BinaryMessage, kind)
+	at.Equal("FLV", string(msg[:3]))
+	at.Len(msg, 13)
+
+	_, msg, err = conn.ReadMessage()
+	at.Nil(err)
+	at.Len(msg, 11+6+4)
+	at.Equal(byte(av.TAG_VIDEO), msg[0])
+	at.Equal([]byte{0x17, 1, 0, 0, 0, 0xff}, msg[11:17])
+	at.Equal([]byte{0, 0, 0, 17}, msg[17:])
+
+	at.Nil(conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")))
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			break
+		}
+	}
+	stat, _ := stream.Stat("live/movie")
+	for i := 0; i < 100 && len(stat.Players) > 0; i++ {
+		// the player is removed on the next packet
+		pub.Write(key)
+		time.Sleep(10 * time.Millisecond)
+		stat, _ = stream.Stat("live/movie")
+	}
+	at.Len(stat.Players, 0)
+}
+
+// writerHandler is a handler other than rtmp.RtmpStream, closing the
+// writers it gets.
+type writerHandler struct {
+	keys chan string
+}
+
+func (h writerHandler) HandleReader(r av.ReadCloser) {}
+
+func (h writerHandler) HandleWriter(w av.WriteCloser) {
+	h.keys <- w.Info().Key
+	w.Close(nil)
+}
+
+func TestPlayOtherHandler(t *testing.T) {
+	at := assert.New(t)
+	h := writerHandler{keys: make(chan string, 1)}
+	w := httptest.NewRecorder()
+	NewServer(h).Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/live/movie.flv", nil))
+	at.Equal(http.StatusOK, w.Code)
+	select {
+	case key := <-h.keys:
+		at.Equal("live/movie", key)
+	default:
+		t.Fatal("the handler got no writer")
+	}
+}
@@ -0,0 +1,270 @@
+package httpopera
+
+import (
+	"bomin/configure"
+	"bomin/protocol/rtmp"
+	"bomin/protocol/rtmp/rtmprelay"
+	"bomin/protocol/rtmp/transcode"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+const apiPrefix = "/api/v2/"
+
+type apiApp struct {
+	Name       string   `json:"name"`
+	Live       bool     `json:"live"`
+	Hls        bool     `json:"hls"`
+	StaticPush []string `json:"static_push"`
+	Forwards   []string `json:"forward_nodes"`
+	Origins    []string `json:"edge_origins"`
+}
+
+// apiRelayRequest is the body of POST /api/v2/relays. A push relay plays the
+// local stream app/name and publishes it to url, a pull relay plays url and
+// publishes it locally as app/name.
+type apiRelayRequest struct {
+	Type string `json:"type"`
+	App  string `json:"app"`
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+func writeJson(w http.ResponseWriter, code int, v interface{}) {
+	resp, _ := json.Marshal(v)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(resp)
+}
+
+func writeError(w http.ResponseWriter, code int, format string, args ...interface{}) {
+	writeJson(w, code, &Response{Status: code, Message: fmt.Sprintf(format, args...)})
+}
+
+// serveAPI dispatches the v2 management API:
+//
+//	GET    /api/v2/streams
+//	GET    /api/v2/streams/{app}/{name}
+//	DELETE /api/v2/clients/{uid}
+//	GET    /api/v2/relays
+//	POST   /api/v2/relays
+//	DELETE /api/v2/relays/{id}
+//	GET    /api/v2/files
+//	POST   /api/v2/files
+//	DELETE /api/v2/files/{app}/{name}
+//	GET    /api/v2/forwards
+//	GET    /api/v2/transcodes
+//	GET    /api/v2/apps
+//	GET    /api/v2/events
+//	GET    /api/v2/sse
+//	GET    /api/v2/endpoints
+//	GET    /api/v2/openapi.json
+func (s *Server) serveAPI(w http.ResponseWriter, req *http.Request) {
+	path := strings.TrimPrefix(req.URL.Path, apiPrefix)
+	resource, arg := path, ""
+	if i := strings.Index(path, "/"); i >= 0 {
+		resource, arg = path[:i], path[i+1:]
+	}
+
+	switch resource {
+	case "streams":
+		s.apiStreams(w, req, arg)
+	case "clients":
+		s.apiClients(w, req, arg)
+	case "relays":
+		s.apiRelays(w, req, arg)
+	case "files":
+		s.apiFiles(w, req, arg)
+	case "forwards":
+		s.apiForwards(w, req, arg)
+	case "transcodes":
+		s.apiTranscodes(w, req, arg)
+	case "apps":
+		s.apiApps(w, req, arg)
+	case "events":
+		s.apiEvents(w, req, arg)
+	case "sse":
+		s.apiSSE(w, req, arg)
+	case "endpoints":
+		s.apiEndpoints(w, req, arg)
+	case "openapi.json":
+		if !allowMethod(w, req, http.MethodGet) {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(openAPISpec))
+	default:
+		writeError(w, http.StatusNotFound, "unknown resource %q", resource)
+	}
+}
+
+func allowMethod(w http.ResponseWriter, req *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if req.Method == m {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(w, http.StatusMethodNotAllowed, "method %s not allowed", req.Method)
+	return false
+}
+
+func (s *Server) rtmpStream(w http.ResponseWriter) (*rtmp.RtmpStream, bool) {
+	rtmpStream, ok := s.handler.(*rtmp.RtmpStream)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "rtmp stream handler not available")
+	}
+	return rtmpStream, ok
+}
+
+func (s *Server) apiStreams(w http.ResponseWriter, req *http.Request, key string) {
+	if !allowMethod(w, req, http.MethodGet) {
+		return
+	}
+	rtmpStream, ok := s.rtmpStream(w)
+	if !ok {
+		return
+	}
+	if key == "" {
+		stats := rtmpStream.Stats()
+		sort.Slice(stats, func(i, j int) bool { return stats[i].Key < stats[j].Key })
+		writeJson(w, http.StatusOK, stats)
+		return
+	}
+	stat, found := rtmpStream.Stat(key)
+	if !found {
+		writeError(w, http.StatusNotFound, "stream %s not found", key)
+		return
+	}
+	writeJson(w, http.StatusOK, stat)
+}
+
+func (s *Server) apiClients(w http.ResponseWriter, req *http.Request, uid string) {
+	if !allowMethod(w, req, http.MethodDelete) {
+		return
+	}
+	if uid == "" {
+		writeError(w, http.StatusBadRequest, "client uid is required")
+		return
+	}
+	rtmpStream, ok := s.rtmpStream(w)
+	if !ok {
+		return
+	}
+	if !rtmpStream.Kick(uid) {
+		writeError(w, http.StatusNotFound, "client %s not found", uid)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) apiRelays(w http.ResponseWriter, req *http.Request, id string) {
+	switch {
+	case id == "" && req.Method == http.MethodGet:
+		relays := s.relays()
+		sort.Slice(relays, func(i, j int) bool { return relays[i].Key < relays[j].Key })
+		writeJson(w, http.StatusOK, relays)
+	case id == "" && req.Method == http.MethodPost:
+		var r apiRelayRequest
+		if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid body: %v", err)
+			return
+		}
+		if r.App == "" || r.Name == "" || r.URL == "" {
+			writeError(w, http.StatusBadRequest, "app, name and url are required")
+			return
+		}
+		key, playurl, publishurl, err := s.relayURLs(r.Type, r.App, r.Name, r.URL)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+		// the relay connects before it is started
+		if err := s.startRelay(key, playurl, publishurl); err != nil {
+			writeError(w, http.StatusBadGateway, "%v", err)
+			return
+		}
+		writeJson(w, http.StatusCreated, relay{key, s.relayStatus(key)})
+	case id != "" && req.Method == http.MethodDelete:
+		if !s.stopRelay(id) {
+			writeError(w, http.StatusNotFound, "relay %s not found", id)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case id != "":
+		allowMethod(w, req, http.MethodDelete)
+	default:
+		allowMethod(w, req, http.MethodGet, http.MethodPost)
+	}
+}
+
+func (s *Server) apiForwards(w http.ResponseWriter, req *http.Request, arg string) {
+	if !allowMethod(w, req, http.MethodGet) {
+		return
+	}
+	rtmpStream, ok := s.rtmpStream(w)
+	if !ok {
+		return
+	}
+	forwards := rtmpStream.Forwards()
+	if forwards == nil {
+		forwards = []rtmprelay.ForwardStatus{}
+	}
+	writeJson(w, http.StatusOK, forwards)
+}
+
+func (s *Server) apiTranscodes(w http.ResponseWriter, req *http.Request, arg string) {
+	if !allowMethod(w, req, http.MethodGet) {
+		return
+	}
+	transcodes := []transcode.Status{}
+	if s.transcoder != nil {
+		transcodes = append(transcodes, s.transcoder.List()...)
+	}
+	writeJson(w, http.StatusOK, transcodes)
+}
+
+func (s *Server) apiApps(w http.ResponseWriter, req *http.Request, arg string) {
+	if !allowMethod(w, req, http.MethodGet) {
+		return
+	}
+	apps := []apiApp{}
+	for _, app := range configure.Config().Server {
+		apps = append(apps, apiApp{
+			Name:       app.Appname,
+			Live:       app.Liveon == "on",
+			Hls:        app.Hlson == "on",
+			StaticPush: app.Static_push,
+			Forwards:   app.Forward_nodes,
+			Origins:    app.Edge_origins,
+		})
+	}
+	writeJson(w, http.StatusOK, apps)
+}
+
+func (s *Server) apiEvents(w http.ResponseWriter, req *http.Request, arg string) {
+	if !allowMethod(w, req, http.MethodGet) {
+		return
+	}
+	rtmpStream, ok := s.rtmpStream(w)
+	if !ok {
+		return
+	}
+	writeJson(w, http.StatusOK, rtmpStream.HealthEvents())
+}
+
+type apiEndpoints struct {
+	Rtmp    string `json:"rtmp"`
+	HttpFlv string `json:"httpflv,omitempty"`
+	Hls     string `json:"hls,omitempty"`
+}
+
+func (s *Server) apiEndpoints(w http.ResponseWriter, req *http.Request, arg string) {
+	if !allowMethod(w, req, http.MethodGet) {
+		return
+	}
+	writeJson(w, http.StatusOK, apiEndpoints{s.rtmpAddr, s.flvAddr, s.hlsAddr})
+}
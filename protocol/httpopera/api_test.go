@@ -0,0 +1,270 @@
+package httpopera
+
+import (
+	"bomin/av"
+	"bomin/configure"
+	"bomin/container/flv"
+	"bomin/protocol/rtmp"
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func apiRequest(s *Server, method, path, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	s.serveAPI(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+	return w
+}
+
+func TestAPIStreams(t *testing.T) {
+	at := assert.New(t)
+	s := NewServer(rtmp.NewRtmpStream(), ":1935")
+
+	w := apiRequest(s, http.MethodGet, "/api/v2/streams", "")
+	at.Equal(http.StatusOK, w.Code)
+	at.Equal("application/json", w.Header().Get("Content-Type"))
+	at.Equal("[]", w.Body.String())
+
+	w = apiRequest(s, http.MethodGet, "/api/v2/streams/live/movie", "")
+	at.Equal(http.StatusNotFound, w.Code)
+	var resp Response
+	at.Nil(json.Unmarshal(w.Body.Bytes(), &resp))
+	at.Equal(http.StatusNotFound, resp.Status)
+	at.Equal("stream live/movie not found", resp.Message)
+
+	w = apiRequest(s, http.MethodPost, "/api/v2/streams", "")
+	at.Equal(http.StatusMethodNotAllowed, w.Code)
+	at.Equal("GET", w.Header().Get("Allow"))
+
+	w = apiRequest(s, http.MethodDelete, "/api/v2/clients/nobody", "")
+	at.Equal(http.StatusNotFound, w.Code)
+
+	w = apiRequest(s, http.MethodGet, "/api/v2/nothing", "")
+	at.Equal(http.StatusNotFound, w.Code)
+}
+
+func TestAPIRelays(t *testing.T) {
+	at := assert.New(t)
+	saved := configure.RtmpServercfg
+	defer func() { configure.RtmpServercfg = saved }()
+	configure.RtmpServercfg = configure.ServerCfg{Server: []configure.Application{{Appname: "live", Liveon: "on"}}}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	stream := rtmp.NewRtmpStream()
+	go rtmp.NewRtmpServer(stream, nil).Serve(listener)
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	s := NewServer(stream, ":"+port)
+	local := "rtmp://127.0.0.1:" + port
+
+	w := apiRequest(s, http.MethodPost, "/api/v2/relays", `{"type":"sideways","app":"live","name":"movie","url":"rtmp://127.0.0.1:1/live/movie"}`)
+	at.Equal(http.StatusBadRequest, w.Code)
+	w = apiRequest(s, http.MethodPost, "/api/v2/relays", `{"type":"push"}`)
+	at.Equal(http.StatusBadRequest, w.Code)
+	w = apiRequest(s, http.MethodPost, "/api/v2/relays", `{`)
+	at.Equal(http.StatusBadRequest, w.Code)
+
+	w = apiRequest(s, http.MethodPost, "/api/v2/relays", `{"type":"push","app":"live","name":"movie","url":"http://127.0.0.1/live/copy"}`)
+	at.Equal(http.StatusBadRequest, w.Code)
+	w = apiRequest(s, http.MethodPost, "/api/v2/relays", `{"type":"push","app":"live","name":"movie","url":"rtmp://127.0.0.1/live"}`)
+	at.Equal(http.StatusBadRequest, w.Code)
+	w = apiRequest(s, http.MethodPost, "/api/v2/relays", `{"type":"push","app":"live","name":"movie","url":"rtmp://127.0.0.1:1/live/copy"}`)
+	at.Equal(http.StatusBadGateway, w.Code)
+	w = apiRequest(s, http.MethodGet, "/api/v2/relays", "")
+	at.Equal("[]", w.Body.String())
+
+	w = apiRequest(s, http.MethodPost, "/api/v2/relays", `{"type":"push","app":"live","name":"movie","url":"`+local+`/live/copy"}`)
+	at.Equal(http.StatusCreated, w.Code)
+	var r relay
+	at.Nil(json.Unmarshal(w.Body.Bytes(), &r))
+	at.Equal("push:live/movie", r.Key)
+	at.Equal(local+"/live/movie", r.PlayUrl)
+	at.Equal(local+"/live/copy", r.PublishUrl)
+
+	_, playurl, _, err := s.relayURLs("push", "live@media.example.com", "movie", local+"/live/copy")
+	at.Nil(err)
+	at.Equal(local+"/live/movie?vhost=media.example.com", playurl)
+
+	w = apiRequest(s, http.MethodGet, "/api/v2/relays", "")
+	at.Equal(http.StatusOK, w.Code)
+	var relays []relay
+	at.Nil(json.Unmarshal(w.Body.Bytes(), &relays))
+	at.Len(relays, 1)
+
+	w = apiRequest(s, http.MethodDelete, "/api/v2/relays/push:live/movie", "")
+	at.Equal(http.StatusNoContent, w.Code)
+	w = apiRequest(s, http.MethodDelete, "/api/v2/relays/push:live/movie", "")
+	at.Equal(http.StatusNotFound, w.Code)
+}
+
+func TestAPIFiles(t *testing.T) {
+	at := assert.New(t)
+	saved := configure.RtmpServercfg
+	defer func() { configure.RtmpServercfg = saved }()
+	configure.RtmpServercfg = configure.ServerCfg{Server: []configure.Application{
+		{Appname: "live", Liveon: "on"},
+	}}
+	stream := rtmp.NewRtmpStream()
+	s := NewServer(stream, ":1935")
+	body := `{"app":"live","name":"slate","file":"slate.flv","loop":true,"offset_ms":40}`
+	w := apiRequest(s, http.MethodPost, "/api/v2/files", body)
+	at.Equal(http.StatusForbidden, w.Code)
+
+	dir, err := ioutil.TempDir("", "files")
+	at.Nil(err)
+	defer os.RemoveAll(dir)
+	f, err := os.Create(filepath.Join(dir, "slate.flv"))
+	at.Nil(err)
+	fw := flv.NewFLVWriter("live", "slate", "", f)
+	for ts := uint32(0); ts < 1000; ts += 40 {
+		fw.Write(&av.Packet{IsVideo: true, TimeStamp: ts, Data: []byte{0x17, 1, 0, 0, 0, 0xff}})
+	}
+	fw.Close(nil)
+	s.SetFileDir(dir)
+
+	w = apiRequest(s, http.MethodPost, "/api/v2/files", `{"app":"live","name":"slate","file":"../slate.flv"}`)
+	at.Equal(http.StatusCreated, w.Code)
+	w = apiRequest(s, http.MethodPost, "/api/v2/files", `{"app":"live","name":"other","file":"missing.flv"}`)
+	at.Equal(http.StatusBadRequest, w.Code)
+	w = apiRequest(s, http.MethodPost, "/api/v2/files", `{"app":"live","name":"../slate","file":"slate.flv"}`)
+	at.Equal(http.StatusBadRequest, w.Code)
+	w = apiRequest(s, http.MethodPost, "/api/v2/files", `{"app":"live","name":"a/slate","file":"slate.flv"}`)
+	at.Equal(http.StatusBadRequest, w.Code)
+	w = apiRequest(s, http.MethodPost, "/api/v2/files", `{"app":"vod","name":"slate","file":"slate.flv"}`)
+	at.Equal(http.StatusForbidden, w.Code)
+	w = apiRequest(s, http.MethodPost, "/api/v2/files", body)
+	at.Equal(http.StatusCreated, w.Code)
+	at.Equal(`{"key":"live/slate","file":"slate.flv","loop":true,"offset_ms":40}`, w.Body.String())
+
+	w = apiRequest(s, http.MethodGet, "/api/v2/files", "")
+	at.Equal(`[{"key":"live/slate","file":"slate.flv","loop":true,"offset_ms":40}]`, w.Body.String())
+	stat, found := stream.Stat("live/slate")
+	at.True(found)
+	at.Equal("flv.FileReader", stat.Publisher.Type)
+
+	w = apiRequest(s, http.MethodDelete, "/api/v2/files/live/slate", "")
+	at.Equal(http.StatusNoContent, w.Code)
+	w = apiRequest(s, http.MethodDelete, "/api/v2/files/live/slate", "")
+	at.Equal(http.StatusNotFound, w.Code)
+	w = apiRequest(s, http.MethodGet, "/api/v2/files", "")
+	at.Equal("[]", w.Body.String())
+}
+
+func TestAPIApps(t *testing.T) {
+	at := assert.New(t)
+	saved := configure.RtmpServercfg
+	defer func() { configure.RtmpServercfg = saved }()
+	configure.RtmpServercfg = configure.ServerCfg{Server: []configure.Application{
+		{Appname: "live", Liveon: "on", Hlson: "on"},
+	}}
+	s := NewServer(rtmp.NewRtmpStream(), ":1935")
+
+	w := apiRequest(s, http.MethodGet, "/api/v2/apps", "")
+	at.Equal(http.StatusOK, w.Code)
+	var apps []apiApp
+	at.Nil(json.Unmarshal(w.Body.Bytes(), &apps))
+	at.Equal([]apiApp{{Name: "live", Live: true, Hls: true}}, apps)
+}
+
+func TestAPIOpenAPI(t *testing.T) {
+	at := assert.New(t)
+	s := NewServer(rtmp.NewRtmpStream(), ":1935")
+	w := apiRequest(s, http.MethodGet, "/api/v2/openapi.json", "")
+	at.Equal(http.StatusOK, w.Code)
+	var spec map[string]interface{}
+	at.Nil(json.Unmarshal(w.Body.Bytes(), &spec))
+	at.Contains(spec["paths"], "/api/v2/streams")
+}
+
+func TestMetrics(t *testing.T) {
+	at := assert.New(t)
+	s := NewServer(rtmp.NewRtmpStream(), ":1935")
+	w := httptest.NewRecorder()
+	s.GetMetrics(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	at.Equal(http.StatusOK, w.Code)
+	out := w.Body.String()
+	at.Contains(out, "# TYPE bomin_publishers gauge\n")
+	at.Contains(out, "# TYPE bomin_dropped_packets_total counter\n")
+	at.Contains(out, "bomin_rtmp_handshake_failures_total 0\n")
+	at.Contains(out, "# TYPE bomin_relay_reconnects_total counter\n")
+}
+
+func TestSSE(t *testing.T) {
+	at := assert.New(t)
+	rs := rtmp.NewRtmpStream()
+	s := NewServer(rs, ":1935")
+	rs.OnHealthEvent(s.events.publish)
+	ts := httptest.NewServer(http.HandlerFunc(s.serveAPI))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/api/v2/sse")
+	at.Nil(err)
+	defer resp.Body.Close()
+	at.Equal("text/event-stream", resp.Header.Get("Content-Type"))
+
+	r := bufio.NewReader(resp.Body)
+	readEvent := func() (string, string) {
+		var event, data string
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil || line == "\n" {
+				return event, data
+			}
+			if strings.HasPrefix(line, "event: ") {
+				event = strings.TrimSpace(line[7:])
+			} else if strings.HasPrefix(line, "data: ") {
+				data = strings.TrimSpace(line[6:])
+			}
+		}
+	}
+	event, data := readEvent()
+	at.Equal("streams", event)
+	at.Equal("[]", data)
+	event, data = readEvent()
+	at.Equal("relays", event)
+	at.Equal("[]", data)
+
+	// wait for the handler to subscribe before publishing
+	for i := 0; i < 100; i++ {
+		s.events.lock.Lock()
+		n := len(s.events.subs)
+		s.events.lock.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.events.publish(rtmp.HealthEvent{Key: "live/movie", Problem: rtmp.ProblemAudioGap, Active: true})
+	event, data = readEvent()
+	at.Equal("health", event)
+	var e rtmp.HealthEvent
+	at.Nil(json.Unmarshal([]byte(data), &e))
+	at.Equal("live/movie", e.Key)
+}
+
+func TestDashboard(t *testing.T) {
+	at := assert.New(t)
+	s := NewServer(rtmp.NewRtmpStream(), ":1935")
+	s.SetPlayAddrs(":7001", "")
+	w := httptest.NewRecorder()
+	s.GetDashboard(w, httptest.NewRequest(http.MethodGet, "/dashboard", nil))
+	at.Equal(http.StatusOK, w.Code)
+	at.Contains(w.Body.String(), `new EventSource("api/v2/sse")`)
+	// the client supplied names are never spliced into markup
+	at.NotContains(w.Body.String(), "innerHTML")
+
+	w = apiRequest(s, http.MethodGet, "/api/v2/endpoints", "")
+	at.Equal(`{"rtmp":":1935","httpflv":":7001"}`, w.Body.String())
+}
@@ -0,0 +1,261 @@
+package httpopera
+
+import (
+	"net/http"
+)
+
+//http://127.0.0.1:8090/dashboard
+func (s *Server) GetDashboard(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, http.MethodGet) {
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(dashboardHTML))
+}
+
+// dashboardHTML is the dashboard page. It only talks to the v2 API and
+// refreshes itself from /api/v2/sse. The API paths are relative so the page
+// also works with the handler mounted under a prefix. Everything the clients
+// name, stream keys, UIDs and errors, is set as text through the DOM, never
+// as markup. The page itself is compiled in, but the hls.js and flv.js
+// preview players are loaded from cdn.jsdelivr.net the first time a preview
+// is opened, so previews other than native HLS need the browser to reach it.
+const dashboardHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>bomin dashboard</title>
+<style>
+body { font-family: sans-serif; margin: 20px; color: #222; }
+h2 { margin-top: 28px; }
+table { border-collapse: collapse; width: 100%; }
+th, td { border-bottom: 1px solid #ddd; padding: 4px 8px; text-align: left; font-size: 14px; vertical-align: top; }
+th { background: #f4f4f4; }
+button { font-size: 12px; }
+.ok { color: #080; } .degraded { color: #c00; } .idle { color: #888; }
+.players { font-size: 12px; color: #555; }
+#status { float: right; font-size: 12px; }
+#preview { display: none; margin-top: 12px; }
+#preview video { width: 640px; max-width: 100%; background: #000; }
+#events { font-family: monospace; font-size: 12px; max-height: 200px; overflow-y: auto; }
+form input, form select { font-size: 13px; }
+</style>
+</head>
+<body>
+<span id="status">connecting...</span>
+<h1>bomin</h1>
+
+<h2>Streams</h2>
+<table>
+<thead><tr><th>Stream</th><th>Health</th><th>Video</th><th>Audio</th><th>Bitrate</th><th>Uptime</th><th>Publisher</th><th>Players</th><th></th></tr></thead>
+<tbody id="streams"></tbody>
+</table>
+<div id="preview"><div id="preview-title"></div><video id="video" controls autoplay muted></video><br><button onclick="closePreview()">close</button></div>
+
+<h2>Relays</h2>
+<table>
+<thead><tr><th>Relay</th><th>State</th><th>Play</th><th>Publish</th><th>Reconnects</th><th>Bytes in/out</th><th>Last error</th><th></th></tr></thead>
+<tbody id="relays"></tbody>
+</table>
+<form id="relay-form" onsubmit="startRelay(event)">
+<select id="relay-type"><option value="push">push</option><option value="pull">pull</option></select>
+<input id="relay-app" placeholder="app" value="live" size="8">
+<input id="relay-name" placeholder="name" size="12">
+<input id="relay-url" placeholder="rtmp://host/app/name" size="40">
+<button type="submit">start relay</button>
+</form>
+
+<h2>Health events</h2>
+<div id="events"></div>
+
+<script>
+var endpoints = {};
+var player = null;
+
+// el makes an element with the text and children given. The streams, UIDs
+// and errors come from the clients, they are only ever set as text.
+function el(tag, text, children) {
+  var e = document.createElement(tag);
+  if (text != null) { e.textContent = String(text); }
+  (children || []).forEach(function (c) { e.appendChild(c); });
+  return e;
+}
+
+function button(label, onclick) {
+  var b = el("button", label);
+  b.addEventListener("click", onclick);
+  return b;
+}
+
+function lines(texts) {
+  var nodes = [];
+  texts.forEach(function (t, i) {
+    if (i > 0) { nodes.push(el("br")); }
+    nodes.push(t instanceof Node ? t : document.createTextNode(t));
+  });
+  return nodes;
+}
+
+function fill(tbody, rows, columns, empty) {
+  tbody.textContent = "";
+  if (!rows.length) {
+    var td = el("td", empty);
+    td.colSpan = columns;
+    rows = [el("tr", null, [td])];
+  }
+  rows.forEach(function (r) { tbody.appendChild(r); });
+}
+
+function api(method, path, body) {
+  var opts = {method: method};
+  if (body) {
+    opts.headers = {"Content-Type": "application/json"};
+    opts.body = JSON.stringify(body);
+  }
+  return fetch("api/v2/" + path, opts).then(function (resp) {
+    if (resp.ok) { return; }
+    return resp.json().then(function (e) { alert(e.message); });
+  });
+}
+
+function port(addr) {
+  var i = addr.lastIndexOf(":");
+  return i < 0 ? addr : addr.substring(i + 1);
+}
+
+function playURL(addr, key, ext) {
+  return location.protocol + "//" + location.hostname + ":" + port(addr) + "/" + key + ext;
+}
+
+function duration(sec) {
+  var h = Math.floor(sec / 3600), m = Math.floor(sec / 60) % 60, s = sec % 60;
+  return (h ? h + "h" : "") + (h || m ? m + "m" : "") + s + "s";
+}
+
+function kick(uid) {
+  if (confirm("kick " + uid + "?")) { api("DELETE", "clients/" + encodeURIComponent(uid)); }
+}
+
+function renderStreams(streams) {
+  var rows = streams.map(function (s) {
+    var v = s.video, a = s.audio, h = s.health;
+    var video = v ? v.codec + " " + (v.width ? v.width + "x" + v.height : "") + " " + v.measured_fps.toFixed(1) + "fps" : "";
+    var audio = a ? a.codec + " " + (a.sample_rate || "") + (a.channels ? " " + a.channels + "ch" : "") : "";
+    var health = el("td", null, lines([h.state].concat(h.problems.map(function (p) { return p.detail; }))));
+    health.className = h.state;
+    var pub = el("td");
+    if (s.publisher) {
+      pub.appendChild(document.createTextNode(s.publisher.uid + " "));
+      pub.appendChild(button("kick", function () { kick(s.publisher.uid); }));
+    }
+    var players = el("td", null, lines([String(s.players.length)].concat(s.players.map(function (p) {
+      return el("span", p.type + " " + p.uid + (p.dropped ? " (" + p.dropped + " dropped)" : "") + " ",
+        [button("kick", function () { kick(p.uid); })]);
+    }))));
+    players.className = "players";
+    var preview = el("td");
+    if (s.publishing && endpoints.httpflv) {
+      preview.appendChild(button("FLV", function () { openPreview("flv", s.key); }));
+    }
+    if (s.publishing && endpoints.hls) {
+      preview.appendChild(button("HLS", function () { openPreview("hls", s.key); }));
+    }
+    return el("tr", null, [el("td", s.key), health, el("td", video), el("td", audio),
+      el("td", s.bitrate_kbps + " kbps"), el("td", s.publisher ? duration(s.uptime) : ""), pub, players, preview]);
+  });
+  fill(document.getElementById("streams"), rows, 9, "no streams");
+}
+
+function renderRelays(relays) {
+  var rows = relays.map(function (r) {
+    return el("tr", null, [el("td", r.key), el("td", r.state), el("td", r.play_url), el("td", r.publish_url),
+      el("td", r.reconnects), el("td", r.bytes_in + " / " + r.bytes_out), el("td", r.last_error),
+      el("td", null, [button("stop", function () { stopRelay(r.key); })])]);
+  });
+  fill(document.getElementById("relays"), rows, 8, "no relays");
+}
+
+function addEvent(e) {
+  var div = document.createElement("div");
+  div.textContent = new Date(e.time).toLocaleTimeString() + " " + e.key + " " + e.problem + " " +
+    (e.active ? "raised: " + e.detail : "cleared");
+  var box = document.getElementById("events");
+  box.insertBefore(div, box.firstChild);
+  while (box.childNodes.length > 100) { box.removeChild(box.lastChild); }
+}
+
+function startRelay(ev) {
+  ev.preventDefault();
+  api("POST", "relays", {
+    type: document.getElementById("relay-type").value,
+    app: document.getElementById("relay-app").value,
+    name: document.getElementById("relay-name").value,
+    url: document.getElementById("relay-url").value
+  });
+}
+
+function stopRelay(key) {
+  api("DELETE", "relays/" + encodeURIComponent(key));
+}
+
+function loadScript(src, done) {
+  var script = document.createElement("script");
+  script.src = src;
+  script.onload = done;
+  script.onerror = function () {
+    document.getElementById("preview-title").textContent = "cannot load the player from " + src;
+  };
+  document.head.appendChild(script);
+}
+
+function closePreview() {
+  if (player) { player.destroy(); player = null; }
+  var video = document.getElementById("video");
+  video.removeAttribute("src");
+  video.load();
+  document.getElementById("preview").style.display = "none";
+}
+
+function openPreview(kind, key) {
+  closePreview();
+  var video = document.getElementById("video");
+  document.getElementById("preview").style.display = "block";
+  document.getElementById("preview-title").textContent = kind.toUpperCase() + " " + key;
+  if (kind == "hls") {
+    var url = playURL(endpoints.hls, key, ".m3u8");
+    if (video.canPlayType("application/vnd.apple.mpegurl")) {
+      video.src = url;
+      return;
+    }
+    loadScript("https://cdn.jsdelivr.net/npm/hls.js@1", function () {
+      player = new Hls();
+      player.loadSource(url);
+      player.attachMedia(video);
+    });
+    return;
+  }
+  loadScript("https://cdn.jsdelivr.net/npm/flv.js@1/dist/flv.min.js", function () {
+    player = flvjs.createPlayer({type: "flv", isLive: true, url: playURL(endpoints.httpflv, key, ".flv")});
+    player.attachMediaElement(video);
+    player.load();
+    player.play();
+  });
+}
+
+function connect() {
+  var status = document.getElementById("status");
+  var source = new EventSource("api/v2/sse");
+  source.onopen = function () { status.textContent = "live"; };
+  source.onerror = function () { status.textContent = "reconnecting..."; };
+  source.addEventListener("streams", function (e) { renderStreams(JSON.parse(e.data)); });
+  source.addEventListener("relays", function (e) { renderRelays(JSON.parse(e.data)); });
+  source.addEventListener("health", function (e) { addEvent(JSON.parse(e.data)); });
+}
+
+fetch("api/v2/endpoints").then(function (r) { return r.json(); }).then(function (e) { endpoints = e; });
+fetch("api/v2/events").then(function (r) { return r.json(); }).then(function (events) { events.forEach(addEvent); });
+connect();
+</script>
+</body>
+</html>
+`
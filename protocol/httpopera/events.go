@@ -0,0 +1,115 @@
+package httpopera
+
+import (
+	"bomin/protocol/rtmp"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	sseInterval = 2 * time.Second
+	sseQueueNum = 64
+)
+
+// broadcaster passes health events on to the connected SSE clients. Clients
+// that fall behind miss events instead of blocking the publisher.
+type broadcaster struct {
+	lock sync.Mutex
+	subs map[chan rtmp.HealthEvent]struct{}
+}
+
+func newBroadcaster() *broadcaster {
+	return &broadcaster{subs: make(map[chan rtmp.HealthEvent]struct{})}
+}
+
+func (b *broadcaster) subscribe() chan rtmp.HealthEvent {
+	ch := make(chan rtmp.HealthEvent, sseQueueNum)
+	b.lock.Lock()
+	b.subs[ch] = struct{}{}
+	b.lock.Unlock()
+	return ch
+}
+
+func (b *broadcaster) unsubscribe(ch chan rtmp.HealthEvent) {
+	b.lock.Lock()
+	delete(b.subs, ch)
+	b.lock.Unlock()
+}
+
+func (b *broadcaster) publish(e rtmp.HealthEvent) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, event string, v interface{}) error {
+	data, _ := json.Marshal(v)
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data); err != nil {
+		return err
+	}
+	w.(http.Flusher).Flush()
+	return nil
+}
+
+// apiSSE streams Server-Sent Events: "streams" with the stream list every
+// couple of seconds, "relays" with the relay list alongside, and "health"
+// for every health event.
+func (s *Server) apiSSE(w http.ResponseWriter, req *http.Request, arg string) {
+	if !allowMethod(w, req, http.MethodGet) {
+		return
+	}
+	rtmpStream, ok := s.rtmpStream(w)
+	if !ok {
+		return
+	}
+	if _, ok := w.(http.Flusher); !ok {
+		writeError(w, http.StatusInternalServerError, "streaming not supported")
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	events := s.events.subscribe()
+	defer s.events.unsubscribe(events)
+	ticker := time.NewTicker(sseInterval)
+	defer ticker.Stop()
+
+	for {
+		stats := rtmpStream.Stats()
+		sort.Slice(stats, func(i, j int) bool { return stats[i].Key < stats[j].Key })
+		if writeEvent(w, "streams", stats) != nil {
+			return
+		}
+		relays := s.relays()
+		sort.Slice(relays, func(i, j int) bool { return relays[i].Key < relays[j].Key })
+		if writeEvent(w, "relays", relays) != nil {
+			return
+		}
+
+	wait:
+		for {
+			select {
+			case <-req.Context().Done():
+				return
+			case <-s.done:
+				return
+			case e := <-events:
+				if writeEvent(w, "health", e) != nil {
+					return
+				}
+			case <-ticker.C:
+				break wait
+			}
+		}
+	}
+}
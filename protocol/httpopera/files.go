@@ -0,0 +1,149 @@
+package httpopera
+
+import (
+	"bomin/av"
+	"bomin/configure"
+	"bomin/container/flv"
+	"encoding/json"
+	"net/http"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// apiFileRequest is the body of POST /api/v2/files, it publishes the FLV
+// file under the file directory as app/name.
+type apiFileRequest struct {
+	App      string `json:"app"`
+	Name     string `json:"name"`
+	File     string `json:"file"`
+	Loop     bool   `json:"loop"`
+	OffsetMs int64  `json:"offset_ms"`
+}
+
+type apiFile struct {
+	Key      string `json:"key"`
+	File     string `json:"file"`
+	Loop     bool   `json:"loop"`
+	OffsetMs int64  `json:"offset_ms"`
+}
+
+// SetFileDir lets the API publish the FLV files under dir, an empty dir
+// turns file publishing off.
+func (s *Server) SetFileDir(dir string) {
+	s.fileDir = dir
+}
+
+// SetGetter makes the streams published by the API muxed by getter too,
+// as the RTMP server does for its publishers.
+func (s *Server) SetGetter(getter av.GetWriter) {
+	s.getter = getter
+}
+
+func (s *Server) apiFiles(w http.ResponseWriter, req *http.Request, key string) {
+	switch {
+	case key == "" && req.Method == http.MethodGet:
+		writeJson(w, http.StatusOK, s.files())
+	case key == "" && req.Method == http.MethodPost:
+		if s.fileDir == "" {
+			writeError(w, http.StatusForbidden, "file publishing is disabled")
+			return
+		}
+		var r apiFileRequest
+		if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid body: %v", err)
+			return
+		}
+		if r.App == "" || r.Name == "" || r.File == "" || r.OffsetMs < 0 {
+			writeError(w, http.StatusBadRequest, "app, name and file are required")
+			return
+		}
+		if strings.Contains(r.Name, "/") || strings.Contains(r.Name, "..") {
+			writeError(w, http.StatusBadRequest, "invalid name %q", r.Name)
+			return
+		}
+		if !configure.CheckAppName(r.App) {
+			writeError(w, http.StatusForbidden, "application name=%s is not configured", r.App)
+			return
+		}
+		f, err := s.startFile(r.App+"/"+r.Name, r.File, flv.FileOptions{
+			Loop:   r.Loop,
+			Offset: time.Duration(r.OffsetMs) * time.Millisecond,
+		})
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+		writeJson(w, http.StatusCreated, f)
+	case key != "" && req.Method == http.MethodDelete:
+		if !s.stopFile(key) {
+			writeError(w, http.StatusNotFound, "file stream %s not found", key)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case key != "":
+		allowMethod(w, req, http.MethodDelete)
+	default:
+		allowMethod(w, req, http.MethodGet, http.MethodPost)
+	}
+}
+
+func fileStatus(key string, r *flv.FileReader, file string) apiFile {
+	opts := r.Options()
+	return apiFile{key, file, opts.Loop, int64(opts.Offset / time.Millisecond)}
+}
+
+func (s *Server) files() []apiFile {
+	s.fileLock.Lock()
+	defer s.fileLock.Unlock()
+	files := make([]apiFile, 0, len(s.fileReaders))
+	for key, r := range s.fileReaders {
+		rel, _ := filepath.Rel(s.fileDir, r.Name())
+		files = append(files, fileStatus(key, r, filepath.ToSlash(rel)))
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Key < files[j].Key })
+	return files
+}
+
+// startFile publishes file, relative to the file directory, as key. The
+// publisher of key, a file or not, is replaced.
+func (s *Server) startFile(key, file string, opts flv.FileOptions) (apiFile, error) {
+	// the file cannot be outside the directory
+	file = path.Clean("/" + file)[1:]
+	name := filepath.Join(s.fileDir, filepath.FromSlash(file))
+	r, err := flv.NewFileReader(key, name, opts)
+	if err != nil {
+		return apiFile{}, err
+	}
+	s.handler.HandleReader(r)
+	if s.getter != nil {
+		s.handler.HandleWriter(s.getter.GetWriter(r.Info()))
+	}
+
+	s.fileLock.Lock()
+	s.fileReaders[key] = r
+	s.fileLock.Unlock()
+	go func() {
+		<-r.Done()
+		s.fileLock.Lock()
+		if s.fileReaders[key] == r {
+			delete(s.fileReaders, key)
+		}
+		s.fileLock.Unlock()
+	}()
+	logger.With("key", key).Infof("publishing file %s", file)
+	return fileStatus(key, r, file), nil
+}
+
+func (s *Server) stopFile(key string) bool {
+	s.fileLock.Lock()
+	r, found := s.fileReaders[key]
+	delete(s.fileReaders, key)
+	s.fileLock.Unlock()
+	if found {
+		r.Close(nil)
+	}
+	return found
+}
@@ -2,16 +2,25 @@ package httpopera
 
 import (
 	"bomin/av"
+	"bomin/configure"
+	"bomin/container/flv"
+	"bomin/logging"
 	"bomin/protocol/rtmp"
 	"bomin/protocol/rtmp/rtmprelay"
+	"bomin/protocol/rtmp/transcode"
+	"bomin/utils/metrics"
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
 	"net"
 	"net/http"
+	neturl "net/url"
+	"strings"
+	"sync"
 )
 
+var logger = logging.New("api")
+
 type Response struct {
 	w       http.ResponseWriter
 	Status  int    `json:"status"`
@@ -44,23 +53,64 @@ type ClientInfo struct {
 }
 
 type Server struct {
-	handler  av.Handler
-	session  map[string]*rtmprelay.RtmpRelay
-	rtmpAddr string
+	handler     av.Handler
+	sessionLock sync.Mutex
+	session     map[string]*rtmprelay.RtmpRelay
+	rtmpAddr    string
+	flvAddr     string
+	hlsAddr     string
+	events      *broadcaster
+	done        chan struct{}
+	closeOnce   sync.Once
+
+	getter      av.GetWriter
+	fileDir     string
+	fileLock    sync.Mutex
+	fileReaders map[string]*flv.FileReader
+
+	transcoder *transcode.Supervisor
 }
 
 func NewServer(h av.Handler, rtmpAddr string) *Server {
-	return &Server{
+	s := &Server{
 		handler:  h,
 		session:  make(map[string]*rtmprelay.RtmpRelay),
 		rtmpAddr: rtmpAddr,
+		events:   newBroadcaster(),
+		done:     make(chan struct{}),
+
+		fileReaders: make(map[string]*flv.FileReader),
+	}
+	if rtmpStream, ok := h.(*rtmp.RtmpStream); ok {
+		rtmpStream.OnHealthEvent(s.events.publish)
 	}
+	return s
+}
+
+// SetTranscoder makes the API list the transcoding processes of t.
+func (s *Server) SetTranscoder(t *transcode.Supervisor) {
+	s.transcoder = t
+}
+
+// SetPlayAddrs tells the dashboard where the HTTP-FLV and HLS servers listen,
+// an empty address hides the matching preview.
+func (s *Server) SetPlayAddrs(flvAddr, hlsAddr string) {
+	s.flvAddr = flvAddr
+	s.hlsAddr = hlsAddr
 }
 
 func (s *Server) Serve(l net.Listener) error {
-	mux := http.NewServeMux()
+	http.Serve(l, s.Handler())
+	return nil
+}
 
+// Handler returns the handler of the management routes.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
 	mux.Handle("/statics", http.FileServer(http.Dir("statics")))
+	mux.HandleFunc("/dashboard", func(w http.ResponseWriter, r *http.Request) {
+		s.GetDashboard(w, r)
+	})
 
 	mux.HandleFunc("/control/push", func(w http.ResponseWriter, r *http.Request) {
 		s.handlePush(w, r)
@@ -71,18 +121,36 @@ func (s *Server) Serve(l net.Listener) error {
 	mux.HandleFunc("/stat/livestat", func(w http.ResponseWriter, r *http.Request) {
 		s.GetLiveStatics(w, r)
 	})
-	http.Serve(l, mux)
-	return nil
+	mux.HandleFunc("/stat/forwards", func(w http.ResponseWriter, r *http.Request) {
+		s.GetForwards(w, r)
+	})
+	mux.HandleFunc("/stat/relays", func(w http.ResponseWriter, r *http.Request) {
+		s.GetRelays(w, r)
+	})
+	mux.HandleFunc(apiPrefix, func(w http.ResponseWriter, r *http.Request) {
+		s.serveAPI(w, r)
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		s.GetMetrics(w, r)
+	})
+	return mux
 }
 
 type stream struct {
-	Key             string `json:"key"`
-	Url             string `json:"Url"`
-	StreamId        uint32 `json:"StreamId"`
-	VideoTotalBytes uint64 `json:123456`
-	VideoSpeed      uint64 `json:123456`
-	AudioTotalBytes uint64 `json:123456`
-	AudioSpeed      uint64 `json:123456`
+	Key             string  `json:"key"`
+	Url             string  `json:"Url"`
+	VideoTotalBytes uint64  `json:"VideoTotalBytes"`
+	AudioTotalBytes uint64  `json:"AudioTotalBytes"`
+	Bitrate         float64 `json:"Bitrate"` // kbit/s over 5s
+}
+
+func newStream(key string, c av.Closer) (stream, bool) {
+	counted, ok := c.(av.Counted)
+	if !ok {
+		return stream{}, false
+	}
+	counters := counted.Counters()
+	return stream{key, c.Info().URL, counters.VideoBytes, counters.AudioBytes, counters.Bitrate()}, true
 }
 
 type streams struct {
@@ -101,12 +169,8 @@ func (server *Server) GetLiveStatics(w http.ResponseWriter, req *http.Request) {
 	msgs := new(streams)
 	for item := range rtmpStream.GetStreams().IterBuffered() {
 		if s, ok := item.Val.(*rtmp.Stream); ok {
-			if s.GetReader() != nil {
-				switch s.GetReader().(type) {
-				case *rtmp.VirReader:
-					v := s.GetReader().(*rtmp.VirReader)
-					msg := stream{item.Key, v.Info().URL, v.ReadBWInfo.StreamId, v.ReadBWInfo.VideoDatainBytes, v.ReadBWInfo.VideoSpeedInBytesperMS,
-						v.ReadBWInfo.AudioDatainBytes, v.ReadBWInfo.AudioSpeedInBytesperMS}
+			if r := s.GetReader(); r != nil {
+				if msg, ok := newStream(item.Key, r); ok {
 					msgs.Publishers = append(msgs.Publishers, msg)
 				}
 			}
@@ -114,18 +178,9 @@ func (server *Server) GetLiveStatics(w http.ResponseWriter, req *http.Request) {
 	}
 
 	for item := range rtmpStream.GetStreams().IterBuffered() {
-		ws := item.Val.(*rtmp.Stream).GetWs()
-		for s := range ws.IterBuffered() {
-			if pw, ok := s.Val.(*rtmp.PackWriterCloser); ok {
-				if pw.GetWriter() != nil {
-					switch pw.GetWriter().(type) {
-					case *rtmp.VirWriter:
-						v := pw.GetWriter().(*rtmp.VirWriter)
-						msg := stream{item.Key, v.Info().URL, v.WriteBWInfo.StreamId, v.WriteBWInfo.VideoDatainBytes, v.WriteBWInfo.VideoSpeedInBytesperMS,
-							v.WriteBWInfo.AudioDatainBytes, v.WriteBWInfo.AudioSpeedInBytesperMS}
-						msgs.Players = append(msgs.Players, msg)
-					}
-				}
+		for _, pw := range item.Val.(*rtmp.Stream).GetWs() {
+			if msg, ok := newStream(item.Key, pw.GetWriter()); ok {
+				msgs.Players = append(msgs.Players, msg)
 			}
 		}
 	}
@@ -134,6 +189,135 @@ func (server *Server) GetLiveStatics(w http.ResponseWriter, req *http.Request) {
 	w.Write(resp)
 }
 
+//http://127.0.0.1:8090/stat/forwards
+func (server *Server) GetForwards(w http.ResponseWriter, req *http.Request) {
+	rtmpStream, ok := server.handler.(*rtmp.RtmpStream)
+	if !ok {
+		io.WriteString(w, "<h1>Get rtmp stream information error</h1>")
+		return
+	}
+	resp, _ := json.Marshal(rtmpStream.Forwards())
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resp)
+}
+
+type relay struct {
+	Key string `json:"key"`
+	rtmprelay.RelayStatus
+}
+
+//http://127.0.0.1:8090/metrics
+func (s *Server) GetMetrics(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	mw := metrics.NewWriter(w)
+	if rtmpStream, ok := s.handler.(*rtmp.RtmpStream); ok {
+		rtmpStream.WriteMetrics(mw)
+	}
+	mw.WriteRegistered()
+}
+
+//http://127.0.0.1:8090/stat/relays
+func (s *Server) GetRelays(w http.ResponseWriter, req *http.Request) {
+	resp, _ := json.Marshal(s.relays())
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resp)
+}
+
+func (s *Server) relays() []relay {
+	s.sessionLock.Lock()
+	defer s.sessionLock.Unlock()
+	relays := make([]relay, 0, len(s.session))
+	for key, r := range s.session {
+		relays = append(relays, relay{key, r.Status()})
+	}
+	return relays
+}
+
+func (s *Server) relayStatus(key string) rtmprelay.RelayStatus {
+	s.sessionLock.Lock()
+	defer s.sessionLock.Unlock()
+	if r, ok := s.session[key]; ok {
+		return r.Status()
+	}
+	return rtmprelay.RelayStatus{}
+}
+
+// localURL returns the URL of the local stream app/name, app being qualified
+// by its vhost, if any, as in the stream keys.
+func (s *Server) localURL(app, name string) string {
+	return "rtmp://127.0.0.1" + s.rtmpAddr + "/" + configure.StreamPath(app+"/"+name)
+}
+
+// relayURLs returns the session key and the play and publish URLs of a push
+// or pull relay between the local stream app/name and url.
+func (s *Server) relayURLs(kind, app, name, url string) (key, playurl, publishurl string, err error) {
+	if err := checkRelayURL(url); err != nil {
+		return "", "", "", err
+	}
+	localurl := s.localURL(app, name)
+	switch kind {
+	case "push":
+		return "push:" + app + "/" + name, localurl, url, nil
+	case "pull":
+		return "pull:" + app + "/" + name, url, localurl, nil
+	}
+	return "", "", "", fmt.Errorf("unknown relay type %q", kind)
+}
+
+// checkRelayURL checks that u is an rtmp://host/app/name URL.
+func checkRelayURL(u string) error {
+	parsed, err := neturl.Parse(u)
+	if err != nil {
+		return err
+	}
+	if parsed.Scheme != "rtmp" || parsed.Host == "" {
+		return fmt.Errorf("invalid url %q, rtmp://host/app/name expected", u)
+	}
+	if paths := strings.SplitN(strings.TrimLeft(parsed.Path, "/"), "/", 2); len(paths) != 2 || paths[0] == "" || paths[1] == "" {
+		return fmt.Errorf("invalid url %q, rtmp://host/app/name expected", u)
+	}
+	return nil
+}
+
+// startRelay starts a relay for key, replacing the one already running.
+func (s *Server) startRelay(key, playurl, publishurl string) error {
+	r := rtmprelay.NewRtmpRelay(&playurl, &publishurl)
+	if err := r.Start(); err != nil {
+		return err
+	}
+	s.sessionLock.Lock()
+	old, found := s.session[key]
+	s.session[key] = r
+	s.sessionLock.Unlock()
+	if found {
+		old.Stop()
+	}
+	return nil
+}
+
+func (s *Server) stopRelay(key string) bool {
+	s.sessionLock.Lock()
+	r, found := s.session[key]
+	delete(s.session, key)
+	s.sessionLock.Unlock()
+	if found {
+		r.Stop()
+	}
+	return found
+}
+
+// Close stops all relays and ends the event streams.
+func (s *Server) Close() {
+	s.closeOnce.Do(func() { close(s.done) })
+	s.sessionLock.Lock()
+	session := s.session
+	s.session = make(map[string]*rtmprelay.RtmpRelay)
+	s.sessionLock.Unlock()
+	for _, r := range session {
+		r.Stop()
+	}
+}
+
 //http://127.0.0.1:8090/control/push?&oper=start&app=live&name=123456&url=rtmp://192.168.16.136/live/123456
 func (s *Server) handlePull(w http.ResponseWriter, req *http.Request) {
 	var retString string
@@ -146,43 +330,35 @@ func (s *Server) handlePull(w http.ResponseWriter, req *http.Request) {
 	name := req.Form["name"]
 	url := req.Form["url"]
 
-	log.Printf("control pull: oper=%v, app=%v, name=%v, url=%v", oper, app, name, url)
 	if (len(app) <= 0) || (len(name) <= 0) || (len(url) <= 0) {
 		io.WriteString(w, "control push parameter error, please check them.</br>")
 		return
 	}
 
-	remoteurl := "rtmp://127.0.0.1" + s.rtmpAddr + "/" + app[0] + "/" + name[0]
+	remoteurl := s.localURL(app[0], name[0])
 	localurl := url[0]
 
 	keyString := "pull:" + app[0] + "/" + name[0]
-	if oper[0] == "stop" {
-		pullRtmprelay, found := s.session[keyString]
-
-		if !found {
+	rlog := logger.With("remote", req.RemoteAddr, "key", keyString)
+	if len(oper) > 0 && oper[0] == "stop" {
+		rlog.Info("stop relay")
+		if !s.stopRelay(keyString) {
 			retString = fmt.Sprintf("session key[%s] not exist, please check it again.", keyString)
 			io.WriteString(w, retString)
 			return
 		}
-		log.Printf("rtmprelay stop push %s from %s", remoteurl, localurl)
-		pullRtmprelay.Stop()
-
-		delete(s.session, keyString)
 		retString = fmt.Sprintf("<h1>push url stop %s ok</h1></br>", url[0])
 		io.WriteString(w, retString)
-		log.Printf("pull stop return %s", retString)
 	} else {
-		pullRtmprelay := rtmprelay.NewRtmpRelay(&localurl, &remoteurl)
-		log.Printf("rtmprelay start push %s from %s", remoteurl, localurl)
-		err = pullRtmprelay.Start()
+		rlog.Infof("start relay %s -> %s", localurl, remoteurl)
+		err = s.startRelay(keyString, localurl, remoteurl)
 		if err != nil {
 			retString = fmt.Sprintf("push error=%v", err)
 		} else {
-			s.session[keyString] = pullRtmprelay
 			retString = fmt.Sprintf("<h1>push url start %s ok</h1></br>", url[0])
 		}
 		io.WriteString(w, retString)
-		log.Printf("pull start return %s", retString)
+		rlog.Debugf("start relay: %s", retString)
 	}
 }
 
@@ -198,42 +374,35 @@ func (s *Server) handlePush(w http.ResponseWriter, req *http.Request) {
 	name := req.Form["name"]
 	url := req.Form["url"]
 
-	log.Printf("control push: oper=%v, app=%v, name=%v, url=%v", oper, app, name, url)
 	if (len(app) <= 0) || (len(name) <= 0) || (len(url) <= 0) {
 		io.WriteString(w, "control push parameter error, please check them.</br>")
 		return
 	}
 
-	localurl := "rtmp://127.0.0.1" + s.rtmpAddr + "/" + app[0] + "/" + name[0]
+	localurl := s.localURL(app[0], name[0])
 	remoteurl := url[0]
 
 	keyString := "push:" + app[0] + "/" + name[0]
-	if oper[0] == "stop" {
-		pushRtmprelay, found := s.session[keyString]
-		if !found {
+	rlog := logger.With("remote", req.RemoteAddr, "key", keyString)
+	if len(oper) > 0 && oper[0] == "stop" {
+		rlog.Info("stop relay")
+		if !s.stopRelay(keyString) {
 			retString = fmt.Sprintf("<h1>session key[%s] not exist, please check it again.</h1>", keyString)
 			io.WriteString(w, retString)
 			return
 		}
-		log.Printf("rtmprelay stop push %s from %s", remoteurl, localurl)
-		pushRtmprelay.Stop()
-
-		delete(s.session, keyString)
 		retString = fmt.Sprintf("<h1>push url stop %s ok</h1></br>", url[0])
 		io.WriteString(w, retString)
-		log.Printf("push stop return %s", retString)
 	} else {
-		pushRtmprelay := rtmprelay.NewRtmpRelay(&localurl, &remoteurl)
-		log.Printf("rtmprelay start push %s from %s", remoteurl, localurl)
-		err = pushRtmprelay.Start()
+		rlog.Infof("start relay %s -> %s", localurl, remoteurl)
+		err = s.startRelay(keyString, localurl, remoteurl)
 		if err != nil {
 			retString = fmt.Sprintf("push error=%v", err)
 		} else {
 			retString = fmt.Sprintf("<h1>push url start %s ok</h1></br>", url[0])
-			s.session[keyString] = pushRtmprelay
 		}
 
 		io.WriteString(w, retString)
-		log.Printf("push start return %s", retString)
+		rlog.Debugf("start relay: %s", retString)
 	}
 }
@@ -0,0 +1,279 @@
+package httpopera
+
+// openAPISpec describes the v2 management API, it is served at
+// /api/v2/openapi.json.
+const openAPISpec = `{
+  "openapi": "3.0.0",
+  "info": {"title": "bomin management API", "version": "2.0"},
+  "paths": {
+    "/api/v2/streams": {
+      "get": {
+        "summary": "List streams",
+        "responses": {"200": {"description": "streams", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Stream"}}}}}}
+      }
+    },
+    "/api/v2/streams/{app}/{name}": {
+      "get": {
+        "summary": "Get a stream",
+        "parameters": [
+          {"name": "app", "in": "path", "required": true, "schema": {"type": "string"}},
+          {"name": "name", "in": "path", "required": true, "schema": {"type": "string"}}
+        ],
+        "responses": {
+          "200": {"description": "stream", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Stream"}}}},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/api/v2/clients/{uid}": {
+      "delete": {
+        "summary": "Kick a publisher or player",
+        "parameters": [{"name": "uid", "in": "path", "required": true, "schema": {"type": "string"}}],
+        "responses": {"204": {"description": "kicked"}, "404": {"$ref": "#/components/responses/Error"}}
+      }
+    },
+    "/api/v2/relays": {
+      "get": {
+        "summary": "List relays",
+        "responses": {"200": {"description": "relays", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Relay"}}}}}}
+      },
+      "post": {
+        "summary": "Start a relay",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/RelayRequest"}}}},
+        "responses": {
+          "201": {"description": "relay started", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Relay"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "502": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/api/v2/relays/{id}": {
+      "delete": {
+        "summary": "Stop a relay",
+        "parameters": [{"name": "id", "in": "path", "required": true, "schema": {"type": "string"}, "example": "push:live/movie"}],
+        "responses": {"204": {"description": "stopped"}, "404": {"$ref": "#/components/responses/Error"}}
+      }
+    },
+    "/api/v2/files": {
+      "get": {
+        "summary": "List the files published",
+        "responses": {"200": {"description": "files", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/File"}}}}}}
+      },
+      "post": {
+        "summary": "Publish an FLV file from the file directory",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/FileRequest"}}}},
+        "responses": {
+          "201": {"description": "publishing", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/File"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/api/v2/files/{app}/{name}": {
+      "delete": {
+        "summary": "Stop publishing a file",
+        "parameters": [
+          {"name": "app", "in": "path", "required": true, "schema": {"type": "string"}},
+          {"name": "name", "in": "path", "required": true, "schema": {"type": "string"}}
+        ],
+        "responses": {"204": {"description": "stopped"}, "404": {"$ref": "#/components/responses/Error"}}
+      }
+    },
+    "/api/v2/forwards": {
+      "get": {
+        "summary": "List publish forwards",
+        "responses": {"200": {"description": "forwards", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Forward"}}}}}}
+      }
+    },
+    "/api/v2/transcodes": {
+      "get": {
+        "summary": "List the ffmpeg transcoding processes",
+        "responses": {"200": {"description": "transcodes", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Transcode"}}}}}}
+      }
+    },
+    "/api/v2/events": {
+      "get": {
+        "summary": "Recent stream health events, oldest first",
+        "responses": {"200": {"description": "events", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/HealthEvent"}}}}}}
+      }
+    },
+    "/api/v2/apps": {
+      "get": {
+        "summary": "List configured applications",
+        "responses": {"200": {"description": "apps", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/App"}}}}}}
+      }
+    }
+  },
+  "components": {
+    "responses": {
+      "Error": {"description": "error", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}}
+    },
+    "schemas": {
+      "Error": {
+        "type": "object",
+        "properties": {"status": {"type": "integer"}, "message": {"type": "string"}}
+      },
+      "Client": {
+        "type": "object",
+        "properties": {
+          "uid": {"type": "string"},
+          "url": {"type": "string"},
+          "type": {"type": "string"},
+          "bytes": {"type": "integer", "description": "media bytes, FLV tag bodies"},
+          "video_bytes": {"type": "integer"},
+          "audio_bytes": {"type": "integer"},
+          "packets": {"type": "integer"},
+          "frames": {"type": "integer", "description": "video frames, sequence headers aside"},
+          "dropped": {"type": "integer", "description": "packets dropped because the player could not keep up"},
+          "bitrates_kbps": {"type": "array", "items": {"type": "number"}, "minItems": 3, "maxItems": 3, "description": "bitrate averaged over the last 1s, 5s and 30s"},
+          "bitrate_kbps": {"type": "integer", "description": "bitrate averaged over the last 5s"}
+        }
+      },
+      "Video": {
+        "type": "object",
+        "properties": {
+          "codec": {"type": "string"},
+          "profile": {"type": "string"},
+          "level": {"type": "string"},
+          "width": {"type": "integer"},
+          "height": {"type": "integer"},
+          "frame_rate": {"type": "number", "description": "declared by the SPS or onMetaData"},
+          "measured_fps": {"type": "number"},
+          "bitrate_kbps": {"type": "integer"},
+          "keyframe_interval": {"type": "number", "description": "seconds"}
+        }
+      },
+      "Audio": {
+        "type": "object",
+        "properties": {
+          "codec": {"type": "string"},
+          "profile": {"type": "string"},
+          "sample_rate": {"type": "integer"},
+          "channels": {"type": "integer"},
+          "bitrate_kbps": {"type": "integer"}
+        }
+      },
+      "Stream": {
+        "type": "object",
+        "properties": {
+          "key": {"type": "string"},
+          "publishing": {"type": "boolean"},
+          "video": {"$ref": "#/components/schemas/Video"},
+          "audio": {"$ref": "#/components/schemas/Audio"},
+          "metadata": {"type": "object", "description": "plain onMetaData values"},
+          "health": {"$ref": "#/components/schemas/Health"},
+          "bitrate_kbps": {"type": "integer"},
+          "start_time": {"type": "string", "format": "date-time"},
+          "uptime": {"type": "integer", "description": "seconds"},
+          "publisher": {"$ref": "#/components/schemas/Client"},
+          "players": {"type": "array", "items": {"$ref": "#/components/schemas/Client"}}
+        }
+      },
+      "Health": {
+        "type": "object",
+        "properties": {
+          "state": {"type": "string", "enum": ["ok", "degraded", "idle"]},
+          "problems": {"type": "array", "items": {
+            "type": "object",
+            "properties": {
+              "name": {"type": "string", "enum": ["no_keyframe", "low_fps", "audio_gap", "timestamp_discontinuity", "low_bitrate"]},
+              "detail": {"type": "string"},
+              "since": {"type": "string", "format": "date-time"}
+            }
+          }}
+        }
+      },
+      "HealthEvent": {
+        "type": "object",
+        "properties": {
+          "key": {"type": "string"},
+          "time": {"type": "string", "format": "date-time"},
+          "problem": {"type": "string"},
+          "active": {"type": "boolean", "description": "true when raised, false when cleared"},
+          "detail": {"type": "string"}
+        }
+      },
+      "RelayRequest": {
+        "type": "object",
+        "required": ["type", "app", "name", "url"],
+        "properties": {
+          "type": {"type": "string", "enum": ["push", "pull"]},
+          "app": {"type": "string"},
+          "name": {"type": "string"},
+          "url": {"type": "string"}
+        }
+      },
+      "FileRequest": {
+        "type": "object",
+        "required": ["app", "name", "file"],
+        "properties": {
+          "app": {"type": "string"},
+          "name": {"type": "string"},
+          "file": {"type": "string", "description": "path in the file directory"},
+          "loop": {"type": "boolean"},
+          "offset_ms": {"type": "integer", "description": "start at the first key frame from there"}
+        }
+      },
+      "File": {
+        "type": "object",
+        "properties": {
+          "key": {"type": "string"},
+          "file": {"type": "string"},
+          "loop": {"type": "boolean"},
+          "offset_ms": {"type": "integer"}
+        }
+      },
+      "Relay": {
+        "type": "object",
+        "properties": {
+          "key": {"type": "string"},
+          "play_url": {"type": "string"},
+          "publish_url": {"type": "string"},
+          "state": {"type": "string", "enum": ["connecting", "running", "retrying", "stopped"]},
+          "reconnects": {"type": "integer"},
+          "bytes_in": {"type": "integer"},
+          "bytes_out": {"type": "integer"},
+          "last_error": {"type": "string"},
+          "since": {"type": "string", "format": "date-time"}
+        }
+      },
+      "Forward": {
+        "type": "object",
+        "properties": {
+          "key": {"type": "string"},
+          "url": {"type": "string"},
+          "state": {"type": "string", "enum": ["connecting", "running", "retrying", "stopped"]},
+          "reconnects": {"type": "integer"},
+          "bytes_sent": {"type": "integer"},
+          "dropped": {"type": "integer"},
+          "last_error": {"type": "string"},
+          "since": {"type": "string", "format": "date-time"}
+        }
+      },
+      "Transcode": {
+        "type": "object",
+        "properties": {
+          "key": {"type": "string"},
+          "output": {"type": "string"},
+          "state": {"type": "string", "enum": ["starting", "running", "retrying", "stopped"]},
+          "pid": {"type": "integer"},
+          "restarts": {"type": "integer"},
+          "last_error": {"type": "string"},
+          "since": {"type": "string", "format": "date-time"}
+        }
+      },
+      "App": {
+        "type": "object",
+        "properties": {
+          "name": {"type": "string"},
+          "live": {"type": "boolean"},
+          "hls": {"type": "boolean"},
+          "static_push": {"type": "array", "items": {"type": "string"}},
+          "forward_nodes": {"type": "array", "items": {"type": "string"}},
+          "edge_origins": {"type": "array", "items": {"type": "string"}}
+        }
+      }
+    }
+  }
+}
+`
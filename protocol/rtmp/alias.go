@@ -0,0 +1,35 @@
+package rtmp
+
+import (
+	"bomin/configure"
+	"errors"
+	"net/url"
+)
+
+// ErrReservedName refuses a publisher asking directly for a stream the
+// aliases or rewrites of the app map other names to.
+var ErrReservedName = errors.New("stream name only published through its alias")
+
+// KeyMapper returns the stream a client publishing, or playing, name in app
+// gets, e.g. the one an auth callback answered with for the query of the
+// client. It runs after the aliases and rewrites of the app.
+type KeyMapper func(app, name string, query url.Values, publish bool) string
+
+// SetKeyMapper adds m to the mapping of the stream names clients ask for.
+func (rs *RtmpStream) SetKeyMapper(m KeyMapper) {
+	rs.mapper = m
+}
+
+// MapName returns the stream a client publishing, or playing, name in app
+// with the query parameters query gets. It stays in app.
+func (rs *RtmpStream) MapName(app, name string, query url.Values, publish bool) (string, error) {
+	name, ok := configure.MapStreamName(app, name, publish)
+	if !ok {
+		rejected.With("reserved_name").Inc()
+		return "", ErrReservedName
+	}
+	if rs.mapper != nil {
+		name = rs.mapper(app, name, query, publish)
+	}
+	return name, nil
+}
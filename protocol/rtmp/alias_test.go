@@ -0,0 +1,153 @@
+package rtmp
+
+import (
+	"bomin/av"
+	"bomin/configure"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMapName(t *testing.T) {
+	at := assert.New(t)
+	saved := configure.RtmpServercfg
+	defer func() { configure.RtmpServercfg = saved }()
+	at.Nil(configure.SetConfig(configure.ServerCfg{Server: []configure.Application{
+		{Appname: "live", Liveon: "on",
+			Key_aliases: map[string]string{"8f3a6c": "channel1", "pub_b": "b"},
+			Key_rewrites: []configure.Rewrite{
+				{Match: "^pub_(.*)$", Replace: "$1"},
+				{Match: "^(.*)_hd$", Replace: "hd/$1"},
+			}},
+		{Appname: "alias", Liveon: "on", Key_aliases: map[string]string{"8f3a6c": "channel1"}},
+		{Appname: "fixed", Liveon: "on", Key_rewrites: []configure.Rewrite{{Match: "^secret$", Replace: "movie"}}},
+		{Appname: "open", Liveon: "on"},
+	}}))
+
+	rs := NewRtmpStream()
+	mapName := func(app, name string, query url.Values, publish bool) string {
+		mapped, err := rs.MapName(app, name, query, publish)
+		at.Nil(err)
+		return mapped
+	}
+	at.Equal("channel1", mapName("live", "8f3a6c", nil, true))
+	at.Equal("a", mapName("live", "pub_a", nil, true))
+	at.Equal("b", mapName("live", "pub_b", nil, true))
+	// the first matching rule wins
+	at.Equal("pub_a_hd", mapName("live", "pub_pub_a_hd", nil, true))
+	at.Equal("hd/a", mapName("live", "a_hd", nil, false))
+	at.Equal("8f3a6c", mapName("open", "8f3a6c", nil, true))
+
+	// players watch the target, the aliases are only for publishers
+	at.Equal("channel1", mapName("alias", "channel1", nil, false))
+	at.Equal("8f3a6c", mapName("alias", "8f3a6c", nil, false))
+	at.Equal("other", mapName("alias", "other", nil, true))
+
+	// nobody publishes the targets directly
+	_, err := rs.MapName("alias", "channel1", nil, true)
+	at.Equal(ErrReservedName, err)
+	_, err = rs.MapName("fixed", "movie", nil, true)
+	at.Equal(ErrReservedName, err)
+	at.Equal("movie", mapName("fixed", "movie", nil, false))
+	// the names the rewrites with groups give are not known in advance
+	at.Equal("movie", mapName("live", "movie", nil, true))
+
+	rs.SetKeyMapper(func(app, name string, query url.Values, publish bool) string {
+		if publish && query.Get("token") == "x" {
+			return "auth_" + name
+		}
+		return name
+	})
+	at.Equal("auth_channel1", mapName("live", "8f3a6c", url.Values{"token": {"x"}}, true))
+	at.Equal("channel1", mapName("live", "8f3a6c", nil, true))
+	at.Equal("a", mapName("live", "pub_a", url.Values{"token": {"x"}}, false))
+}
+
+func TestServerReservedName(t *testing.T) {
+	at := assert.New(t)
+	saved := configure.RtmpServercfg
+	defer func() { configure.RtmpServercfg = saved }()
+	configure.RtmpServercfg = configure.ServerCfg{Server: []configure.Application{
+		{Appname: "live", Liveon: "on", Key_aliases: map[string]string{"8f3a6c": "channel1"}},
+	}}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	rs := NewRtmpStream()
+	go NewRtmpServer(rs, nil).Serve(listener)
+
+	direct := NewRtmpClient(NewRtmpStream(), nil)
+	at.Nil(direct.Dial("rtmp://"+listener.Addr().String()+"/live/channel1", av.PUBLISH))
+	time.Sleep(100 * time.Millisecond)
+	at.Nil(rs.getStream("live/channel1"))
+
+	aliased := NewRtmpClient(NewRtmpStream(), nil)
+	at.Nil(aliased.Dial("rtmp://"+listener.Addr().String()+"/live/8f3a6c", av.PUBLISH))
+	deadline := time.Now().Add(time.Second)
+	for rs.getStream("live/channel1") == nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	at.NotNil(rs.getStream("live/channel1"))
+}
+
+func TestServerVhostQuery(t *testing.T) {
+	at := assert.New(t)
+	saved := configure.RtmpServercfg
+	defer func() { configure.RtmpServercfg = saved }()
+	configure.RtmpServercfg = configure.ServerCfg{Server: []configure.Application{
+		{Appname: "live", Liveon: "on"},
+		{Appname: "live", Vhost: "media.example.com", Liveon: "on",
+			Key_rewrites: []configure.Rewrite{{Match: "^secret$", Replace: "movie"}}},
+	}}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	rs := NewRtmpStream()
+	queries := make(chan url.Values, 1)
+	rs.SetKeyMapper(func(app, name string, query url.Values, publish bool) string {
+		queries <- query
+		return name
+	})
+	go NewRtmpServer(rs, nil).Serve(listener)
+
+	client := NewRtmpClient(NewRtmpStream(), nil)
+	at.Nil(client.Dial("rtmp://"+listener.Addr().String()+"/live/secret?vhost=media.example.com&token=x", av.PLAY))
+	select {
+	case query := <-queries:
+		at.Equal("x", query.Get("token"))
+	case <-time.After(time.Second):
+		t.Fatal("no mapping")
+	}
+
+	// the player is on the movie of the vhost's app
+	deadline := time.Now().Add(time.Second)
+	s := rs.getStream("live@media.example.com/movie")
+	for (s == nil || len(s.GetWs()) == 0) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		s = rs.getStream("live@media.example.com/movie")
+	}
+	if at.NotNil(s) && at.Len(s.GetWs(), 1) {
+		w := s.GetWs()[0].GetWriter()
+		info := w.Info()
+		at.Equal("live@media.example.com/movie", info.Key)
+		at.NotContains(info.URL, "token")
+		w.Close(nil)
+	}
+	at.Nil(rs.getStream("live/movie"))
+
+	// the app of the vhost is not reached through its name
+	client = NewRtmpClient(NewRtmpStream(), nil)
+	client.Dial("rtmp://"+listener.Addr().String()+"/live@media.example.com/secret", av.PLAY)
+	select {
+	case <-queries:
+		t.Fatal("qualified app accepted")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
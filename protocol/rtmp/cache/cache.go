@@ -2,12 +2,10 @@ package cache
 
 import (
 	"bomin/av"
-	"flag"
 )
 
-var (
-	gopNum = flag.Int("gopNum", 1, "gop num")
-)
+// DefaultGopNum is the number of GOPs cached for new players by default.
+const DefaultGopNum = 1
 
 type Cache struct {
 	gop      *GopCache
@@ -16,18 +14,20 @@ type Cache struct {
 	metadata *SpecialCache
 }
 
-func NewCache() *Cache {
+func NewCache(gopNum int) *Cache {
 	return &Cache{
-		gop:      NewGopCache(*gopNum),
+		gop:      NewGopCache(gopNum),
 		videoSeq: NewSpecialCache(),
 		audioSeq: NewSpecialCache(),
 		metadata: NewSpecialCache(),
 	}
 }
 
-func (cache *Cache) Write(p av.Packet) {
+// Write keeps p, retained, if new players need it. p must not be modified
+// afterwards.
+func (cache *Cache) Write(p *av.Packet) {
 	if p.IsMetadata {
-		cache.metadata.Write(&p)
+		cache.metadata.Write(p)
 		return
 	} else {
 		if !p.IsVideo {
@@ -35,7 +35,7 @@ func (cache *Cache) Write(p av.Packet) {
 			if ok {
 				if ah.SoundFormat() == av.SOUND_AAC &&
 					ah.AACPacketType() == av.AAC_SEQHDR {
-					cache.audioSeq.Write(&p)
+					cache.audioSeq.Write(p)
 					return
 				} else {
 					return
@@ -46,7 +46,7 @@ func (cache *Cache) Write(p av.Packet) {
 			vh, ok := p.Header.(av.VideoPacketHeader)
 			if ok {
 				if vh.IsSeq() {
-					cache.videoSeq.Write(&p)
+					cache.videoSeq.Write(p)
 					return
 				}
 			} else {
@@ -55,7 +55,7 @@ func (cache *Cache) Write(p av.Packet) {
 
 		}
 	}
-	cache.gop.Write(&p)
+	cache.gop.Write(p)
 }
 
 func (cache *Cache) Send(w av.WriteCloser) error {
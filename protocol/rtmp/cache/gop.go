@@ -24,6 +24,9 @@ func newArray() *array {
 }
 
 func (array *array) reset() {
+	for _, packet := range array.packets {
+		packet.Release()
+	}
 	array.index = 0
 	array.packets = array.packets[:0]
 }
@@ -32,6 +35,7 @@ func (array *array) write(packet *av.Packet) error {
 	if array.index >= maxGOPCap {
 		return ErrGopTooBig
 	}
+	packet.Retain()
 	array.packets = append(array.packets, packet)
 	array.index++
 	return nil
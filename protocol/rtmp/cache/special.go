@@ -34,6 +34,10 @@ func NewSpecialCache() *SpecialCache {
 }
 
 func (specialCache *SpecialCache) Write(p *av.Packet) {
+	p.Retain()
+	if specialCache.p != nil {
+		specialCache.p.Release()
+	}
 	specialCache.p = p
 	specialCache.full = true
 }
@@ -16,22 +16,27 @@ type ChunkStream struct {
 	StreamID  uint32
 	timeDelta uint32
 	exted     bool
+	extTime   uint32
+	inited    bool
 	index     uint32
 	remain    uint32
 	got       bool
 	tmpFromat uint32
 	Data      []byte
+	// Buffer holds Data once read, the reader of the message owns it.
+	Buffer *pool.Buffer
 }
 
 func (chunkStream *ChunkStream) full() bool {
 	return chunkStream.got
 }
 
-func (chunkStream *ChunkStream) new(pool *pool.Pool) {
+func (chunkStream *ChunkStream) new() {
 	chunkStream.got = false
 	chunkStream.index = 0
 	chunkStream.remain = chunkStream.Length
-	chunkStream.Data = pool.Get(int(chunkStream.Length))
+	chunkStream.Buffer = pool.Get(int(chunkStream.Length))
+	chunkStream.Data = chunkStream.Buffer.Bytes()
 }
 
 func (chunkStream *ChunkStream) writeHeader(w *ReadWriter) error {
@@ -119,18 +124,10 @@ func (chunkStream *ChunkStream) writeChunk(w *ReadWriter, chunkSize int) error {
 
 }
 
-func (chunkStream *ChunkStream) readChunk(r *ReadWriter, chunkSize uint32, pool *pool.Pool) error {
+func (chunkStream *ChunkStream) readChunk(r *ReadWriter, chunkSize, maxSize uint32) error {
 	if chunkStream.remain != 0 && chunkStream.tmpFromat != 3 {
 		return fmt.Errorf("inlaid remin = %d", chunkStream.remain)
 	}
-	switch chunkStream.CSID {
-	case 0:
-		id, _ := r.ReadUintLE(1)
-		chunkStream.CSID = id + 64
-	case 1:
-		id, _ := r.ReadUintLE(2)
-		chunkStream.CSID = id + 64
-	}
 
 	switch chunkStream.tmpFromat {
 	case 0:
@@ -141,11 +138,13 @@ func (chunkStream *ChunkStream) readChunk(r *ReadWriter, chunkSize uint32, pool
 		chunkStream.StreamID, _ = r.ReadUintLE(4)
 		if chunkStream.Timestamp == 0xffffff {
 			chunkStream.Timestamp, _ = r.ReadUintBE(4)
+			chunkStream.extTime = chunkStream.Timestamp
 			chunkStream.exted = true
 		} else {
 			chunkStream.exted = false
 		}
-		chunkStream.new(pool)
+		chunkStream.timeDelta = 0
+		chunkStream.inited = true
 	case 1:
 		chunkStream.Format = chunkStream.tmpFromat
 		timeStamp, _ := r.ReadUintBE(3)
@@ -153,58 +152,78 @@ func (chunkStream *ChunkStream) readChunk(r *ReadWriter, chunkSize uint32, pool
 		chunkStream.TypeID, _ = r.ReadUintBE(1)
 		if timeStamp == 0xffffff {
 			timeStamp, _ = r.ReadUintBE(4)
+			chunkStream.extTime = timeStamp
 			chunkStream.exted = true
 		} else {
 			chunkStream.exted = false
 		}
 		chunkStream.timeDelta = timeStamp
 		chunkStream.Timestamp += timeStamp
-		chunkStream.new(pool)
+		chunkStream.inited = true
 	case 2:
+		if !chunkStream.inited {
+			return fmt.Errorf("csid=%d format=2 without previous header", chunkStream.CSID)
+		}
 		chunkStream.Format = chunkStream.tmpFromat
 		timeStamp, _ := r.ReadUintBE(3)
 		if timeStamp == 0xffffff {
 			timeStamp, _ = r.ReadUintBE(4)
+			chunkStream.extTime = timeStamp
 			chunkStream.exted = true
 		} else {
 			chunkStream.exted = false
 		}
 		chunkStream.timeDelta = timeStamp
 		chunkStream.Timestamp += timeStamp
-		chunkStream.new(pool)
 	case 3:
+		if !chunkStream.inited {
+			return fmt.Errorf("csid=%d format=3 without previous header", chunkStream.CSID)
+		}
 		if chunkStream.remain == 0 {
+			// A type 3 chunk starting a new message repeats the extended
+			// timestamp field of the preceding header: an absolute timestamp
+			// after type 0, a delta after type 1 or 2.
 			switch chunkStream.Format {
 			case 0:
 				if chunkStream.exted {
-					timestamp, _ := r.ReadUintBE(4)
-					chunkStream.Timestamp = timestamp
+					chunkStream.Timestamp, _ = r.ReadUintBE(4)
+					chunkStream.extTime = chunkStream.Timestamp
 				}
 			case 1, 2:
 				var timedet uint32
 				if chunkStream.exted {
 					timedet, _ = r.ReadUintBE(4)
+					chunkStream.extTime = timedet
 				} else {
 					timedet = chunkStream.timeDelta
 				}
 				chunkStream.Timestamp += timedet
 			}
-			chunkStream.new(pool)
-		} else {
-			if chunkStream.exted {
-				b, err := r.Peek(4)
-				if err != nil {
-					return err
-				}
-				tmpts := binary.BigEndian.Uint32(b)
-				if tmpts == chunkStream.Timestamp {
-					r.Discard(4)
-				}
+		} else if chunkStream.exted {
+			// Continuation chunks should carry the extended timestamp too,
+			// but some encoders omit it, so only skip it when it matches.
+			b, err := r.Peek(4)
+			if err != nil {
+				return err
+			}
+			if binary.BigEndian.Uint32(b) == chunkStream.extTime {
+				r.Discard(4)
 			}
 		}
 	default:
 		return fmt.Errorf("invalid format=%d", chunkStream.Format)
 	}
+	if err := r.ReadError(); err != nil {
+		return err
+	}
+
+	if chunkStream.remain == 0 {
+		if maxSize > 0 && chunkStream.Length > maxSize {
+			return fmt.Errorf("csid=%d message length=%d exceeds max=%d", chunkStream.CSID, chunkStream.Length, maxSize)
+		}
+		chunkStream.new()
+	}
+
 	size := int(chunkStream.remain)
 	if size > int(chunkSize) {
 		size = int(chunkSize)
@@ -222,3 +241,14 @@ func (chunkStream *ChunkStream) readChunk(r *ReadWriter, chunkSize uint32, pool
 
 	return r.readError
 }
+
+// abort discards a partially received message, as requested by an Abort
+// Message from the peer.
+func (chunkStream *ChunkStream) abort() {
+	chunkStream.got = false
+	chunkStream.index = 0
+	chunkStream.remain = 0
+	chunkStream.Data = nil
+	chunkStream.Buffer.Release()
+	chunkStream.Buffer = nil
+}
@@ -1,7 +1,6 @@
 package core
 
 import (
-	"bomin/utils/pool"
 	"bytes"
 	"github.com/stretchr/testify/assert"
 	"testing"
@@ -29,7 +28,7 @@ func TestChunkRead1(t *testing.T) {
 		h, _ := rw.ReadUintBE(1)
 		chunkinc.tmpFromat = h >> 6
 		chunkinc.CSID = h & 0x3f
-		chunkinc.readChunk(rw, 128, pool.NewPool())
+		chunkinc.readChunk(rw, 128, 0)
 		if chunkinc.remain == 0 {
 			break
 		}
@@ -57,17 +56,17 @@ func TestChunkRead1(t *testing.T) {
 	h, _ := rw.ReadUintBE(1)
 	chunkinc.tmpFromat = h >> 6
 	chunkinc.CSID = h & 0x3f
-	chunkinc.readChunk(rw, 128, pool.NewPool())
+	chunkinc.readChunk(rw, 128, 0)
 
 	h, _ = rw.ReadUintBE(1)
 	chunkinc.tmpFromat = h >> 6
 	chunkinc.CSID = h & 0x3f
-	chunkinc.readChunk(rw, 128, pool.NewPool())
+	chunkinc.readChunk(rw, 128, 0)
 
 	h, _ = rw.ReadUintBE(1)
 	chunkinc.tmpFromat = h >> 6
 	chunkinc.CSID = h & 0x3f
-	chunkinc.readChunk(rw, 128, pool.NewPool())
+	chunkinc.readChunk(rw, 128, 0)
 
 	at.Equal(int(chunkinc.Length), 307)
 	at.Equal(int(chunkinc.TypeID), 9)
@@ -1,13 +1,23 @@
 package core
 
 import (
+	"bomin/logging"
 	"bomin/utils/pio"
-	"bomin/utils/pool"
 	"encoding/binary"
+	"fmt"
 	"net"
 	"time"
 )
 
+const (
+	// defaultMaxMessageSize bounds a single reassembled message; the 24 bit
+	// length field would otherwise let a peer make us allocate 16MB per csid.
+	defaultMaxMessageSize = 8 * 1024 * 1024
+	maxChunkSize          = 0x7fffffff
+)
+
+var logger = logging.New("rtmp")
+
 const (
 	_                     = iota
 	idSetChunkSize
@@ -26,8 +36,9 @@ type Conn struct {
 	remoteWindowAckSize uint32
 	received            uint32
 	ackReceived         uint32
+	maxMessageSize      uint32
+	handshakeTimeout    time.Duration
 	rw                  *ReadWriter
-	pool                *pool.Pool
 	chunks              map[uint32]ChunkStream
 }
 
@@ -38,46 +49,80 @@ func NewConn(c net.Conn, bufferSize int) *Conn {
 		remoteChunkSize:     128,
 		windowAckSize:       2500000,
 		remoteWindowAckSize: 2500000,
-		pool:                pool.NewPool(),
+		maxMessageSize:      defaultMaxMessageSize,
+		handshakeTimeout:    DefaultHandshakeTimeout,
 		rw:                  NewReadWriter(c, bufferSize),
 		chunks:              make(map[uint32]ChunkStream),
 	}
 }
 
+// readBasicHeader reads the chunk basic header, including the 2 and 3 byte
+// forms used for chunk stream ids 64-65599.
+func (conn *Conn) readBasicHeader() (format uint32, csid uint32, err error) {
+	h, err := conn.rw.ReadUintBE(1)
+	if err != nil {
+		return
+	}
+	format = h >> 6
+	csid = h & 0x3f
+	switch csid {
+	case 0:
+		var id uint32
+		if id, err = conn.rw.ReadUintLE(1); err != nil {
+			return
+		}
+		csid = id + 64
+	case 1:
+		var id uint32
+		if id, err = conn.rw.ReadUintLE(2); err != nil {
+			return
+		}
+		csid = id + 64
+	}
+	return
+}
+
 func (conn *Conn) Read(c *ChunkStream) error {
 	for {
-		h, _ := conn.rw.ReadUintBE(1)
-		// if err != nil {
-		// 	log.Println("read from conn error: ", err)
-		// 	return err
-		// }
-		format := h >> 6
-		csid := h & 0x3f
+		format, csid, err := conn.readBasicHeader()
+		if err != nil {
+			return err
+		}
 		cs, ok := conn.chunks[csid]
 		if !ok {
 			cs = ChunkStream{}
-			conn.chunks[csid] = cs
 		}
 		cs.tmpFromat = format
 		cs.CSID = csid
-		err := cs.readChunk(conn.rw, conn.remoteChunkSize, conn.pool)
-		if err != nil {
+		if err := cs.readChunk(conn.rw, conn.remoteChunkSize, conn.maxMessageSize); err != nil {
 			return err
 		}
-		conn.chunks[csid] = cs
 		if cs.full() {
 			*c = cs
+			// the message and its buffer go to the caller
+			cs.Data = nil
+			cs.Buffer = nil
+			conn.chunks[csid] = cs
 			break
 		}
+		conn.chunks[csid] = cs
 	}
 
-	conn.handleControlMsg(c)
+	if err := conn.handleControlMsg(c); err != nil {
+		return err
+	}
 
 	conn.ack(c.Length)
 
 	return nil
 }
 
+// SetMaxMessageSize sets the largest message the peer may send, 0 disables
+// the check.
+func (conn *Conn) SetMaxMessageSize(size uint32) {
+	conn.maxMessageSize = size
+}
+
 func (conn *Conn) Write(c *ChunkStream) error {
 	if c.TypeID == idSetChunkSize {
 		conn.chunkSize = binary.BigEndian.Uint32(c.Data)
@@ -123,12 +168,33 @@ func (conn *Conn) NewSetPeerBandwidth(size uint32) ChunkStream {
 	return ret
 }
 
-func (conn *Conn) handleControlMsg(c *ChunkStream) {
-	if c.TypeID == idSetChunkSize {
-		conn.remoteChunkSize = binary.BigEndian.Uint32(c.Data)
-	} else if c.TypeID == idWindowAckSize {
-		conn.remoteWindowAckSize = binary.BigEndian.Uint32(c.Data)
+func (conn *Conn) handleControlMsg(c *ChunkStream) error {
+	switch c.TypeID {
+	case idSetChunkSize, idAbortMessage, idWindowAckSize:
+		if len(c.Data) < 4 {
+			return fmt.Errorf("control message type=%d length=%d invalid", c.TypeID, len(c.Data))
+		}
+	default:
+		return nil
 	}
+
+	value := binary.BigEndian.Uint32(c.Data)
+	switch c.TypeID {
+	case idSetChunkSize:
+		// the most significant bit must be zero
+		if value == 0 || value > maxChunkSize {
+			return fmt.Errorf("invalid chunk size=%d", value)
+		}
+		conn.remoteChunkSize = value
+	case idAbortMessage:
+		if cs, ok := conn.chunks[value]; ok {
+			cs.abort()
+			conn.chunks[value] = cs
+		}
+	case idWindowAckSize:
+		conn.remoteWindowAckSize = value
+	}
+	return nil
 }
 
 func (conn *Conn) ack(size uint32) {
@@ -197,6 +263,14 @@ func (conn *Conn) SetBegin() {
 	conn.Write(&ret)
 }
 
+func (conn *Conn) SetEOF() {
+	ret := conn.userControlMsg(streamEOF, 4)
+	for i := 0; i < 4; i++ {
+		ret.Data[2+i] = byte(1 >> uint32((3-i)*8) & 0xff)
+	}
+	conn.Write(&ret)
+}
+
 func (conn *Conn) SetRecorded() {
 	ret := conn.userControlMsg(streamIsRecorded, 4)
 	for i := 0; i < 4; i++ {
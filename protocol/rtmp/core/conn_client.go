@@ -2,12 +2,12 @@ package core
 
 import (
 	"bomin/av"
+	"bomin/logging"
 	"bomin/protocol/amf"
 	"bytes"
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"math/rand"
 	"net"
 	neturl "net/url"
@@ -42,11 +42,13 @@ type ConnClient struct {
 	encoder    *amf.Encoder
 	decoder    *amf.Decoder
 	bytesw     *bytes.Buffer
+	log        logging.Logger
 }
 
 func NewConnClient() *ConnClient {
 	return &ConnClient{
 		transID: 1,
+		log:     logger,
 		bytesw:  bytes.NewBuffer(nil),
 		encoder: &amf.Encoder{},
 		decoder: &amf.Decoder{},
@@ -73,7 +75,7 @@ func (connClient *ConnClient) readRespMsg() error {
 			r := bytes.NewReader(rc.Data)
 			vs, _ := connClient.decoder.DecodeBatch(r, amf.AMF0)
 
-			log.Printf("readRespMsg: vs=%v", vs)
+			connClient.log.Tracef("%s response: %v", connClient.curcmdName, vs)
 			for k, v := range vs {
 				switch v.(type) {
 				case string:
@@ -156,7 +158,7 @@ func (connClient *ConnClient) writeConnectMsg() error {
 	event["tcUrl"] = connClient.tcurl
 	connClient.curcmdName = cmdConnect
 
-	log.Printf("writeConnectMsg: connClient.transID=%d, event=%v", connClient.transID, event)
+	connClient.log.Tracef("connect: transID=%d, event=%v", connClient.transID, event)
 	if err := connClient.writeMsg(cmdConnect, connClient.transID, event); err != nil {
 		return err
 	}
@@ -167,7 +169,7 @@ func (connClient *ConnClient) writeCreateStreamMsg() error {
 	connClient.transID++
 	connClient.curcmdName = cmdCreateStream
 
-	log.Printf("writeCreateStreamMsg: connClient.transID=%d", connClient.transID)
+	connClient.log.Tracef("createStream: transID=%d", connClient.transID)
 	if err := connClient.writeMsg(cmdCreateStream, connClient.transID, nil); err != nil {
 		return err
 	}
@@ -179,17 +181,25 @@ func (connClient *ConnClient) writeCreateStreamMsg() error {
 		}
 
 		if err == ErrFail {
-			log.Println("writeCreateStreamMsg readRespMsg err=%v", err)
 			return err
 		}
 	}
 
 }
 
+// streamName returns the name to publish or play, with the query of the URL
+// for the server to check.
+func (connClient *ConnClient) streamName() string {
+	if connClient.query == "" {
+		return connClient.title
+	}
+	return connClient.title + "?" + connClient.query
+}
+
 func (connClient *ConnClient) writePublishMsg() error {
 	connClient.transID++
 	connClient.curcmdName = cmdPublish
-	if err := connClient.writeMsg(cmdPublish, connClient.transID, nil, connClient.title, publishLive); err != nil {
+	if err := connClient.writeMsg(cmdPublish, connClient.transID, nil, connClient.streamName(), publishLive); err != nil {
 		return err
 	}
 	return connClient.readRespMsg()
@@ -198,10 +208,9 @@ func (connClient *ConnClient) writePublishMsg() error {
 func (connClient *ConnClient) writePlayMsg() error {
 	connClient.transID++
 	connClient.curcmdName = cmdPlay
-	log.Printf("writePlayMsg: connClient.transID=%d, cmdPlay=%v, connClient.title=%v",
-		connClient.transID, cmdPlay, connClient.title)
+	connClient.log.Tracef("play: transID=%d, title=%v", connClient.transID, connClient.title)
 
-	if err := connClient.writeMsg(cmdPlay, 0, nil, connClient.title); err != nil {
+	if err := connClient.writeMsg(cmdPlay, 0, nil, connClient.streamName()); err != nil {
 		return err
 	}
 	return connClient.readRespMsg()
@@ -233,10 +242,9 @@ func (connClient *ConnClient) Start(url string, method string) error {
 		}
 		port = ":" + port
 	}
+	connClient.log = logger.With("url", url)
 	ips, err := net.LookupIP(host)
-	log.Printf("ips: %v, host: %v", ips, host)
 	if err != nil {
-		log.Println(err)
 		return err
 	}
 	remoteIP = ips[rand.Intn(len(ips))].String()
@@ -246,41 +254,32 @@ func (connClient *ConnClient) Start(url string, method string) error {
 
 	local, err := net.ResolveTCPAddr("tcp", localIP)
 	if err != nil {
-		log.Println(err)
 		return err
 	}
-	log.Println("remoteIP: ", remoteIP)
 	remote, err := net.ResolveTCPAddr("tcp", remoteIP)
 	if err != nil {
-		log.Println(err)
 		return err
 	}
 	conn, err := net.DialTCP("tcp", local, remote)
 	if err != nil {
-		log.Println(err)
 		return err
 	}
 
-	log.Println("connection:", "local:", conn.LocalAddr(), "remote:", conn.RemoteAddr())
+	connClient.log = connClient.log.With("remote", conn.RemoteAddr())
+	connClient.log.Debugf("connected from %v", conn.LocalAddr())
 
 	connClient.conn = NewConn(conn, 4*1024)
 
-	log.Println("HandshakeClient....")
 	if err := connClient.conn.HandshakeClient(); err != nil {
 		return err
 	}
-
-	log.Println("writeConnectMsg....")
 	if err := connClient.writeConnectMsg(); err != nil {
 		return err
 	}
-	log.Println("writeCreateStreamMsg....")
 	if err := connClient.writeCreateStreamMsg(); err != nil {
-		log.Println("writeCreateStreamMsg error", err)
 		return err
 	}
 
-	log.Println("method control:", method, av.PUBLISH, av.PLAY)
 	if method == av.PUBLISH {
 		if err := connClient.writePublishMsg(); err != nil {
 			return err
@@ -321,6 +320,14 @@ func (connClient *ConnClient) GetInfo() (app string, name string, url string) {
 	return
 }
 
+// RemoteAddr returns the address of the server, nil before Start.
+func (connClient *ConnClient) RemoteAddr() net.Addr {
+	if connClient.conn == nil {
+		return nil
+	}
+	return connClient.conn.RemoteAddr()
+}
+
 func (connClient *ConnClient) GetStreamId() uint32 {
 	return connClient.streamid
 }
@@ -2,12 +2,15 @@ package core
 
 import (
 	"bomin/av"
+	"bomin/logging"
 	"bomin/protocol/amf"
 	"bytes"
 	"errors"
+	"fmt"
 	"io"
-
-	"log"
+	"net"
+	"net/url"
+	"strings"
 )
 
 var (
@@ -20,6 +23,10 @@ var (
 	ErrReq = errors.New("req error")
 )
 
+// maxConnectMessages bounds the messages a client may send before it
+// publishes or plays.
+const maxConnectMessages = 128
+
 var (
 	cmdConnect       = "connect"
 	cmdFcpublish     = "FCPublish"
@@ -69,9 +76,18 @@ type ConnServer struct {
 	transactionID int
 	ConnInfo      ConnectInfo
 	PublishInfo   PublishInfo
-	decoder       *amf.Decoder
-	encoder       *amf.Encoder
-	bytesw        *bytes.Buffer
+	// Vhost is the host name of tcUrl, or its vhost parameter, and Query
+	// the parameters of tcUrl, the app and the stream name, split off them.
+	// Internal is set for the clients of the server itself.
+	Vhost        string
+	Query        url.Values
+	Internal     bool
+	playCSID     uint32
+	playStreamID uint32
+	decoder      *amf.Decoder
+	encoder      *amf.Encoder
+	bytesw       *bytes.Buffer
+	log          logging.Logger
 }
 
 func NewConnServer(conn *Conn) *ConnServer {
@@ -81,6 +97,7 @@ func NewConnServer(conn *Conn) *ConnServer {
 		bytesw:   bytes.NewBuffer(nil),
 		decoder:  &amf.Decoder{},
 		encoder:  &amf.Encoder{},
+		log:      logger.With("remote", conn.RemoteAddr()),
 	}
 }
 
@@ -131,6 +148,11 @@ func (connServer *ConnServer) connect(vs []interface{}) error {
 			}
 		}
 	}
+	connServer.ConnInfo.App = connServer.splitQuery(connServer.ConnInfo.App)
+	if u, err := url.Parse(connServer.ConnInfo.TcUrl); err == nil {
+		connServer.Vhost = u.Hostname()
+		connServer.addQuery(u.Query())
+	}
 	return nil
 }
 
@@ -174,6 +196,33 @@ func (connServer *ConnServer) createStream(vs []interface{}) error {
 	return nil
 }
 
+// splitQuery returns s without its query, whose parameters it adds to the
+// query of the connection.
+func (connServer *ConnServer) splitQuery(s string) string {
+	pos := strings.Index(s, "?")
+	if pos < 0 {
+		return s
+	}
+	if q, err := url.ParseQuery(s[pos+1:]); err == nil {
+		connServer.addQuery(q)
+	}
+	return s[:pos]
+}
+
+// addQuery sets the parameters of q on the query of the connection, the
+// vhost parameter replacing the host of tcUrl.
+func (connServer *ConnServer) addQuery(q url.Values) {
+	if connServer.Query == nil {
+		connServer.Query = make(url.Values)
+	}
+	for k, v := range q {
+		connServer.Query[k] = v
+	}
+	if vhost := q.Get("vhost"); vhost != "" {
+		connServer.Vhost = vhost
+	}
+}
+
 func (connServer *ConnServer) createStreamResp(cur *ChunkStream) error {
 	return connServer.writeMsg(cur.CSID, cur.StreamID, "_result", connServer.transactionID, nil, connServer.streamID)
 }
@@ -193,6 +242,7 @@ func (connServer *ConnServer) publishOrPlay(vs []interface{}) error {
 		case amf.Object:
 		}
 	}
+	connServer.PublishInfo.Name = connServer.splitQuery(connServer.PublishInfo.Name)
 
 	return nil
 }
@@ -240,6 +290,19 @@ func (connServer *ConnServer) playResp(cur *ChunkStream) error {
 	return connServer.conn.Flush()
 }
 
+// UnpublishNotify tells a player that the stream has ended.
+func (connServer *ConnServer) UnpublishNotify() error {
+	event := make(amf.Object)
+	event["level"] = "status"
+	event["code"] = "NetStream.Play.UnpublishNotify"
+	event["description"] = "Stream is now unpublished."
+	if err := connServer.writeMsg(connServer.playCSID, connServer.playStreamID, "onStatus", 0, nil, event); err != nil {
+		return err
+	}
+	connServer.conn.SetEOF()
+	return connServer.conn.Flush()
+}
+
 func (connServer *ConnServer) handleCmdMsg(c *ChunkStream) error {
 	amfType := amf.AMF0
 	if c.TypeID == 17 {
@@ -287,6 +350,8 @@ func (connServer *ConnServer) handleCmdMsg(c *ChunkStream) error {
 			}
 			connServer.done = true
 			connServer.isPublisher = false
+			connServer.playCSID = c.CSID
+			connServer.playStreamID = c.StreamID
 			//log.Println("handle play req done")
 		case cmdFcpublish:
 			connServer.fcPublish(vs)
@@ -295,7 +360,7 @@ func (connServer *ConnServer) handleCmdMsg(c *ChunkStream) error {
 		case cmdFCUnpublish:
 		case cmdDeleteStream:
 		default:
-			log.Println("no support command=", vs[0].(string))
+			connServer.log.Debugf("unsupported command %s", vs[0].(string))
 		}
 	}
 
@@ -304,7 +369,10 @@ func (connServer *ConnServer) handleCmdMsg(c *ChunkStream) error {
 
 func (connServer *ConnServer) ReadMsg() error {
 	var c ChunkStream
-	for {
+	for n := 0; ; n++ {
+		if n == maxConnectMessages {
+			return fmt.Errorf("no publish or play after %d messages", n)
+		}
 		if err := connServer.conn.Read(&c); err != nil {
 			return err
 		}
@@ -348,10 +416,19 @@ func (connServer *ConnServer) Read(c *ChunkStream) (err error) {
 func (connServer *ConnServer) GetInfo() (app string, name string, url string) {
 	app = connServer.ConnInfo.App
 	name = connServer.PublishInfo.Name
-	url = connServer.ConnInfo.TcUrl + "/" + connServer.PublishInfo.Name
+	url = connServer.ConnInfo.TcUrl
+	if pos := strings.Index(url, "?"); pos >= 0 {
+		url = url[:pos]
+	}
+	url = strings.TrimRight(url, "/") + "/" + connServer.PublishInfo.Name
 	return
 }
 
+// RemoteAddr returns the address of the client.
+func (connServer *ConnServer) RemoteAddr() net.Addr {
+	return connServer.conn.RemoteAddr()
+}
+
 func (connServer *ConnServer) Close(err error) {
 	connServer.conn.Close()
 }
@@ -0,0 +1,39 @@
+package core
+
+import (
+	"bomin/protocol/amf"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConnServerQuery(t *testing.T) {
+	at := assert.New(t)
+	connServer := &ConnServer{}
+	at.Nil(connServer.connect([]interface{}{float64(1), amf.Object{
+		"app":   "live?token=a",
+		"tcUrl": "rtmp://Media.Example.com:1935/live?token=a&tenant=t1",
+	}}))
+	at.Equal("live", connServer.ConnInfo.App)
+	at.Equal("Media.Example.com", connServer.Vhost)
+
+	at.Nil(connServer.publishOrPlay([]interface{}{float64(2), nil, "movie?token=b", "live"}))
+	app, name, URL := connServer.GetInfo()
+	at.Equal("live", app)
+	at.Equal("movie", name)
+	at.Equal("rtmp://Media.Example.com:1935/live/movie", URL)
+	at.Equal(url.Values{"token": {"b"}, "tenant": {"t1"}}, connServer.Query)
+
+	// a vhost parameter stands for the host
+	connServer = &ConnServer{}
+	at.Nil(connServer.connect([]interface{}{float64(1), amf.Object{
+		"app":   "live",
+		"tcUrl": "rtmp://10.0.0.1/live/",
+	}}))
+	at.Equal("10.0.0.1", connServer.Vhost)
+	at.Nil(connServer.publishOrPlay([]interface{}{float64(2), nil, "movie?vhost=media.example.com"}))
+	at.Equal("media.example.com", connServer.Vhost)
+	_, _, URL = connServer.GetInfo()
+	at.Equal("rtmp://10.0.0.1/live/movie", URL)
+}
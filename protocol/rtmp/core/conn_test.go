@@ -1,7 +1,6 @@
 package core
 
 import (
-	"bomin/utils/pool"
 	"bytes"
 	"github.com/stretchr/testify/assert"
 	"io"
@@ -21,7 +20,6 @@ func TestConnReadNormal(t *testing.T) {
 	data = append(data, 0xc6)
 	data = append(data, data2...)
 	conn := &Conn{
-		pool:                pool.NewPool(),
 		rw:                  NewReadWriter(bytes.NewBuffer(data), 1024),
 		remoteChunkSize:     128,
 		windowAckSize:       2500000,
@@ -67,7 +65,6 @@ func TestConnCrossReading(t *testing.T) {
 	videoData = append(videoData, data2...)
 
 	conn := &Conn{
-		pool:                pool.NewPool(),
 		rw:                  NewReadWriter(bytes.NewBuffer(videoData), 1024),
 		remoteChunkSize:     128,
 		windowAckSize:       2500000,
@@ -105,7 +102,6 @@ func TestSetChunksizeForWrite(t *testing.T) {
 	buf := bytes.NewBuffer(nil)
 	rw := NewReadWriter(buf, 1024)
 	conn := &Conn{
-		pool:                pool.NewPool(),
 		rw:                  rw,
 		chunkSize:           128,
 		remoteChunkSize:     128,
@@ -157,7 +153,6 @@ func TestSetChunksize(t *testing.T) {
 	data = append(data, data2...)
 	rw := NewReadWriter(bytes.NewBuffer(data), 1024)
 	conn := &Conn{
-		pool:                pool.NewPool(),
 		rw:                  rw,
 		chunkSize:           128,
 		remoteChunkSize:     128,
@@ -205,7 +200,6 @@ func TestConnWrite(t *testing.T) {
 	wr := bytes.NewBuffer(nil)
 	readWriter := NewReadWriter(wr, 128)
 	conn := &Conn{
-		pool:                pool.NewPool(),
 		rw:                  readWriter,
 		chunkSize:           128,
 		remoteChunkSize:     128,
@@ -248,3 +242,229 @@ func TestConnWrite(t *testing.T) {
 	conn.Flush()
 	at.Equal(wr.Bytes(), []byte{0x4, 0x0, 0x0, 0xa0, 0x0, 0x0, 0x4, 0x8, 0x0, 0x0, 0x0, 0x0, 0x1, 0x2, 0x3, 0x4})
 }
+
+func newReadConn(data []byte) *Conn {
+	return &Conn{
+		rw:                  NewReadWriter(bytes.NewBuffer(data), 1024),
+		chunkSize:           128,
+		remoteChunkSize:     128,
+		windowAckSize:       2500000,
+		remoteWindowAckSize: 2500000,
+		maxMessageSize:      defaultMaxMessageSize,
+		chunks:              make(map[uint32]ChunkStream),
+	}
+}
+
+func TestConnReadExtendedCSID(t *testing.T) {
+	at := assert.New(t)
+	// 2 byte basic header: csid = 64 + 10
+	data := []byte{0x00, 0x0a, 0x00, 0x00, 0x00, 0x00, 0x00, 0x03, 0x09, 0x01, 0x00, 0x00, 0x00, 0x01, 0x02, 0x03}
+	// 3 byte basic header: csid = 64 + 0x0102
+	data = append(data, 0x01, 0x02, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0x08, 0x01, 0x00, 0x00, 0x00, 0x04, 0x05)
+	conn := newReadConn(data)
+
+	var c ChunkStream
+	err := conn.Read(&c)
+	at.Equal(err, nil)
+	at.Equal(int(c.CSID), 74)
+	at.Equal(c.Data, []byte{0x01, 0x02, 0x03})
+
+	err = conn.Read(&c)
+	at.Equal(err, nil)
+	at.Equal(int(c.CSID), 64+0x0102)
+	at.Equal(int(c.TypeID), 8)
+	at.Equal(c.Data, []byte{0x04, 0x05})
+
+	err = conn.Read(&c)
+	at.Equal(err, io.EOF)
+}
+
+func TestConnReadTruncatedHeader(t *testing.T) {
+	at := assert.New(t)
+	conn := newReadConn([]byte{0x06, 0x00, 0x00})
+	var c ChunkStream
+	err := conn.Read(&c)
+	at.NotEqual(err, nil)
+
+	// 2 byte basic header cut after the first byte
+	conn = newReadConn([]byte{0x00})
+	err = conn.Read(&c)
+	at.Equal(err, io.EOF)
+}
+
+func TestConnReadExtendedTimestampType3(t *testing.T) {
+	at := assert.New(t)
+	data1 := make([]byte, 128)
+	// type 1 header with an extended timestamp delta of 0x01000000
+	data := []byte{0x46, 0xff, 0xff, 0xff, 0x00, 0x01, 0x00, 0x09, 0x01, 0x00, 0x00, 0x00}
+	data = append(data, data1...)
+	// continuation chunk repeating the extended delta
+	data = append(data, 0xc6, 0x01, 0x00, 0x00, 0x00)
+	data = append(data, data1...)
+	// new message on a type 3 header, the delta is applied again
+	data = append(data, 0xc6, 0x01, 0x00, 0x00, 0x00)
+	data = append(data, data1...)
+	data = append(data, 0xc6, 0x01, 0x00, 0x00, 0x00)
+	data = append(data, data1...)
+	conn := newReadConn(data)
+	// the stream needs a type 0 header first
+	conn.chunks[6] = ChunkStream{inited: true, StreamID: 1}
+
+	var c ChunkStream
+	err := conn.Read(&c)
+	at.Equal(err, nil)
+	at.Equal(len(c.Data), 256)
+	at.Equal(c.Timestamp, uint32(0x01000000))
+
+	err = conn.Read(&c)
+	at.Equal(err, nil)
+	at.Equal(len(c.Data), 256)
+	at.Equal(c.Timestamp, uint32(0x02000000))
+}
+
+func TestConnReadWithoutPreviousHeader(t *testing.T) {
+	at := assert.New(t)
+	conn := newReadConn([]byte{0xc6, 0x00, 0x00, 0x00})
+	var c ChunkStream
+	err := conn.Read(&c)
+	at.NotEqual(err, nil)
+
+	conn = newReadConn([]byte{0x86, 0x00, 0x00, 0x28})
+	err = conn.Read(&c)
+	at.NotEqual(err, nil)
+}
+
+func TestConnReadAbortMessage(t *testing.T) {
+	at := assert.New(t)
+	data1 := make([]byte, 128)
+	// first chunk of a 200 byte video message on csid 6
+	data := []byte{0x06, 0x00, 0x00, 0x00, 0x00, 0x00, 0xc8, 0x09, 0x01, 0x00, 0x00, 0x00}
+	data = append(data, data1...)
+	// abort message for csid 6
+	data = append(data, 0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x04, 0x02, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x06)
+	// a fresh 3 byte message on csid 6
+	data = append(data, 0x06, 0x00, 0x00, 0x00, 0x00, 0x00, 0x03, 0x09, 0x01, 0x00, 0x00, 0x00, 0x07, 0x08, 0x09)
+	conn := newReadConn(data)
+
+	var c ChunkStream
+	err := conn.Read(&c)
+	at.Equal(err, nil)
+	at.Equal(int(c.TypeID), idAbortMessage)
+
+	err = conn.Read(&c)
+	at.Equal(err, nil)
+	at.Equal(int(c.CSID), 6)
+	at.Equal(c.Data, []byte{0x07, 0x08, 0x09})
+}
+
+func TestConnReadMaxMessageSize(t *testing.T) {
+	at := assert.New(t)
+	data := []byte{0x06, 0x00, 0x00, 0x00, 0x00, 0x01, 0x33, 0x09, 0x01, 0x00, 0x00, 0x00}
+	data = append(data, make([]byte, 128)...)
+	conn := newReadConn(data)
+	conn.SetMaxMessageSize(256)
+
+	var c ChunkStream
+	err := conn.Read(&c)
+	at.NotEqual(err, nil)
+}
+
+func TestConnReadInvalidChunkSize(t *testing.T) {
+	at := assert.New(t)
+	conn := newReadConn([]byte{0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x04, 0x01, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00})
+	var c ChunkStream
+	err := conn.Read(&c)
+	at.NotEqual(err, nil)
+
+	conn = newReadConn([]byte{0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0x01, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x01})
+	err = conn.Read(&c)
+	at.NotEqual(err, nil)
+}
+
+func FuzzConnRead(f *testing.F) {
+	f.Add([]byte{0x06, 0x00, 0x00, 0x00, 0x00, 0x00, 0x03, 0x09, 0x01, 0x00, 0x00, 0x00, 0x01, 0x02, 0x03})
+	f.Add([]byte{0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x04, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01})
+	f.Add([]byte{0x01, 0xff, 0xff, 0x06, 0xff, 0xff, 0xff, 0x00, 0x00, 0x02, 0x08, 0x01, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x05, 0xaa, 0xbb})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		conn := newReadConn(data)
+		conn.SetMaxMessageSize(64 * 1024)
+		var c ChunkStream
+		for i := 0; i < 64; i++ {
+			if err := conn.Read(&c); err != nil {
+				return
+			}
+			if uint32(len(c.Data)) != c.Length {
+				t.Fatalf("message length=%d, got %d bytes", c.Length, len(c.Data))
+			}
+		}
+	})
+}
+
+func TestConnReadBuffer(t *testing.T) {
+	at := assert.New(t)
+	data := []byte{0x06, 0x00, 0x00, 0x00, 0x00, 0x00, 0x03, 0x09, 0x01, 0x00, 0x00, 0x00, 0x07, 0x08, 0x09}
+	conn := newReadConn(data)
+
+	var c ChunkStream
+	at.Nil(conn.Read(&c))
+	// the message owns its buffer, the connection reads the next one into
+	// another
+	at.NotNil(c.Buffer)
+	at.Equal(c.Buffer.Bytes(), c.Data)
+	at.Nil(conn.chunks[6].Buffer)
+	at.Nil(conn.chunks[6].Data)
+	c.Buffer.Release()
+}
+
+// loopReader reads data over and over, and discards what is written.
+type loopReader struct {
+	data []byte
+	r    *bytes.Reader
+}
+
+func (l *loopReader) Read(b []byte) (int, error) {
+	if l.r.Len() == 0 {
+		l.r.Reset(l.data)
+	}
+	return l.r.Read(b)
+}
+
+func (l *loopReader) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func BenchmarkConnRead(b *testing.B) {
+	var data bytes.Buffer
+	w := &Conn{rw: NewReadWriter(&data, 1024), chunkSize: 128}
+	video := ChunkStream{Format: 0, CSID: 6, TypeID: 9, StreamID: 1, Length: 4000, Data: make([]byte, 4000)}
+	if err := w.Write(&video); err != nil {
+		b.Fatal(err)
+	}
+	w.Flush()
+
+	for _, release := range []bool{true, false} {
+		name := "released"
+		if !release {
+			name = "garbage"
+		}
+		b.Run(name, func(b *testing.B) {
+			conn := newReadConn(nil)
+			conn.rw = NewReadWriter(&loopReader{data: data.Bytes(), r: bytes.NewReader(nil)}, 1024)
+			var c ChunkStream
+			b.ReportAllocs()
+			b.SetBytes(int64(video.Length))
+			for i := 0; i < b.N; i++ {
+				if err := conn.Read(&c); err != nil {
+					b.Fatal(err)
+				}
+				if release {
+					c.Buffer.Release()
+				}
+			}
+		})
+	}
+}
@@ -11,9 +11,8 @@ import (
 	"time"
 )
 
-var (
-	timeout = 5 * time.Second
-)
+// DefaultHandshakeTimeout bounds the whole handshake of a new connection.
+const DefaultHandshakeTimeout = 5 * time.Second
 
 var (
 	hsClientFullKey = []byte{
@@ -95,6 +94,17 @@ func hsCreate2(p []byte, key []byte) {
 	copy(p[gap:], digest)
 }
 
+// SetHandshakeTimeout bounds the whole handshake, 0 does not.
+func (conn *Conn) SetHandshakeTimeout(d time.Duration) {
+	conn.handshakeTimeout = d
+}
+
+func (conn *Conn) setHandshakeDeadline() {
+	if conn.handshakeTimeout > 0 {
+		conn.Conn.SetDeadline(time.Now().Add(conn.handshakeTimeout))
+	}
+}
+
 func (conn *Conn) HandshakeClient() (err error) {
 	var random [(1 + 1536*2) * 2]byte
 
@@ -107,17 +117,15 @@ func (conn *Conn) HandshakeClient() (err error) {
 
 	C0[0] = 3
 	// > C0C1
-	conn.Conn.SetDeadline(time.Now().Add(timeout))
+	conn.setHandshakeDeadline()
 	if _, err = conn.rw.Write(C0C1); err != nil {
 		return
 	}
-	conn.Conn.SetDeadline(time.Now().Add(timeout))
 	if err = conn.rw.Flush(); err != nil {
 		return
 	}
 
 	// < S0S1S2
-	conn.Conn.SetDeadline(time.Now().Add(timeout))
 	if _, err = io.ReadFull(conn.rw, S0S1S2); err != nil {
 		return
 	}
@@ -130,7 +138,6 @@ func (conn *Conn) HandshakeClient() (err error) {
 	}
 
 	// > C2
-	conn.Conn.SetDeadline(time.Now().Add(timeout))
 	if _, err = conn.rw.Write(C2); err != nil {
 		return
 	}
@@ -154,11 +161,10 @@ func (conn *Conn) HandshakeServer() (err error) {
 	S2 := S0S1S2[1536+1:]
 
 	// < C0C1
-	conn.Conn.SetDeadline(time.Now().Add(timeout))
+	conn.setHandshakeDeadline()
 	if _, err = io.ReadFull(conn.rw, C0C1); err != nil {
 		return
 	}
-	conn.Conn.SetDeadline(time.Now().Add(timeout))
 	if C0[0] != 3 {
 		err = fmt.Errorf("rtmp: handshake version=%d invalid", C0[0])
 		return
@@ -186,17 +192,14 @@ func (conn *Conn) HandshakeServer() (err error) {
 	}
 
 	// > S0S1S2
-	conn.Conn.SetDeadline(time.Now().Add(timeout))
 	if _, err = conn.rw.Write(S0S1S2); err != nil {
 		return
 	}
-	conn.Conn.SetDeadline(time.Now().Add(timeout))
 	if err = conn.rw.Flush(); err != nil {
 		return
 	}
 
 	// < C2
-	conn.Conn.SetDeadline(time.Now().Add(timeout))
 	if _, err = io.ReadFull(conn.rw, C2); err != nil {
 		return
 	}
@@ -0,0 +1,184 @@
+package rtmp
+
+import (
+	"bomin/av"
+	"bomin/configure"
+	"bomin/logging"
+	"bomin/utils/hashring"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultEdgeGrace = 30 * time.Second
+	edgeCheckPeriod  = time.Second
+)
+
+var ErrNoOrigin = errors.New("no origin available")
+
+// Puller is implemented by the edge: Pull makes sure the stream key is being
+// pulled from an origin and reports whether it can be, every call also counts
+// as viewer activity on the stream.
+type Puller interface {
+	Pull(key string) bool
+}
+
+type edgePull struct {
+	key        string
+	origin     string
+	lastActive time.Time
+	log        logging.Logger
+}
+
+// Edge pulls streams that have no local publisher from the origins configured
+// for their application. A pull is shared by all local viewers of the key and
+// is torn down once the last viewer has been gone for the grace period.
+type Edge struct {
+	stream *RtmpStream
+	getter av.GetWriter
+	Grace  time.Duration
+	// ReadTimeout closes a pull that receives nothing for that long.
+	ReadTimeout time.Duration
+
+	lock  sync.Mutex
+	rings map[string]*edgeRing // by app
+	pulls map[string]*edgePull
+}
+
+// edgeRing is the consistent hash ring of the origins of an app.
+type edgeRing struct {
+	origins string // the origin list it was built from
+	ring    *hashring.Ring
+}
+
+func NewEdge(stream *RtmpStream, getter av.GetWriter) *Edge {
+	return &Edge{
+		stream:      stream,
+		getter:      getter,
+		Grace:       defaultEdgeGrace,
+		ReadTimeout: DefaultReadTimeout,
+		rings:       make(map[string]*edgeRing),
+		pulls:       make(map[string]*edgePull),
+	}
+}
+
+// origins returns the origins for key, the consistent hash owner first and
+// the rest in failover order.
+func (e *Edge) origins(key string) []string {
+	app := strings.SplitN(key, "/", 2)[0]
+	list, ok := configure.GetEdgeOriginList(app)
+	if !ok {
+		return nil
+	}
+	// a new configuration replaces the ring of the app
+	origins := strings.Join(list, " ")
+	r, ok := e.rings[app]
+	if !ok || r.origins != origins {
+		r = &edgeRing{origins: origins, ring: hashring.New(list, 0)}
+		e.rings[app] = r
+	}
+	return r.ring.GetN(key, len(list))
+}
+
+func (e *Edge) Pull(key string) bool {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if p, ok := e.pulls[key]; ok {
+		p.lastActive = time.Now()
+		return true
+	}
+	if strings.Index(key, "/") < 0 || e.stream.hasPublisher(key) {
+		return false
+	}
+	origins := e.origins(key)
+	if len(origins) == 0 {
+		return false
+	}
+	p := &edgePull{
+		key:        key,
+		lastActive: time.Now(),
+		log:        logger.With("key", key),
+	}
+	e.pulls[key] = p
+	go e.run(p, origins)
+	return true
+}
+
+// Pulls returns the keys being pulled and the origin serving each of them.
+func (e *Edge) Pulls() map[string]string {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	ret := make(map[string]string, len(e.pulls))
+	for key, p := range e.pulls {
+		ret[key] = p.origin
+	}
+	return ret
+}
+
+func (e *Edge) dial(p *edgePull, origins []string) error {
+	client := NewRtmpClient(e.stream, e.getter)
+	client.ReadTimeout = e.ReadTimeout
+	for _, origin := range origins {
+		url := fmt.Sprintf("%s/%s", strings.TrimRight(origin, "/"), configure.StreamPath(p.key))
+		if err := client.Dial(url, av.PLAY); err != nil {
+			p.log.Warnf("edge pull from %s failed: %v", origin, err)
+			continue
+		}
+		e.lock.Lock()
+		p.origin = origin
+		e.lock.Unlock()
+		p.log.Infof("edge pull from %s", origin)
+		return nil
+	}
+	return ErrNoOrigin
+}
+
+func (e *Edge) run(p *edgePull, origins []string) {
+	defer func() {
+		e.lock.Lock()
+		delete(e.pulls, p.key)
+		e.lock.Unlock()
+	}()
+
+	if err := e.dial(p, origins); err != nil {
+		p.log.Warnf("edge pull failed: %v", err)
+		return
+	}
+
+	ticker := time.NewTicker(edgeCheckPeriod)
+	defer ticker.Stop()
+	for range ticker.C {
+		s := e.stream.getStream(p.key)
+		players := 0
+		if s != nil {
+			players = s.PlayerCount()
+		}
+
+		e.lock.Lock()
+		if players > 0 {
+			p.lastActive = time.Now()
+		}
+		idle := time.Since(p.lastActive)
+		e.lock.Unlock()
+
+		if idle > e.Grace {
+			p.log.Infof("edge pull idle for %v, stop", idle)
+			if s != nil {
+				s.TransStop()
+			}
+			return
+		}
+		if s == nil || !s.IsPublishing() {
+			// the origin dropped us while viewers are still around
+			p.log.Infof("edge pull lost origin %s, reconnect", p.origin)
+			if err := e.dial(p, origins); err != nil {
+				p.log.Warnf("edge pull failed: %v", err)
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package rtmp
+
+import (
+	"bomin/configure"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEdgePull(t *testing.T) {
+	at := assert.New(t)
+	saved := configure.RtmpServercfg
+	defer func() { configure.RtmpServercfg = saved }()
+	configure.RtmpServercfg = configure.ServerCfg{Server: []configure.Application{
+		{Appname: "live", Liveon: "on"},
+		{Appname: "edge", Liveon: "on", Edge_origins: []string{"rtmp://127.0.0.1:1", "rtmp://127.0.0.1:2"}},
+	}}
+
+	stream := NewRtmpStream()
+	edge := NewEdge(stream, nil)
+	stream.SetEdge(edge)
+
+	at.False(stream.Pull("live/movie"))
+	at.False(stream.Pull("movie"))
+
+	origins := edge.origins("edge/movie")
+	at.Equal(2, len(origins))
+	at.Equal(origins, edge.origins("edge/movie"))
+
+	at.True(stream.Pull("edge/movie"))
+	at.True(stream.Pull("edge/movie"))
+	at.Equal(1, len(edge.Pulls()))
+
+	// both origins refuse the connection, the pull gives up
+	deadline := time.Now().Add(5 * time.Second)
+	for len(edge.Pulls()) != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	at.Equal(0, len(edge.Pulls()))
+
+	// a new configuration is seen and replaces the ring of the app
+	cfg := configure.Config()
+	cfg.Server = append([]configure.Application(nil), cfg.Server...)
+	cfg.Server[1].Edge_origins = []string{"rtmp://127.0.0.1:3"}
+	at.Nil(configure.SetConfig(cfg))
+	at.Equal([]string{"rtmp://127.0.0.1:3"}, edge.origins("edge/movie"))
+	at.Len(edge.rings, 1)
+}
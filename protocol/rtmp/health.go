@@ -0,0 +1,342 @@
+package rtmp
+
+import (
+	"bomin/av"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	HealthOK       = "ok"
+	HealthDegraded = "degraded"
+	HealthIdle     = "idle"
+)
+
+// Health problems reported by the analyser.
+const (
+	ProblemNoKeyframe    = "no_keyframe"
+	ProblemLowFPS        = "low_fps"
+	ProblemAudioGap      = "audio_gap"
+	ProblemDiscontinuity = "timestamp_discontinuity"
+	ProblemLowBitrate    = "low_bitrate"
+)
+
+const healthEventNum = 100
+
+// HealthConfig holds the thresholds of the health analyser. Durations are
+// measured on the stream's own timestamps, and on the wall clock while the
+// publisher sends nothing.
+type HealthConfig struct {
+	// KeyframeTimeout is the longest a video track may go without keyframe.
+	KeyframeTimeout time.Duration
+	// MinFPSRatio is the fraction of the usual frame rate below which the
+	// frame rate counts as dropped.
+	MinFPSRatio float64
+	// AudioGap is the longest allowed step between two audio packets.
+	AudioGap time.Duration
+	// MinBitrateRatio is the fraction of the usual bitrate below which the
+	// bitrate counts as collapsed.
+	MinBitrateRatio float64
+	// Hold is how long one-off problems, audio gaps and timestamp
+	// discontinuities, stay reported.
+	Hold time.Duration
+}
+
+var DefaultHealthConfig = HealthConfig{
+	KeyframeTimeout: 10 * time.Second,
+	MinFPSRatio:     0.5,
+	AudioGap:        time.Second,
+	MinBitrateRatio: 0.25,
+	Hold:            10 * time.Second,
+}
+
+// HealthProblem is an active problem of a stream.
+type HealthProblem struct {
+	Name   string    `json:"name"`
+	Detail string    `json:"detail"`
+	Since  time.Time `json:"since"`
+}
+
+// HealthStatus is the health of a stream for the management API.
+type HealthStatus struct {
+	State    string          `json:"state"`
+	Problems []HealthProblem `json:"problems"`
+}
+
+// HealthEvent is emitted when a problem of a stream is raised or cleared.
+type HealthEvent struct {
+	Key     string    `json:"key"`
+	Time    time.Time `json:"time"`
+	Problem string    `json:"problem"`
+	Active  bool      `json:"active"`
+	Detail  string    `json:"detail"`
+}
+
+type activeProblem struct {
+	HealthProblem
+	// until is the stream time in ms the problem clears at, 0 if it
+	// clears by itself
+	until int64
+}
+
+// healthAnalyser taps the packet flow of one publisher and keeps its
+// rolling health state.
+type healthAnalyser struct {
+	cfg      HealthConfig
+	problems map[string]*activeProblem
+
+	started         bool
+	windows         int
+	baseFPS         float64
+	baseBitrate     float64
+	videoStart      int64
+	hasKey          bool
+	lastKey         int64
+	hasAudio        bool
+	lastAudio       int64
+	discontinuities uint64
+
+	// the wall clock times of the last packet, keyframe, or first video
+	// packet, and audio packet
+	lastPacketAt time.Time
+	lastKeyAt    time.Time
+	lastAudioAt  time.Time
+}
+
+func newHealthAnalyser(cfg HealthConfig, discontinuities uint64) *healthAnalyser {
+	return &healthAnalyser{
+		cfg:             cfg,
+		problems:        make(map[string]*activeProblem),
+		videoStart:      -1,
+		discontinuities: discontinuities,
+		lastPacketAt:    time.Now(),
+	}
+}
+
+func ms(d time.Duration) int64 {
+	return int64(d / time.Millisecond)
+}
+
+func (a *healthAnalyser) raise(events []HealthEvent, name, detail string, until int64) []HealthEvent {
+	if p, ok := a.problems[name]; ok {
+		p.Detail = detail
+		if until > p.until {
+			p.until = until
+		}
+		return events
+	}
+	now := time.Now()
+	a.problems[name] = &activeProblem{HealthProblem{name, detail, now}, until}
+	return append(events, HealthEvent{Time: now, Problem: name, Active: true, Detail: detail})
+}
+
+func (a *healthAnalyser) clear(events []HealthEvent, name string) []HealthEvent {
+	p, ok := a.problems[name]
+	if !ok {
+		return events
+	}
+	delete(a.problems, name)
+	return append(events, HealthEvent{Time: time.Now(), Problem: name, Detail: p.Detail})
+}
+
+// observe checks p, already recorded in m, and returns the transitions it
+// caused.
+func (a *healthAnalyser) observe(p *av.Packet, m *mediaInfo, discontinuities uint64) (events []HealthEvent) {
+	if !p.IsVideo && !p.IsAudio {
+		return nil
+	}
+	ts := int64(p.TimeStamp)
+	now := time.Now()
+	a.lastPacketAt = now
+
+	if p.IsVideo {
+		if a.videoStart < 0 {
+			a.videoStart = ts
+			a.lastKeyAt = now
+		}
+		if vh, ok := p.Header.(av.VideoPacketHeader); ok && vh.IsKeyFrame() && !vh.IsSeq() {
+			a.hasKey = true
+			a.lastKey = ts
+			a.lastKeyAt = now
+			events = a.clear(events, ProblemNoKeyframe)
+		}
+	}
+	if a.videoStart >= 0 {
+		last := a.videoStart
+		if a.hasKey {
+			last = a.lastKey
+		}
+		if since := ts - last; since > ms(a.cfg.KeyframeTimeout) {
+			events = a.raise(events, ProblemNoKeyframe,
+				fmt.Sprintf("no keyframe for %.1fs", float64(since)/1000), 0)
+		}
+	}
+
+	if p.IsAudio {
+		// a gap stalled raised is held from the audio coming back
+		if gap, ok := a.problems[ProblemAudioGap]; ok && gap.until == 0 {
+			gap.until = ts + ms(a.cfg.Hold)
+		}
+		if gap := ts - a.lastAudio; a.hasAudio && gap > ms(a.cfg.AudioGap) {
+			events = a.raise(events, ProblemAudioGap,
+				fmt.Sprintf("audio gap of %dms", gap), ts+ms(a.cfg.Hold))
+		}
+		a.hasAudio = true
+		a.lastAudio = ts
+		a.lastAudioAt = now
+	}
+
+	if discontinuities > a.discontinuities {
+		events = a.raise(events, ProblemDiscontinuity,
+			fmt.Sprintf("%d timestamp discontinuities", discontinuities-a.discontinuities), ts+ms(a.cfg.Hold))
+		a.discontinuities = discontinuities
+	}
+
+	if m.windows != a.windows {
+		a.windows = m.windows
+		events = a.checkRates(events, m)
+	}
+
+	for name, p := range a.problems {
+		if p.until > 0 && ts >= p.until {
+			events = a.clear(events, name)
+		}
+	}
+	return events
+}
+
+// stalled checks a publisher that may have stopped sending media, which
+// observe never gets to see, on the wall clock at now. It returns the
+// transitions it caused.
+func (a *healthAnalyser) stalled(now time.Time) (events []HealthEvent) {
+	if a.videoStart >= 0 {
+		if since := now.Sub(a.lastKeyAt); since > a.cfg.KeyframeTimeout {
+			events = a.raise(events, ProblemNoKeyframe,
+				fmt.Sprintf("no keyframe for %.1fs", since.Seconds()), 0)
+		}
+	}
+	if a.hasAudio {
+		if gap := now.Sub(a.lastAudioAt); gap > a.cfg.AudioGap {
+			events = a.raise(events, ProblemAudioGap,
+				fmt.Sprintf("no audio for %dms", ms(gap)), 0)
+		}
+	}
+	// a window without packets never closes
+	if a.baseBitrate > 0 {
+		if idle := now.Sub(a.lastPacketAt); idle > 2*mediaWindow*time.Millisecond {
+			events = a.raise(events, ProblemLowBitrate,
+				fmt.Sprintf("no media for %.1fs, usually %.0f kbps", idle.Seconds(), a.baseBitrate), 0)
+		}
+	}
+	return events
+}
+
+// checkRates compares the last measured frame rate and bitrate with their
+// usual values. The usual values follow the measured ones slowly, and only
+// while they look healthy.
+func (a *healthAnalyser) checkRates(events []HealthEvent, m *mediaInfo) []HealthEvent {
+	bitrate := float64(m.video.Bitrate + m.audio.Bitrate)
+	if !a.started {
+		// the first window is often short of frames, skip it
+		a.started = true
+		return events
+	}
+
+	if m.hasVideo {
+		fps := m.video.MeasuredFPS
+		if a.baseFPS > 0 && fps < a.baseFPS*a.cfg.MinFPSRatio {
+			events = a.raise(events, ProblemLowFPS,
+				fmt.Sprintf("%.1f fps, usually %.1f", fps, a.baseFPS), 0)
+		} else {
+			events = a.clear(events, ProblemLowFPS)
+			a.baseFPS = ewma(a.baseFPS, fps)
+		}
+	}
+
+	if a.baseBitrate > 0 && bitrate < a.baseBitrate*a.cfg.MinBitrateRatio {
+		events = a.raise(events, ProblemLowBitrate,
+			fmt.Sprintf("%.0f kbps, usually %.0f", bitrate, a.baseBitrate), 0)
+	} else {
+		events = a.clear(events, ProblemLowBitrate)
+		a.baseBitrate = ewma(a.baseBitrate, bitrate)
+	}
+	return events
+}
+
+func ewma(avg, v float64) float64 {
+	if avg == 0 {
+		return v
+	}
+	return avg*0.9 + v*0.1
+}
+
+func (a *healthAnalyser) status() *HealthStatus {
+	status := &HealthStatus{State: HealthOK, Problems: []HealthProblem{}}
+	for _, p := range a.problems {
+		status.Problems = append(status.Problems, p.HealthProblem)
+	}
+	if len(status.Problems) > 0 {
+		status.State = HealthDegraded
+		sort.Slice(status.Problems, func(i, j int) bool { return status.Problems[i].Name < status.Problems[j].Name })
+	}
+	return status
+}
+
+// healthLog keeps the recent health events of all streams and passes them
+// on to the handlers.
+type healthLog struct {
+	lock     sync.Mutex
+	events   []HealthEvent
+	handlers []func(HealthEvent)
+}
+
+func (l *healthLog) emit(key string, events []HealthEvent) {
+	if len(events) == 0 {
+		return
+	}
+	l.lock.Lock()
+	handlers := l.handlers
+	klog := logger.With("key", key)
+	for i := range events {
+		events[i].Key = key
+		if events[i].Active {
+			klog.Warnf("health: %s (%s)", events[i].Problem, events[i].Detail)
+		} else {
+			klog.Infof("health: %s cleared", events[i].Problem)
+		}
+		l.events = append(l.events, events[i])
+	}
+	if n := len(l.events); n > healthEventNum {
+		l.events = append(l.events[:0], l.events[n-healthEventNum:]...)
+	}
+	l.lock.Unlock()
+
+	for _, handler := range handlers {
+		for _, e := range events {
+			handler(e)
+		}
+	}
+}
+
+func (l *healthLog) recent() []HealthEvent {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	ret := make([]HealthEvent, len(l.events))
+	copy(ret, l.events)
+	return ret
+}
+
+// HealthEvents returns the recent health events, oldest first.
+func (rs *RtmpStream) HealthEvents() []HealthEvent {
+	return rs.health.recent()
+}
+
+// OnHealthEvent adds a handler called for every health event. It is called
+// from the publisher's goroutine and must not block.
+func (rs *RtmpStream) OnHealthEvent(handler func(HealthEvent)) {
+	rs.health.lock.Lock()
+	rs.health.handlers = append(rs.health.handlers, handler)
+	rs.health.lock.Unlock()
+}
@@ -0,0 +1,158 @@
+package rtmp
+
+import (
+	"bomin/av"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type healthFeed struct {
+	m               mediaInfo
+	a               *healthAnalyser
+	discontinuities uint64
+	events          []HealthEvent
+}
+
+func newHealthFeed() *healthFeed {
+	return &healthFeed{a: newHealthAnalyser(DefaultHealthConfig, 0)}
+}
+
+func (f *healthFeed) packet(p *av.Packet) {
+	f.m.update(p)
+	f.events = append(f.events, f.a.observe(p, &f.m, f.discontinuities)...)
+}
+
+// run feeds from..to ms of 25fps video with a keyframe every keyEvery ms and
+// audio every 20ms unless noAudio.
+func (f *healthFeed) run(from, to, keyEvery uint32, frameEvery uint32, noAudio bool) {
+	for ts := from; ts < to; ts += 20 {
+		if ts%frameEvery == 0 {
+			key := keyEvery > 0 && ts%keyEvery == 0
+			f.packet(&av.Packet{IsVideo: true, TimeStamp: ts,
+				Header: testVideoHeader{codec: av.VIDEO_H264, key: key}, Data: make([]byte, 1000)})
+		}
+		if !noAudio {
+			f.packet(&av.Packet{IsAudio: true, TimeStamp: ts,
+				Header: testAudioHeader{av.SOUND_AAC, av.AAC_RAW}, Data: make([]byte, 100)})
+		}
+	}
+}
+
+func (f *healthFeed) problems() []string {
+	var names []string
+	for _, p := range f.a.status().Problems {
+		names = append(names, p.Name)
+	}
+	return names
+}
+
+func TestHealthOK(t *testing.T) {
+	f := newHealthFeed()
+	f.run(0, 20000, 2000, 40, false)
+	assert.Equal(t, HealthOK, f.a.status().State)
+	assert.Empty(t, f.events)
+}
+
+func TestHealthNoKeyframe(t *testing.T) {
+	at := assert.New(t)
+	f := newHealthFeed()
+	f.run(0, 2000, 2000, 40, false)
+	f.run(2000, 14000, 0, 40, false)
+	at.Equal([]string{ProblemNoKeyframe}, f.problems())
+	at.Equal(HealthDegraded, f.a.status().State)
+	at.Len(f.events, 1)
+	at.True(f.events[0].Active)
+
+	f.run(14000, 14020, 14000, 20, false)
+	at.Empty(f.problems())
+	at.Len(f.events, 2)
+	at.Equal(ProblemNoKeyframe, f.events[1].Problem)
+	at.False(f.events[1].Active)
+}
+
+func TestHealthLowFPSAndBitrate(t *testing.T) {
+	at := assert.New(t)
+	f := newHealthFeed()
+	f.run(0, 10000, 2000, 40, true)
+	at.Empty(f.problems())
+	// 5 fps instead of 25
+	f.run(10000, 13000, 2000, 200, true)
+	at.Equal([]string{ProblemLowBitrate, ProblemLowFPS}, f.problems())
+	f.run(13000, 16000, 2000, 40, true)
+	at.Empty(f.problems())
+}
+
+func TestHealthAudioGapAndDiscontinuity(t *testing.T) {
+	at := assert.New(t)
+	f := newHealthFeed()
+	f.run(0, 4000, 2000, 40, false)
+	f.run(4000, 6000, 2000, 40, true)
+	f.discontinuities++
+	f.run(6000, 8000, 2000, 40, false)
+	at.Equal([]string{ProblemAudioGap, ProblemDiscontinuity}, f.problems())
+	// both clear once the hold time has passed without recurrence
+	f.run(8000, 17000, 2000, 40, false)
+	at.Empty(f.problems())
+}
+
+func TestHealthStalled(t *testing.T) {
+	at := assert.New(t)
+	f := newHealthFeed()
+	f.run(0, 4000, 2000, 40, false)
+	at.Empty(f.a.stalled(time.Now()))
+
+	// the publisher stays connected but sends nothing
+	events := f.a.stalled(time.Now().Add(11 * time.Second))
+	at.Len(events, 3)
+	at.Equal([]string{ProblemAudioGap, ProblemLowBitrate, ProblemNoKeyframe}, f.problems())
+	at.Empty(f.a.stalled(time.Now().Add(12 * time.Second)))
+
+	// it comes back: the keyframe clears at once, the bitrate with the next
+	// healthy window and the audio gap after the hold time
+	f.run(4000, 7000, 2000, 40, false)
+	at.Equal([]string{ProblemAudioGap}, f.problems())
+	f.run(7000, 15000, 2000, 40, false)
+	at.Empty(f.problems())
+}
+
+func TestStreamStalled(t *testing.T) {
+	at := assert.New(t)
+	rs := NewRtmpStream()
+	pub := rs.NewPublisher("live/movie")
+	defer pub.Close(nil)
+	for ts := uint32(0); ts < 100; ts += 40 {
+		at.Nil(pub.Write(&av.Packet{IsVideo: true, TimeStamp: ts,
+			Header: testVideoHeader{codec: av.VIDEO_H264, key: ts == 0}, Data: make([]byte, 10)}))
+	}
+	s := rs.getStream("live/movie")
+	deadline := time.Now().Add(time.Second)
+	for s.Stat("live/movie").Video == nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.checkHealth(time.Now().Add(11 * time.Second))
+	events := rs.HealthEvents()
+	if at.Len(events, 1) {
+		at.Equal("live/movie", events[0].Key)
+		at.Equal(ProblemNoKeyframe, events[0].Problem)
+	}
+}
+
+func TestHealthLog(t *testing.T) {
+	at := assert.New(t)
+	rs := NewRtmpStream()
+	var got []HealthEvent
+	rs.OnHealthEvent(func(e HealthEvent) { got = append(got, e) })
+	// a second handler does not replace the first
+	others := 0
+	rs.OnHealthEvent(func(e HealthEvent) { others++ })
+	for i := 0; i < healthEventNum+5; i++ {
+		rs.health.emit("live/movie", []HealthEvent{{Problem: ProblemAudioGap, Active: i%2 == 0}})
+	}
+	events := rs.HealthEvents()
+	at.Len(events, healthEventNum)
+	at.Len(got, healthEventNum+5)
+	at.Equal(healthEventNum+5, others)
+	at.Equal("live/movie", events[0].Key)
+}
@@ -0,0 +1,149 @@
+package rtmp
+
+import (
+	"bomin/configure"
+	"bomin/protocol/rtmp/transcode"
+	"bomin/utils/metrics"
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrAddrDenied        = errors.New("address not allowed")
+	ErrTooManyPublishers = errors.New("too many publishers")
+	ErrTooManyPlayers    = errors.New("too many players")
+)
+
+var rejected = metrics.NewCounterVec("bomin_rejected_clients_total",
+	"Connections, publishers and players rejected by the limits and address lists.", "reason")
+
+// Admit checks a new publisher, or player, of key from the address remote
+// against the address lists and the client caps of the app.
+func (rs *RtmpStream) Admit(key string, publish bool, remote string) error {
+	app := strings.SplitN(key, "/", 2)[0]
+	ip := remoteIP(remote)
+	maxPublishers, maxPlayers := configure.GetClientLimits(app)
+	if publish {
+		if !configure.CheckPublishAddr(app, ip) {
+			rejected.With("publish_denied").Inc()
+			return ErrAddrDenied
+		}
+		// taking a key over does not add a publisher
+		if maxPublishers > 0 && !rs.hasPublisher(key) {
+			if publishers, _ := rs.appClients(app); publishers >= maxPublishers {
+				rejected.With("max_publishers").Inc()
+				return ErrTooManyPublishers
+			}
+		}
+		return nil
+	}
+	if !configure.CheckPlayAddr(app, ip) {
+		rejected.With("play_denied").Inc()
+		return ErrAddrDenied
+	}
+	if maxPlayers > 0 {
+		if _, players := rs.appClients(app); players >= maxPlayers {
+			rejected.With("max_players").Inc()
+			return ErrTooManyPlayers
+		}
+	}
+	return nil
+}
+
+// SetTokenChecker lets the RTMP clients whose transcode.TokenParam
+// parameter check accepts, the transcoding processes of the server, past
+// the limits, the address lists and the name mappings of the apps, as
+// transcode.Supervisor.UseToken does.
+func (rs *RtmpStream) SetTokenChecker(check func(token string) bool) {
+	rs.tokenChecker = check
+}
+
+// internal reports whether the client with the parameters query is one of
+// the server itself.
+func (rs *RtmpStream) internal(query url.Values) bool {
+	token := query.Get(transcode.TokenParam)
+	return token != "" && rs.tokenChecker != nil && rs.tokenChecker(token)
+}
+
+// appClients counts the publishers and players of the streams of app,
+// leaving the internal ones out. The HLS players, which hold no stream
+// writer, are not among them.
+func (rs *RtmpStream) appClients(app string) (publishers, players int) {
+	for item := range rs.streams.IterBuffered() {
+		if !strings.HasPrefix(item.Key, app+"/") {
+			continue
+		}
+		s := item.Val.(*Stream)
+		id := EmptyID
+		if s.IsPublishing() {
+			id = s.ID()
+			if r := s.GetReader(); r == nil || !r.Info().Internal {
+				publishers++
+			}
+		}
+		for _, pw := range s.ws.load() {
+			if pw.uid != id && !pw.GetWriter().Info().Internal {
+				players++
+			}
+		}
+	}
+	return
+}
+
+// remoteIP returns the IP of remote, an address with or without a port.
+func remoteIP(remote string) net.IP {
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		remote = host
+	}
+	return net.ParseIP(remote)
+}
+
+// connLimiter counts the connections being served, in all and by IP.
+type connLimiter struct {
+	lock  sync.Mutex
+	total int
+	byIP  map[string]int
+}
+
+// acquire counts a new connection from ip unless it goes over max, or
+// maxPerIP for ip; 0 is no limit. It returns the reason of a refusal.
+func (l *connLimiter) acquire(ip string, max, maxPerIP int) string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if max > 0 && l.total >= max {
+		return "max_conns"
+	}
+	if maxPerIP > 0 && l.byIP[ip] >= maxPerIP {
+		return "max_conns_per_ip"
+	}
+	if l.byIP == nil {
+		l.byIP = make(map[string]int)
+	}
+	l.total++
+	l.byIP[ip]++
+	return ""
+}
+
+func (l *connLimiter) release(ip string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.total--
+	if l.byIP[ip]--; l.byIP[ip] <= 0 {
+		delete(l.byIP, ip)
+	}
+}
+
+// limitedConn gives its place back to the limiter when closed.
+type limitedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitedConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
@@ -0,0 +1,161 @@
+package rtmp
+
+import (
+	"bomin/av"
+	"bomin/configure"
+	"bomin/protocol/rtmp/transcode"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdmit(t *testing.T) {
+	at := assert.New(t)
+	saved := configure.RtmpServercfg
+	defer func() { configure.RtmpServercfg = saved }()
+	configure.RtmpServercfg = configure.ServerCfg{Server: []configure.Application{
+		{Appname: "live", Liveon: "on", Max_publishers: 1, Max_players: 1,
+			Publish_allow: []string{"10.0.0.0/8"}, Play_deny: []string{"192.0.2.1"}},
+		{Appname: "open", Liveon: "on"},
+	}}
+
+	rs := NewRtmpStream()
+	at.Equal(ErrAddrDenied, rs.Admit("live/a", true, "192.0.2.1:1935"))
+	at.Equal(ErrAddrDenied, rs.Admit("live/a", false, "192.0.2.1:1935"))
+	at.Nil(rs.Admit("live/a", true, "10.1.2.3:1935"))
+	at.Nil(rs.Admit("live/a", false, "10.1.2.3:1935"))
+	at.Nil(rs.Admit("open/a", true, "192.0.2.1:1935"))
+
+	pub := rs.NewPublisher("live/a")
+	defer pub.Close(nil)
+	at.Nil(pub.Write(keyFrame()))
+	// taking the key over is allowed, a second key is not
+	at.Nil(rs.Admit("live/a", true, "10.1.2.3:1935"))
+	at.Equal(ErrTooManyPublishers, rs.Admit("live/b", true, "10.1.2.3:1935"))
+	// the other apps are not limited
+	at.Nil(rs.Admit("open/b", true, "10.1.2.3:1935"))
+
+	sub := rs.NewSubscriber("live/a", 0)
+	defer sub.Close(nil)
+	at.Equal(ErrTooManyPlayers, rs.Admit("live/a", false, "10.1.2.3:1935"))
+	at.Equal(ErrTooManyPlayers, rs.Admit("live/b", false, "10.1.2.3:1935"))
+	at.Nil(rs.Admit("open/a", false, "10.1.2.3:1935"))
+}
+
+func TestConnLimiter(t *testing.T) {
+	at := assert.New(t)
+	var l connLimiter
+	at.Equal("", l.acquire("10.0.0.1", 3, 2))
+	at.Equal("", l.acquire("10.0.0.1", 3, 2))
+	at.Equal("max_conns_per_ip", l.acquire("10.0.0.1", 3, 2))
+	at.Equal("", l.acquire("10.0.0.2", 3, 2))
+	at.Equal("max_conns", l.acquire("10.0.0.3", 3, 2))
+
+	l.release("10.0.0.1")
+	at.Equal("", l.acquire("10.0.0.3", 3, 2))
+	l.release("10.0.0.2")
+	at.NotContains(l.byIP, "10.0.0.2")
+	at.Equal("", l.acquire("10.0.0.4", 0, 0))
+}
+
+// readClosed returns how long it took the server to close conn.
+func readClosed(t *testing.T, conn net.Conn) time.Duration {
+	start := time.Now()
+	conn.SetReadDeadline(start.Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("connection not closed")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("connection not closed in time")
+	}
+	return time.Since(start)
+}
+
+func TestServerConnLimits(t *testing.T) {
+	at := assert.New(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	srv := NewRtmpServer(NewRtmpStream(), nil)
+	srv.MaxConnsPerIP = 1
+	srv.HandshakeTimeout = 200 * time.Millisecond
+	go srv.Serve(listener)
+
+	first, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	// let the server accept the first connection before the second one
+	time.Sleep(50 * time.Millisecond)
+	second, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	at.True(readClosed(t, second) < 150*time.Millisecond)
+
+	// the silent first connection times out in the handshake, its place is
+	// given back
+	readClosed(t, first)
+	third, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer third.Close()
+	at.True(readClosed(t, third) >= 150*time.Millisecond)
+}
+
+func TestServerInternalClients(t *testing.T) {
+	at := assert.New(t)
+	saved := configure.RtmpServercfg
+	defer func() { configure.RtmpServercfg = saved }()
+	at.Nil(configure.SetConfig(configure.ServerCfg{Server: []configure.Application{
+		{Appname: "live", Liveon: "on", Max_publishers: 1, Publish_allow: []string{"10.0.0.0/8"},
+			Key_rewrites: []configure.Rewrite{{Match: "^pub_(.*)$", Replace: "$1"}}},
+	}}))
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	rs := NewRtmpStream()
+	tokens := map[string]bool{"first": true, "second": true}
+	var lock sync.Mutex
+	rs.SetTokenChecker(func(token string) bool {
+		lock.Lock()
+		defer lock.Unlock()
+		ok := tokens[token]
+		delete(tokens, token)
+		return ok
+	})
+	go NewRtmpServer(rs, nil).Serve(listener)
+
+	publish := func(name string) bool {
+		client := NewRtmpClient(NewRtmpStream(), nil)
+		client.Dial("rtmp://"+listener.Addr().String()+"/live/"+name, av.PUBLISH)
+		key := "live/" + strings.SplitN(name, "?", 2)[0]
+		deadline := time.Now().Add(100 * time.Millisecond)
+		for !rs.hasPublisher(key) && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		return rs.hasPublisher(key)
+	}
+	// the loopback address is not allowed to publish
+	at.False(publish("movie"))
+	at.False(publish("movie?" + transcode.TokenParam + "=guess"))
+	at.True(publish("movie?" + transcode.TokenParam + "=first"))
+	at.True(publish("movie_720?" + transcode.TokenParam + "=second"))
+	// a token lets one client in
+	at.False(publish("movie_480?" + transcode.TokenParam + "=first"))
+
+	// they count for no publisher
+	publishers, _ := rs.appClients("live")
+	at.Equal(0, publishers)
+	at.Nil(rs.Admit("live/other", true, "10.1.2.3:1935"))
+}
@@ -0,0 +1,239 @@
+package rtmp
+
+import (
+	"bomin/av"
+	"bomin/container/flv"
+	"bomin/utils/metrics"
+	"bomin/utils/uid"
+	"errors"
+	"sync"
+)
+
+// ErrClosed is returned by an in-process Publisher or Subscriber closed by
+// its owner.
+var ErrClosed = errors.New("closed")
+
+// DefaultSubscriberBuffer is the queue length of a Subscriber when none is
+// given, enough for a few seconds of audio and video.
+const DefaultSubscriberBuffer = 256
+
+// Publisher publishes a stream from the same process, without an RTMP
+// connection. It takes the place of the current publisher of its key.
+//
+// Write takes packets whose Data is an FLV tag body, as an RTMP publisher
+// sends them; their Header is parsed if it is not set. Write blocks until
+// the stream has handed the previous packet to its players, which never
+// wait on a slow player, so a Publisher is paced by the stream only. The
+// caller paces the media itself, by timestamp, and must not change a
+// packet's Data after writing it. A packet's Buffer reference, if any, goes
+// to the stream.
+type Publisher struct {
+	av.Stats
+	info    av.Info
+	demuxer *flv.Demuxer
+	packets chan *av.Packet
+
+	lock sync.Mutex
+	err  error
+	done chan struct{}
+}
+
+// NewPublisher starts publishing key, "app/name", from the process. It is
+// closed at once, with ErrShutdown, if the stream is shutting down.
+func (rs *RtmpStream) NewPublisher(key string) *Publisher {
+	p := &Publisher{
+		info:    av.Info{Key: key, URL: "local://" + key, UID: uid.NewId()},
+		demuxer: flv.NewDemuxer(),
+		packets: make(chan *av.Packet),
+		done:    make(chan struct{}),
+	}
+	rs.HandleReader(p)
+	return p
+}
+
+func (p *Publisher) Info() av.Info {
+	return p.info
+}
+
+// Alive reports whether the publisher is open, it does not time out.
+func (p *Publisher) Alive() bool {
+	return p.Err() == nil
+}
+
+// Write publishes pkt. It returns the reason the publisher was closed once
+// it is, e.g. ErrKicked, ErrShutdown or another publisher taking the key.
+func (p *Publisher) Write(pkt *av.Packet) error {
+	if pkt.Header == nil && (pkt.IsAudio || pkt.IsVideo) {
+		if err := p.demuxer.DemuxH(pkt); err != nil {
+			return err
+		}
+	}
+	select {
+	case p.packets <- pkt:
+		return nil
+	case <-p.done:
+		return p.Err()
+	}
+}
+
+// Read hands the written packets to the stream.
+func (p *Publisher) Read(pkt *av.Packet) error {
+	select {
+	case next := <-p.packets:
+		*pkt = *next
+		p.Update(pkt)
+		return nil
+	case <-p.done:
+		return p.Err()
+	}
+}
+
+// Close ends the stream, a nil err is reported as ErrClosed. Only the
+// first call counts.
+func (p *Publisher) Close(err error) {
+	if err == nil {
+		err = ErrClosed
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.err == nil {
+		p.err = err
+		close(p.done)
+	}
+}
+
+// Done is closed when the publisher is closed.
+func (p *Publisher) Done() <-chan struct{} {
+	return p.done
+}
+
+// Err returns why the publisher was closed, nil while it is open.
+func (p *Publisher) Err() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.err
+}
+
+// Subscriber plays a stream into the process. Like an RTMP player it gets
+// the cached metadata, sequence headers and GOP first, then the live
+// packets, and it outlives the publisher: a new publisher of the key
+// carries on into the same Subscriber.
+//
+// The stream never waits on a Subscriber. Packets go through a queue of
+// the size given to NewSubscriber; when the reader falls behind and the
+// queue is full the packet is dropped, and the video after it up to the
+// next key frame, so what is read always decodes. Dropped counts them.
+//
+// The packets read may hold a pooled buffer: releasing a packet once done
+// with it recycles the buffer, a packet never released is left to the
+// garbage collector.
+type Subscriber struct {
+	av.Stats
+	info    av.Info
+	packets chan *av.Packet
+
+	lock    sync.Mutex
+	err     error
+	waitKey bool
+}
+
+// NewSubscriber starts playing key, "app/name", into the process with a
+// queue of buffer packets, DefaultSubscriberBuffer if buffer is not
+// positive. Like any player it makes an edge server pull the key.
+func (rs *RtmpStream) NewSubscriber(key string, buffer int) *Subscriber {
+	if buffer <= 0 {
+		buffer = DefaultSubscriberBuffer
+	}
+	s := &Subscriber{
+		info:    av.Info{Key: key, URL: "local://" + key, UID: uid.NewId()},
+		packets: make(chan *av.Packet, buffer),
+	}
+	rs.HandleWriter(s)
+	return s
+}
+
+func (s *Subscriber) Info() av.Info {
+	return s.info
+}
+
+// Alive reports whether the subscriber is open, it does not time out.
+func (s *Subscriber) Alive() bool {
+	return s.Err() == nil
+}
+
+// Write queues a copy of pkt for the reader, or drops it if the queue is
+// full. It only fails once the subscriber is closed.
+func (s *Subscriber) Write(pkt *av.Packet) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	if s.waitKey && pkt.IsVideo {
+		if vh, ok := pkt.Header.(av.VideoPacketHeader); !ok || !(vh.IsKeyFrame() || vh.IsSeq()) {
+			s.drop()
+			return nil
+		}
+		s.waitKey = false
+	}
+	cp := *pkt
+	cp.Retain()
+	select {
+	case s.packets <- &cp:
+		s.Update(pkt)
+	default:
+		cp.Release()
+		s.drop()
+		s.waitKey = true
+	}
+	return nil
+}
+
+func (s *Subscriber) drop() {
+	s.Drop(1)
+	metrics.DroppedPackets.With("local").Inc()
+}
+
+// Packets returns the packet queue. It is closed, after the packets still
+// queued, when the subscriber is closed.
+func (s *Subscriber) Packets() <-chan *av.Packet {
+	return s.packets
+}
+
+// Read takes the next packet from the queue, blocking until there is one.
+// Once the subscriber is closed and the queue read, it returns why.
+func (s *Subscriber) Read(pkt *av.Packet) error {
+	next, ok := <-s.packets
+	if !ok {
+		return s.Err()
+	}
+	*pkt = *next
+	return nil
+}
+
+// Close stops the subscriber, a nil err is reported as ErrClosed. The
+// packets already queued can still be read.
+func (s *Subscriber) Close(err error) {
+	if err == nil {
+		err = ErrClosed
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.err == nil {
+		s.err = err
+		close(s.packets)
+	}
+}
+
+// Err returns why the subscriber was closed, nil while it is open.
+func (s *Subscriber) Err() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.err
+}
+
+// Dropped returns the number of packets dropped because the reader was
+// behind.
+func (s *Subscriber) Dropped() uint64 {
+	return s.Counters().Dropped
+}
@@ -0,0 +1,109 @@
+package rtmp
+
+import (
+	"bomin/av"
+	"bomin/container/flv"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func videoTag(frame byte, avcType byte) *av.Packet {
+	return &av.Packet{IsVideo: true, Data: []byte{frame<<4 | av.VIDEO_H264, avcType, 0, 0, 0, 0xff}}
+}
+
+func keyFrame() *av.Packet   { return videoTag(av.FRAME_KEY, av.AVC_NALU) }
+func interFrame() *av.Packet { return videoTag(av.FRAME_INTER, av.AVC_NALU) }
+func videoSeq() *av.Packet   { return videoTag(av.FRAME_KEY, av.AVC_SEQHDR) }
+
+func readPacket(t *testing.T, s *Subscriber) *av.Packet {
+	select {
+	case p, ok := <-s.Packets():
+		if !ok {
+			t.Fatal("subscriber closed")
+		}
+		return p
+	case <-time.After(time.Second):
+		t.Fatal("no packet")
+	}
+	return nil
+}
+
+func isKey(p *av.Packet) bool {
+	vh, ok := p.Header.(av.VideoPacketHeader)
+	return ok && vh.IsKeyFrame() && !vh.IsSeq()
+}
+
+func TestPublishSubscribe(t *testing.T) {
+	at := assert.New(t)
+	rs := NewRtmpStream()
+	pub := rs.NewPublisher("live/local")
+	for _, p := range []*av.Packet{videoSeq(), keyFrame(), interFrame()} {
+		at.Nil(pub.Write(p))
+	}
+	at.True(rs.hasPublisher("live/local"))
+
+	// a late subscriber starts with the sequence header and the GOP
+	sub := rs.NewSubscriber("live/local", 0)
+	at.Nil(pub.Write(interFrame()))
+	p := readPacket(t, sub)
+	vh := p.Header.(av.VideoPacketHeader)
+	at.True(vh.IsSeq())
+	at.True(isKey(readPacket(t, sub)))
+	at.False(isKey(readPacket(t, sub)))
+	at.False(isKey(readPacket(t, sub)))
+
+	// another publisher takes the key over, the subscriber stays
+	next := rs.NewPublisher("live/local")
+	select {
+	case <-pub.Done():
+	case <-time.After(time.Second):
+		t.Fatal("old publisher not closed")
+	}
+	at.NotNil(pub.Write(keyFrame()))
+	at.Nil(next.Write(keyFrame()))
+	at.Nil(next.Write(interFrame()))
+	at.True(isKey(readPacket(t, sub)))
+
+	at.Nil(rs.Shutdown(context.Background()))
+	at.Equal(ErrShutdown, next.Err())
+	at.Equal(ErrShutdown, next.Write(interFrame()))
+	for range sub.Packets() {
+	}
+	var last av.Packet
+	at.Equal(ErrShutdown, sub.Read(&last))
+}
+
+func TestSubscriberDrops(t *testing.T) {
+	at := assert.New(t)
+	s := NewRtmpStream().NewSubscriber("live/slow", 2)
+	demuxer := flv.NewDemuxer()
+	write := func(p *av.Packet) {
+		at.Nil(demuxer.DemuxH(p))
+		at.Nil(s.Write(p))
+	}
+
+	write(keyFrame())
+	write(interFrame())
+	write(interFrame()) // queue full
+	at.Equal(uint64(1), s.Dropped())
+	readPacket(t, s)
+	readPacket(t, s)
+	write(interFrame()) // still waiting for a key frame
+	at.Equal(uint64(2), s.Dropped())
+	at.Len(s.Packets(), 0)
+	write(keyFrame())
+	write(interFrame())
+	at.True(isKey(readPacket(t, s)))
+	at.False(isKey(readPacket(t, s)))
+
+	write(keyFrame())
+	s.Close(nil)
+	at.Equal(ErrClosed, s.Write(interFrame()))
+	at.False(s.Alive())
+	var p av.Packet
+	at.Nil(s.Read(&p))
+	at.Equal(ErrClosed, s.Read(&p))
+}
@@ -0,0 +1,142 @@
+package rtmp
+
+import (
+	"bomin/av"
+	"bomin/parser/aac"
+	"bomin/parser/h264"
+	"bomin/protocol/amf"
+	"bytes"
+)
+
+// mediaWindow is the span of packet time in ms over which frame rate and
+// bitrate are measured.
+const mediaWindow = 1000
+
+// VideoInfo describes the video track of a stream. Codec details come from
+// the sequence header, falling back to onMetaData, the rest is measured.
+type VideoInfo struct {
+	Codec            string  `json:"codec"`
+	Profile          string  `json:"profile,omitempty"`
+	Level            string  `json:"level,omitempty"`
+	Width            int     `json:"width,omitempty"`
+	Height           int     `json:"height,omitempty"`
+	FrameRate        float64 `json:"frame_rate,omitempty"`
+	MeasuredFPS      float64 `json:"measured_fps"`
+	Bitrate          uint64  `json:"bitrate_kbps"`
+	KeyframeInterval float64 `json:"keyframe_interval"`
+}
+
+// AudioInfo describes the audio track of a stream.
+type AudioInfo struct {
+	Codec      string `json:"codec"`
+	Profile    string `json:"profile,omitempty"`
+	SampleRate int    `json:"sample_rate,omitempty"`
+	Channels   int    `json:"channels,omitempty"`
+	Bitrate    uint64 `json:"bitrate_kbps"`
+}
+
+func (m *mediaInfo) updateVideo(p *av.Packet) {
+	vh, ok := p.Header.(av.VideoPacketHeader)
+	if !ok {
+		return
+	}
+	m.hasVideo = true
+	m.video.Codec = codecName(videoCodecs, vh.CodecID())
+	m.videoBytes += uint64(len(p.Data))
+	if vh.IsSeq() {
+		// the AVCDecoderConfigurationRecord follows the 5 byte tag header
+		if vh.CodecID() == av.VIDEO_H264 && len(p.Data) > 5 {
+			if sps, err := h264.ParseDecoderConfig(p.Data[5:]); err == nil {
+				m.sps = sps
+			}
+		}
+		return
+	}
+	m.frames++
+	if vh.IsKeyFrame() {
+		if m.hasKey {
+			m.video.KeyframeInterval = float64(p.TimeStamp-m.lastKey) / 1000
+		}
+		m.hasKey = true
+		m.lastKey = p.TimeStamp
+	}
+}
+
+func (m *mediaInfo) updateAudio(p *av.Packet) {
+	ah, ok := p.Header.(av.AudioPacketHeader)
+	if !ok {
+		return
+	}
+	m.hasAudio = true
+	m.audio.Codec = codecName(audioCodecs, ah.SoundFormat())
+	m.audioBytes += uint64(len(p.Data))
+	if ah.SoundFormat() == av.SOUND_AAC && ah.AACPacketType() == av.AAC_SEQHDR && len(p.Data) > 2 {
+		if cfg, err := aac.ParseConfig(p.Data[2:]); err == nil {
+			m.audio.Profile = cfg.Profile()
+			m.audio.SampleRate = cfg.SampleRate
+			m.audio.Channels = cfg.Channels
+		}
+	}
+}
+
+func (m *mediaInfo) updateMetadata(p *av.Packet) {
+	vs, _ := (&amf.Decoder{}).DecodeBatch(bytes.NewReader(p.Data), amf.AMF0)
+	for _, v := range vs {
+		obj, ok := v.(amf.Object)
+		if !ok {
+			continue
+		}
+		// keep the plain values, they are what the API shows
+		m.metadata = make(amf.Object, len(obj))
+		for key, val := range obj {
+			switch val.(type) {
+			case float64, string, bool:
+				m.metadata[key] = val
+			}
+		}
+	}
+}
+
+func (m *mediaInfo) metaNumber(key string) float64 {
+	v, _ := m.metadata[key].(float64)
+	return v
+}
+
+// info returns copies of what is known about the tracks.
+func (m *mediaInfo) info() (*VideoInfo, *AudioInfo, amf.Object) {
+	var video *VideoInfo
+	var audio *AudioInfo
+	if m.hasVideo {
+		v := m.video
+		if m.sps != nil {
+			v.Profile = m.sps.Profile()
+			v.Level = m.sps.Level()
+			v.Width = m.sps.Width
+			v.Height = m.sps.Height
+			v.FrameRate = m.sps.FrameRate
+		}
+		if v.Width == 0 {
+			v.Width = int(m.metaNumber("width"))
+			v.Height = int(m.metaNumber("height"))
+		}
+		if v.FrameRate == 0 {
+			v.FrameRate = m.metaNumber("framerate")
+		}
+		video = &v
+	}
+	if m.hasAudio {
+		a := m.audio
+		if a.SampleRate == 0 {
+			a.SampleRate = int(m.metaNumber("audiosamplerate"))
+		}
+		audio = &a
+	}
+	var metadata amf.Object
+	if m.metadata != nil {
+		metadata = make(amf.Object, len(m.metadata))
+		for key, val := range m.metadata {
+			metadata[key] = val
+		}
+	}
+	return video, audio, metadata
+}
@@ -0,0 +1,77 @@
+package rtmp
+
+import (
+	"bomin/av"
+	"bomin/protocol/amf"
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 1280x720 High@3.1 30fps
+var testAVCConfig = []byte{
+	0x17, 0x00, 0x00, 0x00, 0x00,
+	0x01, 0x64, 0x00, 0x1f, 0xff, 0xe1, 0x00, 0x1a,
+	0x67, 0x64, 0x00, 0x1f, 0xac, 0xd9, 0x40, 0x50, 0x05, 0xbb, 0x01, 0x10, 0x00, 0x00, 0x03, 0x00,
+	0x10, 0x00, 0x00, 0x03, 0x03, 0xc0, 0xf1, 0x83, 0x19, 0x60,
+	0x01, 0x00, 0x04, 0x68, 0xeb, 0xe3, 0xcb,
+}
+
+func TestMediaInfoCodecs(t *testing.T) {
+	at := assert.New(t)
+	var m mediaInfo
+
+	m.update(&av.Packet{IsVideo: true, Header: testVideoHeader{codec: av.VIDEO_H264, key: true, seq: true}, Data: testAVCConfig})
+	// AAC LC 44.1kHz stereo
+	m.update(&av.Packet{IsAudio: true, Header: testAudioHeader{av.SOUND_AAC, av.AAC_SEQHDR}, Data: []byte{0xaf, 0x00, 0x12, 0x10}})
+	video, audio, _ := m.info()
+	at.Equal(&VideoInfo{Codec: "h264", Profile: "High", Level: "3.1", Width: 1280, Height: 720, FrameRate: 30}, video)
+	at.Equal(&AudioInfo{Codec: "aac", Profile: "LC", SampleRate: 44100, Channels: 2}, audio)
+
+	var other mediaInfo
+	other.update(&av.Packet{IsVideo: true, Header: testVideoHeader{codec: 99}})
+	video, audio, _ = other.info()
+	at.Equal("unknown(99)", video.Codec)
+	at.Nil(audio)
+}
+
+func TestMediaInfoMetadata(t *testing.T) {
+	at := assert.New(t)
+	var m mediaInfo
+	var buf bytes.Buffer
+	_, err := (&amf.Encoder{}).EncodeBatch(&buf, amf.AMF0, "onMetaData", amf.Object{
+		"width": float64(640), "height": float64(360), "framerate": float64(25),
+		"encoder": "obs", "nested": amf.Object{"a": float64(1)},
+	})
+	at.Nil(err)
+	m.update(&av.Packet{IsMetadata: true, Data: buf.Bytes()})
+	m.update(&av.Packet{IsVideo: true, Header: testVideoHeader{codec: 4, key: true}})
+
+	video, _, metadata := m.info()
+	at.Equal(640, video.Width)
+	at.Equal(360, video.Height)
+	at.Equal(float64(25), video.FrameRate)
+	at.Equal(amf.Object{"width": float64(640), "height": float64(360), "framerate": float64(25), "encoder": "obs"}, metadata)
+}
+
+func TestMediaInfoMeasure(t *testing.T) {
+	at := assert.New(t)
+	var m mediaInfo
+	// 25 fps video of 1000 bytes per frame with a keyframe every 2s,
+	// 125 bytes of audio every 20ms
+	for ts := uint32(0); ts <= 4000; ts += 20 {
+		if ts%40 == 0 {
+			key := ts%2000 == 0
+			m.update(&av.Packet{IsVideo: true, TimeStamp: ts,
+				Header: testVideoHeader{codec: av.VIDEO_H264, key: key}, Data: make([]byte, 1000)})
+		}
+		m.update(&av.Packet{IsAudio: true, TimeStamp: ts,
+			Header: testAudioHeader{av.SOUND_AAC, av.AAC_RAW}, Data: make([]byte, 125)})
+	}
+	video, audio, _ := m.info()
+	at.InDelta(25, video.MeasuredFPS, 0.5)
+	at.Equal(uint64(200), video.Bitrate)
+	at.Equal(float64(2), video.KeyframeInterval)
+	at.Equal(uint64(50), audio.Bitrate)
+}
@@ -0,0 +1,85 @@
+package rtmp
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// players is the set of writers of a stream. Changes copy the list under a
+// lock, the publisher goroutine walks the current list without locking nor
+// allocating.
+type players struct {
+	lock sync.Mutex
+	list atomic.Value // []*PackWriterCloser, never modified once stored
+}
+
+func newPlayers() *players {
+	ps := &players{}
+	ps.list.Store([]*PackWriterCloser(nil))
+	return ps
+}
+
+// load returns the current list, it must not be modified.
+func (ps *players) load() []*PackWriterCloser {
+	return ps.list.Load().([]*PackWriterCloser)
+}
+
+// add adds pw, replacing the writer with the same UID if any.
+func (ps *players) add(pw *PackWriterCloser) {
+	uid := pw.w.Info().UID
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	old := ps.load()
+	list := make([]*PackWriterCloser, 0, len(old)+1)
+	for _, v := range old {
+		if v.uid != uid {
+			list = append(list, v)
+		}
+	}
+	ps.list.Store(append(list, pw))
+}
+
+// get returns the writer with the given UID, nil if there is none.
+func (ps *players) get(uid string) *PackWriterCloser {
+	for _, v := range ps.load() {
+		if v.uid == uid {
+			return v
+		}
+	}
+	return nil
+}
+
+// remove removes the writer with the given UID and returns it, nil if
+// there is none.
+func (ps *players) remove(uid string) *PackWriterCloser {
+	if pw := ps.get(uid); pw != nil && ps.drop(pw) {
+		return pw
+	}
+	return nil
+}
+
+// drop removes pw itself, not a writer that replaced it since. It reports
+// whether pw was there.
+func (ps *players) drop(pw *PackWriterCloser) bool {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	old := ps.load()
+	for i, v := range old {
+		if v == pw {
+			list := make([]*PackWriterCloser, 0, len(old)-1)
+			list = append(list, old[:i]...)
+			ps.list.Store(append(list, old[i+1:]...))
+			return true
+		}
+	}
+	return false
+}
+
+// removeAll empties the set and returns what it held.
+func (ps *players) removeAll() []*PackWriterCloser {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	old := ps.load()
+	ps.list.Store([]*PackWriterCloser(nil))
+	return old
+}
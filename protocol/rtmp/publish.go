@@ -0,0 +1,69 @@
+package rtmp
+
+import (
+	"sync"
+)
+
+// PublishEvent is emitted when a key starts, or stops, being published.
+type PublishEvent struct {
+	Key        string `json:"key"`
+	UID        string `json:"uid"`
+	Publishing bool   `json:"publishing"`
+}
+
+// publishLog keeps the publisher of each key and passes its start and stop
+// on to the handlers. A publisher taking a key over starts it again, the
+// end of the one it replaced stops nothing.
+type publishLog struct {
+	lock     sync.Mutex
+	current  map[string]string
+	handlers []func(PublishEvent)
+}
+
+// claim makes uid the publisher of key before it starts, so that the end
+// of the publisher it replaces is not taken for the end of key.
+func (l *publishLog) claim(key, uid string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.current == nil {
+		l.current = make(map[string]string)
+	}
+	l.current[key] = uid
+}
+
+func (l *publishLog) start(key, uid string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.current == nil {
+		l.current = make(map[string]string)
+	}
+	l.current[key] = uid
+	l.emit(PublishEvent{Key: key, UID: uid, Publishing: true})
+}
+
+func (l *publishLog) stop(key, uid string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if cur, ok := l.current[key]; !ok || cur != uid {
+		return
+	}
+	delete(l.current, key)
+	l.emit(PublishEvent{Key: key, UID: uid})
+}
+
+// emit is called with the lock held, so the handlers see the events of a
+// key in order.
+func (l *publishLog) emit(e PublishEvent) {
+	for _, handler := range l.handlers {
+		handler(e)
+	}
+}
+
+// OnPublish adds a handler called whenever a key starts or stops being
+// published. It is called from the publisher's goroutine and must not
+// block.
+func (rs *RtmpStream) OnPublish(handler func(PublishEvent)) {
+	rs.publishes.lock.Lock()
+	rs.publishes.handlers = append(rs.publishes.handlers, handler)
+	rs.publishes.lock.Unlock()
+}
@@ -0,0 +1,48 @@
+package rtmp
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPublishEvents(t *testing.T) {
+	at := assert.New(t)
+	rs := NewRtmpStream()
+	var lock sync.Mutex
+	var events []PublishEvent
+	rs.OnPublish(func(e PublishEvent) {
+		lock.Lock()
+		events = append(events, e)
+		lock.Unlock()
+	})
+	waitEvents := func(n int) []PublishEvent {
+		deadline := time.Now().Add(time.Second)
+		for {
+			lock.Lock()
+			ret := append([]PublishEvent(nil), events...)
+			lock.Unlock()
+			if len(ret) >= n || time.Now().After(deadline) {
+				return ret
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	first := rs.NewPublisher("live/movie")
+	at.Nil(first.Write(keyFrame()))
+	// taking the key over starts it again, the end of the first publisher
+	// stops nothing
+	second := rs.NewPublisher("live/movie")
+	<-first.Done()
+	second.Close(nil)
+
+	got := waitEvents(3)
+	if at.Len(got, 3) {
+		at.Equal(PublishEvent{Key: "live/movie", UID: first.Info().UID, Publishing: true}, got[0])
+		at.Equal(PublishEvent{Key: "live/movie", UID: second.Info().UID, Publishing: true}, got[1])
+		at.Equal(PublishEvent{Key: "live/movie", UID: second.Info().UID}, got[2])
+	}
+}
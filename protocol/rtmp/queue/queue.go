@@ -0,0 +1,306 @@
+// Package queue is the bounded packet queue between a stream and a slow
+// player: the stream pushes without ever blocking, the player's sender
+// pops, and a full queue drops packets as its policy says.
+package queue
+
+import (
+	"bomin/av"
+	"bomin/utils/metrics"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Policy is what a full queue does.
+type Policy int
+
+const (
+	// DropToKeyframe drops the queued audio and video, and the next video
+	// frames until a key frame: the player resumes on a complete GOP.
+	DropToKeyframe Policy = iota
+	// DropNonReference drops the queued video frames no other frame
+	// refers to, and drops to the next key frame if there are none.
+	DropNonReference
+	// Disconnect closes the queue with ErrTooSlow.
+	Disconnect
+)
+
+var policyNames = []string{"keyframe", "non-reference", "disconnect"}
+
+func (p Policy) String() string {
+	if p < 0 || int(p) >= len(policyNames) {
+		return fmt.Sprintf("Policy(%d)", int(p))
+	}
+	return policyNames[p]
+}
+
+// ParsePolicy returns the policy named name, as printed by String.
+func ParsePolicy(name string) (Policy, error) {
+	for i, n := range policyNames {
+		if n == name {
+			return Policy(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown drop policy %q", name)
+}
+
+// Config is how a queue handles a consumer that cannot keep up.
+type Config struct {
+	Policy Policy
+	// MaxLag closes the queue with ErrTooSlow once the queued packets span
+	// more than MaxLag of stream time, whatever the policy. Zero never
+	// does.
+	MaxLag time.Duration
+}
+
+var DefaultConfig = Config{Policy: DropToKeyframe}
+
+var (
+	// ErrClosed is returned once the queue is closed.
+	ErrClosed = errors.New("queue closed")
+	// ErrTooSlow is returned once the consumer has been cut off.
+	ErrTooSlow = errors.New("consumer too slow")
+)
+
+// Queue is a bounded packet queue with a single consumer.
+type Queue struct {
+	name string
+	cfg  Config
+
+	lock    sync.Mutex
+	cond    *sync.Cond
+	packets []*av.Packet // ring of n packets from head
+	head, n int
+	waitKey bool
+	dropped uint64
+	err     error
+	drain   bool
+}
+
+// New returns a queue of size packets. name labels its drops in the
+// dropped packets metric.
+func New(name string, size int, cfg Config) *Queue {
+	q := &Queue{
+		name:    name,
+		cfg:     cfg,
+		packets: make([]*av.Packet, size),
+	}
+	q.cond = sync.NewCond(&q.lock)
+	return q
+}
+
+// Push queues p, retained until popped or dropped, it never blocks. It
+// fails once the queue is closed, possibly by p itself putting the consumer
+// too far behind.
+func (q *Queue) Push(p *av.Packet) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.err != nil {
+		return q.err
+	}
+	if q.n == len(q.packets) {
+		switch q.cfg.Policy {
+		case Disconnect:
+			q.closeLocked(ErrTooSlow, false)
+			return q.err
+		case DropNonReference:
+			if q.filter(func(p *av.Packet) bool { return !isNonReference(p) }) == 0 {
+				q.dropToKeyframe()
+			}
+		default:
+			q.dropToKeyframe()
+		}
+		if q.n == len(q.packets) {
+			// headers only
+			q.filter(func(*av.Packet) bool { return false })
+		}
+	}
+	if q.waitKey && p.IsVideo {
+		if !isKeyFrame(p) {
+			q.drop(1)
+			return nil
+		}
+		q.waitKey = false
+	}
+
+	p.Retain()
+	q.packets[(q.head+q.n)%len(q.packets)] = p
+	q.n++
+	if q.cfg.MaxLag > 0 && q.lag(p) > q.cfg.MaxLag {
+		q.closeLocked(ErrTooSlow, false)
+		return q.err
+	}
+	q.cond.Signal()
+	return nil
+}
+
+// Pop returns the next packet, waiting for one. The caller releases it
+// once sent. Once the queue is closed it returns ErrClosed, or ErrTooSlow,
+// or io.EOF after the packets left when closed to be drained.
+func (q *Queue) Pop() (*av.Packet, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for q.n == 0 && q.err == nil {
+		q.cond.Wait()
+	}
+	if q.err != nil && !q.drain {
+		return nil, q.err
+	}
+	if q.n == 0 {
+		return nil, io.EOF
+	}
+	p := q.packets[q.head]
+	q.packets[q.head] = nil
+	q.head = (q.head + 1) % len(q.packets)
+	q.n--
+	return p, nil
+}
+
+// Close closes the queue, Pop still returns the packets left if drain is
+// set. A later Close without drain cuts the drain off. It reports whether
+// the queue was open.
+func (q *Queue) Close(drain bool) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	open := q.err == nil
+	q.closeLocked(ErrClosed, drain)
+	return open
+}
+
+func (q *Queue) closeLocked(err error, drain bool) {
+	if q.err == nil {
+		q.err = err
+		q.drain = drain
+	} else if !drain {
+		q.drain = false
+	}
+	if !q.drain {
+		q.clear()
+	}
+	q.cond.Broadcast()
+}
+
+// clear releases the packets left in a closed queue, they do not count as
+// dropped.
+func (q *Queue) clear() {
+	for ; q.n > 0; q.n-- {
+		q.packets[q.head].Release()
+		q.packets[q.head] = nil
+		q.head = (q.head + 1) % len(q.packets)
+	}
+}
+
+// Len returns the number of packets queued.
+func (q *Queue) Len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.n
+}
+
+// Dropped returns the number of packets dropped so far.
+func (q *Queue) Dropped() uint64 {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.dropped
+}
+
+func (q *Queue) drop(n int) {
+	q.dropped += uint64(n)
+	metrics.DroppedPackets.With(q.name).Add(uint64(n))
+}
+
+// dropToKeyframe keeps the queued headers and metadata only, the next
+// video frames are dropped until a key frame.
+func (q *Queue) dropToKeyframe() {
+	q.filter(isHeader)
+	q.waitKey = true
+}
+
+// filter drops the queued packets keep refuses and returns their number.
+func (q *Queue) filter(keep func(*av.Packet) bool) int {
+	size := len(q.packets)
+	kept := 0
+	for i := 0; i < q.n; i++ {
+		p := q.packets[(q.head+i)%size]
+		q.packets[(q.head+i)%size] = nil
+		if keep(p) {
+			q.packets[(q.head+kept)%size] = p
+			kept++
+		} else {
+			p.Release()
+		}
+	}
+	dropped := q.n - kept
+	q.n = kept
+	if dropped > 0 {
+		q.drop(dropped)
+	}
+	return dropped
+}
+
+// lag returns the stream time between the oldest queued frame and p.
+func (q *Queue) lag(p *av.Packet) time.Duration {
+	for i := 0; i < q.n; i++ {
+		first := q.packets[(q.head+i)%len(q.packets)]
+		if !isHeader(first) {
+			return time.Duration(int32(p.TimeStamp-first.TimeStamp)) * time.Millisecond
+		}
+	}
+	return 0
+}
+
+// isHeader reports whether p is metadata or a sequence header, which the
+// queue never drops.
+func isHeader(p *av.Packet) bool {
+	if p.IsMetadata {
+		return true
+	}
+	if p.IsVideo {
+		vh, ok := p.Header.(av.VideoPacketHeader)
+		return ok && vh.IsSeq()
+	}
+	if p.IsAudio {
+		ah, ok := p.Header.(av.AudioPacketHeader)
+		return ok && ah.SoundFormat() == av.SOUND_AAC && ah.AACPacketType() == av.AAC_SEQHDR
+	}
+	return false
+}
+
+func isKeyFrame(p *av.Packet) bool {
+	vh, ok := p.Header.(av.VideoPacketHeader)
+	return ok && (vh.IsKeyFrame() || vh.IsSeq())
+}
+
+// isNonReference reports whether p is a video frame no other frame refers
+// to: a disposable frame, or H.264 NAL units all with nal_ref_idc 0.
+func isNonReference(p *av.Packet) bool {
+	if !p.IsVideo || len(p.Data) < 5 || isKeyFrame(p) {
+		return false
+	}
+	if p.Data[0]>>4 == av.FRAME_DISPOSABLE {
+		return true
+	}
+	if p.Data[0]&0x0f != av.VIDEO_H264 || p.Data[1] != av.AVC_NALU {
+		return false
+	}
+	nalus := p.Data[5:]
+	if len(nalus) == 0 {
+		return false
+	}
+	for len(nalus) > 0 {
+		if len(nalus) < 5 {
+			return false
+		}
+		size := int(nalus[0])<<24 | int(nalus[1])<<16 | int(nalus[2])<<8 | int(nalus[3])
+		if size <= 0 || size > len(nalus)-4 {
+			return false
+		}
+		if nalus[4]>>5&0x03 != 0 {
+			return false
+		}
+		nalus = nalus[4+size:]
+	}
+	return true
+}
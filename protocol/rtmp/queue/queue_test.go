@@ -0,0 +1,141 @@
+package queue
+
+import (
+	"bomin/av"
+	"bomin/container/flv"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func video(ts uint32, frame, avcType byte, nalus ...byte) *av.Packet {
+	p := &av.Packet{IsVideo: true, TimeStamp: ts, Data: append([]byte{frame<<4 | av.VIDEO_H264, avcType, 0, 0, 0}, nalus...)}
+	flv.NewDemuxer().DemuxH(p)
+	return p
+}
+
+func audio(ts uint32) *av.Packet {
+	p := &av.Packet{IsAudio: true, TimeStamp: ts, Data: []byte{av.SOUND_AAC<<4 | 0x0f, av.AAC_RAW, 0xff}}
+	flv.NewDemuxer().DemuxH(p)
+	return p
+}
+
+func seq() *av.Packet                { return video(0, av.FRAME_KEY, av.AVC_SEQHDR) }
+func key(ts uint32) *av.Packet       { return video(ts, av.FRAME_KEY, av.AVC_NALU, 0, 0, 0, 1, 0x65) }
+func reference(ts uint32) *av.Packet { return video(ts, av.FRAME_INTER, av.AVC_NALU, 0, 0, 0, 1, 0x41) }
+
+// nonReference is a B frame, nal_ref_idc 0.
+func nonReference(ts uint32) *av.Packet {
+	return video(ts, av.FRAME_INTER, av.AVC_NALU, 0, 0, 0, 1, 0x01)
+}
+
+func popAll(q *Queue) (stamps []uint32) {
+	for q.Len() > 0 {
+		p, _ := q.Pop()
+		stamps = append(stamps, p.TimeStamp)
+	}
+	return
+}
+
+func TestDropToKeyframe(t *testing.T) {
+	at := assert.New(t)
+	q := New("test", 4, DefaultConfig)
+	for _, p := range []*av.Packet{seq(), key(0), reference(40), audio(40)} {
+		at.Nil(q.Push(p))
+	}
+	// full: the sequence header stays, the frames go until the next key
+	at.Nil(q.Push(reference(80)))
+	at.Nil(q.Push(audio(80)))
+	at.Nil(q.Push(reference(120)))
+	at.Nil(q.Push(key(160)))
+	at.Equal(uint64(5), q.Dropped())
+
+	p, err := q.Pop()
+	at.Nil(err)
+	at.True(isHeader(p))
+	at.Equal([]uint32{80, 160}, popAll(q))
+}
+
+func TestDropNonReference(t *testing.T) {
+	at := assert.New(t)
+	q := New("test", 4, Config{Policy: DropNonReference})
+	for _, p := range []*av.Packet{key(0), nonReference(40), reference(80), nonReference(120)} {
+		at.Nil(q.Push(p))
+	}
+	at.Nil(q.Push(reference(160)))
+	at.Equal(uint64(2), q.Dropped())
+	at.Equal([]uint32{0, 80, 160}, popAll(q))
+
+	// with no non-reference frame left it drops to the next key frame
+	for _, p := range []*av.Packet{key(200), reference(240), reference(280), reference(320)} {
+		at.Nil(q.Push(p))
+	}
+	at.Nil(q.Push(reference(360)))
+	at.Nil(q.Push(key(400)))
+	at.Equal(uint64(7), q.Dropped())
+	at.Equal([]uint32{400}, popAll(q))
+}
+
+func TestDisconnect(t *testing.T) {
+	at := assert.New(t)
+	q := New("test", 2, Config{Policy: Disconnect})
+	at.Nil(q.Push(key(0)))
+	at.Nil(q.Push(reference(40)))
+	at.Equal(ErrTooSlow, q.Push(reference(80)))
+	at.Equal(ErrTooSlow, q.Push(key(120)))
+	_, err := q.Pop()
+	at.Equal(ErrTooSlow, err)
+	at.False(q.Close(false))
+}
+
+func TestMaxLag(t *testing.T) {
+	at := assert.New(t)
+	q := New("test", 100, Config{MaxLag: time.Second})
+	// headers do not count, their timestamps are old
+	at.Nil(q.Push(seq()))
+	at.Nil(q.Push(key(5000)))
+	at.Nil(q.Push(reference(6000)))
+	at.Equal(ErrTooSlow, q.Push(reference(6040)))
+}
+
+func TestPopClose(t *testing.T) {
+	at := assert.New(t)
+	q := New("test", 4, DefaultConfig)
+	popped := make(chan error)
+	go func() {
+		_, err := q.Pop()
+		popped <- err
+	}()
+	at.Nil(q.Push(key(0)))
+	at.Nil(<-popped)
+
+	// drained, then cut off
+	at.Nil(q.Push(reference(40)))
+	at.Nil(q.Push(reference(80)))
+	at.True(q.Close(true))
+	at.Equal(ErrClosed, q.Push(reference(120)))
+	p, err := q.Pop()
+	at.Nil(err)
+	at.Equal(uint32(40), p.TimeStamp)
+	at.False(q.Close(false))
+	_, err = q.Pop()
+	at.Equal(ErrClosed, err)
+
+	q = New("test", 4, DefaultConfig)
+	at.True(q.Close(true))
+	_, err = q.Pop()
+	at.Equal(io.EOF, err)
+}
+
+func TestParsePolicy(t *testing.T) {
+	at := assert.New(t)
+	for _, p := range []Policy{DropToKeyframe, DropNonReference, Disconnect} {
+		parsed, err := ParsePolicy(p.String())
+		at.Nil(err)
+		at.Equal(p, parsed)
+	}
+	_, err := ParsePolicy("sometimes")
+	at.NotNil(err)
+}
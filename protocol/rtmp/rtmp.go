@@ -4,39 +4,54 @@ import (
 	"bomin/av"
 	"bomin/configure"
 	"bomin/container/flv"
+	"bomin/logging"
 	"bomin/protocol/rtmp/core"
+	"bomin/protocol/rtmp/queue"
+	"bomin/protocol/rtmp/rtmprelay"
+	"bomin/utils/metrics"
 	"bomin/utils/uid"
 	"errors"
-	"flag"
 	"fmt"
-
-	"log"
+	"io"
 	"net"
-	"net/url"
 	"reflect"
-	"strings"
 	"time"
 )
 
 const (
-	maxQueueNum           = 1024
-	SAVE_STATICS_INTERVAL = 5000
+	maxQueueNum = 1024
 )
 
-var (
-	readTimeout  = flag.Int("readTimeout", 10, "read time out")
-	writeTimeout = flag.Int("writeTimeout", 10, "write time out")
+// A publisher or player that moves no data for its timeout is closed.
+const (
+	DefaultReadTimeout  = 10 * time.Second
+	DefaultWriteTimeout = 10 * time.Second
+	// DefaultConnectTimeout bounds the commands of a new connection up to
+	// publish or play.
+	DefaultConnectTimeout = 10 * time.Second
 )
 
+var logger = logging.New("rtmp")
+
+var handshakeFailures = metrics.NewCounter("bomin_rtmp_handshake_failures_total",
+	"RTMP connections that failed the server handshake.")
+
 type Client struct {
-	handler av.Handler
-	getter  av.GetWriter
+	handler      av.Handler
+	getter       av.GetWriter
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	// Queue is how the players' queues handle players that cannot keep up.
+	Queue queue.Config
 }
 
 func NewRtmpClient(h av.Handler, getter av.GetWriter) *Client {
 	return &Client{
-		handler: h,
-		getter:  getter,
+		handler:      h,
+		getter:       getter,
+		ReadTimeout:  DefaultReadTimeout,
+		WriteTimeout: DefaultWriteTimeout,
+		Queue:        queue.DefaultConfig,
 	}
 }
 
@@ -46,12 +61,12 @@ func (c *Client) Dial(url string, method string) error {
 		return err
 	}
 	if method == av.PUBLISH {
-		writer := NewVirWriter(connClient)
-		log.Printf("client Dial call NewVirWriter url=%s, method=%s", url, method)
+		writer := NewVirWriter(connClient, c.WriteTimeout, c.Queue)
+		writer.log.Info("publishing to remote")
 		c.handler.HandleWriter(writer)
 	} else if method == av.PLAY {
-		reader := NewVirReader(connClient)
-		log.Printf("client Dial call NewVirReader url=%s, method=%s", url, method)
+		reader := NewVirReader(connClient, c.ReadTimeout)
+		reader.log.Info("playing from remote")
 		c.handler.HandleReader(reader)
 		if c.getter != nil {
 			writer := c.getter.GetWriter(reader.Info())
@@ -66,21 +81,39 @@ func (c *Client) GetHandle() av.Handler {
 }
 
 type Server struct {
-	handler av.Handler
-	getter  av.GetWriter
+	handler      av.Handler
+	getter       av.GetWriter
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	// HandshakeTimeout bounds the handshake and ConnectTimeout the
+	// commands up to publish or play, 0 does not.
+	HandshakeTimeout time.Duration
+	ConnectTimeout   time.Duration
+	// MaxConns caps the connections served at once, MaxConnsPerIP those
+	// from one IP, 0 is no limit.
+	MaxConns      int
+	MaxConnsPerIP int
+	// Queue is how the players' queues handle players that cannot keep up.
+	Queue queue.Config
+	conns connLimiter
 }
 
 func NewRtmpServer(h av.Handler, getter av.GetWriter) *Server {
 	return &Server{
-		handler: h,
-		getter:  getter,
+		handler:          h,
+		getter:           getter,
+		ReadTimeout:      DefaultReadTimeout,
+		WriteTimeout:     DefaultWriteTimeout,
+		HandshakeTimeout: core.DefaultHandshakeTimeout,
+		ConnectTimeout:   DefaultConnectTimeout,
+		Queue:            queue.DefaultConfig,
 	}
 }
 
 func (s *Server) Serve(listener net.Listener) (err error) {
 	defer func() {
 		if r := recover(); r != nil {
-			log.Println("rtmp serve panic: ", r)
+			logger.Errorf("serve panic: %v", r)
 		}
 	}()
 
@@ -90,53 +123,89 @@ func (s *Server) Serve(listener net.Listener) (err error) {
 		if err != nil {
 			return
 		}
+		ip := remoteIP(netconn.RemoteAddr().String()).String()
+		if reason := s.conns.acquire(ip, s.MaxConns, s.MaxConnsPerIP); reason != "" {
+			rejected.With(reason).Inc()
+			logger.With("remote", netconn.RemoteAddr()).Warnf("rejected: %s", reason)
+			netconn.Close()
+			continue
+		}
+		netconn = &limitedConn{Conn: netconn, release: func() { s.conns.release(ip) }}
 		conn := core.NewConn(netconn, 4*1024)
-		log.Println("Client connect remote:", conn.RemoteAddr().String(),
-			"local:", conn.LocalAddr().String())
+		logger.With("remote", conn.RemoteAddr()).Debugf("connected to %v", conn.LocalAddr())
 		go s.handleConn(conn)
 	}
 }
 
 func (s *Server) handleConn(conn *core.Conn) error {
+	clog := logger.With("remote", conn.RemoteAddr())
+	conn.SetHandshakeTimeout(s.HandshakeTimeout)
 	if err := conn.HandshakeServer(); err != nil {
+		handshakeFailures.Inc()
 		conn.Close()
-		log.Println("handleConn HandshakeServer err:", err)
+		clog.Warnf("handshake failed: %v", err)
 		return err
 	}
 	connServer := core.NewConnServer(conn)
 
+	if s.ConnectTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(s.ConnectTimeout))
+	}
 	if err := connServer.ReadMsg(); err != nil {
 		conn.Close()
-		log.Println("handleConn read msg err:", err)
+		clog.Warnf("read command failed: %v", err)
 		return err
 	}
+	conn.SetDeadline(time.Time{})
 
-	appName, _, _ := connServer.GetInfo()
-
-	if ret := configure.CheckAppName(appName); !ret {
+	appName, name, _ := connServer.GetInfo()
+	// the app of a vhost is told apart by its name, in the stream key too
+	resolved, ok := configure.ResolveApp(connServer.Vhost, appName)
+	if ret := ok && configure.CheckAppName(resolved); !ret {
 		err := errors.New(fmt.Sprintf("application name=%s is not configured", appName))
 		conn.Close()
-		log.Println("CheckAppName err:", err)
+		clog.Warnf("rejected: %v", err)
 		return err
 	}
+	appName = resolved
+	connServer.ConnInfo.App = appName
+	if rs, ok := s.handler.(*RtmpStream); ok {
+		// the transcoding processes play and publish the keys themselves
+		connServer.Internal = rs.internal(connServer.Query)
+	}
+	if rs, ok := s.handler.(*RtmpStream); ok && !connServer.Internal {
+		// the stream key, and so the logs, carry the mapped name and not a
+		// secret one
+		mapped, err := rs.MapName(appName, name, connServer.Query, connServer.IsPublisher())
+		if err != nil {
+			conn.Close()
+			clog.Warnf("rejected %s: %v", appName+"/"+name, err)
+			return err
+		}
+		if mapped != name {
+			connServer.PublishInfo.Name = mapped
+			name = mapped
+		}
+		if err := rs.Admit(appName+"/"+name, connServer.IsPublisher(), conn.RemoteAddr().String()); err != nil {
+			conn.Close()
+			clog.Warnf("rejected %s: %v", appName+"/"+name, err)
+			return err
+		}
+	}
 
 	if connServer.IsPublisher() {
-		if pushList, ret := configure.GetStaticPushUrlList(appName); ret && (pushList != nil) {
-			log.Printf("GetStaticPushUrlList: %v", pushList)
-		}
-		reader := NewVirReader(connServer)
+		reader := NewVirReader(connServer, s.ReadTimeout)
 		s.handler.HandleReader(reader)
-		log.Printf("Publisher:%v", reader.Uid)
+		reader.log.Info("publisher connected")
 
 		if s.getter != nil {
-			writeType := reflect.TypeOf(s.getter)
-			log.Printf("Connect type:%v", writeType)
 			writer := s.getter.GetWriter(reader.Info())
+			reader.log.Debugf("attached %T", writer)
 			s.handler.HandleWriter(writer)
 		}
 	} else {
-		writer := NewVirWriter(connServer)
-		log.Printf("Player:%v", writer.Uid)
+		writer := NewVirWriter(connServer, s.WriteTimeout, s.Queue)
+		writer.log.Info("player connected")
 		s.handler.HandleWriter(writer)
 	}
 
@@ -154,71 +223,67 @@ type StreamReadWriteCloser interface {
 	Read(c *core.ChunkStream) error
 }
 
-type StaticsBW struct {
-	StreamId               uint32
-	VideoDatainBytes       uint64
-	LastVideoDatainBytes   uint64
-	VideoSpeedInBytesperMS uint64
-
-	AudioDatainBytes       uint64
-	LastAudioDatainBytes   uint64
-	AudioSpeedInBytesperMS uint64
+// connInfo returns the info of the stream conn publishes or plays, its key
+// being app/name as the connection names them. A stream played from another
+// server, or published by its forwarders and relays, is relayed.
+func connInfo(conn StreamReadWriteCloser, uid string) av.Info {
+	app, name, URL := conn.GetInfo()
+	info := av.Info{Key: app + "/" + name, URL: URL, UID: uid}
+	switch c := conn.(type) {
+	case *core.ConnClient:
+		info.Relayed = true
+	case *core.ConnServer:
+		info.Relayed = c.Query.Get(rtmprelay.RelayParam) != ""
+		info.Internal = c.Internal
+	}
+	return info
+}
 
-	LastTimestamp int64
+// connLogger returns a logger carrying the remote address of conn, when it
+// is known, the uid and the stream key.
+func connLogger(conn StreamReadWriteCloser, uid string) logging.Logger {
+	l := logger
+	if c, ok := conn.(interface{ RemoteAddr() net.Addr }); ok {
+		if addr := c.RemoteAddr(); addr != nil {
+			l = l.With("remote", addr)
+		}
+	}
+	app, name, _ := conn.GetInfo()
+	return l.With("uid", uid, "key", app+"/"+name)
 }
 
 type VirWriter struct {
-	Uid    string
-	closed bool
+	Uid     string
+	drained chan struct{}
 	av.RWBaser
-	conn        StreamReadWriteCloser
-	packetQueue chan *av.Packet
-	WriteBWInfo StaticsBW
+	av.Stats
+	conn  StreamReadWriteCloser
+	queue *queue.Queue
+	log   logging.Logger
 }
 
-func NewVirWriter(conn StreamReadWriteCloser) *VirWriter {
+func NewVirWriter(conn StreamReadWriteCloser, timeout time.Duration, cfg queue.Config) *VirWriter {
 	ret := &VirWriter{
-		Uid:         uid.NewId(),
-		conn:        conn,
-		RWBaser:     av.NewRWBaser(time.Second * time.Duration(*writeTimeout)),
-		packetQueue: make(chan *av.Packet, maxQueueNum),
-		WriteBWInfo: StaticsBW{0, 0, 0, 0, 0, 0, 0, 0},
+		Uid:     uid.NewId(),
+		conn:    conn,
+		RWBaser: av.NewRWBaser(timeout),
+		queue:   queue.New("rtmp", maxQueueNum, cfg),
+		drained: make(chan struct{}),
 	}
+	ret.log = connLogger(conn, ret.Uid)
 
 	go ret.Check()
 	go func() {
-		ret.SendPacket()
-		//if err != nil {
-		//	log.Println(err)
-		//}
+		err := ret.SendPacket()
+		if err == queue.ErrTooSlow {
+			ret.Close(err)
+		}
+		ret.queue.Close(false)
+		close(ret.drained)
 	}()
 	return ret
 }
 
-func (v *VirWriter) SaveStatics(streamid uint32, length uint64, isVideoFlag bool) {
-	nowInMS := int64(time.Now().UnixNano() / 1e6)
-
-	v.WriteBWInfo.StreamId = streamid
-	if isVideoFlag {
-		v.WriteBWInfo.VideoDatainBytes = v.WriteBWInfo.VideoDatainBytes + length
-	} else {
-		v.WriteBWInfo.AudioDatainBytes = v.WriteBWInfo.AudioDatainBytes + length
-	}
-
-	if v.WriteBWInfo.LastTimestamp == 0 {
-		v.WriteBWInfo.LastTimestamp = nowInMS
-	} else if (nowInMS - v.WriteBWInfo.LastTimestamp) >= SAVE_STATICS_INTERVAL {
-		diffTimestamp := (nowInMS - v.WriteBWInfo.LastTimestamp) / 1000
-
-		v.WriteBWInfo.VideoSpeedInBytesperMS = (v.WriteBWInfo.VideoDatainBytes - v.WriteBWInfo.LastVideoDatainBytes) * 8 / uint64(diffTimestamp) / 1000
-		v.WriteBWInfo.AudioSpeedInBytesperMS = (v.WriteBWInfo.AudioDatainBytes - v.WriteBWInfo.LastAudioDatainBytes) * 8 / uint64(diffTimestamp) / 1000
-
-		v.WriteBWInfo.LastVideoDatainBytes = v.WriteBWInfo.VideoDatainBytes
-		v.WriteBWInfo.LastAudioDatainBytes = v.WriteBWInfo.AudioDatainBytes
-		v.WriteBWInfo.LastTimestamp = nowInMS
-	}
-}
-
 func (v *VirWriter) Check() {
 	var c core.ChunkStream
 	for {
@@ -229,168 +294,125 @@ func (v *VirWriter) Check() {
 	}
 }
 
-func (v *VirWriter) DropPacket(pktQue chan *av.Packet, info av.Info) {
-	log.Printf("[%v] packet queue max!!!", info)
-	for i := 0; i < maxQueueNum-84; i++ {
-		tmpPkt, ok := <-pktQue
-		// try to don't drop audio
-		if ok && tmpPkt.IsAudio {
-			if len(pktQue) > maxQueueNum-2 {
-				log.Println("drop audio pkt")
-				<-pktQue
-			} else {
-				pktQue <- tmpPkt
-			}
-
-		}
-
-		if ok && tmpPkt.IsVideo {
-			videoPkt, ok := tmpPkt.Header.(av.VideoPacketHeader)
-			// dont't drop sps config and dont't drop key frame
-			if ok && (videoPkt.IsSeq() || videoPkt.IsKeyFrame()) {
-				pktQue <- tmpPkt
-			}
-			if len(pktQue) > maxQueueNum-10 {
-				log.Println("drop video pkt")
-				<-pktQue
-			}
-		}
-
-	}
-	log.Println("packet queue len: ", len(pktQue))
+// Write queues p, a full queue drops packets as configured.
+func (v *VirWriter) Write(p *av.Packet) error {
+	return v.queue.Push(p)
 }
 
-//
-func (v *VirWriter) Write(p *av.Packet) (err error) {
-	err = nil
-
-	if v.closed {
-		err = errors.New("VirWriter closed")
-		return
-	}
-	defer func() {
-		if e := recover(); e != nil {
-			errString := fmt.Sprintf("VirWriter has already been closed:%v", e)
-			err = errors.New(errString)
-		}
-	}()
-	if len(v.packetQueue) >= maxQueueNum-24 {
-		v.DropPacket(v.packetQueue, v.Info())
-	} else {
-		v.packetQueue <- p
-	}
+// Dropped returns the number of packets dropped for the player.
+func (v *VirWriter) Dropped() uint64 {
+	return v.queue.Dropped()
+}
 
-	return
+// Counters returns what was sent to the player, and dropped by its queue.
+func (v *VirWriter) Counters() av.Counters {
+	c := v.Stats.Counters()
+	c.Dropped = v.queue.Dropped()
+	return c
 }
 
 func (v *VirWriter) SendPacket() error {
 	Flush := reflect.ValueOf(v.conn).MethodByName("Flush")
 	var cs core.ChunkStream
-	for {
-		p, ok := <-v.packetQueue
-		if ok {
-			cs.Data = p.Data
-			cs.Length = uint32(len(p.Data))
-			cs.StreamID = p.StreamID
-			cs.Timestamp = p.TimeStamp
-			cs.Timestamp += v.BaseTimeStamp()
-
-			if p.IsVideo {
-				cs.TypeID = av.TAG_VIDEO
+	send := func(p *av.Packet) error {
+		cs.Data = p.Data
+		cs.Length = uint32(len(p.Data))
+		cs.StreamID = p.StreamID
+		cs.Timestamp = p.TimeStamp
+
+		if p.IsVideo {
+			cs.TypeID = av.TAG_VIDEO
+		} else {
+			if p.IsMetadata {
+				cs.TypeID = av.TAG_SCRIPTDATAAMF0
 			} else {
-				if p.IsMetadata {
-					cs.TypeID = av.TAG_SCRIPTDATAAMF0
-				} else {
-					cs.TypeID = av.TAG_AUDIO
-				}
-			}
-
-			v.SaveStatics(p.StreamID, uint64(cs.Length), p.IsVideo)
-			v.SetPreTime()
-			v.RecTimeStamp(cs.Timestamp, cs.TypeID)
-			err := v.conn.Write(cs)
-			if err != nil {
-				v.closed = true
-				return err
+				cs.TypeID = av.TAG_AUDIO
 			}
-			Flush.Call(nil)
-		} else {
-			return errors.New("closed")
 		}
 
+		v.SetPreTime()
+		if err := v.conn.Write(cs); err != nil {
+			v.Close(err)
+			return err
+		}
+		Flush.Call(nil)
+		v.Update(p)
+		return nil
+	}
+	for {
+		p, err := v.queue.Pop()
+		if err == io.EOF {
+			v.unpublish()
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		err = send(p)
+		p.Release()
+		if err != nil {
+			return err
+		}
 	}
-	return nil
 }
 
 func (v *VirWriter) Info() (ret av.Info) {
-	ret.UID = v.Uid
-	_, _, URL := v.conn.GetInfo()
-	ret.URL = URL
-	_url, err := url.Parse(URL)
-	if err != nil {
-		log.Println(err)
-	}
-	ret.Key = strings.TrimLeft(_url.Path, "/")
+	ret = connInfo(v.conn, v.Uid)
 	ret.Inter = true
 	return
 }
 
+// unpublish ends the stream for the player once the queue is drained.
+func (v *VirWriter) unpublish() {
+	if n, ok := v.conn.(interface{ UnpublishNotify() error }); ok {
+		if err := n.UnpublishNotify(); err != nil {
+			v.log.Debugf("unpublish notify failed: %v", err)
+		}
+	}
+	v.conn.Close(ErrShutdown)
+}
+
+// Drained is closed once the writer has stopped sending.
+func (v *VirWriter) Drained() <-chan struct{} {
+	return v.drained
+}
+
+// Close disconnects the player. Closed with ErrShutdown the writer first
+// sends what is queued and NetStream.Play.UnpublishNotify.
 func (v *VirWriter) Close(err error) {
-	log.Println("Disconnect player:", v.Info().UID)
-	if !v.closed {
-		close(v.packetQueue)
+	drain := err == ErrShutdown
+	if v.queue.Close(drain) {
+		v.log.Infof("player disconnected: %v", err)
+	}
+	if !drain {
+		v.conn.Close(err)
 	}
-	v.closed = true
-	v.conn.Close(err)
 }
 
 type VirReader struct {
 	Uid string
 	av.RWBaser
-	demuxer    *flv.Demuxer
-	conn       StreamReadWriteCloser
-	ReadBWInfo StaticsBW
+	av.Stats
+	demuxer *flv.Demuxer
+	conn    StreamReadWriteCloser
+	log     logging.Logger
 }
 
-func NewVirReader(conn StreamReadWriteCloser) *VirReader {
+func NewVirReader(conn StreamReadWriteCloser, timeout time.Duration) *VirReader {
+	id := uid.NewId()
 	return &VirReader{
-		Uid:        uid.NewId(),
-		conn:       conn,
-		RWBaser:    av.NewRWBaser(time.Second * time.Duration(*writeTimeout)),
-		demuxer:    flv.NewDemuxer(),
-		ReadBWInfo: StaticsBW{0, 0, 0, 0, 0, 0, 0, 0},
-	}
-}
-
-func (v *VirReader) SaveStatics(streamid uint32, length uint64, isVideoFlag bool) {
-	nowInMS := int64(time.Now().UnixNano() / 1e6)
-
-	v.ReadBWInfo.StreamId = streamid
-	if isVideoFlag {
-		v.ReadBWInfo.VideoDatainBytes = v.ReadBWInfo.VideoDatainBytes + length
-	} else {
-		v.ReadBWInfo.AudioDatainBytes = v.ReadBWInfo.AudioDatainBytes + length
-	}
-
-	if v.ReadBWInfo.LastTimestamp == 0 {
-		v.ReadBWInfo.LastTimestamp = nowInMS
-	} else if (nowInMS - v.ReadBWInfo.LastTimestamp) >= SAVE_STATICS_INTERVAL {
-		diffTimestamp := (nowInMS - v.ReadBWInfo.LastTimestamp) / 1000
-
-		//log.Printf("now=%d, last=%d, diff=%d", nowInMS, v.ReadBWInfo.LastTimestamp, diffTimestamp)
-		v.ReadBWInfo.VideoSpeedInBytesperMS = (v.ReadBWInfo.VideoDatainBytes - v.ReadBWInfo.LastVideoDatainBytes) * 8 / uint64(diffTimestamp) / 1000
-		v.ReadBWInfo.AudioSpeedInBytesperMS = (v.ReadBWInfo.AudioDatainBytes - v.ReadBWInfo.LastAudioDatainBytes) * 8 / uint64(diffTimestamp) / 1000
-
-		v.ReadBWInfo.LastVideoDatainBytes = v.ReadBWInfo.VideoDatainBytes
-		v.ReadBWInfo.LastAudioDatainBytes = v.ReadBWInfo.AudioDatainBytes
-		v.ReadBWInfo.LastTimestamp = nowInMS
+		Uid:     id,
+		conn:    conn,
+		RWBaser: av.NewRWBaser(timeout),
+		demuxer: flv.NewDemuxer(),
+		log:     connLogger(conn, id),
 	}
 }
 
 func (v *VirReader) Read(p *av.Packet) (err error) {
 	defer func() {
 		if r := recover(); r != nil {
-			log.Println("rtmp read packet panic: ", r)
+			v.log.Errorf("read packet panic: %v", r)
 		}
 	}()
 
@@ -407,6 +429,7 @@ func (v *VirReader) Read(p *av.Packet) (err error) {
 			cs.TypeID == av.TAG_SCRIPTDATAAMF3 {
 			break
 		}
+		cs.Buffer.Release()
 	}
 
 	p.IsAudio = cs.TypeID == av.TAG_AUDIO
@@ -414,26 +437,19 @@ func (v *VirReader) Read(p *av.Packet) (err error) {
 	p.IsMetadata = cs.TypeID == av.TAG_SCRIPTDATAAMF0 || cs.TypeID == av.TAG_SCRIPTDATAAMF3
 	p.StreamID = cs.StreamID
 	p.Data = cs.Data
+	p.Buffer = cs.Buffer
 	p.TimeStamp = cs.Timestamp
 
-	v.SaveStatics(p.StreamID, uint64(len(p.Data)), p.IsVideo)
 	v.demuxer.DemuxH(p)
+	v.Update(p)
 	return err
 }
 
 func (v *VirReader) Info() (ret av.Info) {
-	ret.UID = v.Uid
-	_, _, URL := v.conn.GetInfo()
-	ret.URL = URL
-	_url, err := url.Parse(URL)
-	if err != nil {
-		log.Println(err)
-	}
-	ret.Key = strings.TrimLeft(_url.Path, "/")
-	return
+	return connInfo(v.conn, v.Uid)
 }
 
 func (v *VirReader) Close(err error) {
-	log.Println("publisher ", v.Info(), "closed: "+err.Error())
+	v.log.Infof("publisher disconnected: %v", err)
 	v.conn.Close(err)
 }
@@ -0,0 +1,427 @@
+package rtmprelay
+
+import (
+	"bomin/av"
+	"bomin/configure"
+	"bomin/logging"
+	"bomin/protocol/rtmp/core"
+	"bomin/utils/metrics"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultForwardTemplate = "rtmp://{node}/{app}/{name}"
+
+	forwardQueueNum   = 1024
+	forwardMinBackoff = time.Second
+	forwardMaxBackoff = 30 * time.Second
+)
+
+const (
+	ForwardConnecting = "connecting"
+	ForwardRunning    = "running"
+	ForwardRetrying   = "retrying"
+	ForwardStopped    = "stopped"
+)
+
+var ErrForwardStopped = errors.New("forward stopped")
+
+// RelayParam is the query parameter the forwarders and relays publish with,
+// so that the server they publish to does not forward the stream again.
+const RelayParam = "bomin_relay"
+
+// relayURL returns the URL u publishes to, marked with RelayParam.
+func relayURL(u string) string {
+	sep := "?"
+	if strings.Contains(u, "?") {
+		sep = "&"
+	}
+	return u + sep + RelayParam + "=1"
+}
+
+var reconnects = metrics.NewCounterVec("bomin_relay_reconnects_total",
+	"Reconnects of relays and publish forwards.", "kind")
+
+// ForwardStatus is a snapshot of a Forwarder for the management API.
+type ForwardStatus struct {
+	Key        string    `json:"key"`
+	URL        string    `json:"url"`
+	State      string    `json:"state"`
+	Reconnects int       `json:"reconnects"`
+	BytesSent  uint64    `json:"bytes_sent"`
+	Dropped    uint64    `json:"dropped"`
+	LastError  string    `json:"last_error,omitempty"`
+	Since      time.Time `json:"since"`
+}
+
+// ExpandTemplate fills {node}, {app}, {name}, {key} and {vhost} of a forward
+// target template for the stream key. {app} and {key} stand for the
+// application without its vhost, which only {vhost} gives.
+func ExpandTemplate(template, node, key string) string {
+	app, name := key, ""
+	if i := strings.Index(key, "/"); i >= 0 {
+		app, name = key[:i], key[i+1:]
+	}
+	app, vhost := configure.SplitApp(app)
+	if name != "" {
+		key = app + "/" + name
+	} else {
+		key = app
+	}
+	return strings.NewReplacer(
+		"{node}", node,
+		"{app}", app,
+		"{name}", name,
+		"{key}", key,
+		"{vhost}", vhost,
+	).Replace(template)
+}
+
+// ForwardTargets returns the URLs a publish of key is forwarded to: the
+// static_push entries of its application, followed by the forward template
+// expanded for each forward node.
+func ForwardTargets(key string) []string {
+	app := strings.SplitN(key, "/", 2)[0]
+	var targets []string
+	if pushList, ok := configure.GetStaticPushUrlList(app); ok {
+		for _, push := range pushList {
+			targets = append(targets, ExpandTemplate(push, "", key))
+		}
+	}
+	if nodes, template, ok := configure.GetForwardConfig(app); ok {
+		if template == "" {
+			template = DefaultForwardTemplate
+			// so that the nodes serve it from the app of the vhost too
+			if _, vhost := configure.SplitApp(app); vhost != "" {
+				template += "?vhost={vhost}"
+			}
+		}
+		for _, node := range nodes {
+			targets = append(targets, ExpandTemplate(template, node, key))
+		}
+	}
+	return targets
+}
+
+// Forwarder republishes one stream to one remote URL. It reconnects with
+// exponential backoff and resends the cached metadata and sequence headers
+// after every reconnect. Packets are queued in a bounded queue and dropped
+// when the remote side can't keep up.
+type Forwarder struct {
+	key string
+	url string
+
+	packetQueue chan *av.Packet
+	stop        chan struct{}
+	stopOnce    sync.Once
+
+	lock       sync.Mutex
+	metadata   *av.Packet
+	videoSeq   *av.Packet
+	audioSeq   *av.Packet
+	state      string
+	reconnects int
+	bytesSent  uint64
+	dropped    uint64
+	lastErr    error
+	since      time.Time
+	log        logging.Logger
+}
+
+func NewForwarder(key, url string) *Forwarder {
+	return &Forwarder{
+		key:         key,
+		url:         url,
+		packetQueue: make(chan *av.Packet, forwardQueueNum),
+		stop:        make(chan struct{}),
+		state:       ForwardConnecting,
+		since:       time.Now(),
+		log:         logger.With("key", key, "url", url),
+	}
+}
+
+func (f *Forwarder) Start() {
+	go f.run()
+}
+
+func (f *Forwarder) Stop() {
+	f.stopOnce.Do(func() {
+		close(f.stop)
+	})
+}
+
+// Write queues a copy of p, it never blocks.
+func (f *Forwarder) Write(p *av.Packet) {
+	pkt := *p
+
+	var header **av.Packet
+	if pkt.IsMetadata {
+		header = &f.metadata
+	} else if vh, ok := pkt.Header.(av.VideoPacketHeader); ok && pkt.IsVideo && vh.IsSeq() {
+		header = &f.videoSeq
+	} else if ah, ok := pkt.Header.(av.AudioPacketHeader); ok && pkt.IsAudio &&
+		ah.SoundFormat() == av.SOUND_AAC && ah.AACPacketType() == av.AAC_SEQHDR {
+		header = &f.audioSeq
+	}
+	if header != nil {
+		// kept for every new connection, with data of its own
+		h := pkt
+		h.Data = append([]byte(nil), pkt.Data...)
+		h.Buffer = nil
+		f.lock.Lock()
+		*header = &h
+		f.lock.Unlock()
+	}
+
+	pkt.Retain()
+	select {
+	case f.packetQueue <- &pkt:
+	default:
+		pkt.Release()
+		f.lock.Lock()
+		f.dropped++
+		f.lock.Unlock()
+	}
+}
+
+func (f *Forwarder) Status() ForwardStatus {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	status := ForwardStatus{
+		Key:        f.key,
+		URL:        f.url,
+		State:      f.state,
+		Reconnects: f.reconnects,
+		BytesSent:  f.bytesSent,
+		Dropped:    f.dropped,
+		Since:      f.since,
+	}
+	if f.lastErr != nil {
+		status.LastError = f.lastErr.Error()
+	}
+	return status
+}
+
+func (f *Forwarder) setState(state string, err error) {
+	f.lock.Lock()
+	if f.state != state {
+		f.state = state
+		f.since = time.Now()
+	}
+	if err != nil {
+		f.lastErr = err
+	}
+	f.lock.Unlock()
+}
+
+// forwardBackoff is the delay before the next reconnect of a forwarder.
+type forwardBackoff struct {
+	next time.Duration
+}
+
+// failed returns how long to wait after a session that lasted ran failed.
+// The delay doubles with every failure, a session that ran for a while
+// starts it over.
+func (b *forwardBackoff) failed(ran time.Duration) time.Duration {
+	if b.next == 0 || ran > forwardMaxBackoff {
+		b.next = forwardMinBackoff
+	}
+	delay := b.next
+	b.next *= 2
+	if b.next > forwardMaxBackoff {
+		b.next = forwardMaxBackoff
+	}
+	return delay
+}
+
+func (f *Forwarder) run() {
+	var backoff forwardBackoff
+	for {
+		start := time.Now()
+		err := f.publish()
+		if err == ErrForwardStopped {
+			break
+		}
+		delay := backoff.failed(time.Since(start))
+		f.log.Warnf("forward failed: %v, retry in %v", err, delay)
+		f.setState(ForwardRetrying, err)
+
+		select {
+		case <-f.stop:
+			f.setState(ForwardStopped, nil)
+			return
+		case <-time.After(delay):
+		}
+		f.lock.Lock()
+		f.reconnects++
+		f.lock.Unlock()
+		reconnects.With("forward").Inc()
+		f.setState(ForwardConnecting, nil)
+	}
+	f.setState(ForwardStopped, nil)
+}
+
+// publish runs one connection to the remote side until it fails or the
+// forwarder is stopped.
+func (f *Forwarder) publish() error {
+	client := core.NewConnClient()
+	if err := client.Start(relayURL(f.url), av.PUBLISH); err != nil {
+		return err
+	}
+	defer client.Close(nil)
+	f.setState(ForwardRunning, nil)
+	f.log.Info("forward started")
+
+	// what was queued while disconnected is stale, the remote side starts
+	// over from the headers and the next keyframe
+	f.flush()
+
+	f.lock.Lock()
+	headers := []*av.Packet{f.metadata, f.videoSeq, f.audioSeq}
+	hasVideo := f.videoSeq != nil
+	f.lock.Unlock()
+	for _, p := range headers {
+		if p == nil {
+			continue
+		}
+		if err := f.send(client, p); err != nil {
+			return err
+		}
+	}
+
+	// the remote decoder needs a keyframe before the first inter frame
+	waitKey := hasVideo
+	for {
+		select {
+		case <-f.stop:
+			return ErrForwardStopped
+		case p := <-f.packetQueue:
+			if waitKey && p.IsVideo {
+				if vh, ok := p.Header.(av.VideoPacketHeader); ok && vh.IsKeyFrame() {
+					waitKey = false
+				}
+			}
+			if waitKey {
+				p.Release()
+				continue
+			}
+			err := f.send(client, p)
+			p.Release()
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// flush drops the queued packets.
+func (f *Forwarder) flush() {
+	for {
+		select {
+		case p := <-f.packetQueue:
+			p.Release()
+			f.lock.Lock()
+			f.dropped++
+			f.lock.Unlock()
+		default:
+			return
+		}
+	}
+}
+
+func (f *Forwarder) send(client *core.ConnClient, p *av.Packet) error {
+	var cs core.ChunkStream
+	cs.Data = p.Data
+	cs.Length = uint32(len(p.Data))
+	cs.StreamID = client.GetStreamId()
+	cs.Timestamp = p.TimeStamp
+	if p.IsVideo {
+		cs.TypeID = av.TAG_VIDEO
+	} else if p.IsMetadata {
+		cs.TypeID = av.TAG_SCRIPTDATAAMF0
+	} else {
+		cs.TypeID = av.TAG_AUDIO
+	}
+	if err := client.Write(cs); err != nil {
+		return err
+	}
+	if err := client.Flush(); err != nil {
+		return err
+	}
+	f.lock.Lock()
+	f.bytesSent += uint64(cs.Length)
+	f.lock.Unlock()
+	return nil
+}
+
+// ForwardManager keeps the forwarders of all streams being published.
+type ForwardManager struct {
+	lock       sync.RWMutex
+	forwarders map[string][]*Forwarder
+}
+
+func NewForwardManager() *ForwardManager {
+	return &ForwardManager{
+		forwarders: make(map[string][]*Forwarder),
+	}
+}
+
+// Start starts forwarding key to its configured targets, replacing any
+// forwarders left over from a previous publisher. Relayed streams are not
+// forwarded: the caller does not start them.
+func (m *ForwardManager) Start(key string) []*Forwarder {
+	targets := ForwardTargets(key)
+	m.lock.Lock()
+	old := m.forwarders[key]
+	delete(m.forwarders, key)
+	m.lock.Unlock()
+	for _, f := range old {
+		f.Stop()
+	}
+	if len(targets) == 0 {
+		return nil
+	}
+
+	forwarders := make([]*Forwarder, 0, len(targets))
+	for _, url := range targets {
+		f := NewForwarder(key, url)
+		f.Start()
+		forwarders = append(forwarders, f)
+	}
+	m.lock.Lock()
+	m.forwarders[key] = forwarders
+	m.lock.Unlock()
+	return forwarders
+}
+
+// Stop stops the forwarders returned by Start. They are only removed from
+// the manager if a newer publisher of key hasn't replaced them yet.
+func (m *ForwardManager) Stop(key string, forwarders []*Forwarder) {
+	if len(forwarders) == 0 {
+		return
+	}
+	m.lock.Lock()
+	if cur := m.forwarders[key]; len(cur) > 0 && cur[0] == forwarders[0] {
+		delete(m.forwarders, key)
+	}
+	m.lock.Unlock()
+	for _, f := range forwarders {
+		f.Stop()
+	}
+}
+
+// List returns the status of every forwarder.
+func (m *ForwardManager) List() []ForwardStatus {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	var ret []ForwardStatus
+	for _, forwarders := range m.forwarders {
+		for _, f := range forwarders {
+			ret = append(ret, f.Status())
+		}
+	}
+	return ret
+}
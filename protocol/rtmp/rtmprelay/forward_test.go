@@ -0,0 +1,135 @@
+package rtmprelay
+
+import (
+	"bomin/av"
+	"bomin/configure"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type videoHeader struct {
+	key, seq bool
+}
+
+func (h videoHeader) IsKeyFrame() bool       { return h.key }
+func (h videoHeader) IsSeq() bool            { return h.seq }
+func (h videoHeader) CodecID() uint8         { return av.VIDEO_H264 }
+func (h videoHeader) CompositionTime() int32 { return 0 }
+
+func TestExpandTemplate(t *testing.T) {
+	at := assert.New(t)
+	at.Equal("rtmp://node2:1935/live/movie", ExpandTemplate(DefaultForwardTemplate, "node2:1935", "live/movie"))
+	at.Equal("rtmp://backup/live/movie_copy", ExpandTemplate("rtmp://backup/{key}_copy", "", "live/movie"))
+	at.Equal("rtmp://xx/live", ExpandTemplate("rtmp://xx/live", "", "live/movie"))
+	at.Equal("rtmp://backup/live/movie?vhost=media.example.com",
+		ExpandTemplate("rtmp://backup/{key}?vhost={vhost}", "", "live@media.example.com/movie"))
+}
+
+func TestForwardTargets(t *testing.T) {
+	at := assert.New(t)
+	saved := configure.RtmpServercfg
+	defer func() { configure.RtmpServercfg = saved }()
+	configure.RtmpServercfg = configure.ServerCfg{Server: []configure.Application{
+		{Appname: "live", Liveon: "on", Static_push: []string{"rtmp://cdn/{app}/{name}"},
+			Forward_nodes: []string{"node2", "node3"}},
+		{Appname: "other", Liveon: "on"},
+		{Appname: "live", Vhost: "media.example.com", Liveon: "on", Static_push: []string{"rtmp://cdn/{app}/{name}"},
+			Forward_nodes: []string{"node2"}},
+	}}
+
+	at.Equal([]string{"rtmp://cdn/live/movie", "rtmp://node2/live/movie", "rtmp://node3/live/movie"},
+		ForwardTargets("live/movie"))
+	at.Nil(ForwardTargets("other/movie"))
+	at.Equal([]string{"rtmp://cdn/live/movie", "rtmp://node2/live/movie?vhost=media.example.com"},
+		ForwardTargets("live@media.example.com/movie"))
+}
+
+func TestForwarderQueueBounded(t *testing.T) {
+	at := assert.New(t)
+	f := NewForwarder("live/movie", "rtmp://127.0.0.1:1/live/movie")
+	seq := &av.Packet{IsVideo: true, Header: videoHeader{key: true, seq: true}}
+	f.Write(seq)
+	for i := 0; i < forwardQueueNum+10; i++ {
+		f.Write(&av.Packet{IsVideo: true, Header: videoHeader{}})
+	}
+	status := f.Status()
+	at.Equal(uint64(11), status.Dropped)
+	at.Equal(ForwardConnecting, status.State)
+	at.NotNil(f.videoSeq)
+}
+
+func TestForwarderFlush(t *testing.T) {
+	at := assert.New(t)
+	f := NewForwarder("live/movie", "rtmp://127.0.0.1:1/live/movie")
+	f.Write(&av.Packet{IsVideo: true, Header: videoHeader{key: true, seq: true}})
+	f.Write(&av.Packet{IsVideo: true, Header: videoHeader{key: true}})
+	f.flush()
+	at.Len(f.packetQueue, 0)
+	at.Equal(uint64(2), f.Status().Dropped)
+	// the headers are kept for the connection
+	at.NotNil(f.videoSeq)
+}
+
+func TestRelayURL(t *testing.T) {
+	at := assert.New(t)
+	at.Equal("rtmp://node2/live/movie?bomin_relay=1", relayURL("rtmp://node2/live/movie"))
+	at.Equal("rtmp://node2/live/movie?token=x&bomin_relay=1", relayURL("rtmp://node2/live/movie?token=x"))
+}
+
+func TestForwarderRetryAndStop(t *testing.T) {
+	at := assert.New(t)
+	f := NewForwarder("live/movie", "rtmp://127.0.0.1:1/live/movie")
+	f.Start()
+	deadline := time.Now().Add(5 * time.Second)
+	for f.Status().State != ForwardRetrying && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	status := f.Status()
+	at.Equal(ForwardRetrying, status.State)
+	at.NotEqual("", status.LastError)
+
+	f.Stop()
+	f.Stop()
+	deadline = time.Now().Add(5 * time.Second)
+	for f.Status().State != ForwardStopped && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	at.Equal(ForwardStopped, f.Status().State)
+}
+
+func TestForwardManager(t *testing.T) {
+	at := assert.New(t)
+	saved := configure.RtmpServercfg
+	defer func() { configure.RtmpServercfg = saved }()
+	configure.RtmpServercfg = configure.ServerCfg{Server: []configure.Application{
+		{Appname: "live", Liveon: "on", Forward_nodes: []string{"127.0.0.1:1"}},
+	}}
+
+	m := NewForwardManager()
+	old := m.Start("live/movie")
+	at.Equal(1, len(old))
+	cur := m.Start("live/movie")
+	at.Equal(1, len(m.List()))
+
+	// the old publisher going away leaves the new forwarders alone
+	m.Stop("live/movie", old)
+	at.Equal(1, len(m.List()))
+	m.Stop("live/movie", cur)
+	at.Equal(0, len(m.List()))
+}
+
+func TestForwardBackoff(t *testing.T) {
+	at := assert.New(t)
+	var b forwardBackoff
+	at.Equal(forwardMinBackoff, b.failed(0))
+	at.Equal(2*forwardMinBackoff, b.failed(time.Second))
+	for i := 0; i < 10; i++ {
+		b.failed(0)
+	}
+	at.Equal(forwardMaxBackoff, b.failed(0))
+	// a long session starts over
+	at.Equal(forwardMinBackoff, b.failed(time.Hour))
+	at.Equal(2*forwardMinBackoff, b.failed(0))
+}
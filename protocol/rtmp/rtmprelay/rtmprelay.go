@@ -1,125 +1,314 @@
 package rtmprelay
 
 import (
+	"bomin/av"
+	"bomin/logging"
 	"bomin/protocol/amf"
 	"bomin/protocol/rtmp/core"
 	"bytes"
 	"errors"
 	"fmt"
-	"io"
-	"log"
+	"sync"
+	"time"
 )
 
-var (
-	STOP_CTRL = "RTMPRELAY_STOP"
+const (
+	RelayConnecting = "connecting"
+	RelayRunning    = "running"
+	RelayRetrying   = "retrying"
+	RelayStopped    = "stopped"
+
+	relayMinBackoff = time.Second
+	relayMaxBackoff = 30 * time.Second
 )
 
+var ErrRelayStopped = errors.New("relay stopped")
+
+var logger = logging.New("relay")
+
+// RelayStatus is a snapshot of a RtmpRelay for the management API.
+type RelayStatus struct {
+	PlayUrl    string    `json:"play_url"`
+	PublishUrl string    `json:"publish_url"`
+	State      string    `json:"state"`
+	Reconnects int       `json:"reconnects"`
+	BytesIn    uint64    `json:"bytes_in"`
+	BytesOut   uint64    `json:"bytes_out"`
+	LastError  string    `json:"last_error,omitempty"`
+	Since      time.Time `json:"since"`
+}
+
+// RtmpRelay plays PlayUrl and publishes everything it receives, media,
+// metadata and sequence headers, to PublishUrl. When either side fails both
+// are reconnected with exponential backoff until Stop is called.
 type RtmpRelay struct {
-	PlayUrl              string
-	PublishUrl           string
-	cs_chan              chan core.ChunkStream
-	sndctrl_chan         chan string
-	connectPlayClient    *core.ConnClient
-	connectPublishClient *core.ConnClient
-	startflag            bool
+	PlayUrl    string
+	PublishUrl string
+
+	stop     chan struct{}
+	stopOnce sync.Once
+
+	lock       sync.Mutex
+	startflag  bool
+	state      string
+	reconnects int
+	bytesIn    uint64
+	bytesOut   uint64
+	lastErr    error
+	since      time.Time
+	metadata   *core.ChunkStream
+	videoSeq   *core.ChunkStream
+	audioSeq   *core.ChunkStream
+	log        logging.Logger
 }
 
 func NewRtmpRelay(playurl *string, publishurl *string) *RtmpRelay {
 	return &RtmpRelay{
-		PlayUrl:              *playurl,
-		PublishUrl:           *publishurl,
-		cs_chan:              make(chan core.ChunkStream, 500),
-		sndctrl_chan:         make(chan string),
-		connectPlayClient:    nil,
-		connectPublishClient: nil,
-		startflag:            false,
+		PlayUrl:    *playurl,
+		PublishUrl: *publishurl,
+		stop:       make(chan struct{}),
+		state:      RelayStopped,
+		since:      time.Now(),
+		log:        logger.With("play", *playurl, "publish", *publishurl),
 	}
 }
 
-func (self *RtmpRelay) rcvPlayChunkStream() {
-	log.Println("rcvPlayRtmpMediaPacket connectClient.Read...")
-	for {
-		var rc core.ChunkStream
+// Start connects both sides and starts relaying. A relay that cannot connect
+// at first is not started and returns the error, it is only reconnected
+// once it ran.
+func (self *RtmpRelay) Start() error {
+	self.lock.Lock()
+	if self.startflag {
+		self.lock.Unlock()
+		return fmt.Errorf("The rtmprelay already started, playurl=%s, publishurl=%s", self.PlayUrl, self.PublishUrl)
+	}
+	self.startflag = true
+	self.state = RelayConnecting
+	self.since = time.Now()
+	self.lock.Unlock()
 
-		if self.startflag == false {
-			self.connectPlayClient.Close(nil)
-			log.Printf("rcvPlayChunkStream close: playurl=%s, publishurl=%s", self.PlayUrl, self.PublishUrl)
-			break
-		}
-		err := self.connectPlayClient.Read(&rc)
+	play, publish, err := self.connect()
+	if err != nil {
+		self.log.Warnf("relay failed: %v", err)
+		self.setState(RelayStopped, err)
+		self.lock.Lock()
+		self.startflag = false
+		self.lock.Unlock()
+		return err
+	}
+	go self.run(play, publish)
+	return nil
+}
 
-		if err != nil && err == io.EOF {
-			break
-		}
-		//log.Printf("connectPlayClient.Read return rc.TypeID=%v length=%d, err=%v", rc.TypeID, len(rc.Data), err)
-		switch rc.TypeID {
-		case 20, 17:
-			r := bytes.NewReader(rc.Data)
-			vs, err := self.connectPlayClient.DecodeBatch(r, amf.AMF0)
+// Stop stops the relay, it doesn't wait for the connections to close.
+func (self *RtmpRelay) Stop() {
+	self.lock.Lock()
+	started := self.startflag
+	self.lock.Unlock()
+	if !started {
+		self.log.Debug("relay already stopped")
+		return
+	}
+	self.stopOnce.Do(func() {
+		close(self.stop)
+	})
+}
 
-			log.Printf("rcvPlayRtmpMediaPacket: vs=%v, err=%v", vs, err)
-		case 18:
-			log.Printf("rcvPlayRtmpMediaPacket: metadata....")
-		case 8, 9:
-			self.cs_chan <- rc
-		}
+func (self *RtmpRelay) Status() RelayStatus {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	status := RelayStatus{
+		PlayUrl:    self.PlayUrl,
+		PublishUrl: self.PublishUrl,
+		State:      self.state,
+		Reconnects: self.reconnects,
+		BytesIn:    self.bytesIn,
+		BytesOut:   self.bytesOut,
+		Since:      self.since,
+	}
+	if self.lastErr != nil {
+		status.LastError = self.lastErr.Error()
+	}
+	return status
+}
+
+func (self *RtmpRelay) setState(state string, err error) {
+	self.lock.Lock()
+	if self.state != state {
+		self.state = state
+		self.since = time.Now()
+	}
+	if err != nil {
+		self.lastErr = err
 	}
+	self.lock.Unlock()
 }
 
-func (self *RtmpRelay) sendPublishChunkStream() {
+// run relays from the connected play and publish sides, then reconnects
+// them until stopped.
+func (self *RtmpRelay) run(play, publish *core.ConnClient) {
+	backoff := relayMinBackoff
 	for {
+		start := time.Now()
+		err := self.session(play, publish)
+		play, publish = nil, nil
+		if err == ErrRelayStopped {
+			break
+		}
+		// a session that ran for a while starts the backoff over
+		if time.Since(start) > relayMaxBackoff {
+			backoff = relayMinBackoff
+		}
+		self.log.Warnf("relay failed: %v, retry in %v", err, backoff)
+		self.setState(RelayRetrying, err)
+
 		select {
-		case rc := <-self.cs_chan:
-			//log.Printf("sendPublishChunkStream: rc.TypeID=%v length=%d", rc.TypeID, len(rc.Data))
-			self.connectPublishClient.Write(rc)
-		case ctrlcmd := <-self.sndctrl_chan:
-			if ctrlcmd == STOP_CTRL {
-				self.connectPublishClient.Close(nil)
-				log.Printf("sendPublishChunkStream close: playurl=%s, publishurl=%s", self.PlayUrl, self.PublishUrl)
-				break
-			}
+		case <-self.stop:
+			self.setState(RelayStopped, nil)
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > relayMaxBackoff {
+			backoff = relayMaxBackoff
 		}
+		self.lock.Lock()
+		self.reconnects++
+		self.lock.Unlock()
+		reconnects.With("relay").Inc()
+		self.setState(RelayConnecting, nil)
 	}
+	self.setState(RelayStopped, nil)
 }
 
-func (self *RtmpRelay) Start() error {
-	if self.startflag {
-		err := errors.New(fmt.Sprintf("The rtmprelay already started, playurl=%s, publishurl=%s", self.PlayUrl, self.PublishUrl))
-		return err
+func (self *RtmpRelay) stopped() bool {
+	select {
+	case <-self.stop:
+		return true
+	default:
+		return false
 	}
+}
 
-	self.connectPlayClient = core.NewConnClient()
-	self.connectPublishClient = core.NewConnClient()
+// connect connects the play leg, then the publish leg.
+func (self *RtmpRelay) connect() (play, publish *core.ConnClient, err error) {
+	play = core.NewConnClient()
+	if err = play.Start(self.PlayUrl, av.PLAY); err != nil {
+		return nil, nil, err
+	}
+	publish = core.NewConnClient()
+	if err = publish.Start(relayURL(self.PublishUrl), av.PUBLISH); err != nil {
+		play.Close(nil)
+		return nil, nil, err
+	}
+	return play, publish, nil
+}
 
-	log.Printf("play server addr:%v starting....", self.PlayUrl)
-	err := self.connectPlayClient.Start(self.PlayUrl, "play")
-	if err != nil {
-		log.Printf("connectPlayClient.Start url=%v error", self.PlayUrl)
-		return err
+// session copies messages from the play leg to the publish leg until one of
+// them fails, connecting them first unless they are given.
+func (self *RtmpRelay) session(play, publish *core.ConnClient) error {
+	if play == nil {
+		if self.stopped() {
+			return ErrRelayStopped
+		}
+		var err error
+		if play, publish, err = self.connect(); err != nil {
+			return err
+		}
 	}
 
-	log.Printf("publish server addr:%v starting....", self.PublishUrl)
-	err = self.connectPublishClient.Start(self.PublishUrl, "publish")
-	if err != nil {
-		log.Printf("connectPublishClient.Start url=%v error", self.PublishUrl)
-		self.connectPlayClient.Close(nil)
-		return err
+	// closing the connections unblocks the read below when stopped
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-self.stop:
+		case <-done:
+		}
+		play.Close(nil)
+		publish.Close(nil)
+	}()
+
+	self.setState(RelayRunning, nil)
+	self.log.Info("relay running")
+
+	self.lock.Lock()
+	headers := []*core.ChunkStream{self.metadata, self.videoSeq, self.audioSeq}
+	self.lock.Unlock()
+	for _, cs := range headers {
+		if cs == nil {
+			continue
+		}
+		if err := self.send(publish, *cs); err != nil {
+			return err
+		}
 	}
 
-	self.startflag = true
-	go self.rcvPlayChunkStream()
-	go self.sendPublishChunkStream()
+	for {
+		var rc core.ChunkStream
+		if err := play.Read(&rc); err != nil {
+			if self.stopped() {
+				return ErrRelayStopped
+			}
+			return err
+		}
+		self.lock.Lock()
+		self.bytesIn += uint64(rc.Length)
+		self.lock.Unlock()
 
-	return nil
+		switch rc.TypeID {
+		case 20, 17:
+			r := bytes.NewReader(rc.Data)
+			vs, err := play.DecodeBatch(r, amf.AMF0)
+			self.log.Debugf("command from play side: vs=%v, err=%v", vs, err)
+		case av.TAG_SCRIPTDATAAMF0, av.TAG_SCRIPTDATAAMF3:
+			self.cache(&self.metadata, rc)
+			if err := self.send(publish, rc); err != nil {
+				return err
+			}
+		case av.TAG_AUDIO, av.TAG_VIDEO:
+			if isSeqHeader(&rc) {
+				if rc.TypeID == av.TAG_VIDEO {
+					self.cache(&self.videoSeq, rc)
+				} else {
+					self.cache(&self.audioSeq, rc)
+				}
+			}
+			if err := self.send(publish, rc); err != nil {
+				return err
+			}
+		}
+	}
 }
 
-func (self *RtmpRelay) Stop() {
-	if !self.startflag {
-		log.Printf("The rtmprelay already stoped, playurl=%s, publishurl=%s", self.PlayUrl, self.PublishUrl)
-		return
-	}
+func (self *RtmpRelay) cache(dst **core.ChunkStream, cs core.ChunkStream) {
+	self.lock.Lock()
+	*dst = &cs
+	self.lock.Unlock()
+}
 
-	self.startflag = false
-	self.sndctrl_chan <- STOP_CTRL
+func (self *RtmpRelay) send(publish *core.ConnClient, cs core.ChunkStream) error {
+	cs.StreamID = publish.GetStreamId()
+	if err := publish.Write(cs); err != nil {
+		return err
+	}
+	if err := publish.Flush(); err != nil {
+		return err
+	}
+	self.lock.Lock()
+	self.bytesOut += uint64(cs.Length)
+	self.lock.Unlock()
+	return nil
+}
 
+// isSeqHeader reports whether an FLV audio or video tag body carries an
+// AVC or AAC sequence header.
+func isSeqHeader(cs *core.ChunkStream) bool {
+	if len(cs.Data) < 2 {
+		return false
+	}
+	if cs.TypeID == av.TAG_VIDEO {
+		return cs.Data[0]>>4 == av.FRAME_KEY && cs.Data[0]&0x0f == av.VIDEO_H264 && cs.Data[1] == av.AVC_SEQHDR
+	}
+	return cs.Data[0]>>4 == av.SOUND_AAC && cs.Data[1] == av.AAC_SEQHDR
 }
@@ -0,0 +1,106 @@
+package rtmprelay
+
+import (
+	"bomin/av"
+	"bomin/protocol/rtmp/core"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRelaySeqHeader(t *testing.T) {
+	at := assert.New(t)
+	at.True(isSeqHeader(&core.ChunkStream{TypeID: av.TAG_VIDEO, Data: []byte{0x17, 0x00}}))
+	at.False(isSeqHeader(&core.ChunkStream{TypeID: av.TAG_VIDEO, Data: []byte{0x17, 0x01}}))
+	at.False(isSeqHeader(&core.ChunkStream{TypeID: av.TAG_VIDEO, Data: []byte{0x27, 0x00}}))
+	at.True(isSeqHeader(&core.ChunkStream{TypeID: av.TAG_AUDIO, Data: []byte{0xaf, 0x00}}))
+	at.False(isSeqHeader(&core.ChunkStream{TypeID: av.TAG_AUDIO, Data: []byte{0xaf, 0x01}}))
+	at.False(isSeqHeader(&core.ChunkStream{TypeID: av.TAG_AUDIO, Data: []byte{0xaf}}))
+}
+
+func TestRelayStartFails(t *testing.T) {
+	at := assert.New(t)
+	play := "rtmp://127.0.0.1:1/live/movie"
+	publish := "rtmp://127.0.0.1:1/live/copy"
+	r := NewRtmpRelay(&play, &publish)
+	at.Equal(RelayStopped, r.Status().State)
+	at.NotNil(r.Start())
+	status := r.Status()
+	at.Equal(RelayStopped, status.State)
+	at.NotEmpty(status.LastError)
+	at.NotContains(r.Start().Error(), "already started")
+}
+
+// serveRtmp accepts RTMP clients on listener and answers their first command,
+// the connections are closed with the listener.
+func serveRtmp(t *testing.T, listener net.Listener) {
+	var conns []net.Conn
+	defer func() {
+		for _, c := range conns {
+			c.Close()
+		}
+	}()
+	for {
+		netconn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		conns = append(conns, netconn)
+		conn := core.NewConn(netconn, 4*1024)
+		if err := conn.HandshakeServer(); err != nil {
+			t.Error(err)
+			return
+		}
+		if err := core.NewConnServer(conn).ReadMsg(); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+}
+
+func TestRelayRetryAndStop(t *testing.T) {
+	at := assert.New(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		serveRtmp(t, listener)
+		close(done)
+	}()
+	play := "rtmp://" + listener.Addr().String() + "/live/movie"
+	publish := "rtmp://" + listener.Addr().String() + "/live/copy"
+	r := NewRtmpRelay(&play, &publish)
+	at.Nil(r.Start())
+	at.NotNil(r.Start())
+	listener.Close()
+	<-done
+
+	deadline := time.Now().Add(2 * time.Second)
+	for r.Status().State != RelayRetrying && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	status := r.Status()
+	at.Equal(RelayRetrying, status.State)
+	at.NotEmpty(status.LastError)
+
+	stopped := make(chan struct{})
+	go func() {
+		r.Stop()
+		r.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Stop blocked")
+	}
+	deadline = time.Now().Add(2 * time.Second)
+	for r.Status().State != RelayStopped && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	at.Equal(RelayStopped, r.Status().State)
+}
@@ -0,0 +1,58 @@
+package rtmp
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+)
+
+// ErrShutdown is what publishers and players are closed with when the
+// server shuts down. Writers closed with it send what they have queued and
+// end the stream properly before disconnecting.
+var ErrShutdown = errors.New("server shutting down")
+
+var errDrainTimeout = errors.New("drain timed out")
+
+// drainer is implemented by the writers that keep sending after being
+// closed with ErrShutdown.
+type drainer interface {
+	Close(error)
+	// Drained is closed once the writer has stopped sending.
+	Drained() <-chan struct{}
+}
+
+func (rs *RtmpStream) isClosing() bool {
+	return atomic.LoadInt32(&rs.closing) != 0
+}
+
+// Shutdown ends all streams: players are closed with ErrShutdown, then the
+// publishers are disconnected. New publishers and players are refused from
+// then on. It waits for the players to drain until ctx is done, then cuts
+// off the rest and returns ctx.Err().
+func (rs *RtmpStream) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&rs.closing, 1)
+
+	var draining []drainer
+	for item := range rs.streams.IterBuffered() {
+		s := item.Val.(*Stream)
+		for _, pw := range s.ws.removeAll() {
+			pw.w.Close(ErrShutdown)
+			if d, ok := pw.w.(drainer); ok {
+				draining = append(draining, d)
+			}
+		}
+		s.stop(ErrShutdown)
+	}
+
+	for i, d := range draining {
+		select {
+		case <-d.Drained():
+		case <-ctx.Done():
+			for _, d := range draining[i:] {
+				d.Close(errDrainTimeout)
+			}
+			return ctx.Err()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package rtmp
+
+import (
+	"bomin/av"
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testReader struct {
+	info   av.Info
+	lock   sync.Mutex
+	closed error
+	done   chan struct{}
+}
+
+func newTestReader(key string) *testReader {
+	return &testReader{info: av.Info{Key: key, UID: "publisher"}, done: make(chan struct{})}
+}
+
+func (r *testReader) Info() av.Info { return r.info }
+func (r *testReader) Alive() bool   { return true }
+
+func (r *testReader) Read(p *av.Packet) error {
+	<-r.done
+	return r.closeErr()
+}
+
+func (r *testReader) Close(err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.closed == nil {
+		r.closed = err
+		close(r.done)
+	}
+}
+
+func (r *testReader) closeErr() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.closed
+}
+
+// testWriter drains when released after being closed with ErrShutdown.
+type testWriter struct {
+	info    av.Info
+	lock    sync.Mutex
+	errs    []error
+	release chan struct{}
+	drained chan struct{}
+}
+
+func newTestWriter(key, uid string) *testWriter {
+	return &testWriter{
+		info:    av.Info{Key: key, UID: uid},
+		release: make(chan struct{}),
+		drained: make(chan struct{}),
+	}
+}
+
+func (w *testWriter) Info() av.Info            { return w.info }
+func (w *testWriter) Alive() bool              { return true }
+func (w *testWriter) Write(p *av.Packet) error { return nil }
+func (w *testWriter) Drained() <-chan struct{} { return w.drained }
+
+func (w *testWriter) Close(err error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.errs = append(w.errs, err)
+	if len(w.errs) == 1 {
+		go func() {
+			<-w.release
+			close(w.drained)
+		}()
+	}
+	if err != ErrShutdown {
+		close(w.release)
+	}
+}
+
+func (w *testWriter) closeErrs() []error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return append([]error(nil), w.errs...)
+}
+
+func TestShutdown(t *testing.T) {
+	at := assert.New(t)
+	rs := NewRtmpStream()
+	r := newTestReader("live/movie")
+	rs.HandleReader(r)
+	w := newTestWriter("live/movie", "player")
+	rs.HandleWriter(w)
+
+	done := make(chan error)
+	go func() { done <- rs.Shutdown(context.Background()) }()
+
+	time.Sleep(20 * time.Millisecond)
+	at.Equal([]error{ErrShutdown}, w.closeErrs())
+	at.Equal(ErrShutdown, r.closeErr())
+	select {
+	case <-done:
+		t.Fatal("shutdown returned before the player drained")
+	default:
+	}
+
+	close(w.release)
+	select {
+	case err := <-done:
+		at.Nil(err)
+	case <-time.After(time.Second):
+		t.Fatal("shutdown did not return")
+	}
+
+	// nobody gets in any more
+	late := newTestWriter("live/movie", "late")
+	rs.HandleWriter(late)
+	at.Equal([]error{ErrShutdown}, late.closeErrs())
+	lateReader := newTestReader("live/other")
+	rs.HandleReader(lateReader)
+	at.Equal(ErrShutdown, lateReader.closeErr())
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	at := assert.New(t)
+	rs := NewRtmpStream()
+	w := newTestWriter("live/movie", "player")
+	rs.HandleWriter(w)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	at.Equal(context.DeadlineExceeded, rs.Shutdown(ctx))
+	at.Equal([]error{ErrShutdown, errDrainTimeout}, w.closeErrs())
+}
@@ -0,0 +1,271 @@
+package rtmp
+
+import (
+	"bomin/av"
+	"bomin/parser/h264"
+	"bomin/protocol/amf"
+	"bomin/utils/metrics"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+var ErrKicked = errors.New("kicked")
+
+// ClientStat describes one publisher or player of a stream. Its Dropped
+// counter is the number of packets dropped for a player that could not keep
+// up.
+type ClientStat struct {
+	UID  string `json:"uid"`
+	URL  string `json:"url"`
+	Type string `json:"type"`
+	av.Counters
+	// Bitrate is the bitrate averaged over 5s, rounded.
+	Bitrate uint64 `json:"bitrate_kbps"`
+}
+
+// StreamStat is a snapshot of a stream for the management API.
+type StreamStat struct {
+	Key        string        `json:"key"`
+	Publishing bool          `json:"publishing"`
+	Video      *VideoInfo    `json:"video,omitempty"`
+	Audio      *AudioInfo    `json:"audio,omitempty"`
+	Metadata   amf.Object    `json:"metadata,omitempty"`
+	Health     *HealthStatus `json:"health"`
+	Bitrate    uint64        `json:"bitrate_kbps"`
+	StartTime  time.Time     `json:"start_time"`
+	Uptime     int64         `json:"uptime"`
+	Publisher  *ClientStat   `json:"publisher,omitempty"`
+	Players    []ClientStat  `json:"players"`
+}
+
+// mediaInfo is what the packets of the current publisher tell about it.
+type mediaInfo struct {
+	hasVideo bool
+	hasAudio bool
+	video    VideoInfo
+	audio    AudioInfo
+	metadata amf.Object
+	sps      *h264.SPS
+
+	// windows counts the measurements done so far
+	windows    int
+	winStarted bool
+	winStart   uint32
+	frames     int
+	videoBytes uint64
+	audioBytes uint64
+
+	hasKey  bool
+	lastKey uint32
+}
+
+var videoCodecs = map[uint8]string{
+	2:             "h263",
+	3:             "screen",
+	4:             "vp6",
+	5:             "vp6a",
+	6:             "screen2",
+	av.VIDEO_H264: "h264",
+	12:            "h265",
+}
+
+var audioCodecs = map[uint8]string{
+	0:                              "pcm",
+	1:                              "adpcm",
+	av.SOUND_MP3:                   "mp3",
+	3:                              "pcm_le",
+	av.SOUND_NELLYMOSER_16KHZ_MONO: "nellymoser",
+	av.SOUND_NELLYMOSER_8KHZ_MONO:  "nellymoser",
+	av.SOUND_NELLYMOSER:            "nellymoser",
+	av.SOUND_ALAW:                  "alaw",
+	av.SOUND_MULAW:                 "mulaw",
+	av.SOUND_AAC:                   "aac",
+	av.SOUND_SPEEX:                 "speex",
+}
+
+func codecName(names map[uint8]string, id uint8) string {
+	if name, ok := names[id]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", id)
+}
+
+// update records the media properties carried by p, whose timestamp must
+// already be corrected.
+func (m *mediaInfo) update(p *av.Packet) {
+	switch {
+	case p.IsVideo:
+		m.updateVideo(p)
+	case p.IsAudio:
+		m.updateAudio(p)
+	case p.IsMetadata:
+		m.updateMetadata(p)
+		return
+	default:
+		return
+	}
+
+	if !m.winStarted {
+		m.winStarted = true
+		m.winStart = p.TimeStamp
+	}
+	// audio and video interleave, a packet of one track may be a little
+	// older than the one of the other the window started on
+	if elapsed := int32(p.TimeStamp - m.winStart); elapsed >= mediaWindow {
+		m.video.MeasuredFPS = float64(m.frames) * 1000 / float64(elapsed)
+		// bytes * 8 / ms is kbit/s
+		m.video.Bitrate = m.videoBytes * 8 / uint64(elapsed)
+		m.audio.Bitrate = m.audioBytes * 8 / uint64(elapsed)
+		m.windows++
+		m.winStart = p.TimeStamp
+		m.frames = 0
+		m.videoBytes = 0
+		m.audioBytes = 0
+	}
+}
+
+func clientStat(c av.Closer) ClientStat {
+	info := c.Info()
+	stat := ClientStat{
+		UID:  info.UID,
+		URL:  info.URL,
+		Type: strings.TrimPrefix(fmt.Sprintf("%T", c), "*"),
+	}
+	if counted, ok := c.(av.Counted); ok {
+		stat.Counters = counted.Counters()
+		stat.Bitrate = uint64(stat.Counters.Bitrate() + 0.5)
+	}
+	return stat
+}
+
+// Stat returns a snapshot of the stream.
+func (s *Stream) Stat(key string) StreamStat {
+	s.lock.Lock()
+	video, audio, metadata := s.media.info()
+	startTime := s.startTime
+	r, publishing := s.r, s.r != nil && s.isStart
+	health := &HealthStatus{State: HealthIdle, Problems: []HealthProblem{}}
+	if s.analyser != nil && publishing {
+		health = s.analyser.status()
+	}
+	s.lock.Unlock()
+
+	stat := StreamStat{
+		Key:        key,
+		Publishing: publishing,
+		Video:      video,
+		Audio:      audio,
+		Metadata:   metadata,
+		Health:     health,
+		Players:    []ClientStat{},
+	}
+	if video != nil {
+		stat.Bitrate += video.Bitrate
+	}
+	if audio != nil {
+		stat.Bitrate += audio.Bitrate
+	}
+	id := EmptyID
+	if r != nil {
+		id = r.Info().UID
+		pub := clientStat(r)
+		stat.Publisher = &pub
+		stat.StartTime = startTime
+		stat.Uptime = int64(time.Since(startTime) / time.Second)
+	}
+	for _, pw := range s.ws.load() {
+		if pw.uid == id {
+			continue
+		}
+		stat.Players = append(stat.Players, clientStat(pw.w))
+	}
+	return stat
+}
+
+// Stats returns a snapshot of every stream.
+func (rs *RtmpStream) Stats() []StreamStat {
+	ret := []StreamStat{}
+	for item := range rs.streams.IterBuffered() {
+		ret = append(ret, item.Val.(*Stream).Stat(item.Key))
+	}
+	return ret
+}
+
+// Stat returns a snapshot of the stream key.
+func (rs *RtmpStream) Stat(key string) (StreamStat, bool) {
+	s := rs.getStream(key)
+	if s == nil {
+		return StreamStat{}, false
+	}
+	return s.Stat(key), true
+}
+
+// Kick disconnects the publisher or player with the given UID. It reports
+// whether such a client was found.
+func (rs *RtmpStream) Kick(uid string) bool {
+	for item := range rs.streams.IterBuffered() {
+		s := item.Val.(*Stream)
+		if r := s.GetReader(); r != nil && r.Info().UID == uid {
+			s.TransStop()
+			return true
+		}
+		if pw := s.ws.remove(uid); pw != nil {
+			pw.w.Close(ErrKicked)
+			return true
+		}
+	}
+	return false
+}
+
+type appMetrics struct {
+	publishers, players float64
+	bytesIn, bytesOut   float64
+}
+
+// WriteMetrics writes the per application gauges of the streams.
+func (rs *RtmpStream) WriteMetrics(w *metrics.Writer) {
+	apps := make(map[string]*appMetrics)
+	for item := range rs.streams.IterBuffered() {
+		app := strings.SplitN(item.Key, "/", 2)[0]
+		m, ok := apps[app]
+		if !ok {
+			m = &appMetrics{}
+			apps[app] = m
+		}
+		stat := item.Val.(*Stream).Stat(item.Key)
+		if stat.Publishing {
+			m.publishers++
+		}
+		if stat.Publisher != nil {
+			m.bytesIn += float64(stat.Publisher.Bytes)
+		}
+		for _, player := range stat.Players {
+			m.players++
+			m.bytesOut += float64(player.Bytes)
+		}
+	}
+	names := make([]string, 0, len(apps))
+	for app := range apps {
+		names = append(names, app)
+	}
+	sort.Strings(names)
+
+	gauges := []struct {
+		name, help string
+		value      func(*appMetrics) float64
+	}{
+		{"bomin_publishers", "Active publishers.", func(m *appMetrics) float64 { return m.publishers }},
+		{"bomin_players", "Active players.", func(m *appMetrics) float64 { return m.players }},
+		{"bomin_bytes_in", "Bytes received from the current publishers.", func(m *appMetrics) float64 { return m.bytesIn }},
+		{"bomin_bytes_out", "Bytes sent to the current players.", func(m *appMetrics) float64 { return m.bytesOut }},
+	}
+	for _, g := range gauges {
+		w.Header(g.name, g.help, metrics.TypeGauge)
+		for _, app := range names {
+			w.Sample(g.name, g.value(apps[app]), "app", app)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package rtmp
+
+import (
+	"bomin/av"
+	"bomin/protocol/amf"
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testVideoHeader struct {
+	codec    uint8
+	key, seq bool
+}
+
+func (h testVideoHeader) IsKeyFrame() bool       { return h.key }
+func (h testVideoHeader) IsSeq() bool            { return h.seq }
+func (h testVideoHeader) CodecID() uint8         { return h.codec }
+func (h testVideoHeader) CompositionTime() int32 { return 0 }
+
+type testAudioHeader struct {
+	format, packetType uint8
+}
+
+func (h testAudioHeader) SoundFormat() uint8   { return h.format }
+func (h testAudioHeader) AACPacketType() uint8 { return h.packetType }
+
+func TestMediaInfoUpdate(t *testing.T) {
+	at := assert.New(t)
+	var m mediaInfo
+
+	m.update(&av.Packet{IsVideo: true, Header: testVideoHeader{codec: av.VIDEO_H264, key: true}})
+	m.update(&av.Packet{IsAudio: true, Header: testAudioHeader{av.SOUND_AAC, av.AAC_RAW}})
+	video, audio, _ := m.info()
+	at.Equal("h264", video.Codec)
+	at.Equal("aac", audio.Codec)
+
+	m.update(&av.Packet{IsVideo: true, Header: testVideoHeader{codec: 99}})
+	video, _, _ = m.info()
+	at.Equal("unknown(99)", video.Codec)
+
+	var buf bytes.Buffer
+	_, err := (&amf.Encoder{}).EncodeBatch(&buf, amf.AMF0, "onMetaData",
+		amf.Object{"width": float64(1280), "height": float64(720)})
+	at.Nil(err)
+	m.update(&av.Packet{IsMetadata: true, Data: buf.Bytes()})
+	video, _, _ = m.info()
+	at.Equal(1280, video.Width)
+	at.Equal(720, video.Height)
+}
+
+func TestMediaInfoInterleaved(t *testing.T) {
+	at := assert.New(t)
+	var m mediaInfo
+	// the audio lags the video by 30ms: the window the video starts must not
+	// be closed by the older audio that follows
+	for ts := uint32(1000); ts <= 5000; ts += 40 {
+		m.update(&av.Packet{IsVideo: true, TimeStamp: ts,
+			Header: testVideoHeader{codec: av.VIDEO_H264}, Data: make([]byte, 1000)})
+		m.update(&av.Packet{IsAudio: true, TimeStamp: ts - 30,
+			Header: testAudioHeader{av.SOUND_AAC, av.AAC_RAW}, Data: make([]byte, 250)})
+		video, audio, _ := m.info()
+		if m.windows > 0 {
+			at.InDelta(25, video.MeasuredFPS, 1)
+			at.InDelta(200, video.Bitrate, 10)
+			at.InDelta(50, audio.Bitrate, 5)
+		}
+	}
+	at.Equal(4, m.windows)
+}
+
+func TestKickUnknown(t *testing.T) {
+	rs := NewRtmpStream()
+	assert.False(t, rs.Kick("nobody"))
+	_, found := rs.Stat("live/movie")
+	assert.False(t, found)
+}
+
+func TestStatCounters(t *testing.T) {
+	at := assert.New(t)
+	rs := NewRtmpStream()
+	sub := rs.NewSubscriber("live/movie", 0)
+	pub := rs.NewPublisher("live/movie")
+	for _, p := range []*av.Packet{videoSeq(), keyFrame(), interFrame()} {
+		at.Nil(pub.Write(p))
+	}
+	// the stream has handed the first two out once the last is taken
+	at.Nil(pub.Write(interFrame()))
+	readPacket(t, sub)
+	readPacket(t, sub)
+
+	stat, _ := rs.Stat("live/movie")
+	at.Equal("rtmp.Publisher", stat.Publisher.Type)
+	at.True(stat.Publisher.Packets >= 3)
+	at.True(stat.Publisher.Frames >= 2)
+	at.True(stat.Publisher.Bytes > 0)
+	at.Len(stat.Players, 1)
+	at.True(stat.Players[0].Packets >= 2)
+	at.Equal(stat.Players[0].VideoBytes, stat.Players[0].Bytes)
+	pub.Close(nil)
+}
@@ -6,8 +6,7 @@ import (
 	"bomin/protocol/rtmp/rtmprelay"
 	"errors"
 	"github.com/orcaman/concurrent-map"
-	"log"
-	"strings"
+	"sync"
 	"time"
 )
 
@@ -16,51 +15,81 @@ var (
 )
 
 type RtmpStream struct {
-	streams cmap.ConcurrentMap //key
+	streams   cmap.ConcurrentMap //key
+	edge      Puller
+	mapper    KeyMapper
+	forwards  *rtmprelay.ForwardManager
+	health    *healthLog
+	publishes *publishLog
+	closing   int32
+	// GopNum is the number of GOPs cached for new players of the streams
+	// created afterwards.
+	GopNum int
+
+	// tokenChecker lets the server's own clients past the limits, see
+	// SetTokenChecker.
+	tokenChecker func(token string) bool
 }
 
 func NewRtmpStream() *RtmpStream {
 	ret := &RtmpStream{
-		streams: cmap.New(),
+		streams:   cmap.New(),
+		forwards:  rtmprelay.NewForwardManager(),
+		health:    &healthLog{},
+		publishes: &publishLog{},
+		GopNum:    cache.DefaultGopNum,
 	}
 	go ret.CheckAlive()
+	go ret.checkHealth()
 	return ret
 }
 
 func (rs *RtmpStream) HandleReader(r av.ReadCloser) {
+	if rs.isClosing() {
+		r.Close(ErrShutdown)
+		return
+	}
 	info := r.Info()
 	//log.Printf("HandleReader: info[%v]", info)
+	rs.publishes.claim(info.Key, info.UID)
 
 	var stream *Stream
 	i, ok := rs.streams.Get(info.Key)
 	if stream, ok = i.(*Stream); ok {
-		stream.TransStop()
 		id := stream.ID()
 		if id != EmptyID && id != info.UID {
-			ns := NewStream()
+			// the players move before the old publisher is stopped, which
+			// would close them
+			ns := rs.newStream(info)
 			stream.Copy(ns)
+			stream.TransStop()
 			stream = ns
 			rs.streams.Set(info.Key, ns)
+		} else {
+			stream.TransStop()
 		}
 	} else {
-		stream = NewStream()
+		stream = rs.newStream(info)
 		rs.streams.Set(info.Key, stream)
-		stream.info = info
 	}
 
 	stream.AddReader(r)
 }
 
 func (rs *RtmpStream) HandleWriter(w av.WriteCloser) {
+	if rs.isClosing() {
+		w.Close(ErrShutdown)
+		return
+	}
 	info := w.Info()
 	//log.Printf("HandleWriter: info[%v]", info)
 
 	var s *Stream
 	ok := rs.streams.Has(info.Key)
 	if !ok {
-		s = NewStream()
+		s = rs.newStream(info)
 		rs.streams.Set(info.Key, s)
-		s.info = info
+		s.AddWriter(w)
 	} else {
 		item, ok := rs.streams.Get(info.Key)
 		if ok {
@@ -68,12 +97,70 @@ func (rs *RtmpStream) HandleWriter(w av.WriteCloser) {
 			s.AddWriter(w)
 		}
 	}
+
+	if s != nil && s.GetReader() == nil {
+		rs.Pull(info.Key)
+	}
+}
+
+func (rs *RtmpStream) newStream(info av.Info) *Stream {
+	s := NewStream(rs.GopNum)
+	s.info = info
+	s.forwards = rs.forwards
+	s.health = rs.health
+	s.publishes = rs.publishes
+	return s
 }
 
 func (rs *RtmpStream) GetStreams() cmap.ConcurrentMap {
 	return rs.streams
 }
 
+// Forwards returns the status of all publish forwards.
+func (rs *RtmpStream) Forwards() []rtmprelay.ForwardStatus {
+	return rs.forwards.List()
+}
+
+// SetEdge makes players of unpublished keys pull them through p.
+func (rs *RtmpStream) SetEdge(p Puller) {
+	rs.edge = p
+}
+
+// Pull asks the edge, if any, to pull key. It reports whether the key is
+// published locally or being pulled.
+func (rs *RtmpStream) Pull(key string) bool {
+	if rs.hasPublisher(key) {
+		return true
+	}
+	if rs.edge == nil {
+		return false
+	}
+	return rs.edge.Pull(key)
+}
+
+func (rs *RtmpStream) getStream(key string) *Stream {
+	item, ok := rs.streams.Get(key)
+	if !ok {
+		return nil
+	}
+	return item.(*Stream)
+}
+
+func (rs *RtmpStream) hasPublisher(key string) bool {
+	s := rs.getStream(key)
+	return s != nil && s.IsPublishing()
+}
+
+// checkHealth checks the health of the streams whose publishers send
+// nothing, every second.
+func (rs *RtmpStream) checkHealth() {
+	for now := range time.Tick(time.Second) {
+		for item := range rs.streams.IterBuffered() {
+			item.Val.(*Stream).checkHealth(now)
+		}
+	}
+}
+
 func (rs *RtmpStream) CheckAlive() {
 	for {
 		<-time.After(5 * time.Second)
@@ -87,15 +174,29 @@ func (rs *RtmpStream) CheckAlive() {
 }
 
 type Stream struct {
-	isStart bool
-	cache   *cache.Cache
-	r       av.ReadCloser
-	ws      cmap.ConcurrentMap
-	info    av.Info
+	cache    *cache.Cache
+	forwards *rtmprelay.ForwardManager
+	ws       *players
+	info     av.Info
+
+	// pub is held while a packet is handed out, and by what must not
+	// happen meanwhile
+	pub sync.Mutex
+
+	lock      sync.Mutex
+	r         av.ReadCloser
+	isStart   bool
+	corrector *av.TimestampCorrector
+	media     mediaInfo
+	analyser  *healthAnalyser
+	health    *healthLog
+	publishes *publishLog
+	startTime time.Time
 }
 
 type PackWriterCloser struct {
 	init bool
+	uid  string
 	w    av.WriteCloser
 }
 
@@ -103,296 +204,239 @@ func (p *PackWriterCloser) GetWriter() av.WriteCloser {
 	return p.w
 }
 
-func NewStream() *Stream {
+func NewStream(gopNum int) *Stream {
 	return &Stream{
-		cache: cache.NewCache(),
-		ws:    cmap.New(),
+		cache:     cache.NewCache(gopNum),
+		corrector: av.NewTimestampCorrector(),
+		ws:        newPlayers(),
 	}
 }
 
 func (s *Stream) ID() string {
-	if s.r != nil {
-		return s.r.Info().UID
+	if r := s.GetReader(); r != nil {
+		return r.Info().UID
 	}
 	return EmptyID
 }
 
 func (s *Stream) GetReader() av.ReadCloser {
+	s.lock.Lock()
+	defer s.lock.Unlock()
 	return s.r
 }
 
-func (s *Stream) GetWs() cmap.ConcurrentMap {
-	return s.ws
-}
-
-func (s *Stream) Copy(dst *Stream) {
-	for item := range s.ws.IterBuffered() {
-		v := item.Val.(*PackWriterCloser)
-		s.ws.Remove(item.Key)
-		v.w.CalcBaseTimestamp()
-		dst.AddWriter(v.w)
-	}
+// GetWs returns the writers of the stream, the list must not be modified.
+func (s *Stream) GetWs() []*PackWriterCloser {
+	return s.ws.load()
 }
 
-func (s *Stream) AddReader(r av.ReadCloser) {
-	s.r = r
-	go s.TransStart()
+// IsPublishing reports whether a publisher is feeding the stream.
+func (s *Stream) IsPublishing() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.r != nil && s.isStart
 }
 
-func (s *Stream) AddWriter(w av.WriteCloser) {
-	info := w.Info()
-	pw := &PackWriterCloser{w: w}
-	s.ws.Set(info.UID, pw)
+// isCurrent reports whether r is still the publisher of the stream.
+func (s *Stream) isCurrent(r av.ReadCloser) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.r == r && s.isStart
 }
 
-/*检测本application下是否配置static_push,
-如果配置, 启动push远端的连接*/
-func (s *Stream) StartStaticPush() {
-	key := s.info.Key
-
-	dscr := strings.Split(key, "/")
-	if len(dscr) < 1 {
-		return
-	}
-
-	index := strings.Index(key, "/")
-	if index < 0 {
-		return
-	}
-
-	//streamname := key[index+1:]
-	appname := dscr[0]
-
-	pushurllist, err := rtmprelay.GetStaticPushList(appname)
-	if err != nil || len(pushurllist) < 1 {
-		//log.Printf("StartStaticPush: GetStaticPushList error=%v", err)
-		return
-	}
-
-	for _, pushurl := range pushurllist {
-		//pushurl := pushurl + "/" + streamname
-		log.Printf("StartStaticPush: static pushurl=%s", pushurl)
-
-		staticpushObj := rtmprelay.GetAndCreateStaticPushObject(pushurl)
-		if staticpushObj != nil {
-			if err := staticpushObj.Start(); err != nil {
-				log.Printf("StartStaticPush: staticpushObj.Start %s error=%v", pushurl, err)
-			} else {
-				log.Printf("StartStaticPush: staticpushObj.Start %s ok", pushurl)
-			}
-		} else {
-			log.Printf("StartStaticPush GetStaticPushObject %s error", pushurl)
+// PlayerCount returns the number of players. Writers attached on behalf of
+// the publisher, such as the HLS muxer, share its UID and are not counted.
+func (s *Stream) PlayerCount() int {
+	id := s.ID()
+	n := 0
+	for _, pw := range s.ws.load() {
+		if pw.uid != id {
+			n++
 		}
 	}
+	return n
 }
 
-func (s *Stream) StopStaticPush() {
-	key := s.info.Key
-
-	//log.Printf("StopStaticPush......%s", key)
-	dscr := strings.Split(key, "/")
-	if len(dscr) < 1 {
-		return
+// Copy moves the players to dst, which takes over from a new publisher.
+// The timestamp corrector moves along so the players' clocks keep running.
+func (s *Stream) Copy(dst *Stream) {
+	// the old publisher hands out nothing more
+	s.pub.Lock()
+	defer s.pub.Unlock()
+	s.lock.Lock()
+	corrector := s.corrector
+	s.lock.Unlock()
+	corrector.Continue()
+	dst.lock.Lock()
+	dst.corrector = corrector
+	dst.lock.Unlock()
+	for _, pw := range s.ws.removeAll() {
+		dst.AddWriter(pw.w)
 	}
+}
 
-	index := strings.Index(key, "/")
-	if index < 0 {
-		return
+func (s *Stream) AddReader(r av.ReadCloser) {
+	s.lock.Lock()
+	s.media = mediaInfo{}
+	s.analyser = newHealthAnalyser(DefaultHealthConfig, s.corrector.Discontinuities)
+	s.startTime = time.Now()
+	s.r = r
+	s.isStart = true
+	s.lock.Unlock()
+	var forwarders []*rtmprelay.Forwarder
+	// two servers forwarding to each other would pass a stream back and
+	// forth
+	if s.forwards != nil && !r.Info().Relayed {
+		forwarders = s.forwards.Start(s.info.Key)
 	}
-
-	//streamName := key[index+1:]
-	appName := dscr[0]
-
-	//log.Printf("StopStaticPush: current streamName=%s， appName=%s", streamName, appName)
-	pushUrlList, err := rtmprelay.GetStaticPushList(appName)
-	if err != nil || len(pushUrlList) < 1 {
-		//log.Printf("StopStaticPush: GetStaticPushList error=%v", err)
-		return
+	if s.publishes != nil {
+		s.publishes.start(s.info.Key, r.Info().UID)
 	}
+	go s.transmit(r, forwarders)
+}
 
-	for _, pushUrl := range pushUrlList {
-		log.Printf("StopStaticPush: static pushUrl=%s", pushUrl)
-		staticPushObj, err := rtmprelay.GetStaticPushObject(pushUrl)
-		if (staticPushObj != nil) && (err == nil) {
-			staticPushObj.Stop()
-			rtmprelay.ReleaseStaticPushObject(pushUrl)
-			log.Printf("StopStaticPush: staticPushObj.Stop %s ", pushUrl)
-		} else {
-			log.Printf("StopStaticPush GetStaticPushObject %s error", pushUrl)
-		}
-	}
+func (s *Stream) AddWriter(w av.WriteCloser) {
+	info := w.Info()
+	s.ws.add(&PackWriterCloser{uid: info.UID, w: w})
 }
 
-func (s *Stream) IsSendStaticPush() bool {
-	key := s.info.Key
+// transmit hands out the packets of r to the writers until r fails or is
+// replaced. Each packet is allocated once and shared by all writers, so
+// writers must not modify the packets they are given.
+func (s *Stream) transmit(r av.ReadCloser, forwarders []*rtmprelay.Forwarder) {
+	var p av.Packet
+	for {
+		err := r.Read(&p)
+		s.pub.Lock()
+		if err != nil || !s.isCurrent(r) {
+			s.transEnd(r, forwarders)
+			s.pub.Unlock()
+			return
+		}
 
-	dscr := strings.Split(key, "/")
-	if len(dscr) < 1 {
-		return false
-	}
+		s.lock.Lock()
+		s.corrector.Correct(&p)
+		s.media.update(&p)
+		events := s.analyser.observe(&p, &s.media, s.corrector.Discontinuities)
+		s.lock.Unlock()
+		if s.health != nil {
+			s.health.emit(s.info.Key, events)
+		}
 
-	appName := dscr[0]
+		for _, f := range forwarders {
+			f.Write(&p)
+		}
 
-	//log.Printf("SendStaticPush: current streamname=%s， appName=%s", streamname, appName)
-	pushUrlList, err := rtmprelay.GetStaticPushList(appName)
-	if err != nil || len(pushUrlList) < 1 {
-		//log.Printf("SendStaticPush: GetStaticPushList error=%v", err)
-		return false
+		pkt := new(av.Packet)
+		*pkt = p
+		s.cache.Write(pkt)
+		s.send(pkt)
+		s.pub.Unlock()
+		// the cache and the players hold their own references
+		pkt.Release()
 	}
+}
 
-	index := strings.Index(key, "/")
-	if index < 0 {
-		return false
+// checkHealth raises the problems of a publisher that stopped sending media
+// while it stays connected.
+func (s *Stream) checkHealth(now time.Time) {
+	var events []HealthEvent
+	s.lock.Lock()
+	if s.r != nil && s.isStart && s.analyser != nil {
+		events = s.analyser.stalled(now)
 	}
-
-	for _, pushurl := range pushUrlList {
-		log.Printf("SendStaticPush: static pushurl=%s", pushurl)
-
-		staticpushObj, err := rtmprelay.GetStaticPushObject(pushurl)
-		if (staticpushObj != nil) && (err == nil) {
-			return true
-			//staticpushObj.WriteAvPacket(&packet)
-			//log.Printf("SendStaticPush: WriteAvPacket %s ", pushurl)
-		} else {
-			log.Printf("SendStaticPush GetStaticPushObject %s error", pushurl)
-		}
+	s.lock.Unlock()
+	if s.health != nil {
+		s.health.emit(s.info.Key, events)
 	}
-	return false
 }
 
-func (s *Stream) SendStaticPush(packet av.Packet) {
-	key := s.info.Key
-
-	dscr := strings.Split(key, "/")
-	if len(dscr) < 1 {
-		return
+// transEnd stops what was started for the publisher r.
+func (s *Stream) transEnd(r av.ReadCloser, forwarders []*rtmprelay.Forwarder) {
+	if s.forwards != nil {
+		s.forwards.Stop(s.info.Key, forwarders)
 	}
-
-	index := strings.Index(key, "/")
-	if index < 0 {
-		return
+	if s.publishes != nil {
+		s.publishes.stop(s.info.Key, r.Info().UID)
 	}
-
-	streamName := key[index+1:]
-	appName := dscr[0]
-
-	log.Printf("SendStaticPush: current streamName=%s， appName=%s", streamName, appName)
-	pushUrlList, err := rtmprelay.GetStaticPushList(appName)
-	if err != nil || len(pushUrlList) < 1 {
-		//log.Printf("SendStaticPush: GetStaticPushList error=%v", err)
-		return
+	// a replaced publisher leaves the players to the new one
+	s.lock.Lock()
+	current := s.r == r
+	if current {
+		s.isStart = false
 	}
-
-	for _, pushurl := range pushUrlList {
-		log.Printf("SendStaticPush: static pushurl=%s", pushurl)
-
-		staticPushObj, err := rtmprelay.GetStaticPushObject(pushurl)
-		if (staticPushObj != nil) && (err == nil) {
-			staticPushObj.WriteAvPacket(&packet)
-			//log.Printf("SendStaticPush: WriteAvPacket %s ", pushurl)
-		} else {
-			log.Printf("SendStaticPush GetStaticPushObject %s error", pushurl)
-		}
+	s.lock.Unlock()
+	if current {
+		s.closeInter(r)
 	}
 }
 
-func (s *Stream) TransStart() {
-	s.isStart = true
-	var p av.Packet
-
-	//log.Printf("TransStart:%v", s.info)
-
-	s.StartStaticPush()
-
-	for {
-		if !s.isStart {
-			s.closeInter()
-			return
-		}
-		err := s.r.Read(&p)
-		if err != nil {
-			s.closeInter()
-			s.isStart = false
-			return
-		}
-
-		if s.IsSendStaticPush() {
-			s.SendStaticPush(p)
-		}
-
-		s.cache.Write(p)
-
-		for item := range s.ws.IterBuffered() {
-			v := item.Val.(*PackWriterCloser)
-			if !v.init {
-				log.Printf("cache.send: %v", v.w.Info().UID)
-				if err = s.cache.Send(v.w); err != nil {
-					log.Printf("[%s] send cache packet error: %v, remove", v.w.Info(), err)
-					s.ws.Remove(item.Key)
-					continue
-				}
-				v.init = true
-			} else {
-				newPackage := p
-				//writeType := reflect.TypeOf(v.w)
-				//log.Printf("w.Write: type=%v, %v", writeType, v.w.Info())
-				if err = v.w.Write(&newPackage); err != nil {
-					log.Printf("[%s] write packet error: %v", v.w.Info().UID, err)
-					s.ws.Remove(item.Key)
-				}
+// send hands out p to the writers, a new writer gets the cache first.
+func (s *Stream) send(p *av.Packet) {
+	for _, v := range s.ws.load() {
+		if !v.init {
+			if err := s.cache.Send(v.w); err != nil {
+				logger.With("uid", v.uid, "key", s.info.Key).Infof("send cache failed, removed: %v", err)
+				s.ws.drop(v)
+				continue
 			}
+			v.init = true
+		} else if err := v.w.Write(p); err != nil {
+			logger.With("uid", v.uid, "key", s.info.Key).Infof("write failed, removed: %v", err)
+			s.ws.drop(v)
 		}
 	}
 }
 
 func (s *Stream) TransStop() {
-	log.Printf("TransStop: %s", s.info.Key)
+	s.stop(errors.New("stop old"))
+}
 
-	if s.isStart && s.r != nil {
-		s.r.Close(errors.New("stop old"))
-	}
+func (s *Stream) stop(err error) {
+	logger.With("key", s.info.Key).Debug("stop publishing")
 
+	s.lock.Lock()
+	r := s.r
+	started := s.isStart
 	s.isStart = false
+	s.lock.Unlock()
+	if started && r != nil {
+		r.Close(err)
+	}
 }
 
 func (s *Stream) CheckAlive() (n int) {
-	if s.r != nil && s.isStart {
-		if s.r.Alive() {
+	s.lock.Lock()
+	r := s.r
+	started := s.isStart
+	s.lock.Unlock()
+	if r != nil && started {
+		if r.Alive() {
 			n++
 		} else {
-			s.r.Close(errors.New("read timeout"))
+			r.Close(errors.New("read timeout"))
 		}
 	}
-	for item := range s.ws.IterBuffered() {
-		v := item.Val.(*PackWriterCloser)
-		if v.w != nil {
-			if !v.w.Alive() && s.isStart {
-				s.ws.Remove(item.Key)
-				v.w.Close(errors.New("write timeout"))
-				continue
-			}
-			n++
+	for _, v := range s.ws.load() {
+		if !v.w.Alive() && started {
+			s.ws.drop(v)
+			v.w.Close(errors.New("write timeout"))
+			continue
 		}
-
+		n++
 	}
 	return
 }
 
-func (s *Stream) closeInter() {
-	if s.r != nil {
-		s.StopStaticPush()
-		log.Printf("Disconnect publisher:%v", s.r.Info().UID)
-	}
+// closeInter closes the players that end with the publisher r.
+func (s *Stream) closeInter(r av.ReadCloser) {
+	logger.With("uid", r.Info().UID, "key", s.info.Key).Debug("close players")
 
-	for item := range s.ws.IterBuffered() {
-		v := item.Val.(*PackWriterCloser)
-		if v.w != nil {
-			if v.w.Info().IsInterval() {
-				v.w.Close(errors.New("closed"))
-				s.ws.Remove(item.Key)
-				//log.Printf("[%v] player closed and remove\n", v.w.Info().UID)
-			}
+	for _, v := range s.ws.load() {
+		if v.w.Info().IsInterval() {
+			v.w.Close(errors.New("closed"))
+			s.ws.drop(v)
+			//log.Printf("[%v] player closed and remove\n", v.w.Info().UID)
 		}
-
 	}
 }
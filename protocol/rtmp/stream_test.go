@@ -0,0 +1,245 @@
+package rtmp
+
+import (
+	"bomin/av"
+	"bomin/configure"
+	"bomin/container/flv"
+	"bomin/protocol/rtmp/rtmprelay"
+	"bomin/utils/pool"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// loopReader reads n packets of a 50 frame GOP, then io.EOF.
+type loopReader struct {
+	info    av.Info
+	n       int
+	i       int
+	packets []av.Packet
+	done    chan struct{}
+}
+
+func newLoopReader(key string, n int) *loopReader {
+	r := &loopReader{info: av.Info{Key: key, UID: "loop"}, n: n, done: make(chan struct{})}
+	demuxer := flv.NewDemuxer()
+	for i := 0; i < 50; i++ {
+		p := interFrame()
+		if i == 0 {
+			p = keyFrame()
+		}
+		demuxer.DemuxH(p)
+		r.packets = append(r.packets, *p)
+	}
+	return r
+}
+
+func (r *loopReader) Info() av.Info { return r.info }
+func (r *loopReader) Alive() bool   { return true }
+func (r *loopReader) Close(error)   {}
+
+func (r *loopReader) Read(p *av.Packet) error {
+	if r.i == r.n {
+		close(r.done)
+		return io.EOF
+	}
+	*p = r.packets[r.i%len(r.packets)]
+	p.TimeStamp = uint32(r.i * 40)
+	r.i++
+	return nil
+}
+
+// pooledReader reads the packets of a loopReader into pooled buffers, each
+// ending with its timestamp.
+type pooledReader struct {
+	*loopReader
+}
+
+func (r pooledReader) Read(p *av.Packet) error {
+	if err := r.loopReader.Read(p); err != nil {
+		return err
+	}
+	b := pool.Get(len(p.Data) + 4)
+	data := b.Bytes()
+	copy(data, p.Data)
+	binary.BigEndian.PutUint32(data[len(p.Data):], p.TimeStamp)
+	p.Data, p.Buffer = data, b
+	return nil
+}
+
+// countWriter counts the packets it is given, in order.
+type countWriter struct {
+	info av.Info
+	lock sync.Mutex
+	n    int
+	last uint32
+	err  error
+}
+
+func (w *countWriter) Info() av.Info { return w.info }
+func (w *countWriter) Alive() bool   { return true }
+func (w *countWriter) Close(error)   {}
+
+func (w *countWriter) Write(p *av.Packet) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.n > 0 && p.TimeStamp <= w.last && w.err == nil {
+		w.err = fmt.Errorf("packet at %d after %d", p.TimeStamp, w.last)
+	}
+	w.n++
+	w.last = p.TimeStamp
+	return nil
+}
+
+func TestStreamConcurrentPlayers(t *testing.T) {
+	at := assert.New(t)
+	rs := NewRtmpStream()
+	r := newLoopReader("live/movie", 2000)
+	var writers []*countWriter
+	for i := 0; i < 10; i++ {
+		w := &countWriter{info: av.Info{Key: "live/movie", UID: fmt.Sprint("stay", i)}}
+		writers = append(writers, w)
+		rs.HandleWriter(w)
+	}
+	rs.HandleReader(r)
+
+	// players come and go, and the API looks, while packets are handed out
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				uid := fmt.Sprint("player", i, "-", j)
+				rs.HandleWriter(&countWriter{info: av.Info{Key: "live/movie", UID: uid}})
+				rs.Stat("live/movie")
+				rs.Kick(uid)
+			}
+		}(i)
+	}
+	wg.Wait()
+	<-r.done
+
+	for _, w := range writers {
+		w.lock.Lock()
+		at.Nil(w.err)
+		at.True(w.n > 0)
+		w.lock.Unlock()
+	}
+	stat, _ := rs.Stat("live/movie")
+	at.Len(stat.Players, len(writers))
+}
+
+func TestStreamReplacePublisher(t *testing.T) {
+	at := assert.New(t)
+	rs := NewRtmpStream()
+	first := newTestReader("live/movie")
+	rs.HandleReader(first)
+	w := newTestWriter("live/movie", "player")
+	w.info.Inter = true
+	rs.HandleWriter(w)
+
+	next := newTestReader("live/movie")
+	next.info.UID = "next"
+	rs.HandleReader(next)
+	at.NotNil(first.closeErr())
+	// the old publisher ending does not close the player it handed over
+	time.Sleep(20 * time.Millisecond)
+	at.Empty(w.closeErrs())
+	stat, _ := rs.Stat("live/movie")
+	at.Equal("next", stat.Publisher.UID)
+	at.Len(stat.Players, 1)
+
+	next.Close(io.EOF)
+	time.Sleep(20 * time.Millisecond)
+	at.Len(w.closeErrs(), 1)
+}
+
+func TestStreamPooledBuffers(t *testing.T) {
+	at := assert.New(t)
+	rs := NewRtmpStream()
+	sub := rs.NewSubscriber("live/movie", 16)
+	rs.HandleWriter(&countWriter{info: av.Info{Key: "live/movie", UID: "count"}})
+	r := pooledReader{newLoopReader("live/movie", 2000)}
+	rs.HandleReader(r)
+
+	// the subscriber falls behind, the buffers it dropped are recycled
+	// while it still reads those it kept
+	check := func(p *av.Packet) {
+		at.Equal(p.TimeStamp, binary.BigEndian.Uint32(p.Data[len(p.Data)-4:]))
+		p.Release()
+	}
+	for done := false; !done; {
+		select {
+		case p := <-sub.Packets():
+			check(p)
+			time.Sleep(100 * time.Microsecond)
+		case <-r.done:
+			done = true
+		}
+	}
+	for len(sub.Packets()) > 0 {
+		check(<-sub.Packets())
+	}
+	at.True(sub.Dropped() > 0)
+	sub.Close(nil)
+}
+
+func BenchmarkStreamFanout(b *testing.B) {
+	for _, players := range []int{1, 100, 1000} {
+		b.Run(fmt.Sprint(players, "players"), func(b *testing.B) {
+			s := NewStream(1)
+			s.info.Key = "live/movie"
+			for i := 0; i < players; i++ {
+				s.AddWriter(&countWriter{info: av.Info{Key: "live/movie", UID: fmt.Sprint(i)}})
+			}
+			r := newLoopReader("live/movie", b.N)
+			b.ReportAllocs()
+			b.ResetTimer()
+			s.AddReader(r)
+			<-r.done
+		})
+	}
+}
+
+func TestServerRelayedNotForwarded(t *testing.T) {
+	at := assert.New(t)
+	saved := configure.RtmpServercfg
+	defer func() { configure.RtmpServercfg = saved }()
+	configure.RtmpServercfg = configure.ServerCfg{Server: []configure.Application{
+		{Appname: "live", Liveon: "on", Forward_nodes: []string{"127.0.0.1:1"}},
+	}}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	rs := NewRtmpStream()
+	go NewRtmpServer(rs, nil).Serve(listener)
+
+	publish := func(name string) *Stream {
+		client := NewRtmpClient(NewRtmpStream(), nil)
+		at.Nil(client.Dial("rtmp://"+listener.Addr().String()+"/live/"+name, av.PUBLISH))
+		deadline := time.Now().Add(time.Second)
+		for !rs.hasPublisher("live/"+strings.SplitN(name, "?", 2)[0]) && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		return rs.getStream("live/" + strings.SplitN(name, "?", 2)[0])
+	}
+	// what another server forwards is not forwarded back
+	if s := publish("relayed?" + rtmprelay.RelayParam + "=1"); at.NotNil(s) {
+		at.True(s.GetReader().Info().Relayed)
+	}
+	at.Empty(rs.Forwards())
+	if s := publish("movie"); at.NotNil(s) {
+		at.False(s.GetReader().Info().Relayed)
+	}
+	at.Len(rs.Forwards(), 1)
+}
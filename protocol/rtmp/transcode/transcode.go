@@ -0,0 +1,406 @@
+// Package transcode runs ffmpeg to transcode the streams published to the
+// applications with transcode profiles. Each profile of a stream is one
+// ffmpeg process, playing the stream from the local RTMP server and
+// publishing the result back to it, restarted until the stream ends.
+package transcode
+
+import (
+	"bomin/configure"
+	"bomin/logging"
+	"bomin/utils/metrics"
+	"bomin/utils/uid"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	StateStarting = "starting"
+	StateRunning  = "running"
+	StateRetrying = "retrying"
+	StateStopped  = "stopped"
+
+	minBackoff = time.Second
+	maxBackoff = 30 * time.Second
+	// stopTimeout is how long ffmpeg has to exit once interrupted before it
+	// is killed.
+	stopTimeout = 5 * time.Second
+)
+
+// DefaultCommand is the ffmpeg binary run when none is set, looked up in
+// the PATH.
+const DefaultCommand = "ffmpeg"
+
+// TokenParam is the parameter of the URLs the ffmpeg processes play and
+// publish carrying a token of their supervisor, which lets them past the
+// limits, address lists and name mappings of the apps. The tokens show on
+// the command lines of the processes, so each of them lets one connection
+// in and is revoked once the process exits.
+const TokenParam = "bomin_transcode"
+
+var errStopped = errors.New("transcode stopped")
+
+var logger = logging.New("transcode")
+
+var restarts = metrics.NewCounter("bomin_transcode_restarts_total",
+	"Restarts of the ffmpeg transcoding processes.")
+
+// Status is a snapshot of a transcoding process for the management API.
+type Status struct {
+	Key       string    `json:"key"`
+	Output    string    `json:"output"`
+	State     string    `json:"state"`
+	Pid       int       `json:"pid,omitempty"`
+	Restarts  int       `json:"restarts"`
+	LastError string    `json:"last_error,omitempty"`
+	Since     time.Time `json:"since"`
+}
+
+// Supervisor starts the transcoding of a stream when it starts being
+// published and stops it when it stops.
+type Supervisor struct {
+	// Command is the ffmpeg binary, DefaultCommand when empty.
+	Command string
+
+	url     string
+	lock    sync.Mutex
+	tokens  map[string]bool   // given out, not used yet
+	jobs    map[string][]*job // by source key
+	outputs map[string]bool
+	closed  bool
+}
+
+// NewSupervisor returns a supervisor whose ffmpeg processes play and
+// publish on the RTMP server at url, e.g. rtmp://127.0.0.1:1935. With an
+// empty url nothing is transcoded until SetURL.
+func NewSupervisor(url string) *Supervisor {
+	return &Supervisor{
+		url:     strings.TrimRight(url, "/"),
+		tokens:  make(map[string]bool),
+		jobs:    make(map[string][]*job),
+		outputs: make(map[string]bool),
+	}
+}
+
+// UseToken reports whether token is one given to an ffmpeg process and not
+// used yet, see TokenParam. It is used up.
+func (s *Supervisor) UseToken(token string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.tokens[token] {
+		return false
+	}
+	delete(s.tokens, token)
+	return true
+}
+
+// args returns the arguments of an ffmpeg process transcoding key into
+// output with the options profile, and the tokens of its URLs.
+func (s *Supervisor) args(key, output string, profile []string) (args, tokens []string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	args = []string{"-hide_banner", "-loglevel", "error", "-i", s.streamURL(key, &tokens)}
+	args = append(args, profile...)
+	args = append(args, "-f", "flv", s.streamURL(output, &tokens))
+	return args, tokens
+}
+
+// streamURL returns the URL ffmpeg plays, or publishes, key at with a new
+// token, which it adds to tokens. It is called with the lock held.
+func (s *Supervisor) streamURL(key string, tokens *[]string) string {
+	token := uid.NewId()
+	s.tokens[token] = true
+	*tokens = append(*tokens, token)
+	url := s.url + "/" + configure.StreamPath(key)
+	if strings.Contains(url, "?") {
+		return url + "&" + TokenParam + "=" + token
+	}
+	return url + "?" + TokenParam + "=" + token
+}
+
+// revoke withdraws tokens, used or not.
+func (s *Supervisor) revoke(tokens []string) {
+	s.lock.Lock()
+	for _, token := range tokens {
+		delete(s.tokens, token)
+	}
+	s.lock.Unlock()
+}
+
+// SetURL sets the RTMP server the streams published afterwards are
+// transcoded on.
+func (s *Supervisor) SetURL(url string) {
+	s.lock.Lock()
+	s.url = strings.TrimRight(url, "/")
+	s.lock.Unlock()
+}
+
+// Publish starts the profiles of the application of key when key starts
+// being published, and stops them when it stops. The outputs of the
+// profiles are not transcoded themselves. It never blocks.
+func (s *Supervisor) Publish(key string, publishing bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !publishing {
+		for _, j := range s.jobs[key] {
+			j.Stop()
+			delete(s.outputs, j.output)
+		}
+		delete(s.jobs, key)
+		return
+	}
+	// a publisher taking the key over leaves the processes be, they go on
+	// playing the key
+	if s.closed || s.url == "" || s.outputs[key] || len(s.jobs[key]) > 0 {
+		return
+	}
+	pos := strings.Index(key, "/")
+	if pos < 0 {
+		return
+	}
+	app, name := key[:pos], key[pos+1:]
+	command := s.Command
+	if command == "" {
+		command = DefaultCommand
+	}
+	for _, profile := range configure.GetTranscodeProfiles(app) {
+		output := app + "/" + strings.Replace(profile.Name, "{name}", name, -1)
+		if output == key || s.outputs[output] {
+			continue
+		}
+		j := newJob(s, key, output, command, profile.Args)
+		s.jobs[key] = append(s.jobs[key], j)
+		s.outputs[output] = true
+		go j.run()
+	}
+}
+
+// List returns the status of the transcoding processes, by output.
+func (s *Supervisor) List() []Status {
+	s.lock.Lock()
+	var ret []Status
+	for _, jobs := range s.jobs {
+		for _, j := range jobs {
+			ret = append(ret, j.Status())
+		}
+	}
+	s.lock.Unlock()
+	sort.Slice(ret, func(i, k int) bool { return ret[i].Output < ret[k].Output })
+	return ret
+}
+
+// Close stops all the processes and waits for them to exit. The streams
+// published afterwards are not transcoded.
+func (s *Supervisor) Close() {
+	s.lock.Lock()
+	s.closed = true
+	var jobs []*job
+	for key, js := range s.jobs {
+		jobs = append(jobs, js...)
+		delete(s.jobs, key)
+	}
+	s.outputs = make(map[string]bool)
+	s.lock.Unlock()
+	for _, j := range jobs {
+		j.Stop()
+	}
+	for _, j := range jobs {
+		<-j.done
+	}
+}
+
+// job runs the ffmpeg process of one profile of a stream.
+type job struct {
+	sup     *Supervisor
+	key     string
+	output  string
+	command string
+	profile []string
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+
+	lock     sync.Mutex
+	state    string
+	pid      int
+	restarts int
+	lastErr  error
+	since    time.Time
+	log      logging.Logger
+}
+
+func newJob(sup *Supervisor, key, output, command string, profile []string) *job {
+	return &job{
+		sup:     sup,
+		key:     key,
+		output:  output,
+		command: command,
+		profile: profile,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+		state:   StateStarting,
+		since:   time.Now(),
+		log:     logger.With("key", key, "output", output),
+	}
+}
+
+func (j *job) Stop() {
+	j.stopOnce.Do(func() {
+		close(j.stop)
+	})
+}
+
+func (j *job) Status() Status {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	status := Status{
+		Key:      j.key,
+		Output:   j.output,
+		State:    j.state,
+		Pid:      j.pid,
+		Restarts: j.restarts,
+		Since:    j.since,
+	}
+	if j.lastErr != nil {
+		status.LastError = j.lastErr.Error()
+	}
+	return status
+}
+
+func (j *job) setState(state string, pid int, err error) {
+	j.lock.Lock()
+	if j.state != state {
+		j.state = state
+		j.since = time.Now()
+	}
+	j.pid = pid
+	if err != nil {
+		j.lastErr = err
+	}
+	j.lock.Unlock()
+}
+
+func (j *job) run() {
+	defer close(j.done)
+	backoff := minBackoff
+	for {
+		started := time.Now()
+		err := j.exec()
+		if err == errStopped {
+			break
+		}
+		// a process that ran for a while failed on its own, not at start
+		if time.Since(started) > maxBackoff {
+			backoff = minBackoff
+		}
+		j.log.Warnf("ffmpeg failed: %v, restart in %v", err, backoff)
+		j.setState(StateRetrying, 0, err)
+
+		select {
+		case <-j.stop:
+			j.setState(StateStopped, 0, nil)
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+		j.lock.Lock()
+		j.restarts++
+		j.lock.Unlock()
+		restarts.Inc()
+		j.setState(StateStarting, 0, nil)
+	}
+	j.setState(StateStopped, 0, nil)
+}
+
+// exec runs ffmpeg until it exits or the job is stopped.
+func (j *job) exec() error {
+	select {
+	case <-j.stop:
+		return errStopped
+	default:
+	}
+	// every process gets tokens of its own
+	args, tokens := j.sup.args(j.key, j.output, j.profile)
+	defer j.sup.revoke(tokens)
+	stderr := &lastLine{log: j.log}
+	cmd := exec.Command(j.command, args...)
+	cmd.Stderr = stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	j.setState(StateRunning, cmd.Process.Pid, nil)
+	j.log.Infof("ffmpeg started, pid %d", cmd.Process.Pid)
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+	select {
+	case err := <-exited:
+		if err == nil {
+			err = errors.New("exited")
+		}
+		if line := stderr.String(); line != "" {
+			err = fmt.Errorf("%v: %s", err, line)
+		}
+		return err
+	case <-j.stop:
+	}
+	// ffmpeg finishes its output when interrupted
+	if err := cmd.Process.Signal(os.Interrupt); err != nil {
+		cmd.Process.Kill()
+	}
+	select {
+	case <-exited:
+	case <-time.After(stopTimeout):
+		cmd.Process.Kill()
+		<-exited
+	}
+	j.log.Info("ffmpeg stopped")
+	return errStopped
+}
+
+// lastLine logs what ffmpeg writes line by line and keeps the last line,
+// usually the error it exits on.
+type lastLine struct {
+	log     logging.Logger
+	partial []byte
+	last    string
+}
+
+func (l *lastLine) Write(p []byte) (int, error) {
+	l.partial = append(l.partial, p...)
+	for {
+		i := bytes.IndexByte(l.partial, '\n')
+		if i < 0 {
+			break
+		}
+		l.line(string(l.partial[:i]))
+		l.partial = l.partial[i+1:]
+	}
+	return len(p), nil
+}
+
+func (l *lastLine) line(s string) {
+	if s = strings.TrimSpace(s); s != "" {
+		l.log.Debugf("ffmpeg: %s", s)
+		l.last = s
+	}
+}
+
+// String returns the last line, to be called once ffmpeg has exited.
+func (l *lastLine) String() string {
+	l.line(string(l.partial))
+	l.partial = nil
+	return l.last
+}
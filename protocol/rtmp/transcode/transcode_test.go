@@ -0,0 +1,181 @@
+package transcode
+
+import (
+	"bomin/configure"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeFFmpeg writes a shell script standing for ffmpeg, running body, and
+// returns its path and that of the file it appends its arguments to.
+func fakeFFmpeg(t *testing.T, body string) (string, string, func()) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a shell")
+	}
+	dir, err := ioutil.TempDir("", "transcode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := filepath.Join(dir, "args")
+	script := filepath.Join(dir, "ffmpeg")
+	content := "#!/bin/sh\necho \"$@\" >> " + args + "\n" + body + "\n"
+	if err := ioutil.WriteFile(script, []byte(content), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return script, args, func() { os.RemoveAll(dir) }
+}
+
+func useProfiles(profiles ...configure.Transcode) func() {
+	saved := configure.RtmpServercfg
+	configure.RtmpServercfg = configure.ServerCfg{Server: []configure.Application{
+		{Appname: "live", Liveon: "on", Transcode: profiles},
+		{Appname: "raw", Liveon: "on"},
+	}}
+	return func() { configure.RtmpServercfg = saved }
+}
+
+func waitState(s *Supervisor, output, state string) (Status, bool) {
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, status := range s.List() {
+			if status.Output == output && status.State == state {
+				return status, true
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return Status{}, false
+}
+
+func TestSupervisor(t *testing.T) {
+	at := assert.New(t)
+	defer useProfiles(
+		configure.Transcode{Name: "{name}_720", Args: []string{"-s", "1280x720"}},
+		configure.Transcode{Name: "{name}_480", Args: []string{"-s", "854x480"}},
+	)()
+	script, args, remove := fakeFFmpeg(t, "exec sleep 60")
+	defer remove()
+
+	s := NewSupervisor("")
+	s.Command = script
+	defer s.Close()
+	// nothing to pull from yet
+	s.Publish("live/movie", true)
+	at.Empty(s.List())
+	s.Publish("live/movie", false)
+
+	s.SetURL("rtmp://127.0.0.1:1935/")
+	s.Publish("live/movie", true)
+	s.Publish("raw/movie", true)
+	status, ok := waitState(s, "live/movie_720", StateRunning)
+	at.True(ok)
+	at.Equal("live/movie", status.Key)
+	at.NotZero(status.Pid)
+	_, ok = waitState(s, "live/movie_480", StateRunning)
+	at.True(ok)
+
+	// the outputs and another publisher of the key start nothing
+	s.Publish("live/movie_720", true)
+	s.Publish("live/movie", true)
+	at.Len(s.List(), 2)
+
+	// the processes may not have written their arguments yet
+	var lines []string
+	deadline := time.Now().Add(3 * time.Second)
+	for len(lines) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		data, _ := ioutil.ReadFile(args)
+		lines = strings.Split(strings.TrimSpace(string(data)), "\n")
+	}
+	at.Len(lines, 2)
+	re := regexp.MustCompile(`^-hide_banner -loglevel error -i rtmp://127.0.0.1:1935/live/movie\?` + TokenParam +
+		`=(\S+) -s 1280x720 -f flv rtmp://127.0.0.1:1935/live/movie_720\?` + TokenParam + `=(\S+)$`)
+	var tokens []string
+	for _, line := range lines {
+		if m := re.FindStringSubmatch(line); m != nil {
+			tokens = m[1:]
+		}
+	}
+	// each token lets one connection in
+	if at.Len(tokens, 2) {
+		at.NotEqual(tokens[0], tokens[1])
+		at.True(s.UseToken(tokens[0]))
+		at.False(s.UseToken(tokens[0]))
+	}
+	at.False(s.UseToken(""))
+
+	vargs, vtokens := s.args("live@media.example.com/movie", "live@media.example.com/movie_720", nil)
+	at.Equal("rtmp://127.0.0.1:1935/live/movie?vhost=media.example.com&"+TokenParam+"="+vtokens[0], vargs[4])
+	s.revoke(vtokens)
+	at.False(s.UseToken(vtokens[1]))
+
+	s.Publish("live/movie", false)
+	at.Empty(s.List())
+	// the tokens of the stopped processes are revoked
+	deadline = time.Now().Add(3 * time.Second)
+	left := -1
+	for left != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		s.lock.Lock()
+		left = len(s.tokens)
+		s.lock.Unlock()
+	}
+	at.Equal(0, left)
+	// the output ending afterwards is no source
+	s.Publish("live/movie_720", false)
+}
+
+func TestSupervisorRestart(t *testing.T) {
+	at := assert.New(t)
+	defer useProfiles(configure.Transcode{Name: "{name}_low"})()
+	script, _, remove := fakeFFmpeg(t, "echo 'Connection refused' >&2\nexit 1")
+	defer remove()
+
+	s := NewSupervisor("rtmp://127.0.0.1:1935")
+	s.Command = script
+	s.Publish("live/movie", true)
+	status, ok := waitState(s, "live/movie_low", StateRetrying)
+	at.True(ok)
+	at.Equal("exit status 1: Connection refused", status.LastError)
+	at.Zero(status.Pid)
+
+	deadline := time.Now().Add(3 * time.Second)
+	for s.List()[0].Restarts == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	at.NotZero(s.List()[0].Restarts)
+
+	done := make(chan struct{})
+	go func() {
+		s.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("close hangs")
+	}
+	at.Empty(s.List())
+	s.Publish("live/movie", true)
+	at.Empty(s.List())
+}
+
+func TestSupervisorMissingCommand(t *testing.T) {
+	at := assert.New(t)
+	defer useProfiles(configure.Transcode{Name: "{name}_low"})()
+	s := NewSupervisor("rtmp://127.0.0.1:1935")
+	s.Command = filepath.Join(os.TempDir(), "no-such-ffmpeg")
+	defer s.Close()
+	s.Publish("live/movie", true)
+	status, ok := waitState(s, "live/movie_low", StateRetrying)
+	at.True(ok)
+	at.Contains(status.LastError, "no-such-ffmpeg")
+}
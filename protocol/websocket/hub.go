@@ -1,5 +1,20 @@
 package websocket
 
+import (
+	"bomin/configure"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// defaultRoom is the room of the clients that name no stream.
+const defaultRoom = "room"
+
+// keyMapper maps the stream names clients ask for, as rtmp.RtmpStream.
+type keyMapper interface {
+	MapName(app, name string, query url.Values, publish bool) (string, error)
+}
+
 type Hub struct {
 	// Registered clients.
 	clients map[*Client]bool
@@ -10,6 +25,7 @@ type Hub struct {
 	// Unregister requests from clients.
 	unregister chan *Client
 	rooms      map[*Room]bool
+	mapper     keyMapper
 }
 
 func NewHub() *Hub {
@@ -22,6 +38,35 @@ func NewHub() *Hub {
 	}
 }
 
+// SetKeyMapper maps the stream names of the rooms with m, as those of the
+// RTMP, HTTP-FLV and HLS clients.
+func (h *Hub) SetKeyMapper(m keyMapper) {
+	h.mapper = m
+}
+
+// roomName returns the room of the stream app/name of the query of r, the
+// default room without one. A client with publish=1 publishes the stream,
+// the others watch it.
+func (h *Hub) roomName(r *http.Request) (string, error) {
+	query := r.URL.Query()
+	app, name := query.Get("app"), query.Get("name")
+	if app == "" || name == "" {
+		return defaultRoom, nil
+	}
+	resolved, ok := configure.ResolveApp(r.Host, app)
+	if !ok || !configure.CheckAppName(resolved) {
+		return "", fmt.Errorf("application name=%s is not configured", app)
+	}
+	if h.mapper != nil {
+		mapped, err := h.mapper.MapName(resolved, name, query, query.Get("publish") == "1")
+		if err != nil {
+			return "", err
+		}
+		name = mapped
+	}
+	return resolved + "/" + name, nil
+}
+
 func (h *Hub) GetRoom(roomName string) *Room {
 	for r := range h.rooms {
 		if r.Name == roomName {
@@ -0,0 +1,51 @@
+package websocket
+
+import (
+	"bomin/configure"
+	"errors"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type aliasMapper map[string]string
+
+func (m aliasMapper) MapName(app, name string, query url.Values, publish bool) (string, error) {
+	if !publish {
+		return name, nil
+	}
+	if alias, ok := m[name]; ok {
+		return alias, nil
+	}
+	return "", errors.New("reserved")
+}
+
+func TestRoomName(t *testing.T) {
+	at := assert.New(t)
+	saved := configure.RtmpServercfg
+	defer func() { configure.RtmpServercfg = saved }()
+	configure.RtmpServercfg = configure.ServerCfg{Server: []configure.Application{
+		{Appname: "live", Liveon: "on"},
+	}}
+	h := NewHub()
+	h.SetKeyMapper(aliasMapper{"8f3a6c": "channel1"})
+
+	room := func(query string) (string, error) {
+		return h.roomName(httptest.NewRequest("GET", "/ws?"+query, nil))
+	}
+	name, err := room("")
+	at.Nil(err)
+	at.Equal(defaultRoom, name)
+	name, err = room("app=live&name=8f3a6c&publish=1")
+	at.Nil(err)
+	at.Equal("live/channel1", name)
+	name, err = room("app=live&name=channel1")
+	at.Nil(err)
+	at.Equal("live/channel1", name)
+	_, err = room("app=live&name=channel1&publish=1")
+	at.NotNil(err)
+	_, err = room("app=other&name=channel1")
+	at.NotNil(err)
+}
@@ -54,6 +54,7 @@ type Room struct {
 type Client struct {
 	id   string
 	hub  *Hub
+	room string
 	Room *Room
 	// The websocket connection.
 	conn *websocket.Conn
@@ -216,9 +217,9 @@ func (c *Client) sendOffer(targetId string, sdp map[string]string) {
 
 func (c *Client) joinRoom() {
 	var room *Room
-	room = c.hub.GetRoom("room")
+	room = c.hub.GetRoom(c.room)
 	if room == nil {
-		room = &Room{Name: "room"}
+		room = &Room{Name: c.room}
 		room.StreamId = c.id
 		room.Clients = append(room.Clients, c)
 		c.hub.rooms[room] = true
@@ -319,6 +320,11 @@ func (c *Client) writePump() {
 
 // serveWs handles websocket requests from the peer.
 func ServeWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	room, err := hub.roomName(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Println(err)
@@ -326,7 +332,7 @@ func ServeWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
 	}
 	client := &Client{
 		id:  uid.NewId(),
-		hub: hub, conn: conn, send: make(chan []byte, 256)}
+		hub: hub, room: room, conn: conn, send: make(chan []byte, 256)}
 
 	client.hub.register <- client
 	// Allow collection of memory referenced by the caller by doing all work in
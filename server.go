@@ -0,0 +1,338 @@
+// Package bomin is a live streaming server: RTMP publishing and playback,
+// HTTP-FLV, HLS and a management API, in one embeddable Server.
+package bomin
+
+import (
+	"bomin/av"
+	"bomin/container/flv"
+	"bomin/protocol/hls"
+	"bomin/protocol/httpflv"
+	"bomin/protocol/httpopera"
+	"bomin/protocol/rtmp"
+	"bomin/protocol/rtmp/cache"
+	"bomin/protocol/rtmp/queue"
+	"bomin/protocol/rtmp/transcode"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Options configures a Server. An empty address disables its listener,
+// the handlers can still be mounted elsewhere.
+type Options struct {
+	RtmpAddr    string
+	HttpFlvAddr string
+	HlsAddr     string
+	ApiAddr     string
+	// EnableHls muxes HLS when HlsAddr is empty, for mounting HlsHandler.
+	EnableHls bool
+	// ReadTimeout and WriteTimeout close the publishers and players that
+	// move no data for that long, zero means the rtmp package defaults.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	// HandshakeTimeout bounds the RTMP handshake and ConnectTimeout the
+	// commands up to publish or play, zero means the defaults.
+	HandshakeTimeout time.Duration
+	ConnectTimeout   time.Duration
+	// MaxConns caps the RTMP connections served at once, MaxConnsPerIP
+	// those from one IP, zero is no limit.
+	MaxConns      int
+	MaxConnsPerIP int
+	// MapKey maps the stream names clients ask for after the aliases and
+	// rewrites of the app, e.g. to the stream an auth callback names. Nil
+	// leaves them.
+	MapKey rtmp.KeyMapper
+	// GopNum is the number of GOPs cached for new players, zero means
+	// cache.DefaultGopNum.
+	GopNum int
+	// Queue is how the players' queues handle players that cannot keep
+	// up, the zero value is queue.DefaultConfig.
+	Queue queue.Config
+	// FileDir is where the API may publish FLV files from, empty turns
+	// that off.
+	FileDir string
+	// FFmpeg is the ffmpeg binary run for the transcode profiles of the
+	// apps, empty means transcode.DefaultCommand. Nothing is transcoded
+	// without an RTMP listener to pull from and push to.
+	FFmpeg string
+	// DrainTimeout bounds how long Shutdown lets the players drain, zero
+	// leaves it to the context.
+	DrainTimeout time.Duration
+}
+
+var DefaultOptions = Options{
+	RtmpAddr:     ":1935",
+	HttpFlvAddr:  ":7001",
+	HlsAddr:      ":7002",
+	ApiAddr:      ":8090",
+	DrainTimeout: 10 * time.Second,
+}
+
+var ErrServerStarted = errors.New("server already started")
+
+// Server runs the RTMP server and the HTTP servers around one RtmpStream.
+type Server struct {
+	opts   Options
+	stream *rtmp.RtmpStream
+	rtmp   *rtmp.Server
+	flv    *httpflv.Server
+	hls    *hls.Server
+	api    *httpopera.Server
+	getter av.GetWriter
+	// transcoder follows the publishers with the transcode profiles of
+	// their app
+	transcoder *transcode.Supervisor
+
+	lock      sync.Mutex
+	started   bool
+	listeners []net.Listener
+	https     []*http.Server
+}
+
+func NewServer(opts Options) *Server {
+	if opts.ReadTimeout <= 0 {
+		opts.ReadTimeout = rtmp.DefaultReadTimeout
+	}
+	if opts.WriteTimeout <= 0 {
+		opts.WriteTimeout = rtmp.DefaultWriteTimeout
+	}
+	if opts.GopNum <= 0 {
+		opts.GopNum = cache.DefaultGopNum
+	}
+	s := &Server{
+		opts:   opts,
+		stream: rtmp.NewRtmpStream(),
+	}
+	s.stream.GopNum = opts.GopNum
+	s.stream.SetKeyMapper(opts.MapKey)
+	if opts.HlsAddr != "" || opts.EnableHls {
+		s.hls = hls.NewServer()
+		s.hls.Queue = opts.Queue
+		s.hls.SetPuller(s.stream)
+		s.hls.SetKeyMapper(s.stream)
+		s.hls.SetAdmitter(s.stream)
+		s.getter = s.hls
+	}
+	// keys without a local publisher are pulled from the app's edge_origins
+	edge := rtmp.NewEdge(s.stream, s.getter)
+	edge.ReadTimeout = opts.ReadTimeout
+	s.stream.SetEdge(edge)
+	s.rtmp = rtmp.NewRtmpServer(s.stream, s.getter)
+	s.rtmp.ReadTimeout = opts.ReadTimeout
+	s.rtmp.WriteTimeout = opts.WriteTimeout
+	if opts.HandshakeTimeout > 0 {
+		s.rtmp.HandshakeTimeout = opts.HandshakeTimeout
+	}
+	if opts.ConnectTimeout > 0 {
+		s.rtmp.ConnectTimeout = opts.ConnectTimeout
+	}
+	s.rtmp.MaxConns = opts.MaxConns
+	s.rtmp.MaxConnsPerIP = opts.MaxConnsPerIP
+	s.rtmp.Queue = opts.Queue
+	s.flv = httpflv.NewServer(s.stream)
+	s.flv.Queue = opts.Queue
+	s.flv.SetGetter(s.getter)
+	s.api = httpopera.NewServer(s.stream, opts.RtmpAddr)
+	s.api.SetPlayAddrs(opts.HttpFlvAddr, opts.HlsAddr)
+	s.api.SetGetter(s.getter)
+	s.api.SetFileDir(opts.FileDir)
+	s.transcoder = transcode.NewSupervisor("")
+	s.transcoder.Command = opts.FFmpeg
+	s.stream.SetTokenChecker(s.transcoder.UseToken)
+	s.stream.OnPublish(func(e rtmp.PublishEvent) {
+		s.transcoder.Publish(e.Key, e.Publishing)
+	})
+	s.api.SetTranscoder(s.transcoder)
+	return s
+}
+
+// Stream returns the streams served.
+func (s *Server) Stream() *rtmp.RtmpStream {
+	return s.stream
+}
+
+// FlvHandler returns the handler playing streams as /app/name.flv, to be
+// mounted on another mux, e.g. with http.StripPrefix.
+func (s *Server) FlvHandler() http.Handler {
+	return s.flv.Handler()
+}
+
+// HlsHandler returns the handler serving /app/name.m3u8 and its segments,
+// or nil when HLS is disabled.
+func (s *Server) HlsHandler() http.Handler {
+	if s.hls == nil {
+		return nil
+	}
+	return s.hls.Handler()
+}
+
+// APIHandler returns the handler of the management API and the dashboard.
+func (s *Server) APIHandler() http.Handler {
+	return s.api.Handler()
+}
+
+// Publish feeds r into the stream of its key, as if it were an RTMP
+// publisher. Packets are FLV tags as produced by the flv demuxer; r is
+// closed when it is replaced, kicked or the server shuts down.
+func (s *Server) Publish(r av.ReadCloser) {
+	s.stream.HandleReader(r)
+	s.muxHls(r.Info())
+}
+
+// NewPublisher is RtmpStream.NewPublisher, with the stream muxed to HLS
+// like the other publishers.
+func (s *Server) NewPublisher(key string) *rtmp.Publisher {
+	p := s.stream.NewPublisher(key)
+	s.muxHls(p.Info())
+	return p
+}
+
+// PublishFile publishes the FLV file name as key, see flv.FileReader.
+func (s *Server) PublishFile(key, name string, opts flv.FileOptions) (*flv.FileReader, error) {
+	r, err := flv.NewFileReader(key, name, opts)
+	if err != nil {
+		return nil, err
+	}
+	s.Publish(r)
+	return r, nil
+}
+
+func (s *Server) muxHls(info av.Info) {
+	if s.getter != nil {
+		s.stream.HandleWriter(s.getter.GetWriter(info))
+	}
+}
+
+// Subscribe attaches w as a player of the stream of its key. It is sent
+// the cached metadata, sequence headers and GOP first, then the live
+// packets, and closed when the stream ends.
+func (s *Server) Subscribe(w av.WriteCloser) {
+	s.stream.HandleWriter(w)
+}
+
+// Start listens on the configured addresses and serves them in the
+// background. Nothing is left listening if one of them fails.
+func (s *Server) Start() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.started {
+		return ErrServerStarted
+	}
+
+	type service struct {
+		addr    string
+		handler http.Handler
+	}
+	var services []service
+	if s.opts.HttpFlvAddr != "" {
+		services = append(services, service{s.opts.HttpFlvAddr, s.flv.Handler()})
+	}
+	if s.opts.HlsAddr != "" {
+		services = append(services, service{s.opts.HlsAddr, s.hls.Handler()})
+	}
+	if s.opts.ApiAddr != "" {
+		services = append(services, service{s.opts.ApiAddr, s.api.Handler()})
+	}
+
+	closeAll := func() {
+		for _, l := range s.listeners {
+			l.Close()
+		}
+		s.listeners = nil
+	}
+	var rtmpListener net.Listener
+	if s.opts.RtmpAddr != "" {
+		l, err := net.Listen("tcp", s.opts.RtmpAddr)
+		if err != nil {
+			return err
+		}
+		rtmpListener = l
+		s.listeners = append(s.listeners, l)
+	}
+	httpListeners := make([]net.Listener, len(services))
+	for i, svc := range services {
+		l, err := net.Listen("tcp", svc.addr)
+		if err != nil {
+			closeAll()
+			return err
+		}
+		httpListeners[i] = l
+		s.listeners = append(s.listeners, l)
+	}
+
+	s.started = true
+	if rtmpListener != nil {
+		s.transcoder.SetURL(localURL(rtmpListener.Addr()))
+		go s.rtmp.Serve(rtmpListener)
+	}
+	for i, svc := range services {
+		srv := &http.Server{Handler: svc.handler}
+		s.https = append(s.https, srv)
+		go srv.Serve(httpListeners[i])
+	}
+	return nil
+}
+
+// localURL returns the RTMP URL of the listener address addr for the local
+// clients, the loopback address standing for an unspecified one.
+func localURL(addr net.Addr) string {
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return "rtmp://" + addr.String()
+	}
+	if ip := net.ParseIP(host); ip == nil || ip.IsUnspecified() {
+		host = "127.0.0.1"
+	}
+	return "rtmp://" + net.JoinHostPort(host, port)
+}
+
+// Addrs returns the addresses listened on in the order RTMP, HTTP-FLV,
+// HLS and API, leaving out the disabled ones.
+func (s *Server) Addrs() []net.Addr {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	addrs := make([]net.Addr, len(s.listeners))
+	for i, l := range s.listeners {
+		addrs[i] = l.Addr()
+	}
+	return addrs
+}
+
+// Shutdown stops accepting connections, stops the relays and the
+// transcoding, and ends all streams: RTMP players are sent
+// NetStream.Play.UnpublishNotify, HTTP-FLV responses are ended and HLS
+// playlists get EXT-X-ENDLIST, each after what was queued for them. It
+// waits for that until ctx is done or the drain timeout passes, then closes
+// the remaining connections.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.lock.Lock()
+	listeners, https := s.listeners, s.https
+	s.lock.Unlock()
+
+	if s.opts.DrainTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.opts.DrainTimeout)
+		defer cancel()
+	}
+
+	// open HTTP connections are served on, so HLS players can fetch the
+	// end of their playlist
+	for _, l := range listeners {
+		l.Close()
+	}
+	s.api.Close()
+	s.transcoder.Close()
+	err := s.stream.Shutdown(ctx)
+	for _, srv := range https {
+		if e := srv.Shutdown(ctx); e != nil {
+			srv.Close()
+			if err == nil {
+				err = e
+			}
+		}
+	}
+	return err
+}
@@ -0,0 +1,211 @@
+package bomin
+
+import (
+	"bomin/av"
+	"bomin/configure"
+	"bomin/protocol/rtmp/transcode"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerStartShutdown(t *testing.T) {
+	at := assert.New(t)
+	s := NewServer(Options{
+		RtmpAddr:     "127.0.0.1:0",
+		HttpFlvAddr:  "127.0.0.1:0",
+		ApiAddr:      "127.0.0.1:0",
+		DrainTimeout: time.Second,
+	})
+	at.Nil(s.Start())
+	at.Equal(ErrServerStarted, s.Start())
+
+	addrs := s.Addrs()
+	at.Len(addrs, 3)
+	resp, err := http.Get("http://" + addrs[1].String() + "/live/movie.flv")
+	at.Nil(err)
+	resp.Body.Close()
+	at.Equal(http.StatusNotFound, resp.StatusCode)
+	resp, err = http.Get("http://" + addrs[2].String() + "/api/v2/streams")
+	at.Nil(err)
+	resp.Body.Close()
+	at.Equal(http.StatusOK, resp.StatusCode)
+
+	at.Nil(s.Shutdown(context.Background()))
+	for _, addr := range addrs {
+		_, err := net.DialTimeout("tcp", addr.String(), time.Second)
+		at.NotNil(err, addr.String())
+	}
+}
+
+func TestServerStartFails(t *testing.T) {
+	at := assert.New(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	at.Nil(err)
+	defer l.Close()
+
+	s := NewServer(Options{RtmpAddr: "127.0.0.1:0", ApiAddr: l.Addr().String()})
+	at.NotNil(s.Start())
+	at.Len(s.Addrs(), 0)
+}
+
+// chanReader publishes the packets sent on its channel.
+type chanReader struct {
+	info    av.Info
+	packets chan av.Packet
+}
+
+func (r *chanReader) Info() av.Info { return r.info }
+func (r *chanReader) Alive() bool   { return true }
+func (r *chanReader) Close(error)   {}
+
+func (r *chanReader) Read(p *av.Packet) error {
+	packet, ok := <-r.packets
+	if !ok {
+		return io.EOF
+	}
+	*p = packet
+	return nil
+}
+
+type sliceWriter struct {
+	info    av.Info
+	lock    sync.Mutex
+	packets []av.Packet
+}
+
+func (w *sliceWriter) Info() av.Info { return w.info }
+func (w *sliceWriter) Alive() bool   { return true }
+func (w *sliceWriter) Close(error)   {}
+
+func (w *sliceWriter) Write(p *av.Packet) error {
+	w.lock.Lock()
+	w.packets = append(w.packets, *p)
+	w.lock.Unlock()
+	return nil
+}
+
+func (w *sliceWriter) len() int {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return len(w.packets)
+}
+
+func TestServerEmbedded(t *testing.T) {
+	at := assert.New(t)
+	s := NewServer(Options{})
+	at.Nil(s.HlsHandler())
+	mux := http.NewServeMux()
+	mux.Handle("/flv/", http.StripPrefix("/flv", s.FlvHandler()))
+	mux.Handle("/admin/", http.StripPrefix("/admin", s.APIHandler()))
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	r := &chanReader{info: av.Info{Key: "live/movie", UID: "app"}, packets: make(chan av.Packet)}
+	s.Publish(r)
+	w := &sliceWriter{info: av.Info{Key: "live/movie", UID: "sub"}}
+	s.Subscribe(w)
+
+	// the first packet sends the cache, the metadata, to the new player,
+	// the second is handed out by the time the third is read
+	r.packets <- av.Packet{IsMetadata: true, Data: []byte{2}}
+	r.packets <- av.Packet{IsMetadata: true, Data: []byte{2}}
+	r.packets <- av.Packet{IsMetadata: true, Data: []byte{2}}
+	at.True(w.len() >= 2)
+
+	resp, err := http.Get(ts.URL + "/admin/api/v2/streams/live/movie")
+	at.Nil(err)
+	resp.Body.Close()
+	at.Equal(http.StatusOK, resp.StatusCode)
+
+	// the response starts once the tags are past its buffer
+	done, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case r.packets <- av.Packet{IsMetadata: true, Data: make([]byte, 8192)}:
+			case <-done:
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	resp, err = http.Get(ts.URL + "/flv/live/movie.flv")
+	at.Nil(err)
+	header := make([]byte, 3)
+	_, err = io.ReadFull(resp.Body, header)
+	resp.Body.Close()
+	close(done)
+	at.Nil(err)
+	at.Equal("FLV", string(header))
+
+	at.Nil(s.Shutdown(context.Background()))
+	<-stopped
+	close(r.packets)
+}
+
+func TestServerTranscode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a shell")
+	}
+	at := assert.New(t)
+	saved := configure.RtmpServercfg
+	defer func() { configure.RtmpServercfg = saved }()
+	configure.RtmpServercfg = configure.ServerCfg{Server: []configure.Application{
+		{Appname: "live", Liveon: "on", Transcode: []configure.Transcode{{Name: "{name}_low"}}},
+	}}
+	dir, err := ioutil.TempDir("", "bomin")
+	at.Nil(err)
+	defer os.RemoveAll(dir)
+	ffmpeg := filepath.Join(dir, "ffmpeg")
+	at.Nil(ioutil.WriteFile(ffmpeg, []byte("#!/bin/sh\nexec sleep 60\n"), 0755))
+
+	s := NewServer(Options{RtmpAddr: "127.0.0.1:0", ApiAddr: "127.0.0.1:0", FFmpeg: ffmpeg})
+	at.Nil(s.Start())
+	addrs := s.Addrs()
+	pub := s.NewPublisher("live/movie")
+
+	var transcodes []transcode.Status
+	deadline := time.Now().Add(3 * time.Second)
+	for len(transcodes) == 0 || transcodes[0].State != transcode.StateRunning {
+		if time.Now().After(deadline) {
+			t.Fatalf("not transcoding: %+v", transcodes)
+		}
+		time.Sleep(10 * time.Millisecond)
+		resp, err := http.Get("http://" + addrs[1].String() + "/api/v2/transcodes")
+		at.Nil(err)
+		at.Nil(json.NewDecoder(resp.Body).Decode(&transcodes))
+		resp.Body.Close()
+	}
+	at.Equal("live/movie", transcodes[0].Key)
+	at.Equal("live/movie_low", transcodes[0].Output)
+	at.Equal("rtmp://"+addrs[0].String(), localURL(addrs[0]))
+
+	pub.Close(nil)
+	deadline = time.Now().Add(3 * time.Second)
+	for len(s.transcoder.List()) != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	at.Empty(s.transcoder.List())
+	at.Nil(s.Shutdown(context.Background()))
+}
+
+func TestLocalURL(t *testing.T) {
+	at := assert.New(t)
+	at.Equal("rtmp://127.0.0.1:1935", localURL(&net.TCPAddr{IP: net.IPv6unspecified, Port: 1935}))
+	at.Equal("rtmp://127.0.0.1:1935", localURL(&net.TCPAddr{IP: net.IPv4zero, Port: 1935}))
+	at.Equal("rtmp://[::1]:1935", localURL(&net.TCPAddr{IP: net.IPv6loopback, Port: 1935}))
+}
@@ -0,0 +1,74 @@
+package hashring
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+)
+
+const defaultReplicas = 64
+
+// Ring is a consistent hash ring over a fixed set of nodes. It is not
+// modified after creation and is safe for concurrent use.
+type Ring struct {
+	nodes  []string
+	hashes []uint32
+	owners map[uint32]string
+}
+
+// New builds a ring with replicas virtual points per node, replicas <= 0
+// selects the default.
+func New(nodes []string, replicas int) *Ring {
+	if replicas <= 0 {
+		replicas = defaultReplicas
+	}
+	r := &Ring{
+		nodes:  nodes,
+		owners: make(map[uint32]string, len(nodes)*replicas),
+	}
+	for _, node := range nodes {
+		for i := 0; i < replicas; i++ {
+			h := crc32.ChecksumIEEE([]byte(strconv.Itoa(i) + "#" + node))
+			if _, ok := r.owners[h]; ok {
+				continue
+			}
+			r.owners[h] = node
+			r.hashes = append(r.hashes, h)
+		}
+	}
+	sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+	return r
+}
+
+// Get returns the node owning key, or "" for an empty ring.
+func (r *Ring) Get(key string) string {
+	nodes := r.GetN(key, 1)
+	if len(nodes) == 0 {
+		return ""
+	}
+	return nodes[0]
+}
+
+// GetN returns up to n distinct nodes for key in ring order, the first one
+// is the owner and the rest are its failover candidates.
+func (r *Ring) GetN(key string, n int) []string {
+	if len(r.hashes) == 0 || n <= 0 {
+		return nil
+	}
+	if n > len(r.nodes) {
+		n = len(r.nodes)
+	}
+	h := crc32.ChecksumIEEE([]byte(key))
+	start := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+
+	ret := make([]string, 0, n)
+	seen := make(map[string]bool, n)
+	for i := 0; i < len(r.hashes) && len(ret) < n; i++ {
+		node := r.owners[r.hashes[(start+i)%len(r.hashes)]]
+		if !seen[node] {
+			seen[node] = true
+			ret = append(ret, node)
+		}
+	}
+	return ret
+}
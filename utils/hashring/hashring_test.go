@@ -0,0 +1,50 @@
+package hashring
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRingStable(t *testing.T) {
+	at := assert.New(t)
+	r := New([]string{"a", "b", "c"}, 0)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("live/%d", i)
+		at.Equal(r.Get(key), r.Get(key))
+	}
+}
+
+func TestRingGetNDistinct(t *testing.T) {
+	at := assert.New(t)
+	r := New([]string{"a", "b", "c"}, 0)
+	nodes := r.GetN("live/movie", 5)
+	at.Equal(3, len(nodes))
+	at.Equal(r.Get("live/movie"), nodes[0])
+	at.NotEqual(nodes[0], nodes[1])
+	at.NotEqual(nodes[1], nodes[2])
+	at.NotEqual(nodes[0], nodes[2])
+}
+
+func TestRingMinimalMove(t *testing.T) {
+	at := assert.New(t)
+	r3 := New([]string{"a", "b", "c"}, 0)
+	r4 := New([]string{"a", "b", "c", "d"}, 0)
+	moved := 0
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("live/%d", i)
+		if n := r4.Get(key); n != r3.Get(key) {
+			at.Equal("d", n)
+			moved++
+		}
+	}
+	at.True(moved > 0 && moved < 500)
+}
+
+func TestRingEmpty(t *testing.T) {
+	at := assert.New(t)
+	r := New(nil, 0)
+	at.Equal("", r.Get("live/movie"))
+	at.Nil(r.GetN("live/movie", 2))
+}
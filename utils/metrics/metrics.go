@@ -0,0 +1,184 @@
+// Package metrics keeps process wide counters and writes them, together with
+// gauges collected at scrape time, in the Prometheus text exposition format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	TypeCounter = "counter"
+	TypeGauge   = "gauge"
+)
+
+// Counter is a monotonically increasing value, safe for concurrent use.
+type Counter struct {
+	v uint64
+}
+
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.v, 1)
+}
+
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.v, n)
+}
+
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.v)
+}
+
+// CounterVec is a family of counters told apart by the value of one label.
+type CounterVec struct {
+	label    string
+	lock     sync.RWMutex
+	counters map[string]*Counter
+}
+
+// With returns the counter for the label value, creating it on first use.
+func (v *CounterVec) With(value string) *Counter {
+	v.lock.RLock()
+	c, ok := v.counters[value]
+	v.lock.RUnlock()
+	if ok {
+		return c
+	}
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if c, ok = v.counters[value]; !ok {
+		c = &Counter{}
+		v.counters[value] = c
+	}
+	return c
+}
+
+type family struct {
+	name    string
+	help    string
+	counter *Counter
+	vec     *CounterVec
+}
+
+var (
+	registryLock sync.Mutex
+	registry     = make(map[string]*family)
+)
+
+func register(f *family) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	if _, ok := registry[f.name]; ok {
+		panic("metrics: duplicate metric " + f.name)
+	}
+	registry[f.name] = f
+}
+
+// NewCounter creates and registers a counter.
+func NewCounter(name, help string) *Counter {
+	c := &Counter{}
+	register(&family{name: name, help: help, counter: c})
+	return c
+}
+
+// NewCounterVec creates and registers a counter family with one label.
+func NewCounterVec(name, help, label string) *CounterVec {
+	v := &CounterVec{label: label, counters: make(map[string]*Counter)}
+	register(&family{name: name, help: help, vec: v})
+	return v
+}
+
+// DroppedPackets counts the packets dropped by the writers' queues, by
+// writer type.
+var DroppedPackets = NewCounterVec("bomin_dropped_packets_total",
+	"Packets dropped because a writer could not keep up.", "writer")
+
+// Writer writes metrics in the Prometheus text exposition format. The first
+// write error is kept and returned by Err.
+type Writer struct {
+	w   io.Writer
+	err error
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+func (w *Writer) Err() error {
+	return w.err
+}
+
+func (w *Writer) printf(format string, args ...interface{}) {
+	if w.err != nil {
+		return
+	}
+	_, w.err = fmt.Fprintf(w.w, format, args...)
+}
+
+// Header starts the metric family name.
+func (w *Writer) Header(name, help, typ string) {
+	w.printf("# HELP %s %s\n", name, escape(help, false))
+	w.printf("# TYPE %s %s\n", name, typ)
+}
+
+// Sample writes one value, labels are given as name, value pairs.
+func (w *Writer) Sample(name string, value float64, labels ...string) {
+	var b strings.Builder
+	b.WriteString(name)
+	if len(labels) >= 2 {
+		b.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(labels[i])
+			b.WriteString(`="`)
+			b.WriteString(escape(labels[i+1], true))
+			b.WriteByte('"')
+		}
+		b.WriteByte('}')
+	}
+	w.printf("%s %s\n", b.String(), strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+// WriteRegistered writes every registered counter, sorted by name.
+func (w *Writer) WriteRegistered() {
+	registryLock.Lock()
+	families := make([]*family, 0, len(registry))
+	for _, f := range registry {
+		families = append(families, f)
+	}
+	registryLock.Unlock()
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+
+	for _, f := range families {
+		w.Header(f.name, f.help, TypeCounter)
+		if f.counter != nil {
+			w.Sample(f.name, float64(f.counter.Value()))
+			continue
+		}
+		f.vec.lock.RLock()
+		values := make([]string, 0, len(f.vec.counters))
+		for value := range f.vec.counters {
+			values = append(values, value)
+		}
+		f.vec.lock.RUnlock()
+		sort.Strings(values)
+		for _, value := range values {
+			w.Sample(f.name, float64(f.vec.With(value).Value()), f.vec.label, value)
+		}
+	}
+}
+
+func escape(s string, quote bool) string {
+	r := []string{`\`, `\\`, "\n", `\n`}
+	if quote {
+		r = append(r, `"`, `\"`)
+	}
+	return strings.NewReplacer(r...).Replace(s)
+}
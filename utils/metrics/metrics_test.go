@@ -0,0 +1,55 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCounterConcurrent(t *testing.T) {
+	var c Counter
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				c.Inc()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, uint64(1000), c.Value())
+}
+
+func TestWriteRegistered(t *testing.T) {
+	at := assert.New(t)
+	c := NewCounter("test_events_total", "Events seen.")
+	v := NewCounterVec("test_errors_total", "Errors by kind.", "kind")
+	c.Add(3)
+	v.With("b").Inc()
+	v.With("a").Add(2)
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.WriteRegistered()
+	at.Nil(w.Err())
+	out := buf.String()
+	at.Contains(out, "# TYPE test_events_total counter\ntest_events_total 3\n")
+	at.Contains(out, "# HELP test_errors_total Errors by kind.\n# TYPE test_errors_total counter\n"+
+		"test_errors_total{kind=\"a\"} 2\ntest_errors_total{kind=\"b\"} 1\n")
+	at.True(strings.Index(out, "test_errors_total") < strings.Index(out, "test_events_total"))
+
+	at.Panics(func() { NewCounter("test_events_total", "") })
+}
+
+func TestSampleLabels(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.Sample("x", 1.5, "app", "li\"ve\n", "stream", `a\b`)
+	w.Sample("y", 1e9)
+	assert.Equal(t, "x{app=\"li\\\"ve\\n\",stream=\"a\\\\b\"} 1.5\ny 1e+09\n", buf.String())
+}
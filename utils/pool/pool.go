@@ -1,24 +1,86 @@
+// Package pool recycles the buffers messages are read into.
 package pool
 
-type Pool struct {
-	pos int
-	buf []byte
-}
+import (
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	minClassShift = 8  // 256B
+	maxClassShift = 20 // 1MB
+)
 
-const maxpoolsize = 500 * 1024
+// classes pools the buffers by power of two size, bigger buffers are left to
+// the garbage collector.
+var classes [maxClassShift - minClassShift + 1]sync.Pool
+
+// Buffer is a byte slice shared by reference counting. Whoever keeps it takes
+// a reference with Retain and gives it back with Release, the last Release
+// recycles it. A buffer nobody releases is simply garbage collected, so
+// forgetting a Release costs an allocation, not a corruption.
+type Buffer struct {
+	refs  int32
+	class int
+	size  int
+	data  []byte
+}
 
-func (pool *Pool) Get(size int) []byte {
-	if maxpoolsize-pool.pos < size {
-		pool.pos = 0
-		pool.buf = make([]byte, maxpoolsize)
+// Get returns a buffer of size bytes holding one reference. Its content is
+// left over from its previous use.
+func Get(size int) *Buffer {
+	class := classOf(size)
+	if class < 0 {
+		return &Buffer{refs: 1, class: class, size: size, data: make([]byte, size)}
 	}
-	b := pool.buf[pool.pos: pool.pos+size]
-	pool.pos += size
+	b, _ := classes[class].Get().(*Buffer)
+	if b == nil {
+		b = &Buffer{class: class, data: make([]byte, 1<<uint(class+minClassShift))}
+	}
+	atomic.StoreInt32(&b.refs, 1)
+	b.size = size
 	return b
 }
 
-func NewPool() *Pool {
-	return &Pool{
-		buf: make([]byte, maxpoolsize),
+// classOf returns the class of the buffers able to hold size bytes, -1 when
+// too big to pool.
+func classOf(size int) int {
+	for class := range classes {
+		if size <= 1<<uint(class+minClassShift) {
+			return class
+		}
+	}
+	return -1
+}
+
+// Bytes returns the content of b. The slice is capped so appending to it
+// never spills into the rest of the buffer.
+func (b *Buffer) Bytes() []byte {
+	return b.data[:b.size:b.size]
+}
+
+// Retain adds a reference to b, the caller must already hold one. It does
+// nothing on a nil buffer.
+func (b *Buffer) Retain() {
+	if b == nil {
+		return
+	}
+	if atomic.AddInt32(&b.refs, 1) <= 1 {
+		panic("pool: buffer retained after its last release")
+	}
+}
+
+// Release drops a reference to b, the last one recycles it and its bytes
+// must not be used anymore. It does nothing on a nil buffer.
+func (b *Buffer) Release() {
+	if b == nil {
+		return
+	}
+	refs := atomic.AddInt32(&b.refs, -1)
+	if refs < 0 {
+		panic("pool: buffer released more than retained")
+	}
+	if refs == 0 && b.class >= 0 {
+		classes[b.class].Put(b)
 	}
 }
@@ -0,0 +1,57 @@
+package pool
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuffer(t *testing.T) {
+	at := assert.New(t)
+	b := Get(1000)
+	at.Len(b.Bytes(), 1000)
+	at.Equal(1000, cap(b.Bytes()))
+	at.Equal(1024, cap(b.data))
+
+	b.Retain()
+	b.Release()
+	at.Equal(int32(1), b.refs)
+	b.Release()
+	at.Equal(int32(0), b.refs)
+	at.Panics(b.Release)
+	at.Panics(b.Retain)
+
+	big := Get(2 << 20)
+	at.Len(big.Bytes(), 2<<20)
+	at.Equal(-1, big.class)
+	big.Release()
+
+	var none *Buffer
+	none.Retain()
+	none.Release()
+}
+
+func TestClassOf(t *testing.T) {
+	at := assert.New(t)
+	at.Equal(0, classOf(0))
+	at.Equal(0, classOf(256))
+	at.Equal(1, classOf(257))
+	at.Equal(maxClassShift-minClassShift, classOf(1<<20))
+	at.Equal(-1, classOf(1<<20+1))
+}
+
+var sink []byte
+
+func BenchmarkGet(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		Get(4096).Release()
+	}
+}
+
+func BenchmarkMake(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		sink = make([]byte, 4096)
+	}
+}